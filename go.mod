@@ -6,9 +6,13 @@ require (
 	github.com/cespare/xxhash v1.1.0 // indirect
 	github.com/confluentinc/confluent-kafka-go v1.7.1-0.20210712201822-4676126e6e46
 	github.com/getsentry/sentry-go v0.11.0
-	github.com/goccy/go-json v0.7.6
+	github.com/goccy/go-json v0.10.5
 	github.com/gogo/protobuf v1.3.2
+	github.com/golang/protobuf v1.5.2
 	github.com/golang/snappy v0.0.4
+	github.com/jhump/protoreflect v1.10.3
+	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/prometheus/prometheus v2.5.0+incompatible
 	github.com/spf13/viper v1.8.1
 	github.com/stretchr/testify v1.7.0
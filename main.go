@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/getsentry/sentry-go"
-	"github.com/goccy/go-json"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
 	"os"
 	"os/signal"
 	"speedy/pkg"
 	"sync"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -42,16 +47,27 @@ func main() {
 
 	// Init kafka
 	pkg.SugaredLogger.Infof("Using config:\n %s", config.ToPrettyJson())
-	kafkaConsumer, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers": config.KafkaBoostrapServers,
+	kafkaConfigMap, err := pkg.NewKafkaConfigMap(config, kafka.ConfigMap{
 		"group.id":          config.KafkaGroupId,
 		"auto.offset.reset": config.KafkaOffsetReset,
 		"socket.timeout.ms": "300000",
+		// Offsets are committed by the OffsetTracker once messages are delivered to Loki.
+		"enable.auto.commit": false,
+		// Deliver rebalance events to the poll loop, so that revoked partitions can be committed first.
+		"go.application.rebalance.enable": true,
 	})
+	if err != nil {
+		panic(err)
+	}
+	kafkaConsumer, err := kafka.NewConsumer(kafkaConfigMap)
 
 	if err != nil {
 		panic(err)
 	}
+	var tokenRefresher *pkg.OAuthBearerTokenRefresher
+	if config.KafkaSaslOauthbearerTokenFile != "" {
+		tokenRefresher = pkg.NewOAuthBearerTokenRefresher(config.KafkaSaslOauthbearerTokenFile)
+	}
 
 	err = kafkaConsumer.SubscribeTopics(config.SubscribeTopics, nil)
 	if err != nil {
@@ -59,98 +75,285 @@ func main() {
 		sentry.CaptureException(err)
 		panic(err)
 	}
-	defer func(c *kafka.Consumer) {
-		err := c.Close()
-		if err != nil {
-			panic(err)
-		}
-	}(kafkaConsumer)
 	pkg.SugaredLogger.Info("Initializing")
 
+	timestampExtractor, err := pkg.NewTimestampExtractor(config.TimestampSource, config.TimestampField, config.TimestampFormat)
+	if err != nil {
+		panic(err)
+	}
+
+	labelExtractor, err := pkg.NewLabelExtractor(config.Labels)
+	if err != nil {
+		panic(err)
+	}
+
+	decoders, err := pkg.NewTopicDecoders(config.Decoders)
+	if err != nil {
+		panic(err)
+	}
+
+	lineFormatters, err := pkg.NewTopicLineFormatters(config.LineFormats)
+	if err != nil {
+		panic(err)
+	}
+
 	// Init Sink & Pusher
-	var lokiClient = pkg.LokiClientFactoryCreate(config.LokiPushMode, config.LokiPushUrl)
-	var speedyPusher = pkg.NewPusher(lokiClient, config.BufferMaxBatchSize, config.BufferMaxBytesSize)
+	lokiTLSConfig, err := pkg.NewTLSConfig(config.LokiTlsCaFile, config.LokiTlsCertFile, config.LokiTlsKeyFile, config.LokiTlsInsecureSkipVerify)
+	if err != nil {
+		panic(err)
+	}
+	lokiClientOptions := pkg.LokiClientOptions{
+		Timeout:           time.Duration(config.LokiTimeoutMs) * time.Millisecond,
+		TLSConfig:         lokiTLSConfig,
+		GrpcTLS:           config.LokiGrpcTls,
+		KeepaliveTime:     time.Duration(config.LokiGrpcKeepaliveTimeMs) * time.Millisecond,
+		KeepaliveTimeout:  time.Duration(config.LokiGrpcKeepaliveTimeoutMs) * time.Millisecond,
+		BasicAuthUsername: config.LokiBasicAuthUsername,
+		BasicAuthPassword: config.LokiBasicAuthPassword,
+		BearerToken:       config.LokiBearerToken,
+		BearerTokenFile:   config.LokiBearerTokenFile,
+		Headers:           config.LokiHeaders,
+	}
+	lokiClient, err := pkg.LokiClientFactoryCreate(config.LokiPushMode, config.LokiPushUrl, lokiClientOptions)
+	if err != nil {
+		panic(err)
+	}
+	healthChecker := pkg.NewHealthChecker(pkg.HealthOptions{
+		PollMaxAge: time.Duration(config.HealthPollMaxAgeMs) * time.Millisecond,
+		PushMaxAge: time.Duration(config.HealthPushMaxAgeMs) * time.Millisecond,
+	})
+	healthChecker.SetMetadataSource(kafkaConsumer)
+	// Every attempt is instrumented and recorded by the health checks, retries included.
+	lokiClient = pkg.NewRetryingSink(pkg.NewHealthCheckedSink(pkg.NewInstrumentedSink(lokiClient), healthChecker), pkg.RetryPolicy{
+		MaxAttempts:    config.LokiRetryMaxAttempts,
+		MaxElapsedTime: time.Duration(config.LokiRetryMaxElapsedMs) * time.Millisecond,
+		InitialBackoff: time.Duration(config.LokiRetryInitialBackoffMs) * time.Millisecond,
+		MaxBackoff:     time.Duration(config.LokiRetryMaxBackoffMs) * time.Millisecond,
+	})
+	var speedyPusher = pkg.NewShardedPusher(config.PusherShards, lokiClient, config.BufferMaxBatchSize, config.BufferMaxBytesSize)
+	speedyPusher.SetFlushIntervals(time.Duration(config.BufferFlushIntervalMs)*time.Millisecond,
+		time.Duration(config.BufferMinFlushIntervalMs)*time.Millisecond)
+	speedyPusher.SetMaxInflightRequests(config.MaxInflightRequests)
+	var offsetTracker = pkg.NewOffsetTracker(kafkaConsumer)
+	var streamPusher pkg.IStreamPusher = speedyPusher
+	var writeAheadLog *pkg.WriteAheadLog
+	if config.WalDirectory != "" {
+		// The Kafka messages are done once written to the write-ahead log, the pushers deliver its records.
+		writeAheadLog, err = pkg.NewWriteAheadLog(pkg.WriteAheadLogOptions{
+			Directory:       config.WalDirectory,
+			SegmentMaxBytes: config.WalSegmentMaxBytes,
+			MaxBytes:        config.WalMaxBytes,
+			Fsync:           config.WalFsync,
+			SyncInterval:    time.Duration(config.WalSyncIntervalMs) * time.Millisecond,
+		}, speedyPusher)
+		if err != nil {
+			panic(err)
+		}
+		writeAheadLog.SetOffsetTracker(offsetTracker)
+		speedyPusher.SetOffsetTracker(writeAheadLog.OffsetTracker())
+		streamPusher = writeAheadLog
+	} else {
+		speedyPusher.SetOffsetTracker(offsetTracker)
+	}
+	healthChecker.SetLastFlushSource(speedyPusher, time.Duration(config.HealthFlushIntervals)*speedyPusher.FlushInterval())
+	var processor = pkg.NewMessageProcessor(decoders, timestampExtractor, labelExtractor)
+	processor.SetLineFormatters(lineFormatters)
+	flattenOptions := pkg.FlattenOptions{
+		Separator:          config.FlattenSeparator,
+		MaxDepth:           config.FlattenMaxDepth,
+		ArrayMode:          config.FlattenArrayMode,
+		ArrayJoinSeparator: config.FlattenArrayJoinSeparator,
+		EscapeKeys:         config.FlattenEscapeKeys,
+		KeepEmpty:          config.FlattenKeepEmpty,
+	}
+	err = processor.SetFlattenOptions(flattenOptions)
+	if err != nil {
+		panic(err)
+	}
+	if config.Tenant.Source != "" {
+		tenantExtractor, err := pkg.NewTenantExtractor(config.Tenant)
+		if err != nil {
+			panic(err)
+		}
+		processor.SetTenantExtractor(tenantExtractor)
+	}
+	if len(config.Filters) > 0 {
+		messageFilter, err := pkg.NewMessageFilter(config.Filters)
+		if err != nil {
+			panic(err)
+		}
+		processor.SetMessageFilter(messageFilter)
+	}
+	if len(config.RedactionFields) > 0 || len(config.RedactionPatterns) > 0 {
+		redactor, err := pkg.NewRedactor(pkg.RedactionOptions{
+			Fields:   config.RedactionFields,
+			Flatten:  flattenOptions,
+			Patterns: config.RedactionPatterns,
+			Mode:     config.RedactionMode,
+			Mask:     config.RedactionMask,
+			HashSalt: config.RedactionHashSalt,
+		})
+		if err != nil {
+			panic(err)
+		}
+		processor.SetRedactor(redactor)
+	}
+	var dispatcher = pkg.NewDispatcher(config.KafkaPollingGoroutines, processor, streamPusher)
+	dispatcher.SetOffsetTracker(offsetTracker)
+	deadLetterQueue, err := pkg.DeadLetterQueueFactoryCreate(config.DeadLetterMode, config)
+	if err != nil {
+		panic(err)
+	}
+	if deadLetterQueue != nil {
+		speedyPusher.SetDeadLetterQueue(deadLetterQueue)
+		dispatcher.SetDeadLetterQueue(deadLetterQueue)
+	}
 	go speedyPusher.RunForever()
-	isRunning := true
-	var waitGroup sync.WaitGroup
-	for i := 0; i < 1; i++ {
-		waitGroup.Add(1)
-		go func() {
-			defer waitGroup.Done()
-			for isRunning {
-				ev := kafkaConsumer.Poll(config.KafkaPollingTimeoutMs)
-
-				switch event := ev.(type) {
-				case kafka.AssignedPartitions:
-					err := kafkaConsumer.Assign(event.Partitions)
-					if err != nil {
-						pkg.SugaredLogger.Error(err)
-						sentry.CaptureException(err)
-						return
-					}
-				case kafka.RevokedPartitions:
-					err := kafkaConsumer.Unassign()
-					if err != nil {
-						pkg.SugaredLogger.Error(err)
-						sentry.CaptureException(err)
-						return
-					}
-				case *kafka.Message:
-					var messageMap = make(map[string]interface{})
-					err := json.Unmarshal(event.Value, &messageMap)
-					if err != nil {
-						pkg.SugaredLogger.Error(err)
-						continue
-					}
-					flattenMap := pkg.FlattenMap(messageMap)
-					flattenMapString, err := json.Marshal(flattenMap)
-					if err != nil {
-						pkg.SugaredLogger.Error(err)
-						continue
-					}
-
-					labelsMap := map[string]string{
-						"key": *event.TopicPartition.Topic,
-					}
-
-					clientId := (*flattenMap)["clientID"]
-					clientIdStr, ok := clientId.(string)
-					if ok {
-						labelsMap["clientId"] = clientIdStr
-					}
-
-					// Size of clientId key and val
-					labelsSize := 8 + len(clientIdStr)
-
-					speedyPusher.DataChannel <- pkg.LokiStream{
-						Labels: labelsMap,
-						Values: [][]string{{"", string(flattenMapString)}},
-						Size:   len(event.Value) + labelsSize,
-					}
-				case kafka.PartitionEOF:
-					pkg.SugaredLogger.Info()
-				case kafka.Error:
-					if event.Code() == kafka.ErrTimedOut {
-						pkg.SugaredLogger.Debugf("Consumer error: %v\n", err)
-					} else {
-						// The client will automatically try to recover from all errors.
-						pkg.SugaredLogger.Warnf("Consumer error: %v\n", err)
-						sentry.CaptureException(err)
-					}
-				default:
+	dispatcher.Start()
+
+	// Init metrics and health checks
+	prometheus.MustRegister(speedyPusher, pkg.NewConsumerLagCollector(kafkaConsumer))
+	serveMux := http.NewServeMux()
+	serveMux.Handle("/metrics", promhttp.Handler())
+	serveMux.Handle("/healthz", healthChecker.LivenessHandler())
+	serveMux.Handle("/readyz", healthChecker.ReadinessHandler())
+	httpServer := &http.Server{Addr: config.HttpListenAddress, Handler: serveMux}
+	go func() {
+		err := httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			pkg.SugaredLogger.Errorf("failed to serve http: %s", err)
+			sentry.CaptureException(err)
+		}
+	}()
+	// Stop on SIGINT or SIGTERM, which Kubernetes sends. A second signal exits right away.
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	pollContext, stopPolling := context.WithCancel(context.Background())
+	// The shutdown deadline starts with the signal, or when the polling stops on its own. Once it's exceeded, the
+	// pushes in flight are aborted wherever the shutdown is stuck.
+	var shutdownOnce sync.Once
+	var shutdownContext context.Context
+	var cancelShutdown context.CancelFunc
+	startShutdown := func() {
+		shutdownOnce.Do(func() {
+			shutdownContext, cancelShutdown = context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeoutMs)*time.Millisecond)
+			stopPolling()
+			go func() {
+				<-shutdownContext.Done()
+				if shutdownContext.Err() == context.DeadlineExceeded {
+					speedyPusher.CancelSends()
 				}
-			}
-		}()
+			}()
+		})
 	}
 	go func() {
-		// Handle SIGINT
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		// Block until a signal is received.
-		<-c
-		pkg.SugaredLogger.Info("Received SIGINT, shutting down.")
-		isRunning = false
+		received := <-signals
+		pkg.SugaredLogger.Infof("Received %s, shutting down.", received)
+		startShutdown()
+		received = <-signals
+		pkg.SugaredLogger.Warnf("Received %s again, exiting.", received)
+		os.Exit(1)
+	}()
+
+	var waitGroup sync.WaitGroup
+	// A single goroutine polls Kafka, so that offsets are tracked in the order the messages are consumed.
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		defer stopPolling()
+		for pollContext.Err() == nil {
+			ev := kafkaConsumer.Poll(config.KafkaPollingTimeoutMs)
+			healthChecker.RecordPoll()
+
+			switch event := ev.(type) {
+			case kafka.AssignedPartitions:
+				err := kafkaConsumer.Assign(event.Partitions)
+				if err != nil {
+					pkg.SugaredLogger.Error(err)
+					sentry.CaptureException(err)
+					return
+				}
+				healthChecker.RecordAssignment(event.Partitions)
+			case kafka.RevokedPartitions:
+				// Deliver and commit what was consumed so far, then forget the revoked partitions so that
+				// nothing is committed for them after the rebalance.
+				streamPusher.Flush()
+				offsetTracker.Revoke(event.Partitions)
+				healthChecker.RecordRevocation()
+				err := kafkaConsumer.Unassign()
+				if err != nil {
+					pkg.SugaredLogger.Error(err)
+					sentry.CaptureException(err)
+					return
+				}
+			case *kafka.Message:
+				healthChecker.RecordMessage()
+				offsetTracker.Track(event.TopicPartition)
+				// The message isn't dispatched when the polling stops, it's not done and will be consumed again.
+				if dispatcher.Dispatch(pollContext, event) != nil {
+					return
+				}
+			case kafka.OAuthBearerTokenRefresh:
+				if tokenRefresher != nil {
+					tokenRefresher.Refresh(kafkaConsumer)
+				}
+			case kafka.PartitionEOF:
+				pkg.SugaredLogger.Info()
+			case kafka.Error:
+				healthChecker.RecordKafkaError(event)
+				if event.Code() == kafka.ErrTimedOut {
+					pkg.SugaredLogger.Debugf("Consumer error: %v\n", event)
+				} else {
+					// The client will automatically try to recover from all errors.
+					pkg.SugaredLogger.Warnf("Consumer error: %v\n", event)
+					sentry.CaptureException(event)
+				}
+			default:
+			}
+		}
 	}()
 	waitGroup.Wait()
+
+	// Shutdown in order: the polled messages are decoded, the pushers deliver what's left and the offsets of the
+	// delivered data are committed before the consumer leaves the group.
+	pkg.SugaredLogger.Info("Stopped polling, draining.")
+	startShutdown()
+	defer cancelShutdown()
+	dispatcherDone := make(chan struct{})
+	go func() {
+		defer close(dispatcherDone)
+		dispatcher.Shutdown()
+	}()
+	select {
+	case <-dispatcherDone:
+	case <-shutdownContext.Done():
+		pkg.SugaredLogger.Warn("Timed out waiting for the decode workers.")
+	}
+	if writeAheadLog != nil {
+		err = writeAheadLog.Close()
+		if err != nil {
+			pkg.SugaredLogger.Errorf("failed to close the write-ahead log: %s", err)
+			sentry.CaptureException(err)
+		}
+	}
+	err = speedyPusher.ShutdownContext(shutdownContext)
+	if err != nil {
+		pkg.SugaredLogger.Warnf("Timed out flushing the pushers, undelivered data will be consumed again: %s", err)
+	}
+	if deadLetterQueue != nil {
+		deadLetterQueue.Shutdown()
+	}
+	err = offsetTracker.Commit()
+	if err != nil {
+		pkg.SugaredLogger.Errorf("failed to commit the final offsets: %s", err)
+		sentry.CaptureException(err)
+	}
+	err = kafkaConsumer.Close()
+	if err != nil {
+		pkg.SugaredLogger.Errorf("failed to close the consumer: %s", err)
+		sentry.CaptureException(err)
+	}
+	_ = httpServer.Close()
+	sentry.Flush(2 * time.Second)
 	pkg.SugaredLogger.Info("Exiting.")
 }
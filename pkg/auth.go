@@ -0,0 +1,194 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewTLSConfig creates a TLS configuration from a CA bundle and a client certificate, for mTLS.
+// It returns nil when nothing is configured, so that the defaults are used.
+func NewTLSConfig(caFile string, certFile string, keyFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" && !insecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// tokenFile reads a token from a file, the file is read again when it changes so that rotated tokens are picked up.
+type tokenFile struct {
+	path    string
+	mutex   sync.Mutex
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+// Token returns the current token of the file.
+func (f *tokenFile) Token() (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return "", err
+	}
+	if f.token != "" && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.token, nil
+	}
+	content, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", f.path)
+	}
+	f.token, f.modTime, f.size = token, info.ModTime(), info.Size()
+	return f.token, nil
+}
+
+// lokiAuthenticator computes the authentication and custom headers of the Loki push requests.
+type lokiAuthenticator struct {
+	headers       map[string]string
+	authorization string
+	tokenFile     *tokenFile
+}
+
+// newLokiAuthenticator creates a lokiAuthenticator from the options, nil if there's nothing to add to the requests.
+func newLokiAuthenticator(options LokiClientOptions) (*lokiAuthenticator, error) {
+	methods := 0
+	for _, configured := range []bool{options.BasicAuthUsername != "", options.BearerToken != "", options.BearerTokenFile != ""} {
+		if configured {
+			methods++
+		}
+	}
+	if methods > 1 {
+		return nil, fmt.Errorf("only one of basic auth, bearer token and bearer token file can be configured")
+	}
+	if methods == 0 && len(options.Headers) == 0 {
+		return nil, nil
+	}
+
+	authenticator := &lokiAuthenticator{headers: options.Headers}
+	switch {
+	case options.BasicAuthUsername != "":
+		credentials := options.BasicAuthUsername + ":" + options.BasicAuthPassword
+		authenticator.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	case options.BearerToken != "":
+		authenticator.authorization = "Bearer " + options.BearerToken
+	case options.BearerTokenFile != "":
+		authenticator.tokenFile = &tokenFile{path: options.BearerTokenFile}
+		// Fail early if the token can't be read.
+		if _, err := authenticator.tokenFile.Token(); err != nil {
+			return nil, err
+		}
+	}
+	return authenticator, nil
+}
+
+// Headers returns the headers to add to a push request.
+func (a *lokiAuthenticator) Headers() (map[string]string, error) {
+	headers := make(map[string]string, len(a.headers)+1)
+	for name, value := range a.headers {
+		headers[name] = value
+	}
+	if a.authorization != "" {
+		headers["Authorization"] = a.authorization
+	}
+	if a.tokenFile != nil {
+		token, err := a.tokenFile.Token()
+		if err != nil {
+			return nil, err
+		}
+		headers["Authorization"] = "Bearer " + token
+	}
+	return headers, nil
+}
+
+// lokiAuthRoundTripper is an http.RoundTripper that adds the headers of a lokiAuthenticator to the requests.
+type lokiAuthRoundTripper struct {
+	base          http.RoundTripper
+	authenticator *lokiAuthenticator
+}
+
+// RoundTrip sends a copy of the request with the authentication and custom headers.
+func (r *lokiAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	headers, err := r.authenticator.Headers()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	return r.base.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of the base http.RoundTripper.
+func (r *lokiAuthRoundTripper) CloseIdleConnections() {
+	if closer, ok := r.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// GetRequestMetadata returns the headers as gRPC metadata, it makes lokiAuthenticator usable as gRPC credentials.
+func (a *lokiAuthenticator) GetRequestMetadata(_ context.Context, _ ...string) (map[string]string, error) {
+	headers, err := a.Headers()
+	if err != nil {
+		return nil, err
+	}
+	metadata := make(map[string]string, len(headers))
+	for name, value := range headers {
+		metadata[strings.ToLower(name)] = value
+	}
+	return metadata, nil
+}
+
+// RequireTransportSecurity returns false, credentials are also sent over plaintext connections to private networks.
+func (a *lokiAuthenticator) RequireTransportSecurity() bool {
+	return false
+}
+
+// newLokiHttpClientFromOptions creates the http.Client of the HTTP push modes.
+func newLokiHttpClientFromOptions(options LokiClientOptions) (*http.Client, error) {
+	authenticator, err := newLokiAuthenticator(options)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if options.TLSConfig != nil {
+		transport.TLSClientConfig = options.TLSConfig
+	}
+	client := &http.Client{Timeout: options.Timeout, Transport: transport}
+	if authenticator != nil {
+		client.Transport = &lokiAuthRoundTripper{base: transport, authenticator: authenticator}
+	}
+	return client, nil
+}
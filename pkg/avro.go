@@ -0,0 +1,423 @@
+package pkg
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/goccy/go-json"
+	"math"
+	"strings"
+	"sync"
+)
+
+// avroSchema is a parsed Avro schema.
+type avroSchema struct {
+	// kind is the Avro type: null, boolean, int, long, float, double, bytes, string,
+	// record, enum, array, map, union or fixed.
+	kind     string
+	name     string
+	fields   []avroField
+	symbols  []string
+	items    *avroSchema
+	values   *avroSchema
+	branches []*avroSchema
+	size     int
+}
+
+// avroField is a field of an Avro record.
+type avroField struct {
+	name   string
+	schema *avroSchema
+}
+
+// avroPrimitives are the Avro primitive types.
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+// parseAvroSchema parses an Avro schema definition, named types are registered in and resolved from names.
+func parseAvroSchema(definition string, names map[string]*avroSchema) (*avroSchema, error) {
+	var raw interface{}
+	err := json.Unmarshal([]byte(definition), &raw)
+	if err != nil {
+		// Primitive schemas may be given as bare names.
+		raw = definition
+	}
+	return parseAvroType(raw, "", names)
+}
+
+// avroFullName returns the full name of a named type.
+func avroFullName(name string, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// parseAvroType parses the JSON representation of an Avro type.
+func parseAvroType(raw interface{}, namespace string, names map[string]*avroSchema) (*avroSchema, error) {
+	switch v := raw.(type) {
+	case string:
+		if avroPrimitives[v] {
+			return &avroSchema{kind: v}, nil
+		}
+		if schema, ok := names[avroFullName(v, namespace)]; ok {
+			return schema, nil
+		}
+		if schema, ok := names[v]; ok {
+			return schema, nil
+		}
+		return nil, fmt.Errorf("unknown avro type %s", v)
+	case []interface{}:
+		union := &avroSchema{kind: "union", branches: make([]*avroSchema, 0, len(v))}
+		for _, branch := range v {
+			schema, err := parseAvroType(branch, namespace, names)
+			if err != nil {
+				return nil, err
+			}
+			union.branches = append(union.branches, schema)
+		}
+		return union, nil
+	case map[string]interface{}:
+		return parseAvroComplexType(v, namespace, names)
+	}
+	return nil, fmt.Errorf("invalid avro type %v", raw)
+}
+
+// parseAvroComplexType parses an Avro type given as a JSON object.
+func parseAvroComplexType(raw map[string]interface{}, namespace string, names map[string]*avroSchema) (*avroSchema, error) {
+	typeName, ok := raw["type"].(string)
+	if !ok {
+		// The type is itself a complex type, e.g. {"type": {"type": "array", "items": "int"}}.
+		return parseAvroType(raw["type"], namespace, names)
+	}
+
+	// registerName registers the named type before its children are parsed, so it can reference itself.
+	registerName := func(schema *avroSchema) error {
+		name, _ := raw["name"].(string)
+		if name == "" {
+			return fmt.Errorf("avro %s without a name", typeName)
+		}
+		if ns, ok := raw["namespace"].(string); ok && !strings.Contains(name, ".") {
+			namespace = ns
+		}
+		schema.name = avroFullName(name, namespace)
+		if index := strings.LastIndex(schema.name, "."); index >= 0 {
+			namespace = schema.name[:index]
+		}
+		names[schema.name] = schema
+		return nil
+	}
+
+	switch typeName {
+	case "record", "error":
+		schema := &avroSchema{kind: "record"}
+		if err := registerName(schema); err != nil {
+			return nil, err
+		}
+		fields, _ := raw["fields"].([]interface{})
+		for _, rawField := range fields {
+			field, ok := rawField.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid field in avro record %s", schema.name)
+			}
+			name, _ := field["name"].(string)
+			fieldSchema, err := parseAvroType(field["type"], namespace, names)
+			if err != nil {
+				return nil, err
+			}
+			schema.fields = append(schema.fields, avroField{name: name, schema: fieldSchema})
+		}
+		return schema, nil
+	case "enum":
+		schema := &avroSchema{kind: "enum"}
+		if err := registerName(schema); err != nil {
+			return nil, err
+		}
+		symbols, _ := raw["symbols"].([]interface{})
+		for _, symbol := range symbols {
+			symbolName, _ := symbol.(string)
+			schema.symbols = append(schema.symbols, symbolName)
+		}
+		return schema, nil
+	case "fixed":
+		schema := &avroSchema{kind: "fixed"}
+		if err := registerName(schema); err != nil {
+			return nil, err
+		}
+		size, _ := raw["size"].(float64)
+		schema.size = int(size)
+		return schema, nil
+	case "array":
+		items, err := parseAvroType(raw["items"], namespace, names)
+		if err != nil {
+			return nil, err
+		}
+		return &avroSchema{kind: "array", items: items}, nil
+	case "map":
+		values, err := parseAvroType(raw["values"], namespace, names)
+		if err != nil {
+			return nil, err
+		}
+		return &avroSchema{kind: "map", values: values}, nil
+	default:
+		// Primitives, possibly annotated with a logical type which is decoded as the underlying type.
+		return parseAvroType(typeName, namespace, names)
+	}
+}
+
+// avroReader decodes Avro binary data.
+type avroReader struct {
+	data     []byte
+	position int
+}
+
+// readLong reads a zig-zag encoded variable length long.
+func (r *avroReader) readLong() (int64, error) {
+	value, read := binary.Varint(r.data[r.position:])
+	if read <= 0 {
+		return 0, fmt.Errorf("invalid avro long at position %d", r.position)
+	}
+	r.position += read
+	return value, nil
+}
+
+// readFixed reads size bytes.
+func (r *avroReader) readFixed(size int) ([]byte, error) {
+	if size < 0 || r.position+size > len(r.data) {
+		return nil, fmt.Errorf("avro data too short at position %d", r.position)
+	}
+	value := r.data[r.position : r.position+size]
+	r.position += size
+	return value, nil
+}
+
+// readBytes reads length prefixed bytes.
+func (r *avroReader) readBytes() ([]byte, error) {
+	length, err := r.readLong()
+	if err != nil {
+		return nil, err
+	}
+	return r.readFixed(int(length))
+}
+
+// readBlockCount reads the item count of an array or map block.
+func (r *avroReader) readBlockCount() (int64, error) {
+	count, err := r.readLong()
+	if err != nil {
+		return 0, err
+	}
+	if count < 0 {
+		// Negative counts are followed by the block size in bytes.
+		count = -count
+		if _, err := r.readLong(); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// read decodes a value of the given schema into the shape produced by unmarshalling JSON.
+func (r *avroReader) read(schema *avroSchema) (interface{}, error) {
+	switch schema.kind {
+	case "null":
+		return nil, nil
+	case "boolean":
+		value, err := r.readFixed(1)
+		if err != nil {
+			return nil, err
+		}
+		return value[0] != 0, nil
+	case "int", "long":
+		return r.readLong()
+	case "float":
+		value, err := r.readFixed(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(value))), nil
+	case "double":
+		value, err := r.readFixed(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(value)), nil
+	case "bytes", "string":
+		value, err := r.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		return string(value), nil
+	case "fixed":
+		value, err := r.readFixed(schema.size)
+		if err != nil {
+			return nil, err
+		}
+		return string(value), nil
+	case "enum":
+		index, err := r.readLong()
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || int(index) >= len(schema.symbols) {
+			return nil, fmt.Errorf("invalid index %d for avro enum %s", index, schema.name)
+		}
+		return schema.symbols[index], nil
+	case "union":
+		index, err := r.readLong()
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || int(index) >= len(schema.branches) {
+			return nil, fmt.Errorf("invalid avro union index %d", index)
+		}
+		return r.read(schema.branches[index])
+	case "record":
+		record := make(map[string]interface{}, len(schema.fields))
+		for _, field := range schema.fields {
+			value, err := r.read(field.schema)
+			if err != nil {
+				return nil, err
+			}
+			record[field.name] = value
+		}
+		return record, nil
+	case "array":
+		items := make([]interface{}, 0)
+		for {
+			count, err := r.readBlockCount()
+			if err != nil {
+				return nil, err
+			}
+			if count == 0 {
+				return items, nil
+			}
+			for ; count > 0; count-- {
+				item, err := r.read(schema.items)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+			}
+		}
+	case "map":
+		values := make(map[string]interface{})
+		for {
+			count, err := r.readBlockCount()
+			if err != nil {
+				return nil, err
+			}
+			if count == 0 {
+				return values, nil
+			}
+			for ; count > 0; count-- {
+				key, err := r.readBytes()
+				if err != nil {
+					return nil, err
+				}
+				value, err := r.read(schema.values)
+				if err != nil {
+					return nil, err
+				}
+				values[string(key)] = value
+			}
+		}
+	}
+	return nil, fmt.Errorf("unsupported avro type %s", schema.kind)
+}
+
+// AvroDecoder decodes Avro messages in the Confluent wire format, fetching the schemas from a schema registry.
+type AvroDecoder struct {
+	registry *SchemaRegistryClient
+	mutex    sync.Mutex
+	schemas  map[int]*avroSchema
+}
+
+// NewAvroDecoder creates a new AvroDecoder.
+func NewAvroDecoder(registry *SchemaRegistryClient) *AvroDecoder {
+	return &AvroDecoder{registry: registry, schemas: make(map[int]*avroSchema)}
+}
+
+// Decode decodes the Avro record, the line is the record as JSON.
+func (d *AvroDecoder) Decode(message *kafka.Message) (DecodedMessage, error) {
+	schemaId, payload, err := parseConfluentWireFormat(message.Value)
+	if err != nil {
+		return DecodedMessage{}, err
+	}
+	schema, err := d.schema(schemaId)
+	if err != nil {
+		return DecodedMessage{}, err
+	}
+
+	reader := &avroReader{data: payload}
+	value, err := reader.read(schema)
+	if err != nil {
+		return DecodedMessage{}, err
+	}
+	return newStructuredDecodedMessage(value)
+}
+
+// schema returns the parsed schema with the given id.
+func (d *AvroDecoder) schema(id int) (*avroSchema, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if schema, ok := d.schemas[id]; ok {
+		return schema, nil
+	}
+	registrySchema, err := d.registry.SchemaById(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+	if registrySchema.SchemaType != "" && registrySchema.SchemaType != "AVRO" {
+		return nil, fmt.Errorf("schema %d is a %s schema, not avro", id, registrySchema.SchemaType)
+	}
+
+	// Referenced schemas define named types used by the schema, they're parsed first.
+	names := make(map[string]*avroSchema)
+	err = d.parseReferences(registrySchema.References, names)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := parseAvroSchema(registrySchema.Schema, names)
+	if err != nil {
+		return nil, err
+	}
+	d.schemas[id] = schema
+	return schema, nil
+}
+
+// parseReferences parses the referenced schemas, and their own references, into names.
+func (d *AvroDecoder) parseReferences(references []SchemaReference, names map[string]*avroSchema) error {
+	for _, reference := range references {
+		referenced, err := d.registry.SchemaBySubject(context.Background(), reference.Subject, reference.Version)
+		if err != nil {
+			return err
+		}
+		err = d.parseReferences(referenced.References, names)
+		if err != nil {
+			return err
+		}
+		_, err = parseAvroSchema(referenced.Schema, names)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newStructuredDecodedMessage creates a DecodedMessage from a decoded record, the line is the record as JSON.
+// Records that are not objects are stored under the value field.
+func newStructuredDecodedMessage(value interface{}) (DecodedMessage, error) {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		fields = map[string]interface{}{"value": value}
+	}
+	line, err := json.Marshal(fields)
+	if err != nil {
+		return DecodedMessage{}, err
+	}
+	return DecodedMessage{Fields: fields, Line: string(line)}, nil
+}
@@ -0,0 +1,142 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"sync/atomic"
+	"testing"
+)
+
+// testAvroEncoder hand encodes Avro binary data.
+type testAvroEncoder struct {
+	data []byte
+}
+
+func (e *testAvroEncoder) long(value int64) *testAvroEncoder {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	e.data = append(e.data, buffer[:binary.PutVarint(buffer, value)]...)
+	return e
+}
+
+func (e *testAvroEncoder) string(value string) *testAvroEncoder {
+	e.long(int64(len(value)))
+	e.data = append(e.data, value...)
+	return e
+}
+
+func (e *testAvroEncoder) double(value float64) *testAvroEncoder {
+	buffer := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buffer, math.Float64bits(value))
+	e.data = append(e.data, buffer...)
+	return e
+}
+
+func (e *testAvroEncoder) boolean(value bool) *testAvroEncoder {
+	if value {
+		e.data = append(e.data, 1)
+	} else {
+		e.data = append(e.data, 0)
+	}
+	return e
+}
+
+const testAvroClientSchema = `{
+	"type": "record",
+	"name": "Client",
+	"namespace": "speedy",
+	"fields": [{"name": "id", "type": "string"}, {"name": "parent", "type": ["null", "Client"]}]
+}`
+
+const testAvroEventSchema = `{
+	"type": "record",
+	"name": "Event",
+	"namespace": "speedy",
+	"fields": [
+		{"name": "message", "type": "string"},
+		{"name": "count", "type": "long"},
+		{"name": "ratio", "type": "double"},
+		{"name": "ok", "type": "boolean"},
+		{"name": "level", "type": {"type": "enum", "name": "Level", "symbols": ["DEBUG", "INFO"]}},
+		{"name": "error", "type": ["null", "string"]},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "attributes", "type": {"type": "map", "values": "long"}},
+		{"name": "client", "type": "Client"}
+	]
+}`
+
+// Test_AvroDecoder_Decode ensures that Avro records are decoded into maps.
+func Test_AvroDecoder_Decode(t *testing.T) {
+	registry := newTestSchemaRegistry(t, map[string]RegistrySchema{
+		"/schemas/ids/1": {Schema: testAvroEventSchema, References: []SchemaReference{
+			{Name: "speedy.Client", Subject: "client", Version: 1},
+		}},
+		"/subjects/client/versions/1": {Schema: testAvroClientSchema},
+		"/schemas/ids/2":              {Schema: `"string"`},
+		"/schemas/ids/3":              {Schema: "syntax = \"proto3\";", SchemaType: "PROTOBUF"},
+	})
+	decoder := NewAvroDecoder(NewSchemaRegistryClient(registry.server.URL))
+
+	payload := (&testAvroEncoder{}).
+		string("hello").long(-3).double(0.5).boolean(true).
+		long(1).
+		long(1).string("boom").
+		long(2).string("a").string("b").long(0).
+		long(-1).long(4).string("k").long(7).long(0).
+		string("c1").long(1).string("c0").long(0).
+		data
+
+	for i := 0; i < 2; i++ {
+		decoded, err := decoder.Decode(&kafka.Message{Value: confluentWireFormat(1, payload)})
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]interface{}{
+			"message":    "hello",
+			"count":      int64(-3),
+			"ratio":      0.5,
+			"ok":         true,
+			"level":      "INFO",
+			"error":      "boom",
+			"tags":       []interface{}{"a", "b"},
+			"attributes": map[string]interface{}{"k": int64(7)},
+			"client": map[string]interface{}{
+				"id":     "c1",
+				"parent": map[string]interface{}{"id": "c0", "parent": nil},
+			},
+		}, decoded.Fields)
+		assert.Equal(t, `{"attributes":{"k":7},"client":{"id":"c1","parent":{"id":"c0","parent":null}},"count":-3,"error":"boom","level":"INFO","message":"hello","ok":true,"ratio":0.5,"tags":["a","b"]}`, decoded.Line)
+	}
+	// The schemas are cached by id.
+	assert.Equal(t, int32(2), atomic.LoadInt32(&registry.requests))
+
+	decoded, err := decoder.Decode(&kafka.Message{Value: confluentWireFormat(2, (&testAvroEncoder{}).string("plain").data)})
+	assert.Nil(t, err)
+	assert.Equal(t, DecodedMessage{Fields: map[string]interface{}{"value": "plain"}, Line: `{"value":"plain"}`}, decoded)
+
+	_, err = decoder.Decode(&kafka.Message{Value: confluentWireFormat(1, payload[:10])})
+	assert.Error(t, err)
+
+	_, err = decoder.Decode(&kafka.Message{Value: confluentWireFormat(3, payload)})
+	assert.Error(t, err)
+
+	_, err = decoder.Decode(&kafka.Message{Value: confluentWireFormat(4, payload)})
+	assert.Error(t, err)
+
+	_, err = decoder.Decode(&kafka.Message{Value: []byte(`{"a": 1}`)})
+	assert.Error(t, err)
+}
+
+// Test_parseAvroSchema ensures that invalid schemas are rejected.
+func Test_parseAvroSchema(t *testing.T) {
+	var tests = []string{
+		`"Unknown"`,
+		`{"type": "record", "fields": []}`,
+		`{"type": "array", "items": "Unknown"}`,
+		`{"type": "record", "name": "A", "fields": [{"name": "b", "type": "B"}]}`,
+		`42`,
+	}
+	for _, definition := range tests {
+		_, err := parseAvroSchema(definition, make(map[string]*avroSchema))
+		assert.Error(t, err, definition)
+	}
+}
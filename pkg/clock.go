@@ -0,0 +1,29 @@
+package pkg
+
+import "time"
+
+// Clock provides the time to the components that depend on it, so that tests can control it.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTicker returns the channel of a ticker with the given period and the function that stops it.
+	NewTicker(period time.Duration) (<-chan time.Time, func())
+}
+
+// systemClock is the Clock of the system time.
+type systemClock struct {
+}
+
+// SystemClock is the Clock of the system time.
+var SystemClock Clock = systemClock{}
+
+// Now returns time.Now.
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTicker returns a time.Ticker.
+func (systemClock) NewTicker(period time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(period)
+	return ticker.C, ticker.Stop
+}
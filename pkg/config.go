@@ -2,6 +2,7 @@ package pkg
 
 import (
 	"errors"
+	"fmt"
 	"github.com/getsentry/sentry-go"
 	"github.com/goccy/go-json"
 	"github.com/spf13/viper"
@@ -12,11 +13,27 @@ import (
 type Configuration struct {
 	// LoggingLevel is the logging level.
 	LoggingLevel string `json:"logging_level"`
+	// HttpListenAddress is the address of the HTTP server that exposes the /metrics, /healthz and /readyz endpoints.
+	HttpListenAddress string `json:"http_listen_address"`
+	// ShutdownTimeoutMs is the maximum time in milliseconds to flush the remaining data to Loki on shutdown.
+	ShutdownTimeoutMs int `json:"shutdown_timeout_ms"`
+	// HealthPollMaxAgeMs is the maximum time in milliseconds since the last Kafka poll before /healthz fails.
+	HealthPollMaxAgeMs int `json:"health_poll_max_age_ms"`
+	// HealthFlushIntervals is the number of flush intervals without a flush before /healthz fails.
+	HealthFlushIntervals int `json:"health_flush_intervals"`
+	// HealthPushMaxAgeMs is the maximum time in milliseconds since the last successful push while pushes fail
+	// before /readyz fails.
+	HealthPushMaxAgeMs int `json:"health_push_max_age_ms"`
 	// SentryDSN is the DSN used by Sentry, for reporting errors.
 	SentryDSN string `json:"sentry_dsn"`
-	// KafkaPollingGoroutines is the number of goroutines that will poll Kafka for new messages.
+	// KafkaPollingGoroutines is the number of goroutines that will decode the messages polled from Kafka.
 	KafkaPollingGoroutines int `json:"kafka_polling_goroutines"`
-	// KafkaPollingTimeoutMs is the timeout in milliseconds for the message poll().
+	// PusherShards is the number of pushers that batch and send data to Loki, streams are sharded by labels.
+	PusherShards int `json:"pusher_shards"`
+	// MaxInflightRequests is the number of batches each pusher shard sends to Loki concurrently, so up to
+	// PusherShards × MaxInflightRequests pushes are in flight.
+	MaxInflightRequests int `json:"max_inflight_requests"`
+	// KafkaPollingTimeoutMs is the timeout in milliseconds for the message poll(), the shutdown waits for it.
 	KafkaPollingTimeoutMs int `json:"kafka_polling_timeout_ms"`
 	// KafkaBoostrapServers is a string of comma separated boostrap servers.
 	KafkaBoostrapServers string `json:"kafka_boostrap_servers"`
@@ -26,18 +43,162 @@ type Configuration struct {
 	SubscribeTopics []string `json:"subscribe_topics"`
 	// LokiPushUrl is the full URL of the Loki push API endpoint.
 	LokiPushUrl string `json:"loki_push_url"`
-	// LokiPushMode is the mode used to push data to Loki, http or proto.
+	// LokiPushMode is the mode used to push data to Loki, http, proto or grpc.
+	// The grpc mode expects the host:port of the Loki gRPC server as loki_push_url.
 	LokiPushMode string `json:"loki_push_mode"`
+	// LokiTimeoutMs is the timeout in milliseconds of a push request, 0 means no timeout.
+	LokiTimeoutMs int `json:"loki_timeout_ms"`
+	// LokiGrpcTls enables TLS for the grpc push mode.
+	LokiGrpcTls bool `json:"loki_grpc_tls"`
+	// LokiBasicAuthUsername enables basic authentication with LokiBasicAuthPassword.
+	LokiBasicAuthUsername string `json:"loki_basic_auth_username"`
+	// LokiBasicAuthPassword is the basic authentication password.
+	LokiBasicAuthPassword string `json:"loki_basic_auth_password"`
+	// LokiBearerToken is the bearer token sent to Loki.
+	LokiBearerToken string `json:"loki_bearer_token"`
+	// LokiBearerTokenFile is a file that holds the bearer token, it's read again when it changes.
+	LokiBearerTokenFile string `json:"loki_bearer_token_file"`
+	// LokiHeaders are extra headers sent with every push request.
+	LokiHeaders map[string]string `json:"loki_headers"`
+	// LokiTlsCaFile is the CA bundle used to verify the Loki server certificate.
+	LokiTlsCaFile string `json:"loki_tls_ca_file"`
+	// LokiTlsCertFile is the client certificate sent to Loki, for mTLS.
+	LokiTlsCertFile string `json:"loki_tls_cert_file"`
+	// LokiTlsKeyFile is the key of the client certificate.
+	LokiTlsKeyFile string `json:"loki_tls_key_file"`
+	// LokiTlsInsecureSkipVerify disables the verification of the Loki server certificate.
+	LokiTlsInsecureSkipVerify bool `json:"loki_tls_insecure_skip_verify"`
+	// LokiGrpcKeepaliveTimeMs is the interval in milliseconds of the grpc keepalive pings, 0 disables them.
+	LokiGrpcKeepaliveTimeMs int `json:"loki_grpc_keepalive_time_ms"`
+	// LokiGrpcKeepaliveTimeoutMs is the time in milliseconds to wait for a keepalive ping acknowledgement.
+	LokiGrpcKeepaliveTimeoutMs int `json:"loki_grpc_keepalive_timeout_ms"`
 	// BufferMaxBatchSize is the batch size that will be sent to Loki.
 	BufferMaxBatchSize int `json:"buffer_max_batch_size"`
 	// BufferMaxBytesSize is max buffer size in bytes uncompressed and unserialized that will be sent to Loki.
 	BufferMaxBytesSize int `json:"buffer_max_bytes_size"`
+	// BufferFlushIntervalMs is the maximum age in milliseconds of the oldest entry of a batch before it's flushed.
+	BufferFlushIntervalMs int `json:"buffer_flush_interval_ms"`
+	// BufferMinFlushIntervalMs is the minimum time in milliseconds between two timer flushes of a batch.
+	BufferMinFlushIntervalMs int `json:"buffer_min_flush_interval_ms"`
 	// KafkaOffsetReset is analogous to https://kafka.apache.org/documentation/#consumerconfigs_auto.offset.reset
 	KafkaOffsetReset string `json:"kafka_offset_reset"`
+	// KafkaSecurityProtocol is the librdkafka security.protocol: plaintext, ssl, sasl_plaintext or sasl_ssl.
+	KafkaSecurityProtocol string `json:"kafka_security_protocol"`
+	// KafkaSaslMechanism is the SASL mechanism: PLAIN, SCRAM-SHA-256, SCRAM-SHA-512 or OAUTHBEARER.
+	KafkaSaslMechanism string `json:"kafka_sasl_mechanism"`
+	// KafkaSaslUsername is the SASL username.
+	KafkaSaslUsername string `json:"kafka_sasl_username"`
+	// KafkaSaslPassword is the SASL password.
+	KafkaSaslPassword string `json:"kafka_sasl_password"`
+	// KafkaSaslPasswordFile is a file that holds the SASL password.
+	KafkaSaslPasswordFile string `json:"kafka_sasl_password_file"`
+	// KafkaSaslOauthbearerTokenFile is a file that holds the OAUTHBEARER token, it's read whenever the token expires.
+	KafkaSaslOauthbearerTokenFile string `json:"kafka_sasl_oauthbearer_token_file"`
+	// KafkaSslCaLocation is the CA bundle used to verify the brokers.
+	KafkaSslCaLocation string `json:"kafka_ssl_ca_location"`
+	// KafkaSslCertificateLocation is the client certificate, for mTLS.
+	KafkaSslCertificateLocation string `json:"kafka_ssl_certificate_location"`
+	// KafkaSslKeyLocation is the key of the client certificate.
+	KafkaSslKeyLocation string `json:"kafka_ssl_key_location"`
+	// KafkaSslKeyPassword is the password of the client certificate key.
+	KafkaSslKeyPassword string `json:"kafka_ssl_key_password"`
+	// KafkaExtraConfig are librdkafka settings passed as is to the Kafka clients.
+	KafkaExtraConfig map[string]string `json:"kafka_extra_config"`
+	// LokiRetryMaxAttempts is the maximum number of attempts for a push, 0 means unlimited.
+	LokiRetryMaxAttempts int `json:"loki_retry_max_attempts"`
+	// LokiRetryMaxElapsedMs is the maximum time in milliseconds spent retrying a push, 0 means unlimited.
+	LokiRetryMaxElapsedMs int `json:"loki_retry_max_elapsed_ms"`
+	// LokiRetryInitialBackoffMs is the backoff in milliseconds before the first retry.
+	LokiRetryInitialBackoffMs int `json:"loki_retry_initial_backoff_ms"`
+	// LokiRetryMaxBackoffMs is the maximum backoff in milliseconds between two attempts.
+	LokiRetryMaxBackoffMs int `json:"loki_retry_max_backoff_ms"`
+	// DeadLetterMode is the dead letter queue used for undecodable messages and rejected entries, kafka or file.
+	// The dead letter queue is disabled when empty.
+	DeadLetterMode string `json:"dlq_mode"`
+	// DeadLetterKafkaTopic is the topic of the kafka dead letter queue.
+	DeadLetterKafkaTopic string `json:"dlq_kafka_topic"`
+	// DeadLetterFilePath is the path of the file dead letter queue.
+	DeadLetterFilePath string `json:"dlq_file_path"`
+	// WalDirectory is the directory of the write-ahead log between the decoders and the pushers, disabled when empty.
+	WalDirectory string `json:"wal_directory"`
+	// WalSegmentMaxBytes is the size of a write-ahead log segment file.
+	WalSegmentMaxBytes int64 `json:"wal_segment_max_bytes"`
+	// WalMaxBytes is the maximum size of the write-ahead log, consuming pauses while it's reached.
+	WalMaxBytes int64 `json:"wal_max_bytes"`
+	// WalFsync is the fsync policy of the write-ahead log, always, interval or never.
+	WalFsync string `json:"wal_fsync"`
+	// WalSyncIntervalMs is the interval in milliseconds of the write-ahead log syncs.
+	WalSyncIntervalMs int `json:"wal_sync_interval_ms"`
+	// Labels are the rules used to extract the Loki labels from the messages.
+	Labels []LabelRule `json:"labels"`
+	// Decoders are the decoders used for the topics that match their pattern, messages are JSON otherwise.
+	Decoders []DecoderRule `json:"decoders"`
+	// FlattenSeparator joins the keys of the nested message fields.
+	FlattenSeparator string `json:"flatten_separator"`
+	// FlattenMaxDepth is the maximum depth of the flattened fields, deeper values are kept as JSON. 0 means unlimited.
+	FlattenMaxDepth int `json:"flatten_max_depth"`
+	// FlattenArrayMode is the way arrays are flattened, index, join, json or drop.
+	FlattenArrayMode string `json:"flatten_array_mode"`
+	// FlattenArrayJoinSeparator joins the array items with the join array mode.
+	FlattenArrayJoinSeparator string `json:"flatten_array_join_separator"`
+	// FlattenEscapeKeys escapes the separators of the keys, so that the flattened paths are unambiguous.
+	FlattenEscapeKeys bool `json:"flatten_escape_keys"`
+	// FlattenKeepEmpty keeps the empty maps and arrays of the messages as fields, they're dropped otherwise.
+	FlattenKeepEmpty bool `json:"flatten_keep_empty"`
+	// LineFormats are the line formats used for the topics that match their pattern, lines are flattened JSON otherwise.
+	LineFormats []LineFormatRule `json:"line_formats"`
+	// Filters are the rules that drop messages before they're pushed to Loki.
+	Filters []FilterRule `json:"filters"`
+	// RedactionFields are the globs of the flattened field paths whose values are redacted.
+	RedactionFields []string `json:"redaction_fields"`
+	// RedactionPatterns are the patterns redacted from the string values and raw lines.
+	RedactionPatterns []RedactionPattern `json:"redaction_patterns"`
+	// RedactionMode is mask or hash.
+	RedactionMode string `json:"redaction_mode"`
+	// RedactionMask is the replacement of the masked values.
+	RedactionMask string `json:"redaction_mask"`
+	// RedactionHashSalt is the salt of the hash redaction mode.
+	RedactionHashSalt string `json:"redaction_hash_salt"`
+	// LokiTenantId is the static Loki tenant, or the default tenant when Tenant doesn't find one.
+	LokiTenantId string `json:"loki_tenant_id"`
+	// Tenant is the rule used to extract the Loki tenant from the messages, an empty source means no tenant.
+	Tenant ValueRule `json:"tenant"`
+	// TimestampSource is the source of the Loki entry timestamp, kafka, field or now.
+	TimestampSource string `json:"timestamp_source"`
+	// TimestampField is the flattened message field that holds the timestamp, used with the field source.
+	TimestampField string `json:"timestamp_field"`
+	// TimestampFormat is the format of TimestampField, rfc3339, unix, unix_ms, unix_ns or a Go time layout.
+	TimestampFormat string `json:"timestamp_format"`
 }
 
-// ToPrettyJson transforms the current configuration to a pretty json.
+// maskedSecret replaces secrets in ToPrettyJson.
+const maskedSecret = "******"
+
+// ToPrettyJson transforms the current configuration to a pretty json, secrets are masked.
 func (c Configuration) ToPrettyJson() string {
+	if c.LokiBasicAuthPassword != "" {
+		c.LokiBasicAuthPassword = maskedSecret
+	}
+	if c.LokiBearerToken != "" {
+		c.LokiBearerToken = maskedSecret
+	}
+	if c.KafkaSaslPassword != "" {
+		c.KafkaSaslPassword = maskedSecret
+	}
+	if c.KafkaSslKeyPassword != "" {
+		c.KafkaSslKeyPassword = maskedSecret
+	}
+	if c.RedactionHashSalt != "" {
+		c.RedactionHashSalt = maskedSecret
+	}
+	// Headers often hold API keys, their values are masked as well.
+	if len(c.LokiHeaders) > 0 {
+		headers := make(map[string]string, len(c.LokiHeaders))
+		for name := range c.LokiHeaders {
+			headers[name] = maskedSecret
+		}
+		c.LokiHeaders = headers
+	}
 	prettyJson, err := json.MarshalIndent(c, "", " ")
 	if err != nil {
 		SugaredLogger.Error("failed to convert config to pretty json")
@@ -115,23 +276,244 @@ func (v *ViperConfigurator) loadConfig() error {
 	v.viper.SetDefault("buffer_max_bytes_size", math.MaxInt32)
 	v.configuration.BufferMaxBytesSize = v.viper.GetInt("buffer_max_bytes_size")
 
+	v.viper.SetDefault("buffer_flush_interval_ms", 60_000)
+	v.configuration.BufferFlushIntervalMs = v.viper.GetInt("buffer_flush_interval_ms")
+	if v.configuration.BufferFlushIntervalMs <= 0 {
+		return errors.New("buffer_flush_interval_ms must be positive")
+	}
+
+	v.viper.SetDefault("buffer_min_flush_interval_ms", 1_000)
+	v.configuration.BufferMinFlushIntervalMs = v.viper.GetInt("buffer_min_flush_interval_ms")
+
 	v.viper.SetDefault("loki_push_mode", "http")
 	v.configuration.LokiPushMode = v.viper.GetString("loki_push_mode")
 
+	v.viper.SetDefault("loki_timeout_ms", 30_000)
+	v.configuration.LokiTimeoutMs = v.viper.GetInt("loki_timeout_ms")
+
+	v.viper.SetDefault("loki_grpc_tls", false)
+	v.configuration.LokiGrpcTls = v.viper.GetBool("loki_grpc_tls")
+
+	v.viper.SetDefault("loki_basic_auth_username", "")
+	v.configuration.LokiBasicAuthUsername = v.viper.GetString("loki_basic_auth_username")
+
+	v.viper.SetDefault("loki_basic_auth_password", "")
+	v.configuration.LokiBasicAuthPassword = v.viper.GetString("loki_basic_auth_password")
+
+	v.viper.SetDefault("loki_bearer_token", "")
+	v.configuration.LokiBearerToken = v.viper.GetString("loki_bearer_token")
+
+	v.viper.SetDefault("loki_bearer_token_file", "")
+	v.configuration.LokiBearerTokenFile = v.viper.GetString("loki_bearer_token_file")
+
+	v.configuration.LokiHeaders = v.viper.GetStringMapString("loki_headers")
+
+	v.viper.SetDefault("loki_tls_ca_file", "")
+	v.configuration.LokiTlsCaFile = v.viper.GetString("loki_tls_ca_file")
+
+	v.viper.SetDefault("loki_tls_cert_file", "")
+	v.configuration.LokiTlsCertFile = v.viper.GetString("loki_tls_cert_file")
+
+	v.viper.SetDefault("loki_tls_key_file", "")
+	v.configuration.LokiTlsKeyFile = v.viper.GetString("loki_tls_key_file")
+
+	v.viper.SetDefault("loki_tls_insecure_skip_verify", false)
+	v.configuration.LokiTlsInsecureSkipVerify = v.viper.GetBool("loki_tls_insecure_skip_verify")
+
+	v.viper.SetDefault("loki_grpc_keepalive_time_ms", 30_000)
+	v.configuration.LokiGrpcKeepaliveTimeMs = v.viper.GetInt("loki_grpc_keepalive_time_ms")
+
+	v.viper.SetDefault("loki_grpc_keepalive_timeout_ms", 10_000)
+	v.configuration.LokiGrpcKeepaliveTimeoutMs = v.viper.GetInt("loki_grpc_keepalive_timeout_ms")
+
 	v.viper.SetDefault("kafka_offset_reset", "earliest")
 	v.configuration.KafkaOffsetReset = v.viper.GetString("kafka_offset_reset")
 
+	v.viper.SetDefault("kafka_security_protocol", "")
+	v.configuration.KafkaSecurityProtocol = v.viper.GetString("kafka_security_protocol")
+
+	v.viper.SetDefault("kafka_sasl_mechanism", "")
+	v.configuration.KafkaSaslMechanism = v.viper.GetString("kafka_sasl_mechanism")
+
+	v.viper.SetDefault("kafka_sasl_username", "")
+	v.configuration.KafkaSaslUsername = v.viper.GetString("kafka_sasl_username")
+
+	v.viper.SetDefault("kafka_sasl_password", "")
+	v.configuration.KafkaSaslPassword = v.viper.GetString("kafka_sasl_password")
+
+	v.viper.SetDefault("kafka_sasl_password_file", "")
+	v.configuration.KafkaSaslPasswordFile = v.viper.GetString("kafka_sasl_password_file")
+
+	v.viper.SetDefault("kafka_sasl_oauthbearer_token_file", "")
+	v.configuration.KafkaSaslOauthbearerTokenFile = v.viper.GetString("kafka_sasl_oauthbearer_token_file")
+
+	v.viper.SetDefault("kafka_ssl_ca_location", "")
+	v.configuration.KafkaSslCaLocation = v.viper.GetString("kafka_ssl_ca_location")
+
+	v.viper.SetDefault("kafka_ssl_certificate_location", "")
+	v.configuration.KafkaSslCertificateLocation = v.viper.GetString("kafka_ssl_certificate_location")
+
+	v.viper.SetDefault("kafka_ssl_key_location", "")
+	v.configuration.KafkaSslKeyLocation = v.viper.GetString("kafka_ssl_key_location")
+
+	v.viper.SetDefault("kafka_ssl_key_password", "")
+	v.configuration.KafkaSslKeyPassword = v.viper.GetString("kafka_ssl_key_password")
+
+	v.configuration.KafkaExtraConfig = v.viper.GetStringMapString("kafka_extra_config")
+
 	v.viper.SetDefault("logging_level", "info")
 	v.configuration.LoggingLevel = v.viper.GetString("logging_level")
 
+	v.viper.SetDefault("http_listen_address", ":8080")
+	v.configuration.HttpListenAddress = v.viper.GetString("http_listen_address")
+
+	v.viper.SetDefault("shutdown_timeout_ms", 20_000)
+	v.configuration.ShutdownTimeoutMs = v.viper.GetInt("shutdown_timeout_ms")
+
+	v.viper.SetDefault("health_poll_max_age_ms", 120_000)
+	v.configuration.HealthPollMaxAgeMs = v.viper.GetInt("health_poll_max_age_ms")
+
+	v.viper.SetDefault("health_flush_intervals", 3)
+	v.configuration.HealthFlushIntervals = v.viper.GetInt("health_flush_intervals")
+
+	v.viper.SetDefault("health_push_max_age_ms", 300_000)
+	v.configuration.HealthPushMaxAgeMs = v.viper.GetInt("health_push_max_age_ms")
+
 	v.viper.SetDefault("kafka_polling_goroutines", 5)
 	v.configuration.KafkaPollingGoroutines = v.viper.GetInt("kafka_polling_goroutines")
 
-	v.viper.SetDefault("kafka_polling_timeout_ms", 30_000)
+	v.viper.SetDefault("pusher_shards", 4)
+	v.configuration.PusherShards = v.viper.GetInt("pusher_shards")
+
+	v.viper.SetDefault("max_inflight_requests", 1)
+	v.configuration.MaxInflightRequests = v.viper.GetInt("max_inflight_requests")
+	if v.configuration.MaxInflightRequests <= 0 {
+		return errors.New("max_inflight_requests must be positive")
+	}
+
+	v.viper.SetDefault("kafka_polling_timeout_ms", 1_000)
 	v.configuration.KafkaPollingTimeoutMs = v.viper.GetInt("kafka_polling_timeout_ms")
 
 	v.viper.SetDefault("sentry_dsn", "")
 	v.configuration.SentryDSN = v.viper.GetString("sentry_dsn")
 
+	v.viper.SetDefault("loki_retry_max_attempts", 0)
+	v.configuration.LokiRetryMaxAttempts = v.viper.GetInt("loki_retry_max_attempts")
+
+	v.viper.SetDefault("loki_retry_max_elapsed_ms", 0)
+	v.configuration.LokiRetryMaxElapsedMs = v.viper.GetInt("loki_retry_max_elapsed_ms")
+
+	v.viper.SetDefault("loki_retry_initial_backoff_ms", 500)
+	v.configuration.LokiRetryInitialBackoffMs = v.viper.GetInt("loki_retry_initial_backoff_ms")
+
+	v.viper.SetDefault("loki_retry_max_backoff_ms", 30_000)
+	v.configuration.LokiRetryMaxBackoffMs = v.viper.GetInt("loki_retry_max_backoff_ms")
+
+	v.viper.SetDefault("dlq_mode", "")
+	v.configuration.DeadLetterMode = v.viper.GetString("dlq_mode")
+
+	v.viper.SetDefault("dlq_kafka_topic", "")
+	v.configuration.DeadLetterKafkaTopic = v.viper.GetString("dlq_kafka_topic")
+
+	v.viper.SetDefault("dlq_file_path", "")
+	v.configuration.DeadLetterFilePath = v.viper.GetString("dlq_file_path")
+
+	// The offsets are committed once the batches are done, a batch that runs out of retries is only done once it's in
+	// the dead letter queue.
+	finiteRetries := v.configuration.LokiRetryMaxAttempts > 0 || v.configuration.LokiRetryMaxElapsedMs > 0
+	if finiteRetries && v.configuration.DeadLetterMode == "" {
+		return errors.New("loki_retry_max_attempts and loki_retry_max_elapsed_ms require dlq_mode")
+	}
+
+	v.viper.SetDefault("wal_directory", "")
+	v.configuration.WalDirectory = v.viper.GetString("wal_directory")
+
+	v.viper.SetDefault("wal_segment_max_bytes", 64*1024*1024)
+	v.configuration.WalSegmentMaxBytes = v.viper.GetInt64("wal_segment_max_bytes")
+
+	v.viper.SetDefault("wal_max_bytes", 1024*1024*1024)
+	v.configuration.WalMaxBytes = v.viper.GetInt64("wal_max_bytes")
+
+	v.viper.SetDefault("wal_fsync", WalFsyncInterval)
+	v.configuration.WalFsync = v.viper.GetString("wal_fsync")
+
+	v.viper.SetDefault("wal_sync_interval_ms", 1_000)
+	v.configuration.WalSyncIntervalMs = v.viper.GetInt("wal_sync_interval_ms")
+
+	err := v.viper.UnmarshalKey("labels", &v.configuration.Labels)
+	if err != nil {
+		return fmt.Errorf("invalid labels: %w", err)
+	}
+	if len(v.configuration.Labels) == 0 {
+		v.configuration.Labels = DefaultLabelRules
+	}
+
+	err = v.viper.UnmarshalKey("decoders", &v.configuration.Decoders)
+	if err != nil {
+		return fmt.Errorf("invalid decoders: %w", err)
+	}
+
+	v.viper.SetDefault("flatten_separator", ".")
+	v.configuration.FlattenSeparator = v.viper.GetString("flatten_separator")
+	v.viper.SetDefault("flatten_max_depth", 0)
+	v.configuration.FlattenMaxDepth = v.viper.GetInt("flatten_max_depth")
+	v.viper.SetDefault("flatten_array_mode", FlattenArrayIndex)
+	v.configuration.FlattenArrayMode = v.viper.GetString("flatten_array_mode")
+	v.viper.SetDefault("flatten_array_join_separator", ",")
+	v.configuration.FlattenArrayJoinSeparator = v.viper.GetString("flatten_array_join_separator")
+	v.viper.SetDefault("flatten_escape_keys", false)
+	v.configuration.FlattenEscapeKeys = v.viper.GetBool("flatten_escape_keys")
+	v.viper.SetDefault("flatten_keep_empty", false)
+	v.configuration.FlattenKeepEmpty = v.viper.GetBool("flatten_keep_empty")
+
+	err = v.viper.UnmarshalKey("line_formats", &v.configuration.LineFormats)
+	if err != nil {
+		return fmt.Errorf("invalid line formats: %w", err)
+	}
+
+	err = v.viper.UnmarshalKey("filters", &v.configuration.Filters)
+	if err != nil {
+		return fmt.Errorf("invalid filters: %w", err)
+	}
+
+	v.configuration.RedactionFields = v.viper.GetStringSlice("redaction_fields")
+	// The original lines aren't built from the fields, their redacted fields would be sent as they are.
+	for _, rule := range v.configuration.LineFormats {
+		if rule.Format == LineFormatOriginal && len(v.configuration.RedactionFields) > 0 {
+			return errors.New("redaction_fields can't be used with the original line format")
+		}
+	}
+	err = v.viper.UnmarshalKey("redaction_patterns", &v.configuration.RedactionPatterns)
+	if err != nil {
+		return fmt.Errorf("invalid redaction patterns: %w", err)
+	}
+	v.viper.SetDefault("redaction_mode", RedactionModeMask)
+	v.configuration.RedactionMode = v.viper.GetString("redaction_mode")
+	v.viper.SetDefault("redaction_mask", DefaultRedactionMask)
+	v.configuration.RedactionMask = v.viper.GetString("redaction_mask")
+	v.configuration.RedactionHashSalt = v.viper.GetString("redaction_hash_salt")
+
+	v.viper.SetDefault("loki_tenant_id", "")
+	v.configuration.LokiTenantId = v.viper.GetString("loki_tenant_id")
+
+	err = v.viper.UnmarshalKey("tenant", &v.configuration.Tenant)
+	if err != nil {
+		return fmt.Errorf("invalid tenant: %w", err)
+	}
+	if v.configuration.Tenant.Source == "" && v.configuration.LokiTenantId != "" {
+		v.configuration.Tenant = ValueRule{Source: ValueSourceStatic, Value: v.configuration.LokiTenantId}
+	} else if v.configuration.Tenant.Default == "" {
+		v.configuration.Tenant.Default = v.configuration.LokiTenantId
+	}
+
+	v.viper.SetDefault("timestamp_source", TimestampSourceKafka)
+	v.configuration.TimestampSource = v.viper.GetString("timestamp_source")
+
+	v.viper.SetDefault("timestamp_field", "")
+	v.configuration.TimestampField = v.viper.GetString("timestamp_field")
+
+	v.viper.SetDefault("timestamp_format", "rfc3339")
+	v.configuration.TimestampFormat = v.viper.GetString("timestamp_format")
+
 	return nil
 }
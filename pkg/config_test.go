@@ -0,0 +1,246 @@
+package pkg
+
+import (
+	"bytes"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// newTestViperConfigurator creates a ViperConfigurator from the given JSON configuration.
+func newTestViperConfigurator(t *testing.T, config string) (*ViperConfigurator, error) {
+	viperInstance := viper.New()
+	viperInstance.SetConfigType("json")
+	assert.Nil(t, viperInstance.ReadConfig(bytes.NewBufferString(config)))
+	viperConfigurator := &ViperConfigurator{viperInstance, Configuration{}}
+	return viperConfigurator, viperConfigurator.loadConfig()
+}
+
+// minimalTestConfig is the minimal valid configuration.
+const minimalTestConfig = `
+  "kafka_bootstrap_servers": "localhost:9092",
+  "kafka_group_id": "speedy",
+  "subscribe_topics": ["^topic"],
+  "loki_push_url": "http://localhost:3100/loki/api/v1/push"`
+
+// Test_ViperConfigurator_Labels ensures that label rules are loaded, with defaults when none are configured.
+func Test_ViperConfigurator_Labels(t *testing.T) {
+	configurator, err := newTestViperConfigurator(t, "{"+minimalTestConfig+"}")
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultLabelRules, configurator.GetConfig().Labels)
+
+	configurator, err = newTestViperConfigurator(t, `{`+minimalTestConfig+`,
+  "labels": [
+    {"name": "clientId", "source": "field", "path": "client.ID", "default": "none"},
+    {"name": "env", "source": "topic", "regex": "^([a-z]+)\\."}
+  ]
+}`)
+	assert.Nil(t, err)
+	assert.Equal(t, []LabelRule{
+		{Name: "clientId", ValueRule: ValueRule{Source: ValueSourceField, Path: "client.ID", Default: "none"}},
+		{Name: "env", ValueRule: ValueRule{Source: ValueSourceTopic, Regex: `^([a-z]+)\.`}},
+	}, configurator.GetConfig().Labels)
+}
+
+// Test_ViperConfigurator_Decoders ensures that decoder rules are loaded.
+func Test_ViperConfigurator_Decoders(t *testing.T) {
+	configurator, err := newTestViperConfigurator(t, `{`+minimalTestConfig+`,
+  "decoders": [
+    {"topic": "^csv", "type": "csv", "csv_header": ["time", "message"], "csv_delimiter": ";"},
+    {"topic": "^raw", "type": "raw"}
+  ]
+}`)
+	assert.Nil(t, err)
+	assert.Equal(t, []DecoderRule{
+		{Topic: "^csv", Type: DecoderCsv, CsvHeader: []string{"time", "message"}, CsvDelimiter: ";"},
+		{Topic: "^raw", Type: DecoderRaw},
+	}, configurator.GetConfig().Decoders)
+}
+
+// Test_ViperConfigurator_Flatten ensures that the flatten options are loaded with their defaults.
+func Test_ViperConfigurator_Flatten(t *testing.T) {
+	configurator, err := newTestViperConfigurator(t, "{"+minimalTestConfig+"}")
+	assert.Nil(t, err)
+	config := configurator.GetConfig()
+	assert.Equal(t, DefaultFlattenOptions(), FlattenOptions{
+		Separator:          config.FlattenSeparator,
+		MaxDepth:           config.FlattenMaxDepth,
+		ArrayMode:          config.FlattenArrayMode,
+		ArrayJoinSeparator: config.FlattenArrayJoinSeparator,
+		EscapeKeys:         config.FlattenEscapeKeys,
+		KeepEmpty:          config.FlattenKeepEmpty,
+	})
+
+	configurator, err = newTestViperConfigurator(t, `{`+minimalTestConfig+`,
+  "flatten_separator": "_",
+  "flatten_max_depth": 3,
+  "flatten_array_mode": "json",
+  "flatten_escape_keys": true,
+  "flatten_keep_empty": true
+}`)
+	assert.Nil(t, err)
+	config = configurator.GetConfig()
+	assert.Equal(t, "_", config.FlattenSeparator)
+	assert.Equal(t, 3, config.FlattenMaxDepth)
+	assert.Equal(t, FlattenArrayJson, config.FlattenArrayMode)
+	assert.True(t, config.FlattenEscapeKeys)
+	assert.True(t, config.FlattenKeepEmpty)
+}
+
+// Test_ViperConfigurator_FlushIntervals ensures that the flush intervals are loaded with their defaults.
+func Test_ViperConfigurator_FlushIntervals(t *testing.T) {
+	configurator, err := newTestViperConfigurator(t, "{"+minimalTestConfig+"}")
+	assert.Nil(t, err)
+	assert.Equal(t, 60_000, configurator.GetConfig().BufferFlushIntervalMs)
+	assert.Equal(t, 1_000, configurator.GetConfig().BufferMinFlushIntervalMs)
+
+	configurator, err = newTestViperConfigurator(t, `{`+minimalTestConfig+`,
+  "buffer_flush_interval_ms": 5000,
+  "buffer_min_flush_interval_ms": 0
+}`)
+	assert.Nil(t, err)
+	assert.Equal(t, 5_000, configurator.GetConfig().BufferFlushIntervalMs)
+	assert.Equal(t, 0, configurator.GetConfig().BufferMinFlushIntervalMs)
+
+	_, err = newTestViperConfigurator(t, `{`+minimalTestConfig+`, "buffer_flush_interval_ms": 0}`)
+	assert.Error(t, err)
+}
+
+// Test_ViperConfigurator_RetryLimits ensures that the retry limits require a dead letter queue.
+func Test_ViperConfigurator_RetryLimits(t *testing.T) {
+	_, err := newTestViperConfigurator(t, `{`+minimalTestConfig+`, "loki_retry_max_attempts": 3}`)
+	assert.Error(t, err)
+	_, err = newTestViperConfigurator(t, `{`+minimalTestConfig+`, "loki_retry_max_elapsed_ms": 60000}`)
+	assert.Error(t, err)
+
+	configurator, err := newTestViperConfigurator(t, `{`+minimalTestConfig+`,
+  "loki_retry_max_attempts": 3,
+  "dlq_mode": "file",
+  "dlq_file_path": "/tmp/dlq"
+}`)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, configurator.GetConfig().LokiRetryMaxAttempts)
+}
+
+// Test_ViperConfigurator_MaxInflightRequests ensures that the number of concurrent pushes is loaded and must be positive.
+func Test_ViperConfigurator_MaxInflightRequests(t *testing.T) {
+	configurator, err := newTestViperConfigurator(t, "{"+minimalTestConfig+"}")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, configurator.GetConfig().MaxInflightRequests)
+
+	configurator, err = newTestViperConfigurator(t, `{`+minimalTestConfig+`, "max_inflight_requests": 8}`)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, configurator.GetConfig().MaxInflightRequests)
+
+	_, err = newTestViperConfigurator(t, `{`+minimalTestConfig+`, "max_inflight_requests": 0}`)
+	assert.Error(t, err)
+}
+
+// Test_ViperConfigurator_LineFormats ensures that line format rules are loaded.
+func Test_ViperConfigurator_LineFormats(t *testing.T) {
+	configurator, err := newTestViperConfigurator(t, `{`+minimalTestConfig+`,
+  "line_formats": [
+    {"topic": "^nginx", "format": "original"},
+    {"format": "template", "template": "{{.level}} {{.message}}"}
+  ]
+}`)
+	assert.Nil(t, err)
+	assert.Equal(t, []LineFormatRule{
+		{Topic: "^nginx", Format: LineFormatOriginal},
+		{Format: LineFormatTemplate, Template: "{{.level}} {{.message}}"},
+	}, configurator.GetConfig().LineFormats)
+}
+
+// Test_ViperConfigurator_Filters ensures that filter rules are loaded with their nested conditions.
+func Test_ViperConfigurator_Filters(t *testing.T) {
+	configurator, err := newTestViperConfigurator(t, `{`+minimalTestConfig+`,
+  "filters": [
+    {"name": "debug", "action": "drop", "field": "level", "operator": "level_lt", "value": "info"},
+    {"topic": "^audit", "action": "keep", "any": [
+      {"field": "user", "operator": "exists"},
+      {"field": "system", "operator": "equals", "value": "true", "not": true}
+    ]}
+  ]
+}`)
+	assert.Nil(t, err)
+	assert.Equal(t, []FilterRule{
+		{Name: "debug", Action: FilterActionDrop, Field: "level", Operator: FilterOperatorLevelBelow, Value: "info"},
+		{Topic: "^audit", Action: FilterActionKeep, Any: []FilterCondition{
+			{Field: "user", Operator: FilterOperatorExists},
+			{Field: "system", Operator: FilterOperatorEquals, Value: "true", Not: true},
+		}},
+	}, configurator.GetConfig().Filters)
+	assert.Contains(t, configurator.GetConfig().ToPrettyJson(), `"operator": "level_lt"`)
+}
+
+// Test_ViperConfigurator_Redaction ensures that the redaction settings are loaded, with the mask mode by default.
+func Test_ViperConfigurator_Redaction(t *testing.T) {
+	configurator, err := newTestViperConfigurator(t, "{"+minimalTestConfig+"}")
+	assert.Nil(t, err)
+	assert.Equal(t, RedactionModeMask, configurator.GetConfig().RedactionMode)
+	assert.Equal(t, DefaultRedactionMask, configurator.GetConfig().RedactionMask)
+
+	configurator, err = newTestViperConfigurator(t, `{`+minimalTestConfig+`,
+  "redaction_fields": ["user.*.password"],
+  "redaction_patterns": [{"name": "email"}, {"name": "order", "regex": "ORD-[0-9]+"}],
+  "redaction_mode": "hash",
+  "redaction_hash_salt": "salt"
+}`)
+	assert.Nil(t, err)
+	config := configurator.GetConfig()
+	assert.Equal(t, []string{"user.*.password"}, config.RedactionFields)
+	assert.Equal(t, []RedactionPattern{{Name: "email"}, {Name: "order", Regex: "ORD-[0-9]+"}}, config.RedactionPatterns)
+	assert.Equal(t, RedactionModeHash, config.RedactionMode)
+	assert.Equal(t, "salt", config.RedactionHashSalt)
+	assert.NotContains(t, config.ToPrettyJson(), `"salt"`)
+}
+
+// Test_ViperConfigurator_Redaction_OriginalLineFormat ensures that the redaction fields are rejected with the original
+// line format, whose lines aren't built from the fields.
+func Test_ViperConfigurator_Redaction_OriginalLineFormat(t *testing.T) {
+	_, err := newTestViperConfigurator(t, `{`+minimalTestConfig+`,
+  "line_formats": [{"topic": "^nginx", "format": "original"}],
+  "redaction_fields": ["password"]
+}`)
+	assert.EqualError(t, err, "redaction_fields can't be used with the original line format")
+
+	_, err = newTestViperConfigurator(t, `{`+minimalTestConfig+`,
+  "line_formats": [{"topic": "^nginx", "format": "original"}],
+  "redaction_patterns": [{"name": "email"}]
+}`)
+	assert.Nil(t, err)
+}
+
+// Test_ViperConfigurator_Tenant ensures that the tenant rule is loaded, with loki_tenant_id as static or default tenant.
+func Test_ViperConfigurator_Tenant(t *testing.T) {
+	configurator, err := newTestViperConfigurator(t, "{"+minimalTestConfig+"}")
+	assert.Nil(t, err)
+	assert.Equal(t, ValueRule{}, configurator.GetConfig().Tenant)
+
+	configurator, err = newTestViperConfigurator(t, `{`+minimalTestConfig+`, "loki_tenant_id": "team-a"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, ValueRule{Source: ValueSourceStatic, Value: "team-a"}, configurator.GetConfig().Tenant)
+
+	configurator, err = newTestViperConfigurator(t, `{`+minimalTestConfig+`,
+  "loki_tenant_id": "team-a",
+  "tenant": {"source": "header", "path": "tenant"}
+}`)
+	assert.Nil(t, err)
+	assert.Equal(t, ValueRule{Source: ValueSourceHeader, Path: "tenant", Default: "team-a"}, configurator.GetConfig().Tenant)
+}
+
+// Test_Configuration_ToPrettyJson ensures that secrets are masked.
+func Test_Configuration_ToPrettyJson(t *testing.T) {
+	config := Configuration{
+		LokiBasicAuthUsername: "user",
+		LokiBasicAuthPassword: "password",
+		LokiBearerToken:       "token",
+		LokiHeaders:           map[string]string{"x-api-key": "key"},
+	}
+	prettyJson := config.ToPrettyJson()
+	assert.Contains(t, prettyJson, `"loki_basic_auth_username": "user"`)
+	assert.NotContains(t, prettyJson, `"password"`)
+	assert.NotContains(t, prettyJson, `"token"`)
+	assert.NotContains(t, prettyJson, `"key"`)
+	assert.Equal(t, "key", config.LokiHeaders["x-api-key"])
+}
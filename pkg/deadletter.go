@@ -0,0 +1,255 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/getsentry/sentry-go"
+	"github.com/goccy/go-json"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	// DeadLetterReasonDecodeFailed is the reason of messages that couldn't be decoded.
+	DeadLetterReasonDecodeFailed = "decode_failed"
+	// DeadLetterReasonRejected is the reason of entries that Loki rejected.
+	DeadLetterReasonRejected = "loki_rejected"
+	// DeadLetterReasonRetriesExhausted is the reason of entries whose push failed after all the retries.
+	DeadLetterReasonRetriesExhausted = "retries_exhausted"
+)
+
+// DeadLetter is a message that couldn't be delivered to Loki.
+type DeadLetter struct {
+	// Key is the key of the original message.
+	Key []byte
+	// Value is the original message, or the log line for entries rejected by Loki.
+	Value []byte
+	// Headers are the headers of the original message.
+	Headers []kafka.Header
+	// Labels are the Loki labels of the entry, if known.
+	Labels map[string]string
+	// Reason is the reason of the failure, one of the DeadLetterReason constants.
+	Reason string
+	// Source is the position of the original message in Kafka, if known.
+	Source kafka.TopicPartition
+	// Err is the error that caused the failure.
+	Err error
+}
+
+// IDeadLetterQueue is the interface for dead letter queues.
+type IDeadLetterQueue interface {
+	// Send sends the dead letters at once, it returns an error if any of them couldn't be sent.
+	Send(ctx context.Context, letters ...DeadLetter) error
+	Shutdown()
+}
+
+// DeadLetterQueueFactoryCreate is a factory for creating dead letter queues.
+// It returns nil when mode is empty, meaning that the dead letter queue is disabled.
+func DeadLetterQueueFactoryCreate(mode string, config Configuration) (IDeadLetterQueue, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case "kafka":
+		configMap, err := NewKafkaConfigMap(config, nil)
+		if err != nil {
+			return nil, err
+		}
+		queue, err := NewKafkaDeadLetterQueue(configMap, config.DeadLetterKafkaTopic)
+		if err != nil {
+			return nil, err
+		}
+		if config.KafkaSaslOauthbearerTokenFile != "" {
+			queue.SetOAuthBearerTokenRefresher(NewOAuthBearerTokenRefresher(config.KafkaSaslOauthbearerTokenFile))
+		}
+		go queue.handleEvents()
+		return queue, nil
+	case "file":
+		return NewFileDeadLetterQueue(config.DeadLetterFilePath)
+	}
+	return nil, fmt.Errorf("invalid dead letter queue mode %s", mode)
+}
+
+// deadLetterHeaders returns the Kafka headers that describe the dead letter.
+func deadLetterHeaders(letter DeadLetter) []kafka.Header {
+	headers := append([]kafka.Header(nil), letter.Headers...)
+	headers = append(headers, kafka.Header{Key: "speedy-reason", Value: []byte(letter.Reason)})
+	if letter.Err != nil {
+		headers = append(headers, kafka.Header{Key: "speedy-error", Value: []byte(letter.Err.Error())})
+	}
+	if letter.Source.Topic != nil {
+		headers = append(headers,
+			kafka.Header{Key: "speedy-source-topic", Value: []byte(*letter.Source.Topic)},
+			kafka.Header{Key: "speedy-source-partition", Value: []byte(strconv.Itoa(int(letter.Source.Partition)))},
+			kafka.Header{Key: "speedy-source-offset", Value: []byte(strconv.FormatInt(int64(letter.Source.Offset), 10))},
+		)
+	}
+	if len(letter.Labels) > 0 {
+		stream := LokiStream{Labels: letter.Labels}
+		headers = append(headers, kafka.Header{Key: "speedy-labels", Value: []byte(stream.LabelsKey())})
+	}
+	return headers
+}
+
+// KafkaDeadLetterQueue is an IDeadLetterQueue that produces dead letters to a Kafka topic.
+type KafkaDeadLetterQueue struct {
+	producer       *kafka.Producer
+	topic          string
+	tokenRefresher *OAuthBearerTokenRefresher
+}
+
+// NewKafkaDeadLetterQueue constructs a new instance of KafkaDeadLetterQueue.
+func NewKafkaDeadLetterQueue(config *kafka.ConfigMap, topic string) (*KafkaDeadLetterQueue, error) {
+	if topic == "" {
+		return nil, fmt.Errorf("dead letter queue topic is empty")
+	}
+	producer, err := kafka.NewProducer(config)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaDeadLetterQueue{producer: producer, topic: topic}, nil
+}
+
+// SetOAuthBearerTokenRefresher sets the OAuthBearerTokenRefresher that answers the token refresh events of the producer.
+// It must be set before the events are handled.
+func (q *KafkaDeadLetterQueue) SetOAuthBearerTokenRefresher(refresher *OAuthBearerTokenRefresher) {
+	q.tokenRefresher = refresher
+}
+
+// handleEvents handles the producer events that are not delivery reports, until the producer is closed.
+func (q *KafkaDeadLetterQueue) handleEvents() {
+	for event := range q.producer.Events() {
+		switch e := event.(type) {
+		case kafka.OAuthBearerTokenRefresh:
+			if q.tokenRefresher != nil {
+				q.tokenRefresher.Refresh(q.producer)
+			}
+		case kafka.Error:
+			SugaredLogger.Warnf("Dead letter queue producer error: %v", e)
+		}
+	}
+}
+
+// Send produces the dead letters to the dead letter topic, then waits for their delivery reports.
+// It returns the first error, the letters produced before a failed one are still waited for.
+func (q *KafkaDeadLetterQueue) Send(ctx context.Context, letters ...DeadLetter) error {
+	deliveryChan := make(chan kafka.Event, len(letters))
+	var err error
+	produced := 0
+	for _, letter := range letters {
+		err = q.producer.Produce(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &q.topic, Partition: kafka.PartitionAny},
+			Key:            letter.Key,
+			Value:          letter.Value,
+			Headers:        deadLetterHeaders(letter),
+		}, deliveryChan)
+		if err != nil {
+			break
+		}
+		produced++
+	}
+
+	for ; produced > 0; produced-- {
+		select {
+		case event := <-deliveryChan:
+			message, ok := event.(*kafka.Message)
+			if !ok {
+				if err == nil {
+					err = fmt.Errorf("unexpected delivery event %v", event)
+				}
+				continue
+			}
+			if err == nil {
+				err = message.TopicPartition.Error
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// Shutdown waits for the outstanding messages to be delivered and closes the producer.
+func (q *KafkaDeadLetterQueue) Shutdown() {
+	q.producer.Flush(5_000)
+	q.producer.Close()
+}
+
+// fileDeadLetter is the representation of a dead letter in the dead letter file.
+type fileDeadLetter struct {
+	Reason    string            `json:"reason"`
+	Error     string            `json:"error,omitempty"`
+	Topic     string            `json:"topic,omitempty"`
+	Partition int32             `json:"partition"`
+	Offset    int64             `json:"offset"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Key       []byte            `json:"key,omitempty"`
+	Value     []byte            `json:"value"`
+}
+
+// FileDeadLetterQueue is an IDeadLetterQueue that appends dead letters to a newline delimited JSON file.
+// Keys and values are base64 encoded, so that the original bytes are preserved.
+type FileDeadLetterQueue struct {
+	file  *os.File
+	mutex sync.Mutex
+}
+
+// NewFileDeadLetterQueue constructs a new instance of FileDeadLetterQueue.
+func NewFileDeadLetterQueue(path string) (*FileDeadLetterQueue, error) {
+	if path == "" {
+		return nil, fmt.Errorf("dead letter queue file path is empty")
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDeadLetterQueue{file: file}, nil
+}
+
+// Send appends the dead letters to the file with a single write.
+func (q *FileDeadLetterQueue) Send(_ context.Context, letters ...DeadLetter) error {
+	var lines []byte
+	for _, letter := range letters {
+		line, err := fileDeadLetterLine(letter)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	_, err := q.file.Write(lines)
+	return err
+}
+
+// fileDeadLetterLine returns the JSON representation of the dead letter in the dead letter file.
+func fileDeadLetterLine(letter DeadLetter) ([]byte, error) {
+	record := fileDeadLetter{
+		Reason: letter.Reason,
+		Labels: letter.Labels,
+		Key:    letter.Key,
+		Value:  letter.Value,
+	}
+	if letter.Err != nil {
+		record.Error = letter.Err.Error()
+	}
+	if letter.Source.Topic != nil {
+		record.Topic = *letter.Source.Topic
+		record.Partition = letter.Source.Partition
+		record.Offset = int64(letter.Source.Offset)
+	}
+	return json.Marshal(record)
+}
+
+// Shutdown closes the file.
+func (q *FileDeadLetterQueue) Shutdown() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	err := q.file.Close()
+	if err != nil {
+		SugaredLogger.Error(err)
+		sentry.CaptureException(err)
+	}
+}
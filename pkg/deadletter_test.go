@@ -0,0 +1,224 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/goccy/go-json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testDeadLetterQueue is an IDeadLetterQueue used for internal testing.
+type testDeadLetterQueue struct {
+	letters  []DeadLetter
+	sends    int
+	ctx      context.Context
+	err      error
+	shutdown bool
+}
+
+func (q *testDeadLetterQueue) Send(ctx context.Context, letters ...DeadLetter) error {
+	q.sends++
+	q.ctx = ctx
+	if q.err != nil {
+		return q.err
+	}
+	q.letters = append(q.letters, letters...)
+	return nil
+}
+
+func (q *testDeadLetterQueue) Shutdown() {
+	q.shutdown = true
+}
+
+// Test_DeadLetterQueueFactoryCreate ensures that the factory creates the configured dead letter queue.
+func Test_DeadLetterQueueFactoryCreate(t *testing.T) {
+	queue, err := DeadLetterQueueFactoryCreate("", Configuration{})
+	assert.Nil(t, err)
+	assert.Nil(t, queue)
+
+	_, err = DeadLetterQueueFactoryCreate("batman", Configuration{})
+	assert.Error(t, err)
+
+	_, err = DeadLetterQueueFactoryCreate("file", Configuration{})
+	assert.Error(t, err)
+
+	_, err = DeadLetterQueueFactoryCreate("kafka", Configuration{KafkaBoostrapServers: "localhost:9092"})
+	assert.Error(t, err)
+
+	queue, err = DeadLetterQueueFactoryCreate("file", Configuration{DeadLetterFilePath: filepath.Join(t.TempDir(), "dlq")})
+	assert.Nil(t, err)
+	assert.IsType(t, &FileDeadLetterQueue{}, queue)
+	queue.Shutdown()
+}
+
+// Test_deadLetterHeaders ensures that the dead letter headers describe the failure.
+func Test_deadLetterHeaders(t *testing.T) {
+	headers := deadLetterHeaders(DeadLetter{
+		Headers: []kafka.Header{{Key: "original", Value: []byte("header")}},
+		Labels:  map[string]string{"key": "topic"},
+		Reason:  DeadLetterReasonDecodeFailed,
+		Source:  testTopicPartition("topic", 3, 42),
+		Err:     errors.New("invalid character"),
+	})
+
+	assert.Equal(t, []kafka.Header{
+		{Key: "original", Value: []byte("header")},
+		{Key: "speedy-reason", Value: []byte("decode_failed")},
+		{Key: "speedy-error", Value: []byte("invalid character")},
+		{Key: "speedy-source-topic", Value: []byte("topic")},
+		{Key: "speedy-source-partition", Value: []byte("3")},
+		{Key: "speedy-source-offset", Value: []byte("42")},
+		{Key: "speedy-labels", Value: []byte(`{key="topic"}`)},
+	}, headers)
+}
+
+// Test_FileDeadLetterQueue_Send ensures that dead letters are appended to the file with their original bytes.
+func Test_FileDeadLetterQueue_Send(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dlq.ndjson")
+	queue, err := NewFileDeadLetterQueue(path)
+	assert.Nil(t, err)
+
+	assert.Nil(t, queue.Send(context.Background(), DeadLetter{
+		Value:  []byte("not json\n\x00"),
+		Reason: DeadLetterReasonDecodeFailed,
+		Source: testTopicPartition("topic", 1, 10),
+		Err:    errors.New("invalid character"),
+	}))
+	assert.Nil(t, queue.Send(context.Background(), DeadLetter{
+		Value:  []byte("line"),
+		Reason: DeadLetterReasonRejected,
+	}, DeadLetter{
+		Value:  []byte("other line"),
+		Reason: DeadLetterReasonRejected,
+	}))
+	queue.Shutdown()
+
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+	var records []fileDeadLetter
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record fileDeadLetter
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+
+	assert.Equal(t, []fileDeadLetter{
+		{
+			Reason:    DeadLetterReasonDecodeFailed,
+			Error:     "invalid character",
+			Topic:     "topic",
+			Partition: 1,
+			Offset:    10,
+			Value:     []byte("not json\n\x00"),
+		},
+		{
+			Reason: DeadLetterReasonRejected,
+			Value:  []byte("line"),
+		},
+		{
+			Reason: DeadLetterReasonRejected,
+			Value:  []byte("other line"),
+		},
+	}, records)
+}
+
+// Test_Pusher_RunForever_DeadLetterQueue ensures that entries rejected by Loki are sent to the dead letter queue, all
+// the entries of a batch at once.
+func Test_Pusher_RunForever_DeadLetterQueue(t *testing.T) {
+	sink := &SpeedyTestSink{sendDataError: &LokiPushError{StatusCode: 400, Body: "entry too far behind"}}
+	committer := &testOffsetCommitter{}
+	tracker := NewOffsetTracker(committer)
+	queue := &testDeadLetterQueue{}
+	lokiPusher := NewPusher(sink, 10, math.MaxInt32)
+	lokiPusher.SetOffsetTracker(tracker)
+	lokiPusher.SetDeadLetterQueue(queue)
+	go lokiPusher.RunForever()
+
+	source := testTopicPartition("topic", 0, 5)
+	tracker.Track(source)
+	lokiPusher.DataChannel <- LokiStream{
+		Labels:  map[string]string{"label1": "value"},
+		Values:  [][]string{{"0", "log-line-0"}},
+		Sources: []kafka.TopicPartition{source},
+	}
+	other := testTopicPartition("topic", 0, 6)
+	tracker.Track(other)
+	lokiPusher.DataChannel <- LokiStream{
+		Labels:  map[string]string{"label1": "other"},
+		Values:  [][]string{{"0", "log-line-1"}},
+		Sources: []kafka.TopicPartition{other},
+	}
+	lokiPusher.Flush()
+	lokiPusher.Shutdown()
+
+	assert.Equal(t, 1, queue.sends)
+	assert.True(t, queue.ctx == lokiPusher.sendContext)
+	assert.Len(t, queue.letters, 2)
+	assert.Equal(t, []byte("log-line-0"), queue.letters[0].Value)
+	assert.Equal(t, DeadLetterReasonRejected, queue.letters[0].Reason)
+	assert.Equal(t, source, queue.letters[0].Source)
+	assert.Equal(t, map[string]string{"label1": "value"}, queue.letters[0].Labels)
+	assert.Equal(t, []byte("log-line-1"), queue.letters[1].Value)
+	assert.Equal(t, other, queue.letters[1].Source)
+	// Rejected entries are done, their offsets are committed.
+	assert.Equal(t, map[string]int64{"topic[0]": 7}, committedOffsets(committer))
+}
+
+// Test_Pusher_RunForever_RetriesExhausted ensures that the batches out of retries are sent to the dead letter queue and
+// done, and that they stall the commits of their partition without a dead letter queue.
+func Test_Pusher_RunForever_RetriesExhausted(t *testing.T) {
+	for _, withQueue := range []bool{true, false} {
+		t.Run(fmt.Sprintf("dead_letter_queue_%t", withQueue), func(t *testing.T) {
+			sink := &SpeedyTestSink{sendDataError: &RetriesExhaustedError{Err: &LokiPushError{StatusCode: 503}}}
+			committer := &testOffsetCommitter{}
+			tracker := NewOffsetTracker(committer)
+			queue := &testDeadLetterQueue{}
+			lokiPusher := NewPusher(sink, 10, math.MaxInt32)
+			lokiPusher.SetOffsetTracker(tracker)
+			if withQueue {
+				lokiPusher.SetDeadLetterQueue(queue)
+			}
+			go lokiPusher.RunForever()
+
+			source := testTopicPartition("exhausted", 0, 5)
+			tracker.Track(source)
+			lokiPusher.DataChannel <- LokiStream{
+				Labels:  map[string]string{"label1": "value"},
+				Values:  [][]string{{"0", "log-line-0"}},
+				Sources: []kafka.TopicPartition{source},
+			}
+			lokiPusher.Flush()
+			sink.sendDataError = nil
+			next := testTopicPartition("exhausted", 0, 6)
+			tracker.Track(next)
+			lokiPusher.DataChannel <- LokiStream{
+				Labels:  map[string]string{"label1": "value"},
+				Values:  [][]string{{"0", "log-line-1"}},
+				Sources: []kafka.TopicPartition{next},
+			}
+			lokiPusher.Flush()
+			lokiPusher.Shutdown()
+
+			if !withQueue {
+				assert.Empty(t, committer.committed)
+				assert.Equal(t, float64(2), testutil.ToFloat64(pendingOffsets.WithLabelValues("exhausted", "0")))
+				return
+			}
+			assert.Len(t, queue.letters, 1)
+			assert.Equal(t, DeadLetterReasonRetriesExhausted, queue.letters[0].Reason)
+			assert.Equal(t, source, queue.letters[0].Source)
+			assert.Equal(t, map[string]int64{"exhausted[0]": 7}, committedOffsets(committer))
+			assert.Equal(t, float64(0), testutil.ToFloat64(pendingOffsets.WithLabelValues("exhausted", "0")))
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/goccy/go-json"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	// DecoderJson decodes JSON objects.
+	DecoderJson = "json"
+	// DecoderLogfmt decodes logfmt lines.
+	DecoderLogfmt = "logfmt"
+	// DecoderRaw keeps the message as a plain text line.
+	DecoderRaw = "raw"
+	// DecoderCsv decodes CSV records with a configured header.
+	DecoderCsv = "csv"
+	// DecoderAvro decodes Avro records in the Confluent wire format.
+	DecoderAvro = "avro"
+	// DecoderProtobuf decodes Protobuf messages in the Confluent wire format.
+	DecoderProtobuf = "protobuf"
+)
+
+// DecodedMessage is a Kafka message decoded by a Decoder.
+type DecodedMessage struct {
+	// Fields are the structured fields of the message, nil if the message has none.
+	Fields map[string]interface{}
+	// Line is the message as a log line.
+	Line string
+}
+
+// Decoder turns Kafka messages into a field map and a log line.
+type Decoder interface {
+	Decode(message *kafka.Message) (DecodedMessage, error)
+}
+
+// DecoderRule configures the decoder used for the topics that match a pattern.
+type DecoderRule struct {
+	// Topic is the regular expression matched against the topic name, empty matches every topic.
+	Topic string `json:"topic" mapstructure:"topic"`
+	// Type is the decoder type: json, logfmt, raw, csv, avro or protobuf.
+	Type string `json:"type" mapstructure:"type"`
+	// CsvHeader are the names of the CSV columns.
+	CsvHeader []string `json:"csv_header,omitempty" mapstructure:"csv_header"`
+	// CsvDelimiter is the CSV field delimiter, defaults to a comma.
+	CsvDelimiter string `json:"csv_delimiter,omitempty" mapstructure:"csv_delimiter"`
+	// SchemaRegistryUrl is the URL of the schema registry used by the avro and protobuf decoders.
+	SchemaRegistryUrl string `json:"schema_registry_url,omitempty" mapstructure:"schema_registry_url"`
+}
+
+// DecoderFactoryCreate is a factory for creating decoders.
+// The registry is used by the avro and protobuf decoders, it's created from the rule if nil.
+func DecoderFactoryCreate(rule DecoderRule, registry *SchemaRegistryClient) (Decoder, error) {
+	switch rule.Type {
+	case DecoderJson:
+		return &JsonDecoder{}, nil
+	case DecoderLogfmt:
+		return &LogfmtDecoder{}, nil
+	case DecoderRaw:
+		return &RawDecoder{}, nil
+	case DecoderCsv:
+		delimiter := ','
+		if rule.CsvDelimiter != "" {
+			if utf8.RuneCountInString(rule.CsvDelimiter) != 1 {
+				return nil, fmt.Errorf("invalid csv delimiter %q", rule.CsvDelimiter)
+			}
+			delimiter, _ = utf8.DecodeRuneInString(rule.CsvDelimiter)
+		}
+		return NewCsvDecoder(rule.CsvHeader, delimiter)
+	case DecoderAvro, DecoderProtobuf:
+		if registry == nil {
+			if rule.SchemaRegistryUrl == "" {
+				return nil, fmt.Errorf("schema_registry_url is required for the %s decoder", rule.Type)
+			}
+			registry = NewSchemaRegistryClient(rule.SchemaRegistryUrl)
+		}
+		if rule.Type == DecoderAvro {
+			return NewAvroDecoder(registry), nil
+		}
+		return NewProtobufDecoder(registry), nil
+	}
+	return nil, fmt.Errorf("invalid decoder type %s", rule.Type)
+}
+
+// JsonDecoder decodes messages that are JSON objects.
+type JsonDecoder struct {
+}
+
+// Decode unmarshals the JSON object, the line is the original message.
+// The numbers are decoded as float64, except the integers a float64 can't hold exactly, e.g. timestamps in
+// nanoseconds, which are kept as json.Number.
+func (d *JsonDecoder) Decode(message *kafka.Message) (DecodedMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(message.Value))
+	decoder.UseNumber()
+	fields := make(map[string]interface{})
+	err := decoder.Decode(&fields)
+	if err != nil {
+		return DecodedMessage{}, err
+	}
+	if len(bytes.TrimSpace(message.Value[decoder.InputOffset():])) > 0 {
+		return DecodedMessage{}, fmt.Errorf("invalid character after the JSON object at offset %d", decoder.InputOffset())
+	}
+	err = decodeJsonNumbers(fields)
+	if err != nil {
+		return DecodedMessage{}, err
+	}
+	return DecodedMessage{Fields: fields, Line: string(message.Value)}, nil
+}
+
+// decodeJsonNumbers replaces the json.Number values of the maps and arrays by their jsonNumber values.
+func decodeJsonNumbers(value interface{}) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if number, ok := item.(json.Number); ok {
+				decoded, err := jsonNumber(string(number))
+				if err != nil {
+					return err
+				}
+				v[key] = decoded
+			} else if err := decodeJsonNumbers(item); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for index, item := range v {
+			if number, ok := item.(json.Number); ok {
+				decoded, err := jsonNumber(string(number))
+				if err != nil {
+					return err
+				}
+				v[index] = decoded
+			} else if err := decodeJsonNumbers(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// jsonNumber decodes a JSON number as a float64, or as a json.Number when it's an integer a float64 can't hold
+// exactly. The json.Number references the given string.
+func jsonNumber(number string) (interface{}, error) {
+	if integer, err := strconv.ParseInt(number, 10, 64); err == nil && (integer > 1<<53 || integer < -1<<53) {
+		return json.Number(number), nil
+	}
+	return strconv.ParseFloat(number, 64)
+}
+
+// LogfmtDecoder decodes messages that are logfmt lines, e.g. level=info msg="hello world".
+type LogfmtDecoder struct {
+}
+
+// Decode parses the logfmt pairs, keys without a value are decoded as true.
+func (d *LogfmtDecoder) Decode(message *kafka.Message) (DecodedMessage, error) {
+	line := strings.TrimRight(string(message.Value), "\r\n")
+	fields, err := parseLogfmt(line)
+	if err != nil {
+		return DecodedMessage{}, err
+	}
+	return DecodedMessage{Fields: fields, Line: line}, nil
+}
+
+// parseLogfmt parses a logfmt line into a map.
+func parseLogfmt(line string) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	position := 0
+	for {
+		for position < len(line) && line[position] == ' ' {
+			position++
+		}
+		if position >= len(line) {
+			return fields, nil
+		}
+
+		keyStart := position
+		for position < len(line) && line[position] != '=' && line[position] != ' ' {
+			if line[position] == '"' {
+				return nil, fmt.Errorf("unexpected quote in key at position %d", position)
+			}
+			position++
+		}
+		key := line[keyStart:position]
+		if key == "" {
+			return nil, fmt.Errorf("empty key at position %d", position)
+		}
+		if position >= len(line) || line[position] == ' ' {
+			fields[key] = true
+			continue
+		}
+
+		// Skip the '='.
+		position++
+		if position < len(line) && line[position] == '"' {
+			value, end, err := parseLogfmtQuoted(line, position)
+			if err != nil {
+				return nil, err
+			}
+			fields[key] = value
+			position = end
+			continue
+		}
+		valueStart := position
+		for position < len(line) && line[position] != ' ' {
+			position++
+		}
+		fields[key] = line[valueStart:position]
+	}
+}
+
+// parseLogfmtQuoted parses the quoted value that starts at position, it returns the value and the position after it.
+func parseLogfmtQuoted(line string, position int) (string, int, error) {
+	var value strings.Builder
+	for index := position + 1; index < len(line); index++ {
+		switch line[index] {
+		case '\\':
+			if index+1 >= len(line) {
+				return "", 0, fmt.Errorf("unterminated escape at position %d", index)
+			}
+			index++
+			switch line[index] {
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			case 'r':
+				value.WriteByte('\r')
+			default:
+				value.WriteByte(line[index])
+			}
+		case '"':
+			return value.String(), index + 1, nil
+		default:
+			value.WriteByte(line[index])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated quoted value at position %d", position)
+}
+
+// RawDecoder keeps messages as plain text lines without fields.
+type RawDecoder struct {
+}
+
+// Decode returns the message as the line, without the trailing newline.
+func (d *RawDecoder) Decode(message *kafka.Message) (DecodedMessage, error) {
+	return DecodedMessage{Line: strings.TrimRight(string(message.Value), "\r\n")}, nil
+}
+
+// CsvDecoder decodes messages that are a single CSV record.
+type CsvDecoder struct {
+	header    []string
+	delimiter rune
+}
+
+// NewCsvDecoder creates a new CsvDecoder that names the columns after the given header.
+func NewCsvDecoder(header []string, delimiter rune) (*CsvDecoder, error) {
+	if len(header) == 0 {
+		return nil, fmt.Errorf("csv header is empty")
+	}
+	return &CsvDecoder{header: header, delimiter: delimiter}, nil
+}
+
+// Decode parses the CSV record, it must have as many columns as the header.
+func (d *CsvDecoder) Decode(message *kafka.Message) (DecodedMessage, error) {
+	reader := csv.NewReader(bytes.NewReader(message.Value))
+	reader.Comma = d.delimiter
+	reader.FieldsPerRecord = len(d.header)
+	record, err := reader.Read()
+	if err != nil {
+		return DecodedMessage{}, err
+	}
+	fields := make(map[string]interface{}, len(d.header))
+	for index, name := range d.header {
+		fields[name] = record[index]
+	}
+	return DecodedMessage{Fields: fields, Line: strings.TrimRight(string(message.Value), "\r\n")}, nil
+}
+
+// topicDecoder is a Decoder with the topic pattern it's used for.
+type topicDecoder struct {
+	pattern topicPattern
+	decoder Decoder
+}
+
+// TopicDecoders chooses the Decoder of a message according to its topic.
+// The first rule whose pattern matches the topic is used, messages of other topics are decoded as JSON.
+type TopicDecoders struct {
+	decoders []topicDecoder
+	fallback Decoder
+	// cache maps topic names to their Decoder.
+	cache sync.Map
+}
+
+// NewTopicDecoders creates a new TopicDecoders from the given rules.
+func NewTopicDecoders(rules []DecoderRule) (*TopicDecoders, error) {
+	topicDecoders := &TopicDecoders{
+		decoders: make([]topicDecoder, 0, len(rules)),
+		fallback: &JsonDecoder{},
+	}
+	// Rules that use the same schema registry share its client and schema cache.
+	registries := make(map[string]*SchemaRegistryClient)
+	for _, rule := range rules {
+		pattern, err := newTopicPattern(rule.Topic)
+		if err != nil {
+			return nil, fmt.Errorf("invalid decoder topic %s: %w", rule.Topic, err)
+		}
+		registry, ok := registries[rule.SchemaRegistryUrl]
+		if !ok && rule.SchemaRegistryUrl != "" {
+			registry = NewSchemaRegistryClient(rule.SchemaRegistryUrl)
+			registries[rule.SchemaRegistryUrl] = registry
+		}
+		decoder, err := DecoderFactoryCreate(rule, registry)
+		if err != nil {
+			return nil, err
+		}
+		topicDecoders.decoders = append(topicDecoders.decoders, topicDecoder{pattern: pattern, decoder: decoder})
+	}
+	return topicDecoders, nil
+}
+
+// Decoder returns the Decoder for the given topic.
+func (t *TopicDecoders) Decoder(topic string) Decoder {
+	if decoder, ok := t.cache.Load(topic); ok {
+		return decoder.(Decoder)
+	}
+	decoder := t.fallback
+	for _, candidate := range t.decoders {
+		if candidate.pattern.Match(topic) {
+			decoder = candidate.decoder
+			break
+		}
+	}
+	t.cache.Store(topic, decoder)
+	return decoder
+}
+
+// Decode decodes the message with the Decoder of its topic.
+func (t *TopicDecoders) Decode(message *kafka.Message) (DecodedMessage, error) {
+	topic := ""
+	if message.TopicPartition.Topic != nil {
+		topic = *message.TopicPartition.Topic
+	}
+	return t.Decoder(topic).Decode(message)
+}
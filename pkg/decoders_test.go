@@ -0,0 +1,131 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Test_DecoderFactoryCreate ensures that decoders are created according to their type.
+func Test_DecoderFactoryCreate(t *testing.T) {
+	var tests = []struct {
+		rule     DecoderRule
+		expected Decoder
+	}{
+		{DecoderRule{Type: DecoderJson}, &JsonDecoder{}},
+		{DecoderRule{Type: DecoderLogfmt}, &LogfmtDecoder{}},
+		{DecoderRule{Type: DecoderRaw}, &RawDecoder{}},
+		{DecoderRule{Type: DecoderCsv, CsvHeader: []string{"a"}}, &CsvDecoder{header: []string{"a"}, delimiter: ','}},
+		{DecoderRule{Type: DecoderCsv, CsvHeader: []string{"a"}, CsvDelimiter: ";"}, &CsvDecoder{header: []string{"a"}, delimiter: ';'}},
+		{DecoderRule{Type: DecoderCsv}, nil},
+		{DecoderRule{Type: DecoderCsv, CsvHeader: []string{"a"}, CsvDelimiter: ";;"}, nil},
+		{DecoderRule{Type: DecoderAvro}, nil},
+		{DecoderRule{Type: DecoderProtobuf}, nil},
+		{DecoderRule{Type: "batman"}, nil},
+	}
+	for index, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			decoder, err := DecoderFactoryCreate(tt.rule, nil)
+			if tt.expected == nil {
+				assert.Error(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tt.expected, decoder)
+			}
+		})
+	}
+}
+
+// Test_DecoderFactoryCreate_SchemaRegistry ensures that the avro and protobuf decoders use a schema registry.
+func Test_DecoderFactoryCreate_SchemaRegistry(t *testing.T) {
+	decoder, err := DecoderFactoryCreate(DecoderRule{Type: DecoderAvro, SchemaRegistryUrl: "http://registry"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "http://registry", decoder.(*AvroDecoder).registry.registryUrl)
+
+	registry := NewSchemaRegistryClient("http://shared")
+	decoder, err = DecoderFactoryCreate(DecoderRule{Type: DecoderProtobuf}, registry)
+	assert.Nil(t, err)
+	assert.Same(t, registry, decoder.(*ProtobufDecoder).registry)
+
+	topicDecoders, err := NewTopicDecoders([]DecoderRule{
+		{Topic: "^avro", Type: DecoderAvro, SchemaRegistryUrl: "http://registry"},
+		{Topic: "^proto", Type: DecoderProtobuf, SchemaRegistryUrl: "http://registry"},
+	})
+	assert.Nil(t, err)
+	assert.Same(t, topicDecoders.Decoder("avro").(*AvroDecoder).registry, topicDecoders.Decoder("proto").(*ProtobufDecoder).registry)
+}
+
+// Test_Decoders_Decode ensures that the built-in decoders decode messages into fields and lines.
+func Test_Decoders_Decode(t *testing.T) {
+	csvDecoder, err := NewCsvDecoder([]string{"time", "level", "message"}, ',')
+	assert.Nil(t, err)
+	var tests = []struct {
+		decoder  Decoder
+		value    string
+		expected DecodedMessage
+		fails    bool
+	}{
+		{&JsonDecoder{}, `{"a": {"b": 1}}`, DecodedMessage{
+			Fields: map[string]interface{}{"a": map[string]interface{}{"b": float64(1)}},
+			Line:   `{"a": {"b": 1}}`,
+		}, false},
+		{&JsonDecoder{}, `not json`, DecodedMessage{}, true},
+		{&JsonDecoder{}, `{"a": 1} {"b": 2}`, DecodedMessage{}, true},
+		{&JsonDecoder{}, `{"ts": 1700000000123456789, "ids": [1.5, -9007199254740993]} `, DecodedMessage{
+			Fields: map[string]interface{}{
+				"ts":  json.Number("1700000000123456789"),
+				"ids": []interface{}{1.5, json.Number("-9007199254740993")},
+			},
+			Line: `{"ts": 1700000000123456789, "ids": [1.5, -9007199254740993]} `,
+		}, false},
+		{&LogfmtDecoder{}, `level=info msg="hello \"world\"" dry_run duration=1.5s empty= ` + "\n", DecodedMessage{
+			Fields: map[string]interface{}{
+				"level":    "info",
+				"msg":      `hello "world"`,
+				"dry_run":  true,
+				"duration": "1.5s",
+				"empty":    "",
+			},
+			Line: `level=info msg="hello \"world\"" dry_run duration=1.5s empty= `,
+		}, false},
+		{&LogfmtDecoder{}, `msg="unterminated`, DecodedMessage{}, true},
+		{&LogfmtDecoder{}, `=value`, DecodedMessage{}, true},
+		{&RawDecoder{}, "plain text line\r\n", DecodedMessage{Line: "plain text line"}, false},
+		{csvDecoder, `2021-10-17,error,"disk full, retrying"` + "\n", DecodedMessage{
+			Fields: map[string]interface{}{"time": "2021-10-17", "level": "error", "message": "disk full, retrying"},
+			Line:   `2021-10-17,error,"disk full, retrying"`,
+		}, false},
+		{csvDecoder, `2021-10-17,error`, DecodedMessage{}, true},
+	}
+	for index, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			decoded, err := tt.decoder.Decode(&kafka.Message{Value: []byte(tt.value)})
+			if tt.fails {
+				assert.Error(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tt.expected, decoded)
+			}
+		})
+	}
+}
+
+// Test_TopicDecoders_Decoder ensures that the first decoder matching the topic is used, JSON otherwise.
+func Test_TopicDecoders_Decoder(t *testing.T) {
+	decoders, err := NewTopicDecoders([]DecoderRule{
+		{Topic: `^logs\.raw\.`, Type: DecoderRaw},
+		{Topic: `^logs\.`, Type: DecoderLogfmt},
+	})
+	assert.Nil(t, err)
+
+	assert.IsType(t, &RawDecoder{}, decoders.Decoder("logs.raw.nginx"))
+	assert.IsType(t, &LogfmtDecoder{}, decoders.Decoder("logs.app"))
+	assert.IsType(t, &JsonDecoder{}, decoders.Decoder("events"))
+	// Cached decoders are returned on subsequent calls.
+	assert.IsType(t, &RawDecoder{}, decoders.Decoder("logs.raw.nginx"))
+
+	_, err = NewTopicDecoders([]DecoderRule{{Topic: "(", Type: DecoderRaw}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,179 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/getsentry/sentry-go"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// IStreamPusher receives the decoded streams, ShardedPusher and WriteAheadLog implement it.
+type IStreamPusher interface {
+	// Push sends the stream on its way to Loki.
+	Push(stream LokiStream)
+	// Flush delivers the streams pushed so far, so that their Kafka messages are done.
+	Flush()
+}
+
+// Dispatcher decodes Kafka messages with a pool of workers and routes the resulting streams to an IStreamPusher.
+// Messages are assigned to workers by partition, so the messages of a partition are processed in order.
+type Dispatcher struct {
+	channels        []chan *kafka.Message
+	processor       *MessageProcessor
+	pusher          IStreamPusher
+	offsetTracker   *OffsetTracker
+	deadLetterQueue IDeadLetterQueue
+	waitGroup       sync.WaitGroup
+	// registryRetryPolicy is the backoff of the decodings retried while the schema registry is unavailable, they're
+	// retried until the shutdown cancels retryContext.
+	registryRetryPolicy RetryPolicy
+	retryContext        context.Context
+	cancelRetries       context.CancelFunc
+}
+
+// NewDispatcher creates a new Dispatcher with the given number of workers.
+func NewDispatcher(workers int, processor *MessageProcessor, pusher IStreamPusher) *Dispatcher {
+	if processor == nil || pusher == nil {
+		panic("Dispatcher processor or pusher is nil")
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	channels := make([]chan *kafka.Message, workers)
+	for index := range channels {
+		channels[index] = make(chan *kafka.Message, 1000)
+	}
+	retryContext, cancelRetries := context.WithCancel(context.Background())
+	return &Dispatcher{
+		channels:            channels,
+		processor:           processor,
+		pusher:              pusher,
+		registryRetryPolicy: RetryPolicy{InitialBackoff: 500 * time.Millisecond, MaxBackoff: 30 * time.Second},
+		retryContext:        retryContext,
+		cancelRetries:       cancelRetries,
+	}
+}
+
+// SetOffsetTracker sets the OffsetTracker that is notified of the messages that won't reach the pushers.
+func (d *Dispatcher) SetOffsetTracker(tracker *OffsetTracker) {
+	d.offsetTracker = tracker
+}
+
+// SetDeadLetterQueue sets the IDeadLetterQueue that receives the messages that can't be decoded.
+func (d *Dispatcher) SetDeadLetterQueue(queue IDeadLetterQueue) {
+	d.deadLetterQueue = queue
+}
+
+// Start starts the workers.
+func (d *Dispatcher) Start() {
+	for _, channel := range d.channels {
+		d.waitGroup.Add(1)
+		go func(channel chan *kafka.Message) {
+			defer d.waitGroup.Done()
+			for message := range channel {
+				d.process(message)
+			}
+		}(channel)
+	}
+}
+
+// Dispatch sends the message to the worker of its partition, it blocks while the worker is busy.
+// It returns the error of the context when it's done before the message is dispatched.
+func (d *Dispatcher) Dispatch(ctx context.Context, message *kafka.Message) error {
+	messagesConsumed.WithLabelValues(topicName(message.TopicPartition)).Inc()
+	select {
+	case d.channels[d.worker(message.TopicPartition)] <- message:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// worker returns the index of the worker of the given partition.
+func (d *Dispatcher) worker(tp kafka.TopicPartition) int {
+	if len(d.channels) == 1 {
+		return 0
+	}
+	key := partitionKey(tp)
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key.topic))
+	_, _ = hash.Write([]byte{byte(key.partition >> 24), byte(key.partition >> 16), byte(key.partition >> 8), byte(key.partition)})
+	return int(hash.Sum32() % uint32(len(d.channels)))
+}
+
+// process processes a message and pushes the resulting stream.
+func (d *Dispatcher) process(message *kafka.Message) {
+	stream, err := d.processor.Process(message)
+	// The message isn't malformed, it's decoded once the schema registry is back. Meanwhile the worker is blocked,
+	// so the backpressure reaches the Kafka consumer.
+	for attempt := 1; IsSchemaRegistryUnavailableError(err); attempt++ {
+		decodeRetries.WithLabelValues(topicName(message.TopicPartition)).Inc()
+		backoff := d.registryRetryPolicy.backoff(attempt)
+		SugaredLogger.Warnf("decoding attempt %d failed, retrying in %s: %s", attempt, backoff, err)
+		if sleepContext(d.retryContext, backoff) != nil {
+			// Shutting down, the message isn't done and will be consumed again.
+			return
+		}
+		stream, err = d.processor.Process(message)
+	}
+	if errors.Is(err, ErrMessageFiltered) {
+		// Dropped on purpose, the message is done.
+		if d.offsetTracker != nil {
+			d.offsetTracker.MarkDone(message.TopicPartition)
+		}
+		return
+	}
+	if err != nil {
+		SugaredLogger.Error(err)
+		decodeFailures.WithLabelValues(topicName(message.TopicPartition)).Inc()
+		// A message that didn't make it to the dead letter queue isn't done, so its offset isn't committed.
+		if !d.sendToDeadLetterQueue(message, err) {
+			return
+		}
+		if d.offsetTracker != nil {
+			d.offsetTracker.MarkDone(message.TopicPartition)
+		}
+		return
+	}
+	d.pusher.Push(stream)
+}
+
+// deadLetterTimeout bounds the sends of the decode workers to the dead letter queue.
+const deadLetterTimeout = 30 * time.Second
+
+// sendToDeadLetterQueue sends the message that couldn't be processed to the dead letter queue, if one is set.
+// It returns false when the send failed, and true when it succeeded or there's no dead letter queue.
+func (d *Dispatcher) sendToDeadLetterQueue(message *kafka.Message, err error) bool {
+	if d.deadLetterQueue == nil {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), deadLetterTimeout)
+	defer cancel()
+	dlqErr := d.deadLetterQueue.Send(ctx, DeadLetter{
+		Key:     message.Key,
+		Value:   message.Value,
+		Headers: message.Headers,
+		Reason:  DeadLetterReasonDecodeFailed,
+		Source:  message.TopicPartition,
+		Err:     err,
+	})
+	if dlqErr != nil {
+		SugaredLogger.Errorf("failed to send message to the dead letter queue: %s", dlqErr)
+		sentry.CaptureException(dlqErr)
+		return false
+	}
+	return true
+}
+
+// Shutdown stops accepting messages and waits for the workers to process the dispatched ones. The decodings waiting
+// for the schema registry are abandoned, their messages will be consumed again.
+func (d *Dispatcher) Shutdown() {
+	d.cancelRetries()
+	for _, channel := range d.channels {
+		close(channel)
+	}
+	d.waitGroup.Wait()
+}
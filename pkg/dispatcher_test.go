@@ -0,0 +1,187 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test_Dispatcher_Dispatch ensures that messages are processed and pushed, and failures are dead lettered.
+func Test_Dispatcher_Dispatch(t *testing.T) {
+	sink := &concurrentTestSink{}
+	pusher := NewShardedPusher(2, sink, 1000, math.MaxInt32)
+	committer := &testOffsetCommitter{}
+	tracker := NewOffsetTracker(committer)
+	queue := &testDeadLetterQueue{}
+	pusher.SetOffsetTracker(tracker)
+	dispatcher := NewDispatcher(3, newTestMessageProcessor(t), pusher)
+	dispatcher.SetOffsetTracker(tracker)
+	dispatcher.SetDeadLetterQueue(queue)
+	go pusher.RunForever()
+	dispatcher.Start()
+
+	for offset := int64(0); offset < 10; offset++ {
+		message := testMessage("topic", 0, offset, fmt.Sprintf(`{"clientID": "%d"}`, offset%3))
+		if offset == 4 {
+			message = testMessage("topic", 0, offset, "not json")
+		}
+		tracker.Track(message.TopicPartition)
+		assert.Nil(t, dispatcher.Dispatch(context.Background(), message))
+	}
+	dispatcher.Shutdown()
+	pusher.Flush()
+	pusher.Shutdown()
+
+	lines := 0
+	for _, streamLines := range sink.lines() {
+		lines += len(streamLines)
+	}
+	assert.Equal(t, 9, lines)
+	assert.Len(t, queue.letters, 1)
+	assert.Equal(t, []byte("not json"), queue.letters[0].Value)
+	assert.Equal(t, int64(4), int64(queue.letters[0].Source.Offset))
+	assert.Equal(t, map[string]int64{"topic[0]": 10}, committedOffsets(committer))
+}
+
+// Test_Dispatcher_Dispatch_DeadLetterQueueFailure ensures that the messages that couldn't be dead lettered are not
+// done, so their offsets aren't committed.
+func Test_Dispatcher_Dispatch_DeadLetterQueueFailure(t *testing.T) {
+	sink := &concurrentTestSink{}
+	pusher := NewShardedPusher(1, sink, 1000, math.MaxInt32)
+	committer := &testOffsetCommitter{}
+	tracker := NewOffsetTracker(committer)
+	queue := &testDeadLetterQueue{err: errors.New("dead letter queue unreachable")}
+	pusher.SetOffsetTracker(tracker)
+	dispatcher := NewDispatcher(1, newTestMessageProcessor(t), pusher)
+	dispatcher.SetOffsetTracker(tracker)
+	dispatcher.SetDeadLetterQueue(queue)
+	go pusher.RunForever()
+	dispatcher.Start()
+
+	for offset := int64(0); offset < 3; offset++ {
+		message := testMessage("topic", 0, offset, `{"a": 1}`)
+		if offset == 1 {
+			message = testMessage("topic", 0, offset, "not json")
+		}
+		tracker.Track(message.TopicPartition)
+		assert.Nil(t, dispatcher.Dispatch(context.Background(), message))
+	}
+	dispatcher.Shutdown()
+	pusher.Flush()
+	pusher.Shutdown()
+
+	assert.Equal(t, 1, queue.sends)
+	_, hasDeadline := queue.ctx.Deadline()
+	assert.True(t, hasDeadline)
+	// The offsets stop before the message that wasn't dead lettered.
+	assert.Equal(t, map[string]int64{"topic[0]": 1}, committedOffsets(committer))
+}
+
+// Test_Dispatcher_Dispatch_SchemaRegistryUnavailable ensures that the decodings are retried while the schema registry
+// is unavailable, instead of dead lettering the messages, and that they're abandoned on shutdown without being done.
+func Test_Dispatcher_Dispatch_SchemaRegistryUnavailable(t *testing.T) {
+	var requests, failures int32
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= atomic.LoadInt32(&failures) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"schema": "\"string\""}`))
+	}))
+	defer registry.Close()
+
+	for _, recovers := range []bool{true, false} {
+		t.Run(fmt.Sprintf("recovers_%t", recovers), func(t *testing.T) {
+			// The registry fails twice before it's back, or for good.
+			atomic.StoreInt32(&requests, 0)
+			atomic.StoreInt32(&failures, 2)
+			if !recovers {
+				atomic.StoreInt32(&failures, math.MaxInt32)
+			}
+			sink := &concurrentTestSink{}
+			pusher := NewShardedPusher(1, sink, 1000, math.MaxInt32)
+			committer := &testOffsetCommitter{}
+			tracker := NewOffsetTracker(committer)
+			queue := &testDeadLetterQueue{}
+			pusher.SetOffsetTracker(tracker)
+			decoders, err := NewTopicDecoders([]DecoderRule{{Type: DecoderAvro, SchemaRegistryUrl: registry.URL}})
+			assert.Nil(t, err)
+			labelExtractor, err := NewLabelExtractor(DefaultLabelRules)
+			assert.Nil(t, err)
+			timestampExtractor, err := NewTimestampExtractor(TimestampSourceKafka, "", "")
+			assert.Nil(t, err)
+			dispatcher := NewDispatcher(1, NewMessageProcessor(decoders, timestampExtractor, labelExtractor), pusher)
+			dispatcher.registryRetryPolicy = RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+			if !recovers {
+				dispatcher.registryRetryPolicy = RetryPolicy{InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+			}
+			dispatcher.SetOffsetTracker(tracker)
+			dispatcher.SetDeadLetterQueue(queue)
+			go pusher.RunForever()
+			dispatcher.Start()
+
+			message := testMessage("orders", 0, 0, "")
+			message.Value = confluentWireFormat(1, (&testAvroEncoder{}).string("plain").data)
+			tracker.Track(message.TopicPartition)
+			assert.Nil(t, dispatcher.Dispatch(context.Background(), message))
+			// Waits for the schema to be fetched, or for the message to be retrying.
+			assert.Eventually(t, func() bool {
+				return atomic.LoadInt32(&requests) > 2 || !recovers && atomic.LoadInt32(&requests) > 0
+			}, time.Second, time.Millisecond)
+			dispatcher.Shutdown()
+			pusher.Flush()
+			pusher.Shutdown()
+
+			assert.Empty(t, queue.letters)
+			if recovers {
+				assert.Equal(t, []string{`{"value":"plain"}`}, sink.lines()[`{key="orders"}`])
+				assert.Equal(t, map[string]int64{"orders[0]": 1}, committedOffsets(committer))
+			} else {
+				assert.Empty(t, sink.lines())
+				assert.Empty(t, committedOffsets(committer))
+			}
+		})
+	}
+}
+
+// Test_Dispatcher_Dispatch_Shutdown ensures that a dispatch blocked by a sink that never delivers is aborted by its
+// context, and that the shutdown then returns within its timeout.
+func Test_Dispatcher_Dispatch_Shutdown(t *testing.T) {
+	sink := &blockingTestSink{started: make(chan struct{}, 10_000), errors: make(chan error, 10_000)}
+	pusher := NewShardedPusher(1, sink, 1, math.MaxInt32)
+	dispatcher := NewDispatcher(1, newTestMessageProcessor(t), pusher)
+	go pusher.RunForever()
+	dispatcher.Start()
+
+	pollContext, stopPolling := context.WithCancel(context.Background())
+	dispatched := make(chan error)
+	go func() {
+		for offset := int64(0); ; offset++ {
+			if err := dispatcher.Dispatch(pollContext, testMessage("topic", 0, offset, `{"a": 1}`)); err != nil {
+				dispatched <- err
+				return
+			}
+		}
+	}()
+	// The send worker, its queue, the pusher, its channel and the dispatcher channel are full.
+	dataChannel := pusher.Pushers()[0].DataChannel
+	assert.Eventually(t, func() bool {
+		return len(dataChannel) == cap(dataChannel) && len(dispatcher.channels[0]) == cap(dispatcher.channels[0])
+	}, 5*time.Second, time.Millisecond)
+
+	started := time.Now()
+	shutdownContext, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	stopPolling()
+	assert.Equal(t, context.Canceled, <-dispatched)
+	go dispatcher.Shutdown()
+	assert.Equal(t, context.DeadlineExceeded, pusher.ShutdownContext(shutdownContext))
+	assert.Less(t, int64(time.Since(started)), int64(time.Second))
+}
@@ -0,0 +1,300 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// FilterActionKeep keeps only the messages that match the condition.
+	FilterActionKeep = "keep"
+	// FilterActionDrop drops the messages that match the condition.
+	FilterActionDrop = "drop"
+)
+
+const (
+	// FilterOperatorEquals matches fields equal to the value.
+	FilterOperatorEquals = "equals"
+	// FilterOperatorRegex matches fields that match the regular expression of the value.
+	FilterOperatorRegex = "regex"
+	// FilterOperatorExists matches messages that have the field.
+	FilterOperatorExists = "exists"
+	// FilterOperatorGreaterThan matches numeric fields greater than the value.
+	FilterOperatorGreaterThan = "gt"
+	// FilterOperatorGreaterThanOrEqual matches numeric fields greater than or equal to the value.
+	FilterOperatorGreaterThanOrEqual = "gte"
+	// FilterOperatorLessThan matches numeric fields less than the value.
+	FilterOperatorLessThan = "lt"
+	// FilterOperatorLessThanOrEqual matches numeric fields less than or equal to the value.
+	FilterOperatorLessThanOrEqual = "lte"
+	// FilterOperatorLevelAtLeast matches log level fields at least as severe as the value.
+	FilterOperatorLevelAtLeast = "level_gte"
+	// FilterOperatorLevelBelow matches log level fields less severe than the value.
+	FilterOperatorLevelBelow = "level_lt"
+)
+
+// ErrMessageFiltered is returned by MessageProcessor.Process for the messages dropped by the filter rules.
+var ErrMessageFiltered = errors.New("message dropped by a filter rule")
+
+// logLevels maps the common log level names to their severity.
+var logLevels = map[string]int{
+	"trace":    0,
+	"debug":    1,
+	"info":     2,
+	"notice":   2,
+	"warn":     3,
+	"warning":  3,
+	"error":    4,
+	"err":      4,
+	"critical": 5,
+	"crit":     5,
+	"fatal":    5,
+	"panic":    5,
+}
+
+// FilterCondition is a condition on the flattened message fields. It's either a combination of conditions, with All
+// or Any, or an Operator applied to a Field.
+type FilterCondition struct {
+	// All matches when all of the conditions match.
+	All []FilterCondition `json:"all,omitempty" mapstructure:"all"`
+	// Any matches when any of the conditions match.
+	Any []FilterCondition `json:"any,omitempty" mapstructure:"any"`
+	// Field is the flattened field path the operator is applied to.
+	Field string `json:"field,omitempty" mapstructure:"field"`
+	// Operator is equals, regex, exists, gt, gte, lt, lte, level_gte or level_lt.
+	Operator string `json:"operator,omitempty" mapstructure:"operator"`
+	// Value is the operand of the operator.
+	Value string `json:"value,omitempty" mapstructure:"value"`
+	// Not negates the condition.
+	Not bool `json:"not,omitempty" mapstructure:"not"`
+}
+
+// FilterRule keeps or drops the messages of the topics matching Topic according to a condition.
+type FilterRule struct {
+	// Name identifies the rule in the metrics, it defaults to filter_<index>.
+	Name string `json:"name,omitempty" mapstructure:"name"`
+	// Topic is the pattern of the topics the rule applies to, an empty pattern applies to every topic.
+	Topic string `json:"topic,omitempty" mapstructure:"topic"`
+	// Action is keep or drop.
+	Action string `json:"action" mapstructure:"action"`
+	// All, Any, Field, Operator, Value and Not are the condition of the rule, see FilterCondition.
+	All      []FilterCondition `json:"all,omitempty" mapstructure:"all"`
+	Any      []FilterCondition `json:"any,omitempty" mapstructure:"any"`
+	Field    string            `json:"field,omitempty" mapstructure:"field"`
+	Operator string            `json:"operator,omitempty" mapstructure:"operator"`
+	Value    string            `json:"value,omitempty" mapstructure:"value"`
+	Not      bool              `json:"not,omitempty" mapstructure:"not"`
+}
+
+// Condition returns the condition of the rule.
+func (r FilterRule) Condition() FilterCondition {
+	return FilterCondition{All: r.All, Any: r.Any, Field: r.Field, Operator: r.Operator, Value: r.Value, Not: r.Not}
+}
+
+// filterMatcher is a compiled FilterCondition.
+type filterMatcher func(fields map[string]interface{}) bool
+
+// newFilterMatcher compiles the given condition.
+func newFilterMatcher(condition FilterCondition) (filterMatcher, error) {
+	matcher, err := newPositiveFilterMatcher(condition)
+	if err != nil || !condition.Not {
+		return matcher, err
+	}
+	return func(fields map[string]interface{}) bool {
+		return !matcher(fields)
+	}, nil
+}
+
+// newPositiveFilterMatcher compiles the given condition, without its negation.
+func newPositiveFilterMatcher(condition FilterCondition) (filterMatcher, error) {
+	kinds := 0
+	for _, configured := range []bool{len(condition.All) > 0, len(condition.Any) > 0, condition.Operator != ""} {
+		if configured {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return nil, fmt.Errorf("a condition needs exactly one of all, any or operator")
+	}
+
+	if len(condition.All) > 0 || len(condition.Any) > 0 {
+		conditions := condition.All
+		if len(conditions) == 0 {
+			conditions = condition.Any
+		}
+		matchers := make([]filterMatcher, 0, len(conditions))
+		for _, subCondition := range conditions {
+			matcher, err := newFilterMatcher(subCondition)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, matcher)
+		}
+		if len(condition.All) > 0 {
+			return func(fields map[string]interface{}) bool {
+				for _, matcher := range matchers {
+					if !matcher(fields) {
+						return false
+					}
+				}
+				return true
+			}, nil
+		}
+		return func(fields map[string]interface{}) bool {
+			for _, matcher := range matchers {
+				if matcher(fields) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+
+	if condition.Field == "" {
+		return nil, fmt.Errorf("field is required for the %s operator", condition.Operator)
+	}
+	field := condition.Field
+	switch condition.Operator {
+	case FilterOperatorEquals:
+		return func(fields map[string]interface{}) bool {
+			value, ok := fields[field]
+			return ok && stringValue(value) == condition.Value
+		}, nil
+	case FilterOperatorRegex:
+		regex, err := regexp.Compile(condition.Value)
+		if err != nil {
+			return nil, err
+		}
+		return func(fields map[string]interface{}) bool {
+			value, ok := fields[field]
+			return ok && value != nil && regex.MatchString(stringValue(value))
+		}, nil
+	case FilterOperatorExists:
+		return func(fields map[string]interface{}) bool {
+			value, ok := fields[field]
+			return ok && value != nil
+		}, nil
+	case FilterOperatorGreaterThan, FilterOperatorGreaterThanOrEqual, FilterOperatorLessThan, FilterOperatorLessThanOrEqual:
+		operand, err := strconv.ParseFloat(condition.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q for the %s operator", condition.Value, condition.Operator)
+		}
+		compare := map[string]func(float64) bool{
+			FilterOperatorGreaterThan:        func(number float64) bool { return number > operand },
+			FilterOperatorGreaterThanOrEqual: func(number float64) bool { return number >= operand },
+			FilterOperatorLessThan:           func(number float64) bool { return number < operand },
+			FilterOperatorLessThanOrEqual:    func(number float64) bool { return number <= operand },
+		}[condition.Operator]
+		return func(fields map[string]interface{}) bool {
+			value, ok := fields[field]
+			if !ok || value == nil {
+				return false
+			}
+			number, err := strconv.ParseFloat(stringValue(value), 64)
+			return err == nil && compare(number)
+		}, nil
+	case FilterOperatorLevelAtLeast, FilterOperatorLevelBelow:
+		operand, ok := logLevels[strings.ToLower(condition.Value)]
+		if !ok {
+			return nil, fmt.Errorf("unknown log level %q", condition.Value)
+		}
+		atLeast := condition.Operator == FilterOperatorLevelAtLeast
+		return func(fields map[string]interface{}) bool {
+			value, ok := fields[field]
+			if !ok || value == nil {
+				return false
+			}
+			// Messages with an unknown level match neither operator.
+			level, ok := logLevels[strings.ToLower(strings.TrimSpace(stringValue(value)))]
+			return ok && (level >= operand) == atLeast
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid operator %s", condition.Operator)
+}
+
+// messageFilterRule is a compiled FilterRule.
+type messageFilterRule struct {
+	name    string
+	topic   topicPattern
+	keep    bool
+	matcher filterMatcher
+}
+
+// MessageFilter drops messages according to a list of FilterRule. A message is dropped by the first rule of its
+// topic that drops it: a drop rule whose condition matches or a keep rule whose condition doesn't match.
+type MessageFilter struct {
+	rules  []messageFilterRule
+	fields []string
+}
+
+// NewMessageFilter creates a new MessageFilter, the rules are validated and compiled.
+func NewMessageFilter(rules []FilterRule) (*MessageFilter, error) {
+	filter := &MessageFilter{rules: make([]messageFilterRule, 0, len(rules))}
+	seen := make(map[string]bool, len(rules))
+	for index, rule := range rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("filter_%d", index)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate filter %s", name)
+		}
+		seen[name] = true
+		if rule.Action != FilterActionKeep && rule.Action != FilterActionDrop {
+			return nil, fmt.Errorf("filter %s: invalid action %s", name, rule.Action)
+		}
+		topic, err := newTopicPattern(rule.Topic)
+		if err != nil {
+			return nil, fmt.Errorf("filter %s: %w", name, err)
+		}
+		matcher, err := newFilterMatcher(rule.Condition())
+		if err != nil {
+			return nil, fmt.Errorf("filter %s: %w", name, err)
+		}
+		filter.rules = append(filter.rules, messageFilterRule{
+			name:    name,
+			topic:   topic,
+			keep:    rule.Action == FilterActionKeep,
+			matcher: matcher,
+		})
+		filter.fields = appendConditionFields(filter.fields, rule.Condition())
+	}
+	return filter, nil
+}
+
+// appendConditionFields appends the flattened field paths the condition reads.
+func appendConditionFields(fields []string, condition FilterCondition) []string {
+	if condition.Field != "" {
+		fields = append(fields, condition.Field)
+	}
+	for _, subCondition := range condition.All {
+		fields = appendConditionFields(fields, subCondition)
+	}
+	for _, subCondition := range condition.Any {
+		fields = appendConditionFields(fields, subCondition)
+	}
+	return fields
+}
+
+// Fields returns the flattened field paths the rules read.
+func (f *MessageFilter) Fields() []string {
+	return f.fields
+}
+
+// Filter returns the name of the rule that drops the message, empty when the message is kept.
+func (f *MessageFilter) Filter(message *kafka.Message, fields map[string]interface{}) string {
+	topic := topicName(message.TopicPartition)
+	for _, rule := range f.rules {
+		if !rule.topic.Match(topic) {
+			continue
+		}
+		if rule.matcher(fields) != rule.keep {
+			return rule.name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,118 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+// Test_NewMessageFilter ensures that invalid rules are rejected.
+func Test_NewMessageFilter(t *testing.T) {
+	var tests = []FilterRule{
+		{Action: "ignore", Field: "a", Operator: FilterOperatorExists},
+		{Action: FilterActionDrop, Topic: "(", Field: "a", Operator: FilterOperatorExists},
+		{Action: FilterActionDrop},
+		{Action: FilterActionDrop, Field: "a", Operator: "contains"},
+		{Action: FilterActionDrop, Operator: FilterOperatorExists},
+		{Action: FilterActionDrop, Field: "a", Operator: FilterOperatorRegex, Value: "("},
+		{Action: FilterActionDrop, Field: "a", Operator: FilterOperatorGreaterThan, Value: "many"},
+		{Action: FilterActionDrop, Field: "a", Operator: FilterOperatorLevelBelow, Value: "loud"},
+		{Action: FilterActionDrop, Field: "a", Operator: FilterOperatorExists, Any: []FilterCondition{
+			{Field: "b", Operator: FilterOperatorExists},
+		}},
+		{Action: FilterActionDrop, All: []FilterCondition{{Field: "b", Operator: "contains"}}},
+	}
+	for index, rule := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			_, err := NewMessageFilter([]FilterRule{rule})
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := NewMessageFilter([]FilterRule{
+		{Name: "a", Action: FilterActionDrop, Field: "a", Operator: FilterOperatorExists},
+		{Name: "a", Action: FilterActionDrop, Field: "a", Operator: FilterOperatorExists},
+	})
+	assert.Error(t, err)
+}
+
+// Test_MessageFilter_Filter ensures that the operators, combinations and topic scopes of the rules are applied.
+func Test_MessageFilter_Filter(t *testing.T) {
+	filter, err := NewMessageFilter([]FilterRule{
+		{Name: "debug", Action: FilterActionDrop, Field: "level", Operator: FilterOperatorLevelBelow, Value: "info"},
+		{Name: "health", Action: FilterActionDrop, All: []FilterCondition{
+			{Field: "http.path", Operator: FilterOperatorRegex, Value: "^/health"},
+			{Field: "http.status", Operator: FilterOperatorLessThan, Value: "400"},
+		}},
+		{Name: "audit", Topic: "^audit", Action: FilterActionKeep, Any: []FilterCondition{
+			{Field: "user", Operator: FilterOperatorExists},
+			{Field: "system", Operator: FilterOperatorEquals, Value: "true"},
+		}},
+		{Action: FilterActionDrop, Field: "sampled", Operator: FilterOperatorEquals, Value: "false", Not: true},
+	})
+	assert.Nil(t, err)
+
+	var tests = []struct {
+		topic    string
+		fields   map[string]interface{}
+		expected string
+	}{
+		{"app", map[string]interface{}{"level": "DEBUG", "sampled": false}, "debug"},
+		{"app", map[string]interface{}{"level": "warn", "sampled": false}, ""},
+		{"app", map[string]interface{}{"level": "unknown", "sampled": false}, ""},
+		{"app", map[string]interface{}{"http.path": "/healthz", "http.status": float64(200), "sampled": false}, "health"},
+		{"app", map[string]interface{}{"http.path": "/healthz", "http.status": float64(503), "sampled": false}, ""},
+		{"app", map[string]interface{}{"http.path": "/api", "http.status": float64(200), "sampled": false}, ""},
+		{"app", map[string]interface{}{"http.path": "/healthz", "http.status": "n/a", "sampled": false}, ""},
+		{"audit", map[string]interface{}{"user": "alice", "sampled": false}, ""},
+		{"audit", map[string]interface{}{"system": true, "sampled": false}, ""},
+		{"audit", map[string]interface{}{"user": nil, "sampled": false}, "audit"},
+		{"app", map[string]interface{}{"sampled": true}, "filter_3"},
+		{"app", map[string]interface{}{}, "filter_3"},
+	}
+	for index, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			message := testMessage(tt.topic, 0, 0, "")
+			assert.Equal(t, tt.expected, filter.Filter(message, tt.fields))
+		})
+	}
+}
+
+// Test_Dispatcher_Filtered ensures that filtered messages are counted, not pushed and done.
+func Test_Dispatcher_Filtered(t *testing.T) {
+	sink := &concurrentTestSink{}
+	pusher := NewShardedPusher(1, sink, 1000, math.MaxInt32)
+	committer := &testOffsetCommitter{}
+	tracker := NewOffsetTracker(committer)
+	pusher.SetOffsetTracker(tracker)
+	processor := newTestMessageProcessor(t)
+	filter, err := NewMessageFilter([]FilterRule{
+		{Name: "test_debug", Action: FilterActionDrop, Field: "level", Operator: FilterOperatorEquals, Value: "debug"},
+	})
+	assert.Nil(t, err)
+	processor.SetMessageFilter(filter)
+	dispatcher := NewDispatcher(1, processor, pusher)
+	dispatcher.SetOffsetTracker(tracker)
+	go pusher.RunForever()
+	dispatcher.Start()
+
+	dropped := testutil.ToFloat64(messagesFiltered.WithLabelValues("test_debug"))
+	for offset := int64(0); offset < 4; offset++ {
+		message := testMessage("topic", 0, offset, `{"level": "debug"}`)
+		if offset == 2 {
+			message = testMessage("topic", 0, offset, `{"level": "error"}`)
+		}
+		tracker.Track(message.TopicPartition)
+		assert.Nil(t, dispatcher.Dispatch(context.Background(), message))
+	}
+	dispatcher.Shutdown()
+	pusher.Flush()
+	pusher.Shutdown()
+
+	assert.Equal(t, dropped+3, testutil.ToFloat64(messagesFiltered.WithLabelValues("test_debug")))
+	assert.Len(t, sink.streams, 1)
+	assert.Equal(t, map[string]int64{"topic[0]": 4}, committedOffsets(committer))
+}
@@ -0,0 +1,125 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/getsentry/sentry-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"speedy/pkg/logproto"
+	"time"
+)
+
+// LokiGrpcClient is an ISpeedySink that sends data straight to Loki distributors or ingesters over gRPC.
+type LokiGrpcClient struct {
+	connection *grpc.ClientConn
+	client     logproto.PusherClient
+	timeout    time.Duration
+}
+
+// NewLokiGrpcClient constructs a new instance of LokiGrpcClient, the address is the host:port of the Loki gRPC server.
+// The connection is established in the background.
+func NewLokiGrpcClient(address string, options LokiClientOptions) (*LokiGrpcClient, error) {
+	dialOptions := []grpc.DialOption{grpc.WithInsecure()}
+	if options.GrpcTLS {
+		tlsConfig := options.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		dialOptions[0] = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+	authenticator, err := newLokiAuthenticator(options)
+	if err != nil {
+		return nil, err
+	}
+	if authenticator != nil {
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(authenticator))
+	}
+	if options.KeepaliveTime > 0 {
+		dialOptions = append(dialOptions, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                options.KeepaliveTime,
+			Timeout:             options.KeepaliveTimeout,
+			PermitWithoutStream: true,
+		}))
+	}
+	connection, err := grpc.Dial(address, dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return NewLokiGrpcClientFromConnection(connection, options.Timeout), nil
+}
+
+// NewLokiGrpcClientFromConnection constructs a new instance of LokiGrpcClient that uses the given connection.
+func NewLokiGrpcClientFromConnection(connection *grpc.ClientConn, timeout time.Duration) *LokiGrpcClient {
+	return &LokiGrpcClient{
+		connection: connection,
+		client:     logproto.NewPusherClient(connection),
+		timeout:    timeout,
+	}
+}
+
+// SendData sends LokiStreams to Loki with a gRPC push call.
+func (l *LokiGrpcClient) SendData(ctx context.Context, data *LokiStreams) error {
+	pushRequest := newPushRequest(data)
+
+	callCtx := ctx
+	if l.timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, l.timeout)
+		defer cancel()
+	}
+	if data.Tenant != "" {
+		callCtx = metadata.AppendToOutgoingContext(callCtx, TenantHeader, data.Tenant)
+	}
+	_, err := l.client.Push(callCtx, &pushRequest)
+	if err != nil {
+		// The caller gave up, report it as such instead of as a failed push.
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		SugaredLogger.Errorf("failed to push to loki over grpc: %s", err)
+		sentry.CaptureException(err)
+		return grpcPushError(err)
+	}
+	return nil
+}
+
+// Shutdown closes the gRPC connection.
+func (l *LokiGrpcClient) Shutdown() {
+	err := l.connection.Close()
+	if err != nil {
+		SugaredLogger.Error(err)
+	}
+}
+
+// grpcPushError converts a gRPC push error into a LokiPushError when the status tells whether the push can be retried.
+// Loki reports HTTP status codes as gRPC codes, the standard gRPC codes are mapped to their HTTP equivalent.
+// Other errors, e.g. unavailable servers or timeouts, are returned as is and retried.
+func grpcPushError(err error) error {
+	grpcStatus, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	statusCode := int(grpcStatus.Code())
+	switch {
+	case statusCode >= 100 && statusCode < 600:
+	case grpcStatus.Code() == codes.ResourceExhausted:
+		statusCode = http.StatusTooManyRequests
+	case grpcStatus.Code() == codes.InvalidArgument, grpcStatus.Code() == codes.FailedPrecondition, grpcStatus.Code() == codes.OutOfRange:
+		statusCode = http.StatusBadRequest
+	case grpcStatus.Code() == codes.Unauthenticated:
+		statusCode = http.StatusUnauthorized
+	case grpcStatus.Code() == codes.PermissionDenied:
+		statusCode = http.StatusForbidden
+	case grpcStatus.Code() == codes.Internal:
+		statusCode = http.StatusInternalServerError
+	default:
+		return err
+	}
+	return &LokiPushError{StatusCode: statusCode, Body: grpcStatus.Message()}
+}
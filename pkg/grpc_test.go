@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/testdata"
+	"io/ioutil"
+	"net"
+	"speedy/pkg/logproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPusherServer is a logproto.PusherServer that records the push requests.
+type testPusherServer struct {
+	mutex    sync.Mutex
+	requests []*logproto.PushRequest
+	tenants  []string
+	// authorizations holds the authorization metadata of the requests.
+	authorizations []string
+	err            error
+	delay          time.Duration
+}
+
+func (s *testPusherServer) Push(ctx context.Context, req *logproto.PushRequest) (*logproto.PushResponse, error) {
+	if s.delay > 0 {
+		select {
+		case <-time.After(s.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests = append(s.requests, req)
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.tenants = append(s.tenants, strings.Join(md.Get(TenantHeader), ","))
+	s.authorizations = append(s.authorizations, strings.Join(md.Get("authorization"), ","))
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &logproto.PushResponse{}, nil
+}
+
+// startTestPusherServer starts an in-process gRPC server and returns its address.
+func startTestPusherServer(t *testing.T, pusher *testPusherServer, options ...grpc.ServerOption) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := grpc.NewServer(options...)
+	logproto.RegisterPusherServer(server, pusher)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+// testGrpcStreams returns LokiStreams with two entries.
+func testGrpcStreams() *LokiStreams {
+	streams := NewLokiStreams(10, 1000)
+	streams.AddData(LokiStream{
+		Labels: map[string]string{"key": "test"},
+		Values: [][]string{{"1000000000", "hello"}, {"2000000000", "world"}},
+	})
+	return streams
+}
+
+// Test_LokiGrpcClient_SendData ensures that LokiGrpcClient pushes the streams to the gRPC server.
+func Test_LokiGrpcClient_SendData(t *testing.T) {
+	pusher := &testPusherServer{}
+	address := startTestPusherServer(t, pusher)
+	client, err := NewLokiGrpcClient(address, LokiClientOptions{
+		Timeout:          time.Second,
+		KeepaliveTime:    10 * time.Second,
+		KeepaliveTimeout: time.Second,
+	})
+	assert.Nil(t, err)
+	defer client.Shutdown()
+
+	err = client.SendData(context.Background(), testGrpcStreams())
+	assert.Nil(t, err)
+	assert.Len(t, pusher.requests, 1)
+	assert.Equal(t, []logproto.Stream{{
+		Labels: `{key="test"}`,
+		Entries: []logproto.Entry{
+			{Timestamp: time.Unix(1, 0).UTC(), Line: "hello"},
+			{Timestamp: time.Unix(2, 0).UTC(), Line: "world"},
+		},
+	}}, pusher.requests[0].Streams)
+
+	streams := testGrpcStreams()
+	streams.Tenant = "team-a"
+	err = client.SendData(context.Background(), streams)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"", "team-a"}, pusher.tenants)
+}
+
+// Test_LokiGrpcClient_SendData_TLS ensures that LokiGrpcClient pushes over TLS.
+func Test_LokiGrpcClient_SendData_TLS(t *testing.T) {
+	serverCredentials, err := credentials.NewServerTLSFromFile(testdata.Path("server1.pem"), testdata.Path("server1.key"))
+	assert.Nil(t, err)
+	pusher := &testPusherServer{}
+	address := startTestPusherServer(t, pusher, grpc.Creds(serverCredentials))
+
+	ca, err := ioutil.ReadFile(testdata.Path("ca.pem"))
+	assert.Nil(t, err)
+	rootCAs := x509.NewCertPool()
+	assert.True(t, rootCAs.AppendCertsFromPEM(ca))
+	client, err := NewLokiGrpcClient(address, LokiClientOptions{
+		Timeout:     time.Second,
+		GrpcTLS:     true,
+		TLSConfig:   &tls.Config{RootCAs: rootCAs, ServerName: "x.test.google.fr"},
+		BearerToken: "secret",
+	})
+	assert.Nil(t, err)
+	defer client.Shutdown()
+
+	err = client.SendData(context.Background(), testGrpcStreams())
+	assert.Nil(t, err)
+	assert.Len(t, pusher.requests, 1)
+	assert.Equal(t, []string{"Bearer secret"}, pusher.authorizations)
+}
+
+// Test_LokiGrpcClient_SendData_Error ensures that gRPC errors are reported as retryable or rejected.
+func Test_LokiGrpcClient_SendData_Error(t *testing.T) {
+	var tests = []struct {
+		err       error
+		delay     time.Duration
+		retryable bool
+		rejected  bool
+	}{
+		{status.Error(codes.Code(429), "rate limited"), 0, true, false},
+		{status.Error(codes.Code(400), "entry too far behind"), 0, false, true},
+		{status.Error(codes.ResourceExhausted, "rate limited"), 0, true, false},
+		{status.Error(codes.InvalidArgument, "invalid labels"), 0, false, true},
+		{status.Error(codes.Unauthenticated, "no org id"), 0, true, false},
+		{status.Error(codes.Unavailable, "unavailable"), 0, true, false},
+		{nil, time.Second, true, false},
+	}
+	for _, tt := range tests {
+		pusher := &testPusherServer{err: tt.err, delay: tt.delay}
+		address := startTestPusherServer(t, pusher)
+		client, err := NewLokiGrpcClient(address, LokiClientOptions{Timeout: 100 * time.Millisecond})
+		assert.Nil(t, err)
+
+		err = client.SendData(context.Background(), testGrpcStreams())
+		assert.Error(t, err)
+		assert.Equal(t, tt.retryable, IsRetryableError(err), err.Error())
+		assert.Equal(t, tt.rejected, IsRejectedError(err), err.Error())
+		client.Shutdown()
+	}
+
+	// Canceled pushes are not retried.
+	pusher := &testPusherServer{delay: time.Second}
+	address := startTestPusherServer(t, pusher)
+	client, err := NewLokiGrpcClient(address, LokiClientOptions{})
+	assert.Nil(t, err)
+	defer client.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = client.SendData(ctx, testGrpcStreams())
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
@@ -0,0 +1,307 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/goccy/go-json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// HealthStatusOk is the status of a healthy component.
+	HealthStatusOk = "ok"
+	// HealthStatusFailing is the status of an unhealthy component.
+	HealthStatusFailing = "failing"
+)
+
+// ComponentHealth is the health of a component of the pipeline.
+type ComponentHealth struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// HealthReport is the health of the pipeline, it's failing when any of its components is failing.
+type HealthReport struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentHealth `json:"components"`
+}
+
+// newHealthReport creates a HealthReport from the health of the components.
+func newHealthReport(components map[string]ComponentHealth) HealthReport {
+	report := HealthReport{Status: HealthStatusOk, Components: components}
+	for _, component := range components {
+		if component.Status != HealthStatusOk {
+			report.Status = HealthStatusFailing
+		}
+	}
+	return report
+}
+
+// ILastFlushSource provides the time of the last flush of the pushers, ShardedPusher implements it.
+type ILastFlushSource interface {
+	LastFlush() time.Time
+}
+
+// IKafkaMetadataSource provides the cluster metadata, kafka.Consumer implements it.
+type IKafkaMetadataSource interface {
+	GetMetadata(topic *string, allTopics bool, timeoutMs int) (*kafka.Metadata, error)
+}
+
+// HealthOptions are the thresholds of the HealthChecker.
+type HealthOptions struct {
+	// PollMaxAge is the maximum time since the poll loop last polled Kafka.
+	PollMaxAge time.Duration
+	// PushMaxAge is the maximum time since the last successful push when pushes are failing.
+	PushMaxAge time.Duration
+}
+
+// HealthChecker tracks the state of the pipeline for the liveness and readiness checks.
+//
+// Liveness fails when the poll loop or the pushers are stuck, a restart is needed.
+// Readiness fails when Speedy can't consume from Kafka or push to Loki.
+type HealthChecker struct {
+	// Now returns the current time.
+	Now             func() time.Time
+	options         HealthOptions
+	mutex           sync.Mutex
+	startTime       time.Time
+	lastPoll        time.Time
+	assigned        bool
+	partitions      int
+	brokersDown     string
+	lastPushSuccess time.Time
+	lastPushFailure time.Time
+	lastPushAttempt time.Time
+	lastPushError   string
+	lastFlushSource ILastFlushSource
+	flushMaxAge     time.Duration
+	metadataSource  IKafkaMetadataSource
+	metadataTimeout time.Duration
+}
+
+// NewHealthChecker creates a new HealthChecker.
+func NewHealthChecker(options HealthOptions) *HealthChecker {
+	now := time.Now()
+	return &HealthChecker{
+		Now:             time.Now,
+		options:         options,
+		startTime:       now,
+		lastPoll:        now,
+		metadataTimeout: 5 * time.Second,
+	}
+}
+
+// SetLastFlushSource sets the pushers checked by the liveness check and the maximum time since their last flush.
+func (h *HealthChecker) SetLastFlushSource(source ILastFlushSource, maxAge time.Duration) {
+	h.lastFlushSource = source
+	h.flushMaxAge = maxAge
+}
+
+// SetMetadataSource sets the Kafka client used to check that the brokers are back once they were reported down.
+func (h *HealthChecker) SetMetadataSource(source IKafkaMetadataSource) {
+	h.metadataSource = source
+}
+
+// RecordPoll records that the poll loop polled Kafka.
+func (h *HealthChecker) RecordPoll() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastPoll = h.Now()
+}
+
+// RecordAssignment records the partitions assigned to the consumer, the brokers are reachable again.
+func (h *HealthChecker) RecordAssignment(partitions []kafka.TopicPartition) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.assigned = true
+	h.partitions = len(partitions)
+	h.brokersDown = ""
+}
+
+// RecordRevocation records that the partitions of the consumer were revoked.
+func (h *HealthChecker) RecordRevocation() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.assigned = false
+	h.partitions = 0
+}
+
+// RecordMessage records that a message was consumed, the brokers are reachable.
+func (h *HealthChecker) RecordMessage() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.brokersDown = ""
+}
+
+// RecordKafkaError records the errors of the Kafka client, only the loss of all the brokers is relevant.
+func (h *HealthChecker) RecordKafkaError(err kafka.Error) {
+	if err.Code() != kafka.ErrAllBrokersDown {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.brokersDown = err.Error()
+}
+
+// RecordPush records the result of a push to Loki. Rejected pushes count as successful, Loki is reachable.
+func (h *HealthChecker) RecordPush(err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastPushAttempt = h.Now()
+	if err == nil || IsRejectedError(err) {
+		h.lastPushSuccess = h.Now()
+		return
+	}
+	h.lastPushFailure = h.Now()
+	h.lastPushError = err.Error()
+}
+
+// Liveness checks the poll loop and the pushers.
+func (h *HealthChecker) Liveness() HealthReport {
+	var lastFlush time.Time
+	if h.lastFlushSource != nil {
+		lastFlush = h.lastFlushSource.LastFlush()
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	components := map[string]ComponentHealth{
+		"poll_loop": h.checkProgress("last poll", h.lastPoll, h.options.PollMaxAge),
+	}
+	if h.lastFlushSource != nil {
+		components["pusher"] = h.checkProgress("last flush", lastFlush, h.flushMaxAge)
+	}
+	return newHealthReport(components)
+}
+
+// checkProgress checks the last progress of a component. A component that waits for pushes being retried,
+// directly or through backpressure, isn't stuck, the pushes to Loki are checked by Readiness.
+func (h *HealthChecker) checkProgress(event string, last time.Time, maxAge time.Duration) ComponentHealth {
+	health := checkAge(event, h.Now().Sub(last), maxAge)
+	if health.Status != HealthStatusOk && h.lastPushAttempt.After(last) {
+		return checkAge("last push attempt", h.Now().Sub(h.lastPushAttempt), maxAge)
+	}
+	return health
+}
+
+// Readiness checks the Kafka assignment, the Kafka brokers and the pushes to Loki.
+func (h *HealthChecker) Readiness() HealthReport {
+	h.probeBrokers()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	components := map[string]ComponentHealth{
+		"kafka_assignment": {Status: HealthStatusOk, Message: fmt.Sprintf("%d partitions assigned", h.partitions)},
+		"kafka_brokers":    {Status: HealthStatusOk},
+		"loki_push":        h.pushHealth(),
+	}
+	if !h.assigned {
+		components["kafka_assignment"] = ComponentHealth{Status: HealthStatusFailing, Message: "no partitions assigned"}
+	}
+	if h.brokersDown != "" {
+		components["kafka_brokers"] = ComponentHealth{Status: HealthStatusFailing, Message: h.brokersDown}
+	}
+	return newHealthReport(components)
+}
+
+// pushHealth checks the pushes to Loki, they are failing when the last push failed and no push succeeded recently.
+func (h *HealthChecker) pushHealth() ComponentHealth {
+	now := h.Now()
+	lastSuccess := h.lastPushSuccess
+	if lastSuccess.IsZero() {
+		lastSuccess = h.startTime
+	}
+	if h.lastPushFailure.After(h.lastPushSuccess) && now.Sub(lastSuccess) > h.options.PushMaxAge {
+		return ComponentHealth{Status: HealthStatusFailing, Message: h.lastPushError}
+	}
+	if h.lastPushSuccess.IsZero() {
+		return ComponentHealth{Status: HealthStatusOk, Message: "no push yet"}
+	}
+	return ComponentHealth{Status: HealthStatusOk, Message: fmt.Sprintf("last push %s ago", now.Sub(h.lastPushSuccess).Round(time.Second))}
+}
+
+// probeBrokers fetches the cluster metadata while the brokers are reported down, to notice when they are back.
+func (h *HealthChecker) probeBrokers() {
+	h.mutex.Lock()
+	brokersDown := h.brokersDown != ""
+	h.mutex.Unlock()
+	if !brokersDown || h.metadataSource == nil {
+		return
+	}
+	_, err := h.metadataSource.GetMetadata(nil, false, int(h.metadataTimeout.Milliseconds()))
+	if err != nil {
+		return
+	}
+	h.mutex.Lock()
+	h.brokersDown = ""
+	h.mutex.Unlock()
+}
+
+// checkAge checks that the age of the last event of a component doesn't exceed the maximum age, 0 disables the check.
+func checkAge(event string, age time.Duration, maxAge time.Duration) ComponentHealth {
+	message := fmt.Sprintf("%s %s ago", event, age.Round(time.Second))
+	if maxAge > 0 && age > maxAge {
+		return ComponentHealth{Status: HealthStatusFailing, Message: message}
+	}
+	return ComponentHealth{Status: HealthStatusOk, Message: message}
+}
+
+// LivenessHandler serves the liveness report as JSON, with status 503 when it's failing.
+func (h *HealthChecker) LivenessHandler() http.Handler {
+	return healthHandler(h.Liveness)
+}
+
+// ReadinessHandler serves the readiness report as JSON, with status 503 when it's failing.
+func (h *HealthChecker) ReadinessHandler() http.Handler {
+	return healthHandler(h.Readiness)
+}
+
+// healthHandler serves the reports of the given check.
+func healthHandler(check func() HealthReport) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := check()
+		body, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != HealthStatusOk {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_, _ = w.Write(append(body, '\n'))
+	})
+}
+
+// HealthCheckedSink is an ISpeedySink that records the results of the pushes of the wrapped sink in a HealthChecker.
+type HealthCheckedSink struct {
+	sink    ISpeedySink
+	checker *HealthChecker
+}
+
+// NewHealthCheckedSink creates a new HealthCheckedSink.
+func NewHealthCheckedSink(sink ISpeedySink, checker *HealthChecker) *HealthCheckedSink {
+	if sink == nil {
+		panic("Speedy sink is nil")
+	}
+	return &HealthCheckedSink{sink: sink, checker: checker}
+}
+
+// SendData sends the data with the wrapped sink and records the result.
+func (s *HealthCheckedSink) SendData(ctx context.Context, data *LokiStreams) error {
+	err := s.sink.SendData(ctx, data)
+	s.checker.RecordPush(err)
+	return err
+}
+
+// Shutdown shuts down the wrapped sink.
+func (s *HealthCheckedSink) Shutdown() {
+	s.sink.Shutdown()
+}
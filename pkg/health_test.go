@@ -0,0 +1,199 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testClock is a manually advanced clock.
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+// testLastFlushSource reports a fixed last flush.
+type testLastFlushSource struct {
+	lastFlush time.Time
+}
+
+func (s *testLastFlushSource) LastFlush() time.Time {
+	return s.lastFlush
+}
+
+// testMetadataSource fails to fetch the metadata until err is cleared.
+type testMetadataSource struct {
+	err   error
+	calls int
+}
+
+func (s *testMetadataSource) GetMetadata(_ *string, _ bool, _ int) (*kafka.Metadata, error) {
+	s.calls++
+	return &kafka.Metadata{}, s.err
+}
+
+// newTestHealthChecker creates a HealthChecker that uses a testClock.
+func newTestHealthChecker() (*HealthChecker, *testClock) {
+	clock := &testClock{now: time.Unix(1_000_000, 0)}
+	checker := NewHealthChecker(HealthOptions{PollMaxAge: time.Minute, PushMaxAge: 5 * time.Minute})
+	checker.Now = clock.Now
+	checker.startTime, checker.lastPoll = clock.now, clock.now
+	return checker, clock
+}
+
+// Test_HealthChecker_Liveness ensures that a stuck poll loop or pusher fails the liveness check,
+// unless they are waiting for pushes being retried.
+func Test_HealthChecker_Liveness(t *testing.T) {
+	checker, clock := newTestHealthChecker()
+	flushSource := &testLastFlushSource{lastFlush: clock.now}
+	checker.SetLastFlushSource(flushSource, 3*time.Minute)
+	assert.Equal(t, HealthStatusOk, checker.Liveness().Status)
+
+	clock.now = clock.now.Add(2 * time.Minute)
+	report := checker.Liveness()
+	assert.Equal(t, HealthStatusFailing, report.Status)
+	assert.Equal(t, ComponentHealth{Status: HealthStatusFailing, Message: "last poll 2m0s ago"}, report.Components["poll_loop"])
+	assert.Equal(t, HealthStatusOk, report.Components["pusher"].Status)
+
+	checker.RecordPoll()
+	assert.Equal(t, HealthStatusOk, checker.Liveness().Status)
+
+	clock.now = clock.now.Add(2 * time.Minute)
+	checker.RecordPoll()
+	report = checker.Liveness()
+	assert.Equal(t, ComponentHealth{Status: HealthStatusFailing, Message: "last flush 4m0s ago"}, report.Components["pusher"])
+
+	// The pusher is retrying a push.
+	checker.RecordPush(errors.New("connection refused"))
+	report = checker.Liveness()
+	assert.Equal(t, ComponentHealth{Status: HealthStatusOk, Message: "last push attempt 0s ago"}, report.Components["pusher"])
+
+	clock.now = clock.now.Add(4 * time.Minute)
+	assert.Equal(t, HealthStatusFailing, checker.Liveness().Components["poll_loop"].Status)
+	assert.Equal(t, HealthStatusFailing, checker.Liveness().Components["pusher"].Status)
+}
+
+// Test_HealthChecker_Readiness ensures that the Kafka assignment, the Kafka brokers and the pushes are checked.
+func Test_HealthChecker_Readiness(t *testing.T) {
+	checker, clock := newTestHealthChecker()
+	metadataSource := &testMetadataSource{err: errors.New("timed out")}
+	checker.SetMetadataSource(metadataSource)
+
+	report := checker.Readiness()
+	assert.Equal(t, HealthStatusFailing, report.Status)
+	assert.Equal(t, ComponentHealth{Status: HealthStatusFailing, Message: "no partitions assigned"}, report.Components["kafka_assignment"])
+	assert.Equal(t, ComponentHealth{Status: HealthStatusOk, Message: "no push yet"}, report.Components["loki_push"])
+
+	topic := "topic"
+	checker.RecordAssignment([]kafka.TopicPartition{{Topic: &topic, Partition: 0}, {Topic: &topic, Partition: 1}})
+	report = checker.Readiness()
+	assert.Equal(t, HealthStatusOk, report.Status)
+	assert.Equal(t, "2 partitions assigned", report.Components["kafka_assignment"].Message)
+	assert.Equal(t, 0, metadataSource.calls)
+
+	// Brokers down until the metadata can be fetched again.
+	checker.RecordKafkaError(kafka.NewError(kafka.ErrTimedOut, "timed out", false))
+	assert.Equal(t, HealthStatusOk, checker.Readiness().Status)
+	checker.RecordKafkaError(kafka.NewError(kafka.ErrAllBrokersDown, "all brokers down", false))
+	assert.Equal(t, ComponentHealth{Status: HealthStatusFailing, Message: "all brokers down"}, checker.Readiness().Components["kafka_brokers"])
+	metadataSource.err = nil
+	assert.Equal(t, HealthStatusOk, checker.Readiness().Status)
+	assert.Equal(t, 2, metadataSource.calls)
+
+	// Failing pushes are tolerated for PushMaxAge after the last successful push, rejected pushes are successful.
+	checker.RecordPush(nil)
+	clock.now = clock.now.Add(4 * time.Minute)
+	checker.RecordPush(errors.New("connection refused"))
+	assert.Equal(t, ComponentHealth{Status: HealthStatusOk, Message: "last push 4m0s ago"}, checker.Readiness().Components["loki_push"])
+	clock.now = clock.now.Add(2 * time.Minute)
+	checker.RecordPush(context.Canceled)
+	assert.Equal(t, ComponentHealth{Status: HealthStatusFailing, Message: "connection refused"}, checker.Readiness().Components["loki_push"])
+	checker.RecordPush(&LokiPushError{StatusCode: 400})
+	assert.Equal(t, HealthStatusOk, checker.Readiness().Components["loki_push"].Status)
+
+	checker.RecordRevocation()
+	assert.Equal(t, HealthStatusFailing, checker.Readiness().Status)
+}
+
+// Test_HealthChecker_Handlers ensures that the reports are served as JSON, with status 503 when failing.
+func Test_HealthChecker_Handlers(t *testing.T) {
+	checker, clock := newTestHealthChecker()
+
+	recorder := httptest.NewRecorder()
+	checker.LivenessHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	var report HealthReport
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Equal(t, HealthReport{
+		Status:     HealthStatusOk,
+		Components: map[string]ComponentHealth{"poll_loop": {Status: HealthStatusOk, Message: "last poll 0s ago"}},
+	}, report)
+
+	clock.now = clock.now.Add(time.Hour)
+	recorder = httptest.NewRecorder()
+	checker.LivenessHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	checker.ReadinessHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"kafka_assignment"`)
+}
+
+// Test_HealthCheckedSink_SendData ensures that the results of the pushes are recorded.
+func Test_HealthCheckedSink_SendData(t *testing.T) {
+	checker, _ := newTestHealthChecker()
+	sink := &SpeedyTestSink{sendDataError: errors.New("connection refused")}
+	healthCheckedSink := NewHealthCheckedSink(sink, checker)
+
+	assert.Error(t, healthCheckedSink.SendData(context.Background(), NewLokiStreams(1, 1)))
+	assert.Equal(t, "connection refused", checker.lastPushError)
+	assert.True(t, checker.lastPushSuccess.IsZero())
+
+	sink.sendDataError = nil
+	assert.Nil(t, healthCheckedSink.SendData(context.Background(), NewLokiStreams(1, 1)))
+	assert.False(t, checker.lastPushSuccess.IsZero())
+}
+
+// Test_HealthChecker_Readiness_FailingPushes ensures that the readiness fails once the pushes of a pusher whose sink
+// is wrapped in a HealthCheckedSink keep failing.
+func Test_HealthChecker_Readiness_FailingPushes(t *testing.T) {
+	checker, clock := newTestHealthChecker()
+	topic := "topic"
+	checker.RecordAssignment([]kafka.TopicPartition{{Topic: &topic, Partition: 0}})
+	sink := &SpeedyTestSink{sendDataError: errors.New("connection refused")}
+	lokiPusher := NewPusher(NewHealthCheckedSink(sink, checker), 10, 100)
+	go lokiPusher.RunForever()
+
+	clock.now = clock.now.Add(6 * time.Minute)
+	lokiPusher.DataChannel <- LokiStream{Labels: map[string]string{"label1": "value"}, Values: [][]string{{"0", "log-line-0"}}}
+	lokiPusher.Flush()
+	lokiPusher.Shutdown()
+	assert.Equal(t, 1, sink.sendDataCounter)
+
+	recorder := httptest.NewRecorder()
+	checker.ReadinessHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	var report HealthReport
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Equal(t, ComponentHealth{Status: HealthStatusFailing, Message: "connection refused"}, report.Components["loki_push"])
+}
+
+// Test_ShardedPusher_LastFlush ensures that the oldest last flush of the shards is reported.
+func Test_ShardedPusher_LastFlush(t *testing.T) {
+	pusher := NewShardedPusher(3, &SpeedyTestSink{}, 10, 100)
+	oldest := time.Unix(100, 0)
+	pusher.Pushers()[1].lastFlush = oldest
+	assert.Equal(t, oldest, pusher.LastFlush())
+	assert.Equal(t, time.Minute, pusher.FlushInterval())
+}
@@ -0,0 +1,608 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/goccy/go-json"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// ErrAmbiguousFlattenedKeys is returned by JsonFlattener.Flatten for objects with duplicate keys, or keys that are
+// flattened to the same path, whose FlattenMap output depends on the map iteration order.
+var ErrAmbiguousFlattenedKeys = errors.New("ambiguous flattened keys")
+
+// maxJsonFlattenerDepth is the maximum nesting depth of the flattened objects.
+const maxJsonFlattenerDepth = 10000
+
+// jsonFlattenedPair is an encoded flattened key and its encoded value, as offsets in the buffers of the
+// JsonFlattener.
+type jsonFlattenedPair struct {
+	keyStart, keyEnd, valueStart, valueEnd int
+}
+
+// jsonFlattenedField is the decoded value of one of the fields of the JsonFlattener, as offsets in its
+// fieldValues buffer.
+type jsonFlattenedField struct {
+	// path is the index of the field in the fields of the JsonFlattener.
+	path                 int
+	kind                 byte
+	valueStart, valueEnd int
+}
+
+// jsonLinesChunkSize is the size of the chunks the lines of JsonFlattener.FlattenString are allocated from.
+const jsonLinesChunkSize = 64 * 1024
+
+// jsonFlattenedPairs sorts the pairs by encoded key, like the JSON encoder sorts the keys of the maps.
+type jsonFlattenedPairs struct {
+	keys  []byte
+	pairs []jsonFlattenedPair
+}
+
+func (p *jsonFlattenedPairs) Len() int {
+	return len(p.pairs)
+}
+
+func (p *jsonFlattenedPairs) Less(i, j int) bool {
+	return bytes.Compare(p.key(i), p.key(j)) < 0
+}
+
+func (p *jsonFlattenedPairs) Swap(i, j int) {
+	p.pairs[i], p.pairs[j] = p.pairs[j], p.pairs[i]
+}
+
+// key returns the key of the pair at the given index.
+func (p *jsonFlattenedPairs) key(index int) []byte {
+	return p.keys[p.pairs[index].keyStart:p.pairs[index].keyEnd]
+}
+
+// JsonFlattener flattens JSON objects straight from their bytes, without decoding them into maps. Its output is the
+// same as marshalling the FlattenMap of the decoded object, and its buffers are reused between calls, so it's not
+// safe for concurrent use.
+type JsonFlattener struct {
+	data []byte
+	// position is the offset of the next byte of data.
+	position int
+	// path is the decoded flattened key of the current value.
+	path []byte
+	// scratch holds the decoded strings.
+	scratch []byte
+	values  []byte
+	sorted  jsonFlattenedPairs
+	// siblings are the hashes of the keys of the open objects, objects start at their offset in objects.
+	siblings []uint64
+	objects  []int
+	output   []byte
+	// fields are the flattened paths whose values are decoded, found are the ones of the last call.
+	fields      []string
+	found       []jsonFlattenedField
+	fieldValues []byte
+	// lines is the chunk the strings of FlattenString are allocated from, it's only ever appended to.
+	lines []byte
+}
+
+// NewJsonFlattener creates a new JsonFlattener.
+func NewJsonFlattener() *JsonFlattener {
+	return &JsonFlattener{}
+}
+
+// Flatten returns the flattened JSON of the given JSON object, which is only valid until the next call.
+// It returns ErrAmbiguousFlattenedKeys when the output of FlattenMap isn't deterministic.
+func (f *JsonFlattener) Flatten(data []byte) ([]byte, error) {
+	f.data = data
+	f.position = 0
+	f.path = f.path[:0]
+	f.values = f.values[:0]
+	f.sorted.keys = f.sorted.keys[:0]
+	f.sorted.pairs = f.sorted.pairs[:0]
+	f.siblings = f.siblings[:0]
+	f.objects = f.objects[:0]
+	f.found = f.found[:0]
+	f.fieldValues = f.fieldValues[:0]
+
+	f.skipSpace()
+	if f.position >= len(f.data) || f.data[f.position] != '{' {
+		return nil, f.syntaxError("expected an object")
+	}
+	if err := f.flattenValue(0, true); err != nil {
+		return nil, err
+	}
+	f.skipSpace()
+	if f.position != len(f.data) {
+		return nil, f.syntaxError("unexpected data after the object")
+	}
+
+	sort.Sort(&f.sorted)
+	f.output = append(f.output[:0], '{')
+	for index, pair := range f.sorted.pairs {
+		if index > 0 {
+			if bytes.Equal(f.sorted.key(index-1), f.sorted.key(index)) {
+				return nil, ErrAmbiguousFlattenedKeys
+			}
+			f.output = append(f.output, ',')
+		}
+		f.output = append(f.output, f.sorted.key(index)...)
+		f.output = append(f.output, ':')
+		f.output = append(f.output, f.values[pair.valueStart:pair.valueEnd]...)
+	}
+	f.output = append(f.output, '}')
+	return f.output, nil
+}
+
+// FlattenString is like Flatten, but the flattened JSON is returned as a string which stays valid. The strings are
+// allocated from larger chunks, so the lines don't need an allocation each.
+func (f *JsonFlattener) FlattenString(data []byte) (string, error) {
+	output, err := f.Flatten(data)
+	if err != nil {
+		return "", err
+	}
+	if len(output) > cap(f.lines)-len(f.lines) {
+		if len(output) > jsonLinesChunkSize/4 {
+			return string(output), nil
+		}
+		f.lines = make([]byte, 0, jsonLinesChunkSize)
+	}
+	start := len(f.lines)
+	f.lines = append(f.lines, output...)
+	return bytesToString(f.lines[start:]), nil
+}
+
+// SetFields sets the flattened paths whose values are decoded by the next calls, see Fields.
+func (f *JsonFlattener) SetFields(paths []string) {
+	f.fields = paths
+}
+
+// Fields adds the decoded values of the fields found by the last call to the given map, they're decoded like the
+// JsonDecoder decodes them.
+func (f *JsonFlattener) Fields(fields map[string]interface{}) {
+	for _, field := range f.found {
+		value := f.fieldValues[field.valueStart:field.valueEnd]
+		switch field.kind {
+		case '"':
+			fields[f.fields[field.path]] = string(value)
+		case 't':
+			fields[f.fields[field.path]] = true
+		case 'f':
+			fields[f.fields[field.path]] = false
+		case 'n':
+			fields[f.fields[field.path]] = nil
+		default:
+			// The number was already parsed while flattening.
+			number, _ := jsonNumber(bytesToString(value))
+			if _, exact := number.(json.Number); exact {
+				// The values are overwritten by the next call.
+				number = json.Number(string(value))
+			}
+			fields[f.fields[field.path]] = number
+		}
+	}
+}
+
+// syntaxError returns an error at the current position.
+func (f *JsonFlattener) syntaxError(message string) error {
+	return fmt.Errorf("invalid JSON at offset %d: %s", f.position, message)
+}
+
+// skipSpace skips the JSON whitespace.
+func (f *JsonFlattener) skipSpace() {
+	for f.position < len(f.data) {
+		switch f.data[f.position] {
+		case ' ', '\t', '\n', '\r':
+			f.position++
+		default:
+			return
+		}
+	}
+}
+
+// flattenValue flattens the value at the current position, whose key is the current path.
+func (f *JsonFlattener) flattenValue(depth int, root bool) error {
+	if depth > maxJsonFlattenerDepth {
+		return f.syntaxError("too deeply nested")
+	}
+	f.skipSpace()
+	if f.position >= len(f.data) {
+		return f.syntaxError("unexpected end of data")
+	}
+	switch f.data[f.position] {
+	case '{':
+		return f.flattenObject(depth, root)
+	case '[':
+		return f.flattenArray(depth)
+	case '"':
+		start := len(f.values)
+		if err := f.readString(); err != nil {
+			return err
+		}
+		f.values = appendJsonString(f.values, f.scratch)
+		f.addPair(start)
+		f.addField('"', f.scratch)
+		return nil
+	case 't':
+		return f.flattenLiteral("true")
+	case 'f':
+		return f.flattenLiteral("false")
+	case 'n':
+		return f.flattenLiteral("null")
+	}
+	return f.flattenNumber()
+}
+
+// flattenObject flattens the object at the current position, empty objects are dropped.
+func (f *JsonFlattener) flattenObject(depth int, root bool) error {
+	f.position++
+	f.skipSpace()
+	if f.position < len(f.data) && f.data[f.position] == '}' {
+		f.position++
+		return nil
+	}
+
+	pathLength := len(f.path)
+	f.objects = append(f.objects, len(f.siblings))
+	for {
+		f.skipSpace()
+		if f.position >= len(f.data) || f.data[f.position] != '"' {
+			return f.syntaxError("expected a key")
+		}
+		if err := f.readString(); err != nil {
+			return err
+		}
+		// Duplicate keys replace the previous value of the object, the last one wins.
+		hash := fnv64a(f.scratch)
+		for _, sibling := range f.siblings[f.objects[len(f.objects)-1]:] {
+			if sibling == hash {
+				return ErrAmbiguousFlattenedKeys
+			}
+		}
+		f.siblings = append(f.siblings, hash)
+
+		f.path = f.path[:pathLength]
+		if !root {
+			f.path = append(f.path, '.')
+		}
+		f.path = append(f.path, f.scratch...)
+
+		f.skipSpace()
+		if f.position >= len(f.data) || f.data[f.position] != ':' {
+			return f.syntaxError("expected a colon")
+		}
+		f.position++
+		if err := f.flattenValue(depth+1, false); err != nil {
+			return err
+		}
+
+		f.skipSpace()
+		if f.position >= len(f.data) {
+			return f.syntaxError("unexpected end of data")
+		}
+		if f.data[f.position] == '}' {
+			f.position++
+			break
+		}
+		if f.data[f.position] != ',' {
+			return f.syntaxError("expected a comma")
+		}
+		f.position++
+	}
+	f.path = f.path[:pathLength]
+	f.siblings = f.siblings[:f.objects[len(f.objects)-1]]
+	f.objects = f.objects[:len(f.objects)-1]
+	return nil
+}
+
+// flattenArray flattens the array at the current position, empty arrays are dropped.
+func (f *JsonFlattener) flattenArray(depth int) error {
+	f.position++
+	f.skipSpace()
+	if f.position < len(f.data) && f.data[f.position] == ']' {
+		f.position++
+		return nil
+	}
+
+	pathLength := len(f.path)
+	for index := 0; ; index++ {
+		f.path = append(f.path[:pathLength], '[')
+		f.path = strconv.AppendInt(f.path, int64(index), 10)
+		f.path = append(f.path, ']')
+		if err := f.flattenValue(depth+1, false); err != nil {
+			return err
+		}
+
+		f.skipSpace()
+		if f.position >= len(f.data) {
+			return f.syntaxError("unexpected end of data")
+		}
+		if f.data[f.position] == ']' {
+			f.position++
+			break
+		}
+		if f.data[f.position] != ',' {
+			return f.syntaxError("expected a comma")
+		}
+		f.position++
+	}
+	f.path = f.path[:pathLength]
+	return nil
+}
+
+// flattenLiteral flattens the true, false or null literal at the current position.
+func (f *JsonFlattener) flattenLiteral(literal string) error {
+	if !bytes.HasPrefix(f.data[f.position:], []byte(literal)) {
+		return f.syntaxError("invalid literal")
+	}
+	f.position += len(literal)
+	start := len(f.values)
+	f.values = append(f.values, literal...)
+	f.addPair(start)
+	f.addField(literal[0], nil)
+	return nil
+}
+
+// flattenNumber flattens the number at the current position, it's formatted like a decoded float64.
+func (f *JsonFlattener) flattenNumber() error {
+	start := f.position
+	integer, ok := f.scanNumber()
+	if !ok {
+		return f.syntaxError("invalid value")
+	}
+	number := f.data[start:f.position]
+
+	valueStart := len(f.values)
+	// Integers of up to 15 digits are exactly represented by a float64, they're formatted as they're written.
+	if integer && len(number) <= 15 && !bytes.Equal(number, []byte("-0")) {
+		f.values = append(f.values, number...)
+	} else {
+		value, err := strconv.ParseFloat(bytesToString(number), 64)
+		if err != nil {
+			return f.syntaxError("invalid number")
+		}
+		f.values = appendJsonFloat(f.values, value)
+	}
+	f.addPair(valueStart)
+	f.addField('0', number)
+	return nil
+}
+
+// scanNumber skips the number at the current position and returns whether it's an integer.
+func (f *JsonFlattener) scanNumber() (integer bool, ok bool) {
+	if f.position < len(f.data) && f.data[f.position] == '-' {
+		f.position++
+	}
+	if f.position < len(f.data) && f.data[f.position] == '0' {
+		f.position++
+	} else if f.scanDigits() == 0 {
+		return false, false
+	}
+	integer = true
+	if f.position < len(f.data) && f.data[f.position] == '.' {
+		f.position++
+		if f.scanDigits() == 0 {
+			return false, false
+		}
+		integer = false
+	}
+	if f.position < len(f.data) && (f.data[f.position] == 'e' || f.data[f.position] == 'E') {
+		f.position++
+		if f.position < len(f.data) && (f.data[f.position] == '+' || f.data[f.position] == '-') {
+			f.position++
+		}
+		if f.scanDigits() == 0 {
+			return false, false
+		}
+		integer = false
+	}
+	return integer, true
+}
+
+// scanDigits skips the digits at the current position and returns their count.
+func (f *JsonFlattener) scanDigits() int {
+	start := f.position
+	for f.position < len(f.data) && f.data[f.position] >= '0' && f.data[f.position] <= '9' {
+		f.position++
+	}
+	return f.position - start
+}
+
+// addPair adds the current path and the value starting at the given offset of the values buffer.
+func (f *JsonFlattener) addPair(valueStart int) {
+	keyStart := len(f.sorted.keys)
+	f.sorted.keys = appendJsonString(f.sorted.keys, f.path)
+	f.sorted.pairs = append(f.sorted.pairs, jsonFlattenedPair{
+		keyStart:   keyStart,
+		keyEnd:     len(f.sorted.keys),
+		valueStart: valueStart,
+		valueEnd:   len(f.values),
+	})
+}
+
+// addField keeps the kind and decoded value of the current path when it's one of the fields.
+func (f *JsonFlattener) addField(kind byte, value []byte) {
+	for index, path := range f.fields {
+		if path != bytesToString(f.path) {
+			continue
+		}
+		valueStart := len(f.fieldValues)
+		f.fieldValues = append(f.fieldValues, value...)
+		f.found = append(f.found, jsonFlattenedField{
+			path:       index,
+			kind:       kind,
+			valueStart: valueStart,
+			valueEnd:   len(f.fieldValues),
+		})
+		return
+	}
+}
+
+// readString decodes the string at the current position into the scratch buffer.
+func (f *JsonFlattener) readString() error {
+	f.position++
+	f.scratch = f.scratch[:0]
+	for {
+		start := f.position
+		for f.position < len(f.data) && f.data[f.position] != '"' && f.data[f.position] != '\\' {
+			if f.data[f.position] < 0x20 {
+				return f.syntaxError("control character in string")
+			}
+			f.position++
+		}
+		f.scratch = append(f.scratch, f.data[start:f.position]...)
+		if f.position >= len(f.data) {
+			return f.syntaxError("unterminated string")
+		}
+		if f.data[f.position] == '"' {
+			f.position++
+			return nil
+		}
+
+		// Escape sequence.
+		f.position++
+		if f.position >= len(f.data) {
+			return f.syntaxError("unterminated string")
+		}
+		escaped := f.data[f.position]
+		f.position++
+		switch escaped {
+		case '"', '\\', '/':
+			f.scratch = append(f.scratch, escaped)
+		case 'b':
+			f.scratch = append(f.scratch, '\b')
+		case 'f':
+			f.scratch = append(f.scratch, '\f')
+		case 'n':
+			f.scratch = append(f.scratch, '\n')
+		case 'r':
+			f.scratch = append(f.scratch, '\r')
+		case 't':
+			f.scratch = append(f.scratch, '\t')
+		case 'u':
+			character, ok := f.readHexRune()
+			if !ok {
+				return f.syntaxError("invalid unicode escape")
+			}
+			if utf16.IsSurrogate(character) {
+				// Surrogate pairs are combined, lone surrogates are replaced.
+				decoded := utf8.RuneError
+				if bytes.HasPrefix(f.data[f.position:], []byte(`\u`)) {
+					position := f.position
+					f.position += 2
+					low, ok := f.readHexRune()
+					if decoded = utf16.DecodeRune(character, low); !ok || decoded == utf8.RuneError {
+						decoded = utf8.RuneError
+						f.position = position
+					}
+				}
+				character = decoded
+			}
+			f.scratch = utf8.AppendRune(f.scratch, character)
+		default:
+			return f.syntaxError("invalid escape")
+		}
+	}
+}
+
+// readHexRune reads the 4 hexadecimal digits of a unicode escape.
+func (f *JsonFlattener) readHexRune() (rune, bool) {
+	if f.position+4 > len(f.data) {
+		return 0, false
+	}
+	var character rune
+	for _, digit := range f.data[f.position : f.position+4] {
+		character <<= 4
+		switch {
+		case digit >= '0' && digit <= '9':
+			character |= rune(digit - '0')
+		case digit >= 'a' && digit <= 'f':
+			character |= rune(digit - 'a' + 10)
+		case digit >= 'A' && digit <= 'F':
+			character |= rune(digit - 'A' + 10)
+		default:
+			return 0, false
+		}
+	}
+	f.position += 4
+	return character, true
+}
+
+// appendJsonFloat appends the number like the JSON encoder does.
+func appendJsonFloat(buffer []byte, value float64) []byte {
+	format := byte('f')
+	if abs := math.Abs(value); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	return strconv.AppendFloat(buffer, value, format, -1, 64)
+}
+
+// jsonHex are the hexadecimal digits of the unicode escapes.
+const jsonHex = "0123456789abcdef"
+
+// appendJsonString appends the quoted string like the JSON encoder does: HTML characters are escaped and invalid
+// UTF-8 is replaced.
+func appendJsonString(buffer []byte, value []byte) []byte {
+	buffer = append(buffer, '"')
+	start := 0
+	for index := 0; index < len(value); {
+		character := value[index]
+		if character < utf8.RuneSelf {
+			if character >= 0x20 && character != '"' && character != '\\' && character != '<' && character != '>' && character != '&' {
+				index++
+				continue
+			}
+			buffer = append(buffer, value[start:index]...)
+			switch character {
+			case '"', '\\':
+				buffer = append(buffer, '\\', character)
+			case '\n':
+				buffer = append(buffer, '\\', 'n')
+			case '\r':
+				buffer = append(buffer, '\\', 'r')
+			case '\t':
+				buffer = append(buffer, '\\', 't')
+			default:
+				buffer = append(buffer, '\\', 'u', '0', '0', jsonHex[character>>4], jsonHex[character&0xf])
+			}
+			index++
+			start = index
+			continue
+		}
+		decoded, size := utf8.DecodeRune(value[index:])
+		if decoded == utf8.RuneError && size == 1 {
+			buffer = append(buffer, value[start:index]...)
+			buffer = append(buffer, `\ufffd`...)
+			index += size
+			start = index
+			continue
+		}
+		// U+2028 and U+2029 are line separators in JavaScript.
+		if decoded == '\u2028' || decoded == '\u2029' {
+			buffer = append(buffer, value[start:index]...)
+			buffer = append(buffer, '\\', 'u', '2', '0', '2', jsonHex[decoded&0xf])
+			index += size
+			start = index
+			continue
+		}
+		index += size
+	}
+	buffer = append(buffer, value[start:]...)
+	return append(buffer, '"')
+}
+
+// fnv64a returns the FNV-1a hash of the bytes.
+func fnv64a(value []byte) uint64 {
+	hash := uint64(14695981039346656037)
+	for _, character := range value {
+		hash ^= uint64(character)
+		hash *= 1099511628211
+	}
+	return hash
+}
+
+// bytesToString converts the bytes to a string without copying them, the bytes must not be modified while the
+// string is used.
+func bytesToString(value []byte) string {
+	return *(*string)(unsafe.Pointer(&value))
+}
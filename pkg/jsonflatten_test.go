@@ -0,0 +1,378 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// flattenMapJson returns the flattened JSON of the given JSON object, with FlattenMap.
+func flattenMapJson(data []byte) ([]byte, error) {
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return json.Marshal(FlattenMap(fields))
+}
+
+// Test_JsonFlattener_Flatten ensures that the JsonFlattener output is the same as FlattenMap's.
+func Test_JsonFlattener_Flatten(t *testing.T) {
+	var tests = []string{
+		`{}`,
+		` { "a" : 1 , "b" : [ ] , "c" : { } } `,
+		`{"clientID": "client", "nested": {"key": "value", "list": [1, [2, 3], {"x": null}]}, "ok": true, "ko": false}`,
+		`{"n": [0, -0, 1.0, 1.50, 1e2, 1E-7, 0.000001, 1e21, 123456789012345, 1234567890123456789, -12.5e-3]}`,
+		`{"s": "quote \" backslash \\ slash \/ controls \b\f\n\r\t \u0001 html <>& < unicode é é   "}`,
+		`{"s": "pair 😀 lone \ud800 reversed \ude00\ud83d high high \ud800𐀀"}`,
+		"{\"s\": \"invalid \xff\xfe utf-8 \xe2\x28\xa1\", \"\xffkey\": 1}",
+		`{"<key>": {"&": "v"}, "a.b": 1, "a": {"c": 2}}`,
+		`{"": 1, "e": {"": {"": 2}}}`,
+		`{"deep": [[[[{"a": [[]]}]]]]}`,
+	}
+	flattener := NewJsonFlattener()
+	for index, data := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			expected, err := flattenMapJson([]byte(data))
+			assert.Nil(t, err)
+			actual, err := flattener.Flatten([]byte(data))
+			assert.Nil(t, err)
+			assert.Equal(t, string(expected), string(actual))
+		})
+	}
+}
+
+// Test_JsonFlattener_Flatten_Random ensures that the JsonFlattener output is the same as FlattenMap's for random
+// objects.
+func Test_JsonFlattener_Flatten_Random(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	flattener := NewJsonFlattener()
+	for count := 0; count < 5000; count++ {
+		data, err := json.Marshal(randomJsonObject(random, 4))
+		assert.Nil(t, err)
+		actual, err := flattener.Flatten(data)
+		if err == ErrAmbiguousFlattenedKeys {
+			continue
+		}
+		assert.Nil(t, err)
+		expected, err := flattenMapJson(data)
+		assert.Nil(t, err)
+		if !assert.Equal(t, string(expected), string(actual), string(data)) {
+			return
+		}
+	}
+}
+
+// randomJsonText appends a random JSON value written with random whitespace, number forms and string escapes.
+func randomJsonText(random *rand.Rand, buffer []byte, depth int, object bool) []byte {
+	space := func() {
+		buffer = append(buffer, []string{"", "", " ", "\n\t", "\r "}[random.Intn(5)]...)
+	}
+	kind := random.Intn(7)
+	if object {
+		kind = 0
+	} else if depth <= 0 {
+		kind = 2 + random.Intn(5)
+	}
+	space()
+	switch kind {
+	case 0, 1:
+		open, end := byte('{'), byte('}')
+		if kind == 1 {
+			open, end = '[', ']'
+		}
+		buffer = append(buffer, open)
+		for count := random.Intn(4); count > 0; count-- {
+			space()
+			if kind == 0 {
+				buffer = randomJsonString(random, buffer)
+				space()
+				buffer = append(buffer, ':')
+			}
+			buffer = randomJsonText(random, buffer, depth-1, false)
+			if count > 1 {
+				buffer = append(buffer, ',')
+			}
+		}
+		space()
+		buffer = append(buffer, end)
+	case 2:
+		buffer = randomJsonString(random, buffer)
+	case 3:
+		buffer = append(buffer, []string{"true", "false", "null"}[random.Intn(3)]...)
+	default:
+		if random.Intn(2) == 0 {
+			buffer = append(buffer, '-')
+		}
+		if random.Intn(4) == 0 {
+			buffer = append(buffer, '0')
+		} else {
+			buffer = append(buffer, byte('1'+random.Intn(9)))
+			for count := random.Intn(20); count > 0; count-- {
+				buffer = append(buffer, byte('0'+random.Intn(10)))
+			}
+		}
+		if random.Intn(3) == 0 {
+			buffer = append(buffer, '.')
+			for count := 1 + random.Intn(8); count > 0; count-- {
+				buffer = append(buffer, byte('0'+random.Intn(10)))
+			}
+		}
+		if random.Intn(3) == 0 {
+			buffer = append(buffer, []string{"e", "E", "e+", "e-", "E-"}[random.Intn(5)]...)
+			buffer = append(buffer, fmt.Sprint(random.Intn(30))...)
+		}
+	}
+	space()
+	return buffer
+}
+
+// randomJsonString appends a random JSON string with escapes, HTML characters and unicode.
+func randomJsonString(random *rand.Rand, buffer []byte) []byte {
+	parts := []string{
+		"a", "b", ".", "[0]", "<", ">", "&", "é", "\u00e9", "\\\"", "\\\\", "\\/", "\\n", "\\t", "\\u0001",
+		"\\u2028", "\u2029", "\\ud83d\\ude00", "\\ud800", "\\udfff", "😀", "\xff", "\x7f",
+	}
+	buffer = append(buffer, '"')
+	for count := random.Intn(4); count > 0; count-- {
+		buffer = append(buffer, parts[random.Intn(len(parts))]...)
+	}
+	return append(buffer, '"')
+}
+
+// Test_JsonFlattener_Flatten_RandomText ensures that the JsonFlattener output is the same as FlattenMap's for random
+// JSON texts.
+func Test_JsonFlattener_Flatten_RandomText(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	flattener := NewJsonFlattener()
+	compared := 0
+	for count := 0; count < 20000; count++ {
+		data := randomJsonText(random, nil, 4, true)
+		expected, expectedErr := flattenMapJson(data)
+		actual, err := flattener.Flatten(data)
+		if err == ErrAmbiguousFlattenedKeys {
+			continue
+		}
+		if expectedErr != nil {
+			assert.Error(t, err, string(data))
+			continue
+		}
+		compared++
+		if !assert.Nil(t, err, string(data)) || !assert.Equal(t, string(expected), string(actual), string(data)) {
+			return
+		}
+	}
+	assert.Greater(t, compared, 10000)
+}
+
+// Test_JsonFlattener_Flatten_Errors ensures that invalid and ambiguous objects are rejected.
+func Test_JsonFlattener_Flatten_Errors(t *testing.T) {
+	var tests = []string{
+		``, `[]`, `"a"`, `null`, `{`, `{"a"}`, `{"a": }`, `{"a": 1,}`, `{"a": 1} 2`, `{"a": tru}`, `{"a": 01}`,
+		`{"a": 1.}`, `{"a": -}`, `{"a": 1e}`, `{"a": 1e400}`, `{"a": "\x"}`, `{"a": "\u12"}`, "{\"a\": \"\n\"}",
+		`{"a": [1 2]}`, `{"a": "unterminated}`,
+	}
+	flattener := NewJsonFlattener()
+	for index, data := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			_, err := flattener.Flatten([]byte(data))
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := flattener.Flatten([]byte(`{"a": {"x": 1}, "a": {"y": 2}}`))
+	assert.Equal(t, ErrAmbiguousFlattenedKeys, err)
+	_, err = flattener.Flatten([]byte(`{"a.b": 1, "a": {"b": 2}}`))
+	assert.Equal(t, ErrAmbiguousFlattenedKeys, err)
+	// Keys of different objects don't conflict.
+	_, err = flattener.Flatten([]byte(`{"a": {"x": 1}, "b": {"x": 2}}`))
+	assert.Nil(t, err)
+}
+
+// benchmarkJsonMessage is a typical structured log message.
+var benchmarkJsonMessage = []byte(`{"timestamp": "2021-09-01T12:00:00.123Z", "level": "info", "message": "request served",
+  "clientID": "client-42", "http": {"method": "GET", "path": "/api/v1/orders", "status": 200, "duration_ms": 12.5,
+  "headers": {"user-agent": "curl/7.64.1", "accept": "application/json"}}, "tags": ["api", "orders", "v1"],
+  "user": {"id": 1234, "roles": ["admin", "billing"]}, "retries": 0, "cached": false}`)
+
+// Benchmark_FlattenMap measures the decoding, flattening and marshalling of a message with FlattenMap.
+func Benchmark_FlattenMap(b *testing.B) {
+	b.ReportAllocs()
+	for index := 0; index < b.N; index++ {
+		if _, err := flattenMapJson(benchmarkJsonMessage); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Benchmark_JsonFlattener measures the flattening of a message with a JsonFlattener.
+func Benchmark_JsonFlattener(b *testing.B) {
+	flattener := NewJsonFlattener()
+	b.ReportAllocs()
+	for index := 0; index < b.N; index++ {
+		if _, err := flattener.Flatten(benchmarkJsonMessage); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Test_MessageProcessor_Process_StreamingFlatten ensures that the messages the JsonFlattener can't flatten are
+// formatted from their fields.
+func Test_MessageProcessor_Process_StreamingFlatten(t *testing.T) {
+	processor := newTestMessageProcessor(t)
+	stream, err := processor.Process(testMessage("topic", 0, 1, `{"a": {"x": 1}, "a": {"y": 2}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"a.y":2}`, stream.Values[0][1])
+
+	stream, err = processor.Process(testMessage("topic", 0, 2, `{"b": [1, {"c": "<d>"}]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"b[0]":1,"b[1].c":"\u003cd\u003e"}`, stream.Values[0][1])
+}
+
+// Test_JsonFlattener_Fields ensures that the values of the fields are decoded like the JsonDecoder decodes them.
+func Test_JsonFlattener_Fields(t *testing.T) {
+	paths := []string{"timestamp", "http.status", "http.duration_ms", "tags[1]", "cached", "user", "missing"}
+	flattener := NewJsonFlattener()
+	flattener.SetFields(paths)
+	_, err := flattener.Flatten([]byte(`{"nothing": 1}`))
+	assert.Nil(t, err)
+	_, err = flattener.Flatten(benchmarkJsonMessage)
+	assert.Nil(t, err)
+
+	fields := make(map[string]interface{})
+	flattener.Fields(fields)
+	decoded, err := (&JsonDecoder{}).Decode(&kafka.Message{Value: benchmarkJsonMessage})
+	assert.Nil(t, err)
+	expected := make(map[string]interface{})
+	for key, value := range *FlattenMap(decoded.Fields) {
+		for _, path := range paths {
+			if key == path {
+				expected[key] = value
+			}
+		}
+	}
+	assert.Equal(t, expected, fields)
+	assert.Len(t, fields, 5)
+
+	_, err = flattener.Flatten([]byte(`{"timestamp": null, "cached": true, "http": {"status": -0}}`))
+	assert.Nil(t, err)
+	fields = make(map[string]interface{})
+	flattener.Fields(fields)
+	assert.Equal(t, map[string]interface{}{"timestamp": nil, "cached": true, "http.status": 0.0}, fields)
+
+	// The integers a float64 can't hold exactly are kept as they're written.
+	_, err = flattener.Flatten([]byte(`{"timestamp": 1700000000123456789, "http": {"status": 9007199254740992}}`))
+	assert.Nil(t, err)
+	fields = make(map[string]interface{})
+	flattener.Fields(fields)
+	assert.Equal(t, map[string]interface{}{"timestamp": json.Number("1700000000123456789"), "http.status": 9007199254740992.0}, fields)
+}
+
+// newStreamingTestMessageProcessor creates a MessageProcessor whose filter, labels, tenant and timestamp are taken
+// from the message fields, with the JsonFlattener or without it.
+func newStreamingTestMessageProcessor(tb testing.TB, streaming bool) *MessageProcessor {
+	extractor, err := NewTimestampExtractor(TimestampSourceField, "timestamp", "rfc3339")
+	assert.Nil(tb, err)
+	extractor.Now = func() time.Time {
+		return time.Unix(2, 0)
+	}
+	labelExtractor, err := NewLabelExtractor([]LabelRule{
+		{Name: "level", ValueRule: ValueRule{Source: ValueSourceField, Path: "level"}},
+		{Name: "status", ValueRule: ValueRule{Source: ValueSourceField, Path: "http.status"}},
+		{Name: "cached", ValueRule: ValueRule{Source: ValueSourceField, Path: "cached"}},
+		{Name: "topic", ValueRule: ValueRule{Source: ValueSourceTopic}},
+	})
+	assert.Nil(tb, err)
+	decoders, err := NewTopicDecoders(nil)
+	assert.Nil(tb, err)
+	tenantExtractor, err := NewTenantExtractor(ValueRule{Source: ValueSourceField, Path: "clientID"})
+	assert.Nil(tb, err)
+	filter, err := NewMessageFilter([]FilterRule{
+		{Action: FilterActionDrop, Field: "level", Operator: "equals", Value: "debug"},
+		{Action: FilterActionKeep, Any: []FilterCondition{{Field: "http.status", Operator: "gte", Value: "200"}}},
+	})
+	assert.Nil(tb, err)
+
+	processor := NewMessageProcessor(decoders, extractor, labelExtractor)
+	processor.SetTenantExtractor(tenantExtractor)
+	processor.SetMessageFilter(filter)
+	if !streaming {
+		// Any other options disable the JsonFlattener, the depth limit doesn't change the output of the messages.
+		assert.Nil(tb, processor.SetFlattenOptions(FlattenOptions{MaxDepth: 100}))
+	}
+	return processor
+}
+
+// Test_MessageProcessor_Process_StreamingFields ensures that the entries built from the token stream are the same as
+// the ones built from the decoded fields.
+func Test_MessageProcessor_Process_StreamingFields(t *testing.T) {
+	var tests = []string{
+		string(benchmarkJsonMessage),
+		`{"timestamp": 1630497600, "level": "warn", "clientID": "tenant", "http": {"status": 500}, "cached": true}`,
+		`{"timestamp": "2021-09-01T12:00:00Z", "level": "debug", "clientID": "tenant", "http": {"status": 200}}`,
+		`{"timestamp": "2021-09-01T12:00:00Z", "clientID": "tenant", "http": {"status": 100}}`,
+		`{"timestamp": "2021-09-01T12:00:00Z", "clientID": "tenant"}`,
+		`{"clientID": "tenant", "http": {"status": 200, "empty": {}}, "level": null}`,
+		`{"http": {"status": 200}}`,
+	}
+	streaming := newStreamingTestMessageProcessor(t, true)
+	decoding := newStreamingTestMessageProcessor(t, false)
+	assert.True(t, streaming.streamingFlatten("topic", &FlattenedJsonLineFormatter{}))
+	assert.False(t, decoding.streamingFlatten("topic", &FlattenedJsonLineFormatter{}))
+	for index, data := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			message := testMessage("topic", 0, int64(index), data)
+			expected, expectedErr := decoding.Process(message)
+			actual, err := streaming.Process(message)
+			assert.Equal(t, expectedErr, err)
+			assert.Equal(t, expected, actual)
+		})
+	}
+}
+
+// Test_MessageProcessor_flattenJson_Allocs ensures that flattening the line of a message doesn't allocate.
+func Test_MessageProcessor_flattenJson_Allocs(t *testing.T) {
+	processor := newStreamingTestMessageProcessor(t, true)
+	flattener := NewJsonFlattener()
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, ok := processor.flattenJson(flattener, benchmarkJsonMessage); !ok {
+			t.Fatal("the message isn't flattened")
+		}
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+// Benchmark_MessageProcessor_Process measures the processing of a message, from its JSON or from its decoded fields.
+// The flatten-allocs/op metric are the allocations of the flatten step of the JsonFlattener.
+func Benchmark_MessageProcessor_Process(b *testing.B) {
+	for _, streaming := range []bool{true, false} {
+		name := "decoded"
+		if streaming {
+			name = "streaming"
+		}
+		b.Run(name, func(b *testing.B) {
+			processor := newStreamingTestMessageProcessor(b, streaming)
+			message := testMessage("topic", 0, 1, string(benchmarkJsonMessage))
+			flattenAllocs := 0.0
+			if streaming {
+				flattener := NewJsonFlattener()
+				flattenAllocs = testing.AllocsPerRun(100, func() {
+					processor.flattenJson(flattener, message.Value)
+				})
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for index := 0; index < b.N; index++ {
+				if _, err := processor.Process(message); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if streaming {
+				b.ReportMetric(flattenAllocs, "flatten-allocs/op")
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/getsentry/sentry-go"
+	"github.com/goccy/go-json"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// reservedKafkaConfig are the librdkafka settings Speedy relies on, they can't be changed with kafka_extra_config.
+var reservedKafkaConfig = map[string]bool{
+	"enable.auto.commit":              true,
+	"go.application.rebalance.enable": true,
+}
+
+// NewKafkaConfigMap builds the librdkafka configuration shared by the consumer and the dead letter queue producer.
+// It holds the bootstrap servers, the security settings, the given client settings and then kafka_extra_config.
+func NewKafkaConfigMap(config Configuration, settings kafka.ConfigMap) (*kafka.ConfigMap, error) {
+	configMap := kafka.ConfigMap{
+		"bootstrap.servers": config.KafkaBoostrapServers,
+	}
+
+	optional := map[string]string{
+		"security.protocol":        config.KafkaSecurityProtocol,
+		"sasl.mechanisms":          config.KafkaSaslMechanism,
+		"sasl.username":            config.KafkaSaslUsername,
+		"ssl.ca.location":          config.KafkaSslCaLocation,
+		"ssl.certificate.location": config.KafkaSslCertificateLocation,
+		"ssl.key.location":         config.KafkaSslKeyLocation,
+		"ssl.key.password":         config.KafkaSslKeyPassword,
+	}
+	for key, value := range optional {
+		if value != "" {
+			configMap[key] = value
+		}
+	}
+
+	if config.KafkaSaslPassword != "" && config.KafkaSaslPasswordFile != "" {
+		return nil, fmt.Errorf("only one of kafka_sasl_password and kafka_sasl_password_file can be configured")
+	}
+	if config.KafkaSaslPassword != "" {
+		configMap["sasl.password"] = config.KafkaSaslPassword
+	}
+	if config.KafkaSaslPasswordFile != "" {
+		password, err := ioutil.ReadFile(config.KafkaSaslPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		configMap["sasl.password"] = strings.TrimSpace(string(password))
+	}
+
+	for key, value := range settings {
+		configMap[key] = value
+	}
+	for key, value := range config.KafkaExtraConfig {
+		if reservedKafkaConfig[key] {
+			return nil, fmt.Errorf("kafka_extra_config can't change %s", key)
+		}
+		configMap[key] = value
+	}
+	return &configMap, nil
+}
+
+// IOAuthBearerClient is a Kafka client that authenticates with OAUTHBEARER tokens set by the application.
+// Both kafka.Consumer and kafka.Producer implement it.
+type IOAuthBearerClient interface {
+	SetOAuthBearerToken(token kafka.OAuthBearerToken) error
+	SetOAuthBearerTokenFailure(errstr string) error
+}
+
+// OAuthBearerTokenRefresher answers the kafka.OAuthBearerTokenRefresh events with a token read from a file.
+// The file is maintained by another process, e.g. a sidecar that fetches the tokens of the identity provider.
+type OAuthBearerTokenRefresher struct {
+	tokenFile *tokenFile
+	// Now returns the current time.
+	Now func() time.Time
+}
+
+// NewOAuthBearerTokenRefresher creates a new OAuthBearerTokenRefresher that reads the token from the given file.
+func NewOAuthBearerTokenRefresher(path string) *OAuthBearerTokenRefresher {
+	return &OAuthBearerTokenRefresher{tokenFile: &tokenFile{path: path}, Now: time.Now}
+}
+
+// Refresh sets the current token of the file on the client, or reports the failure to librdkafka which retries later.
+func (r *OAuthBearerTokenRefresher) Refresh(client IOAuthBearerClient) {
+	token, err := r.token()
+	if err == nil {
+		err = client.SetOAuthBearerToken(token)
+	}
+	if err != nil {
+		SugaredLogger.Errorf("failed to refresh the kafka oauthbearer token: %s", err)
+		sentry.CaptureException(err)
+		_ = client.SetOAuthBearerTokenFailure(err.Error())
+	}
+}
+
+// token reads the token, the expiration and the principal are taken from the JWT claims when present.
+func (r *OAuthBearerTokenRefresher) token() (kafka.OAuthBearerToken, error) {
+	value, err := r.tokenFile.Token()
+	if err != nil {
+		return kafka.OAuthBearerToken{}, err
+	}
+	token := kafka.OAuthBearerToken{
+		TokenValue: value,
+		// Tokens without an expiration are read again regularly.
+		Expiration: r.Now().Add(5 * time.Minute),
+		Principal:  "speedy",
+	}
+
+	var claims struct {
+		Expiration int64  `json:"exp"`
+		Subject    string `json:"sub"`
+	}
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return token, nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return token, nil
+	}
+	if claims.Expiration > 0 {
+		token.Expiration = time.Unix(claims.Expiration, 0)
+	}
+	if claims.Subject != "" {
+		token.Principal = claims.Subject
+	}
+	return token, nil
+}
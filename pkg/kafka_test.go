@@ -0,0 +1,103 @@
+package pkg
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test_NewKafkaConfigMap ensures that the security settings and the extra config are added to the client settings.
+func Test_NewKafkaConfigMap(t *testing.T) {
+	configMap, err := NewKafkaConfigMap(Configuration{KafkaBoostrapServers: "kafka:9092"}, kafka.ConfigMap{"group.id": "speedy"})
+	assert.Nil(t, err)
+	assert.Equal(t, &kafka.ConfigMap{"bootstrap.servers": "kafka:9092", "group.id": "speedy"}, configMap)
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	assert.Nil(t, ioutil.WriteFile(passwordFile, []byte("secret\n"), 0600))
+	configMap, err = NewKafkaConfigMap(Configuration{
+		KafkaBoostrapServers:  "kafka:9096",
+		KafkaSecurityProtocol: "sasl_ssl",
+		KafkaSaslMechanism:    "SCRAM-SHA-512",
+		KafkaSaslUsername:     "speedy",
+		KafkaSaslPasswordFile: passwordFile,
+		KafkaSslCaLocation:    "/etc/ssl/ca.pem",
+		KafkaExtraConfig:      map[string]string{"socket.timeout.ms": "1000", "client.id": "speedy"},
+	}, kafka.ConfigMap{"socket.timeout.ms": "300000"})
+	assert.Nil(t, err)
+	assert.Equal(t, &kafka.ConfigMap{
+		"bootstrap.servers": "kafka:9096",
+		"security.protocol": "sasl_ssl",
+		"sasl.mechanisms":   "SCRAM-SHA-512",
+		"sasl.username":     "speedy",
+		"sasl.password":     "secret",
+		"ssl.ca.location":   "/etc/ssl/ca.pem",
+		"socket.timeout.ms": "1000",
+		"client.id":         "speedy",
+	}, configMap)
+
+	_, err = NewKafkaConfigMap(Configuration{KafkaSaslPassword: "a", KafkaSaslPasswordFile: passwordFile}, nil)
+	assert.Error(t, err)
+
+	_, err = NewKafkaConfigMap(Configuration{KafkaSaslPasswordFile: filepath.Join(t.TempDir(), "missing")}, nil)
+	assert.Error(t, err)
+
+	_, err = NewKafkaConfigMap(Configuration{KafkaExtraConfig: map[string]string{"enable.auto.commit": "true"}}, nil)
+	assert.Error(t, err)
+}
+
+// testOAuthBearerClient is an IOAuthBearerClient used for internal testing.
+type testOAuthBearerClient struct {
+	token   kafka.OAuthBearerToken
+	failure string
+}
+
+func (c *testOAuthBearerClient) SetOAuthBearerToken(token kafka.OAuthBearerToken) error {
+	if token.TokenValue == "rejected" {
+		return errors.New("rejected token")
+	}
+	c.token = token
+	return nil
+}
+
+func (c *testOAuthBearerClient) SetOAuthBearerTokenFailure(errstr string) error {
+	c.failure = errstr
+	return nil
+}
+
+// Test_OAuthBearerTokenRefresher_Refresh ensures that tokens are read from the file and that failures are reported.
+func Test_OAuthBearerTokenRefresher_Refresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	refresher := NewOAuthBearerTokenRefresher(path)
+	refresher.Now = func() time.Time {
+		return time.Unix(100, 0)
+	}
+
+	client := &testOAuthBearerClient{}
+	refresher.Refresh(client)
+	assert.NotEmpty(t, client.failure)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("opaque"), 0600))
+	client = &testOAuthBearerClient{}
+	refresher.Refresh(client)
+	assert.Empty(t, client.failure)
+	assert.Equal(t, kafka.OAuthBearerToken{TokenValue: "opaque", Expiration: time.Unix(400, 0), Principal: "speedy"}, client.token)
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"exp": 1000, "sub": "speedy-user"}`))
+	jwt := "eyJhbGciOiJub25lIn0." + payload + ".signature"
+	assert.Nil(t, ioutil.WriteFile(path, []byte(jwt), 0600))
+	refresher = NewOAuthBearerTokenRefresher(path)
+	client = &testOAuthBearerClient{}
+	refresher.Refresh(client)
+	assert.Equal(t, kafka.OAuthBearerToken{TokenValue: jwt, Expiration: time.Unix(1000, 0), Principal: "speedy-user"}, client.token)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("rejected"), 0600))
+	refresher = NewOAuthBearerTokenRefresher(path)
+	client = &testOAuthBearerClient{}
+	refresher.Refresh(client)
+	assert.Equal(t, "rejected token", client.failure)
+}
@@ -0,0 +1,214 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/goccy/go-json"
+	"regexp"
+	"strconv"
+)
+
+const (
+	// ValueSourceField takes the value from a flattened message field.
+	ValueSourceField = "field"
+	// ValueSourceHeader takes the value from a Kafka header.
+	ValueSourceHeader = "header"
+	// ValueSourceTopic takes the value from the topic name.
+	ValueSourceTopic = "topic"
+	// ValueSourcePartition takes the value from the partition number.
+	ValueSourcePartition = "partition"
+	// ValueSourceKey takes the value from the message key.
+	ValueSourceKey = "key"
+	// ValueSourceStatic uses a static value.
+	ValueSourceStatic = "static"
+)
+
+// labelNameRegex matches valid Loki label names.
+var labelNameRegex = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// ValueRule configures how a value is extracted from a Kafka message.
+type ValueRule struct {
+	// Source is where the value is taken from: field, header, topic, partition, key or static.
+	Source string `json:"source" mapstructure:"source"`
+	// Path is the flattened field path for the field source, or the header name for the header source.
+	Path string `json:"path,omitempty" mapstructure:"path"`
+	// Value is the value of the static source.
+	Value string `json:"value,omitempty" mapstructure:"value"`
+	// Regex is an optional regular expression applied to the value, the first capture group is used if any.
+	Regex string `json:"regex,omitempty" mapstructure:"regex"`
+	// Default is the value used when the source has no value or the regex doesn't match.
+	Default string `json:"default,omitempty" mapstructure:"default"`
+}
+
+// LabelRule configures how a Loki label is extracted from a Kafka message.
+type LabelRule struct {
+	// Name is the Loki label name.
+	Name      string `json:"name" mapstructure:"name"`
+	ValueRule `mapstructure:",squash"`
+}
+
+// DefaultLabelRules are the label rules used when none are configured.
+var DefaultLabelRules = []LabelRule{
+	{Name: "key", ValueRule: ValueRule{Source: ValueSourceTopic}},
+	{Name: "clientId", ValueRule: ValueRule{Source: ValueSourceField, Path: "clientID"}},
+}
+
+// valueExtractor is a compiled ValueRule.
+type valueExtractor struct {
+	rule  ValueRule
+	regex *regexp.Regexp
+}
+
+// newValueExtractor compiles the given ValueRule.
+func newValueExtractor(rule ValueRule) (*valueExtractor, error) {
+	switch rule.Source {
+	case ValueSourceField, ValueSourceHeader:
+		if rule.Path == "" {
+			return nil, fmt.Errorf("path is required for the %s source", rule.Source)
+		}
+	case ValueSourceTopic, ValueSourcePartition, ValueSourceKey, ValueSourceStatic:
+	default:
+		return nil, fmt.Errorf("invalid source %s", rule.Source)
+	}
+	extractor := &valueExtractor{rule: rule}
+	if rule.Regex != "" {
+		regex, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return nil, err
+		}
+		extractor.regex = regex
+	}
+	return extractor, nil
+}
+
+// Extract returns the value for the given message and flattened fields, the default value if there's none.
+func (e *valueExtractor) Extract(message *kafka.Message, fields map[string]interface{}) string {
+	value := e.sourceValue(message, fields)
+	if e.regex != nil && value != "" {
+		match := e.regex.FindStringSubmatch(value)
+		switch {
+		case match == nil:
+			value = ""
+		case len(match) > 1:
+			value = match[1]
+		default:
+			value = match[0]
+		}
+	}
+	if value == "" {
+		return e.rule.Default
+	}
+	return value
+}
+
+// sourceValue returns the raw value of the source.
+func (e *valueExtractor) sourceValue(message *kafka.Message, fields map[string]interface{}) string {
+	switch e.rule.Source {
+	case ValueSourceField:
+		value, ok := fields[e.rule.Path]
+		if !ok {
+			return ""
+		}
+		return stringValue(value)
+	case ValueSourceHeader:
+		for _, header := range message.Headers {
+			if header.Key == e.rule.Path {
+				return string(header.Value)
+			}
+		}
+	case ValueSourceTopic:
+		if message.TopicPartition.Topic != nil {
+			return *message.TopicPartition.Topic
+		}
+	case ValueSourcePartition:
+		return strconv.Itoa(int(message.TopicPartition.Partition))
+	case ValueSourceKey:
+		return string(message.Key)
+	case ValueSourceStatic:
+		return e.rule.Value
+	}
+	return ""
+}
+
+// stringValue formats a flattened field value as a string.
+func stringValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// ValidateLabelName returns an error if the name is not a valid Loki label name.
+func ValidateLabelName(name string) error {
+	if !labelNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid label name %q, it must match %s", name, labelNameRegex)
+	}
+	if len(name) > 1 && name[:2] == "__" {
+		return fmt.Errorf("invalid label name %q, names starting with __ are reserved", name)
+	}
+	return nil
+}
+
+// LabelExtractor extracts the Loki labels of Kafka messages according to a list of LabelRule.
+type LabelExtractor struct {
+	names      []string
+	extractors []*valueExtractor
+}
+
+// NewLabelExtractor creates a new LabelExtractor, the rules are validated and compiled.
+func NewLabelExtractor(rules []LabelRule) (*LabelExtractor, error) {
+	labelExtractor := &LabelExtractor{
+		names:      make([]string, 0, len(rules)),
+		extractors: make([]*valueExtractor, 0, len(rules)),
+	}
+	seen := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if err := ValidateLabelName(rule.Name); err != nil {
+			return nil, err
+		}
+		if seen[rule.Name] {
+			return nil, fmt.Errorf("duplicate label %s", rule.Name)
+		}
+		seen[rule.Name] = true
+		extractor, err := newValueExtractor(rule.ValueRule)
+		if err != nil {
+			return nil, fmt.Errorf("label %s: %w", rule.Name, err)
+		}
+		labelExtractor.names = append(labelExtractor.names, rule.Name)
+		labelExtractor.extractors = append(labelExtractor.extractors, extractor)
+	}
+	return labelExtractor, nil
+}
+
+// Fields returns the flattened field paths the labels are taken from.
+func (l *LabelExtractor) Fields() []string {
+	fields := make([]string, 0, len(l.extractors))
+	for _, extractor := range l.extractors {
+		if extractor.rule.Source == ValueSourceField {
+			fields = append(fields, extractor.rule.Path)
+		}
+	}
+	return fields
+}
+
+// Extract returns the labels of the given message, labels without a value are omitted.
+func (l *LabelExtractor) Extract(message *kafka.Message, fields map[string]interface{}) map[string]string {
+	labels := make(map[string]string, len(l.names))
+	for index, extractor := range l.extractors {
+		value := extractor.Extract(message, fields)
+		if value != "" {
+			labels[l.names[index]] = value
+		}
+	}
+	return labels
+}
@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Test_ValidateLabelName ensures that label names are validated against Loki's rules.
+func Test_ValidateLabelName(t *testing.T) {
+	for _, name := range []string{"key", "clientId", "_private", "a1_b2"} {
+		assert.Nil(t, ValidateLabelName(name), name)
+	}
+	for _, name := range []string{"", "1abc", "client-id", "client.id", "__name__", "ünicode"} {
+		assert.Error(t, ValidateLabelName(name), name)
+	}
+}
+
+// Test_NewLabelExtractor ensures that invalid label rules are rejected.
+func Test_NewLabelExtractor(t *testing.T) {
+	var tests = []struct {
+		rules []LabelRule
+		valid bool
+	}{
+		{DefaultLabelRules, true},
+		{[]LabelRule{{Name: "bad-name", ValueRule: ValueRule{Source: ValueSourceTopic}}}, false},
+		{[]LabelRule{{Name: "app", ValueRule: ValueRule{Source: "batman"}}}, false},
+		{[]LabelRule{{Name: "app", ValueRule: ValueRule{Source: ValueSourceField}}}, false},
+		{[]LabelRule{{Name: "app", ValueRule: ValueRule{Source: ValueSourceHeader}}}, false},
+		{[]LabelRule{{Name: "app", ValueRule: ValueRule{Source: ValueSourceTopic, Regex: "("}}}, false},
+		{[]LabelRule{
+			{Name: "app", ValueRule: ValueRule{Source: ValueSourceTopic}},
+			{Name: "app", ValueRule: ValueRule{Source: ValueSourceKey}},
+		}, false},
+	}
+	for index, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			_, err := NewLabelExtractor(tt.rules)
+			assert.Equal(t, tt.valid, err == nil)
+		})
+	}
+}
+
+// Test_LabelExtractor_Extract ensures that labels are extracted from every source.
+func Test_LabelExtractor_Extract(t *testing.T) {
+	extractor, err := NewLabelExtractor([]LabelRule{
+		{Name: "topic", ValueRule: ValueRule{Source: ValueSourceTopic}},
+		{Name: "env", ValueRule: ValueRule{Source: ValueSourceTopic, Regex: `^logs\.([a-z]+)\.`}},
+		{Name: "partition", ValueRule: ValueRule{Source: ValueSourcePartition}},
+		{Name: "message_key", ValueRule: ValueRule{Source: ValueSourceKey}},
+		{Name: "cluster", ValueRule: ValueRule{Source: ValueSourceStatic, Value: "eu-central-1"}},
+		{Name: "app", ValueRule: ValueRule{Source: ValueSourceHeader, Path: "app"}},
+		{Name: "level", ValueRule: ValueRule{Source: ValueSourceField, Path: "log.level"}},
+		{Name: "status", ValueRule: ValueRule{Source: ValueSourceField, Path: "status"}},
+		{Name: "version", ValueRule: ValueRule{Source: ValueSourceField, Path: "version", Regex: `^v\d+`}},
+		{Name: "region", ValueRule: ValueRule{Source: ValueSourceField, Path: "region", Default: "unknown"}},
+		{Name: "missing", ValueRule: ValueRule{Source: ValueSourceField, Path: "missing"}},
+		{Name: "no_match", ValueRule: ValueRule{Source: ValueSourceField, Path: "version", Regex: "^x", Default: "none"}},
+	})
+	assert.Nil(t, err)
+
+	topic := "logs.prod.payments"
+	message := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 3},
+		Key:            []byte("user-1"),
+		Headers:        []kafka.Header{{Key: "app", Value: []byte("payments")}},
+	}
+	fields := map[string]interface{}{
+		"log.level": "info",
+		"status":    float64(200),
+		"version":   "v2.1.0",
+	}
+
+	assert.Equal(t, map[string]string{
+		"topic":       "logs.prod.payments",
+		"env":         "prod",
+		"partition":   "3",
+		"message_key": "user-1",
+		"cluster":     "eu-central-1",
+		"app":         "payments",
+		"level":       "info",
+		"status":      "200",
+		"version":     "v2",
+		"region":      "unknown",
+		"no_match":    "none",
+	}, extractor.Extract(message, fields))
+}
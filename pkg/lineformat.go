@@ -0,0 +1,208 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/goccy/go-json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+const (
+	// LineFormatFlattenedJson sends the flattened fields as JSON.
+	LineFormatFlattenedJson = "flattened_json"
+	// LineFormatOriginal sends the line of the decoder, the original message for the text formats.
+	LineFormatOriginal = "original"
+	// LineFormatLogfmt sends the flattened fields as a logfmt line.
+	LineFormatLogfmt = "logfmt"
+	// LineFormatField sends the value of a single flattened field.
+	LineFormatField = "field"
+	// LineFormatTemplate sends a text/template rendered over the flattened fields.
+	LineFormatTemplate = "template"
+)
+
+// LineFormatter builds the Loki line of a decoded message from its flattened fields.
+type LineFormatter interface {
+	Format(decoded DecodedMessage, fields map[string]interface{}) (string, error)
+}
+
+// LineFormatRule configures the line format of the topics that match a pattern.
+type LineFormatRule struct {
+	// Topic is the regular expression matched against the topic name, empty matches every topic.
+	Topic string `json:"topic" mapstructure:"topic"`
+	// Format is flattened_json, original, logfmt, field or template.
+	Format string `json:"format" mapstructure:"format"`
+	// Field is the flattened field sent by the field format.
+	Field string `json:"field,omitempty" mapstructure:"field"`
+	// Template is the text/template of the template format.
+	Template string `json:"template,omitempty" mapstructure:"template"`
+}
+
+// LineFormatterFactoryCreate is a factory for creating line formatters.
+func LineFormatterFactoryCreate(rule LineFormatRule) (LineFormatter, error) {
+	switch rule.Format {
+	case LineFormatFlattenedJson:
+		return &FlattenedJsonLineFormatter{}, nil
+	case LineFormatOriginal:
+		return &OriginalLineFormatter{}, nil
+	case LineFormatLogfmt:
+		return &LogfmtLineFormatter{}, nil
+	case LineFormatField:
+		if rule.Field == "" {
+			return nil, fmt.Errorf("field is required for the field line format")
+		}
+		return &FieldLineFormatter{field: rule.Field}, nil
+	case LineFormatTemplate:
+		return NewTemplateLineFormatter(rule.Template)
+	}
+	return nil, fmt.Errorf("invalid line format %s", rule.Format)
+}
+
+// FlattenedJsonLineFormatter formats the flattened fields as JSON.
+type FlattenedJsonLineFormatter struct {
+}
+
+// Format marshals the flattened fields.
+func (f *FlattenedJsonLineFormatter) Format(_ DecodedMessage, fields map[string]interface{}) (string, error) {
+	line, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	return string(line), nil
+}
+
+// OriginalLineFormatter keeps the line of the decoder.
+type OriginalLineFormatter struct {
+}
+
+// Format returns the decoded line.
+func (f *OriginalLineFormatter) Format(decoded DecodedMessage, _ map[string]interface{}) (string, error) {
+	return decoded.Line, nil
+}
+
+// LogfmtLineFormatter formats the flattened fields as a logfmt line, sorted by key.
+type LogfmtLineFormatter struct {
+}
+
+// Format writes the key=value pairs, keys and values are quoted when needed.
+func (f *LogfmtLineFormatter) Format(_ DecodedMessage, fields map[string]interface{}) (string, error) {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var line strings.Builder
+	for index, key := range keys {
+		if index > 0 {
+			line.WriteByte(' ')
+		}
+		line.WriteString(logfmtQuote(key))
+		line.WriteByte('=')
+		line.WriteString(logfmtQuote(stringValue(fields[key])))
+	}
+	return line.String(), nil
+}
+
+// logfmtQuote quotes the empty text and the text with spaces, equal signs, quotes, backslashes or line breaks.
+func logfmtQuote(text string) string {
+	if text == "" || strings.ContainsAny(text, " =\"\\\t\r\n") {
+		return strconv.Quote(text)
+	}
+	return text
+}
+
+// FieldLineFormatter sends the value of a single field, messages without it are formatted as flattened JSON.
+type FieldLineFormatter struct {
+	field string
+}
+
+// Format returns the value of the field.
+func (f *FieldLineFormatter) Format(decoded DecodedMessage, fields map[string]interface{}) (string, error) {
+	value, ok := fields[f.field]
+	if !ok || value == nil {
+		return (&FlattenedJsonLineFormatter{}).Format(decoded, fields)
+	}
+	return stringValue(value), nil
+}
+
+// TemplateLineFormatter renders a text/template over the flattened fields. Fields are accessed with {{.level}}, or
+// with {{index . "user.id"}} when their path has dots.
+type TemplateLineFormatter struct {
+	template *template.Template
+}
+
+// NewTemplateLineFormatter parses the given template.
+func NewTemplateLineFormatter(text string) (*TemplateLineFormatter, error) {
+	if text == "" {
+		return nil, fmt.Errorf("template is required for the template line format")
+	}
+	parsed, err := template.New("line").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid line template: %w", err)
+	}
+	return &TemplateLineFormatter{template: parsed}, nil
+}
+
+// Format executes the template.
+func (f *TemplateLineFormatter) Format(_ DecodedMessage, fields map[string]interface{}) (string, error) {
+	var line strings.Builder
+	err := f.template.Execute(&line, fields)
+	if err != nil {
+		return "", err
+	}
+	return line.String(), nil
+}
+
+// topicLineFormatter is a LineFormatter with the topic pattern it's used for.
+type topicLineFormatter struct {
+	pattern   topicPattern
+	formatter LineFormatter
+}
+
+// TopicLineFormatters chooses the LineFormatter of a message according to its topic.
+// The first rule whose pattern matches the topic is used, messages of other topics are formatted as flattened JSON.
+type TopicLineFormatters struct {
+	formatters []topicLineFormatter
+	fallback   LineFormatter
+	// cache maps topic names to their LineFormatter.
+	cache sync.Map
+}
+
+// NewTopicLineFormatters creates a new TopicLineFormatters from the given rules.
+func NewTopicLineFormatters(rules []LineFormatRule) (*TopicLineFormatters, error) {
+	topicFormatters := &TopicLineFormatters{
+		formatters: make([]topicLineFormatter, 0, len(rules)),
+		fallback:   &FlattenedJsonLineFormatter{},
+	}
+	for _, rule := range rules {
+		pattern, err := newTopicPattern(rule.Topic)
+		if err != nil {
+			return nil, fmt.Errorf("invalid line format topic %s: %w", rule.Topic, err)
+		}
+		formatter, err := LineFormatterFactoryCreate(rule)
+		if err != nil {
+			return nil, err
+		}
+		topicFormatters.formatters = append(topicFormatters.formatters, topicLineFormatter{pattern: pattern, formatter: formatter})
+	}
+	return topicFormatters, nil
+}
+
+// Formatter returns the LineFormatter for the given topic.
+func (t *TopicLineFormatters) Formatter(topic string) LineFormatter {
+	if formatter, ok := t.cache.Load(topic); ok {
+		return formatter.(LineFormatter)
+	}
+	formatter := t.fallback
+	for _, candidate := range t.formatters {
+		if candidate.pattern.Match(topic) {
+			formatter = candidate.formatter
+			break
+		}
+	}
+	t.cache.Store(topic, formatter)
+	return formatter
+}
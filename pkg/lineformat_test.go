@@ -0,0 +1,104 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Test_LineFormatterFactoryCreate ensures that invalid rules are rejected.
+func Test_LineFormatterFactoryCreate(t *testing.T) {
+	var tests = []LineFormatRule{
+		{Format: "yaml"},
+		{Format: LineFormatField},
+		{Format: LineFormatTemplate},
+		{Format: LineFormatTemplate, Template: "{{.level"},
+	}
+	for index, rule := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			_, err := LineFormatterFactoryCreate(rule)
+			assert.Error(t, err)
+		})
+	}
+}
+
+// Test_LineFormatter_Format ensures that the line formats are rendered.
+func Test_LineFormatter_Format(t *testing.T) {
+	decoded := DecodedMessage{
+		Fields: map[string]interface{}{"level": "info", "message": "hello world", "user": map[string]interface{}{"id": 7}},
+		Line:   `{"level": "info", "message": "hello world", "user": {"id": 7}}`,
+	}
+	fields := map[string]interface{}{"level": "info", "message": "hello world", "user.id": float64(7), "empty": ""}
+
+	var tests = []struct {
+		rule     LineFormatRule
+		expected string
+	}{
+		{LineFormatRule{Format: LineFormatFlattenedJson}, `{"empty":"","level":"info","message":"hello world","user.id":7}`},
+		{LineFormatRule{Format: LineFormatOriginal}, decoded.Line},
+		{LineFormatRule{Format: LineFormatLogfmt}, `empty="" level=info message="hello world" user.id=7`},
+		{LineFormatRule{Format: LineFormatField, Field: "message"}, "hello world"},
+		{LineFormatRule{Format: LineFormatField, Field: "user.id"}, "7"},
+		{LineFormatRule{Format: LineFormatField, Field: "missing"}, `{"empty":"","level":"info","message":"hello world","user.id":7}`},
+		{LineFormatRule{Format: LineFormatTemplate, Template: `[{{.level}}] {{.message}} user={{index . "user.id"}}`}, "[info] hello world user=7"},
+	}
+	for index, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			formatter, err := LineFormatterFactoryCreate(tt.rule)
+			assert.Nil(t, err)
+			line, err := formatter.Format(decoded, fields)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expected, line)
+		})
+	}
+}
+
+// Test_LogfmtLineFormatter_Format_Keys ensures that the keys that would break the logfmt line are quoted.
+func Test_LogfmtLineFormatter_Format_Keys(t *testing.T) {
+	fields := map[string]interface{}{"my key": "a", "a=b": "b", `say"hi"`: "c", "": "d", "plain": "e"}
+	line, err := (&LogfmtLineFormatter{}).Format(DecodedMessage{}, fields)
+	assert.Nil(t, err)
+	assert.Equal(t, `""=d "a=b"=b "my key"=a plain=e "say\"hi\""=c`, line)
+}
+
+// Test_TopicLineFormatters_Formatter ensures that the first rule matching the topic is used.
+func Test_TopicLineFormatters_Formatter(t *testing.T) {
+	formatters, err := NewTopicLineFormatters([]LineFormatRule{
+		{Topic: "^nginx", Format: LineFormatOriginal},
+		{Topic: "^app", Format: LineFormatLogfmt},
+		{Topic: "^app", Format: LineFormatOriginal},
+	})
+	assert.Nil(t, err)
+	assert.IsType(t, &OriginalLineFormatter{}, formatters.Formatter("nginx.access"))
+	assert.IsType(t, &LogfmtLineFormatter{}, formatters.Formatter("app.logs"))
+	assert.IsType(t, &FlattenedJsonLineFormatter{}, formatters.Formatter("other"))
+
+	_, err = NewTopicLineFormatters([]LineFormatRule{{Topic: "(", Format: LineFormatOriginal}})
+	assert.Error(t, err)
+}
+
+// Test_MessageProcessor_Process_LineFormat ensures that the line is formatted according to the topic and that the
+// size of the stream is the size of the formatted line.
+func Test_MessageProcessor_Process_LineFormat(t *testing.T) {
+	processor := newTestMessageProcessor(t)
+	formatters, err := NewTopicLineFormatters([]LineFormatRule{
+		{Topic: "^original", Format: LineFormatOriginal},
+		{Topic: "^message", Format: LineFormatField, Field: "msg"},
+	})
+	assert.Nil(t, err)
+	processor.SetLineFormatters(formatters)
+	redactor, err := NewRedactor(RedactionOptions{Patterns: []RedactionPattern{{Name: "email"}}, Mask: "***"})
+	assert.Nil(t, err)
+	processor.SetRedactor(redactor)
+
+	message := testMessage("original", 0, 1, `{"msg": "sent to a@example.com", "nested": {"key": "value"}}`)
+	stream, err := processor.Process(message)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"msg": "sent to ***", "nested": {"key": "value"}}`, stream.Values[0][1])
+
+	message = testMessage("message", 0, 2, `{"msg": "sent to a@example.com", "level": "info"}`)
+	stream, err = processor.Process(message)
+	assert.Nil(t, err)
+	assert.Equal(t, "sent to ***", stream.Values[0][1])
+	assert.Equal(t, len("sent to ***")+LabelsSize(stream.Labels), stream.Size)
+}
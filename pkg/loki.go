@@ -3,6 +3,7 @@ package pkg
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	"github.com/goccy/go-json"
@@ -12,18 +13,112 @@ import (
 	"io/ioutil"
 	"net/http"
 	"speedy/pkg/logproto"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// TenantHeader is the header that holds the Loki tenant of a push request.
+const TenantHeader = "X-Scope-OrgID"
+
+// LokiClientOptions configures the connections of the Loki clients.
+type LokiClientOptions struct {
+	// Timeout is the timeout of a push request, 0 means no timeout.
+	Timeout time.Duration
+	// TLSConfig configures TLS, e.g. a custom CA bundle or client certificates, nil uses the defaults.
+	TLSConfig *tls.Config
+	// GrpcTLS enables TLS for the grpc client, the HTTP clients use TLS according to the URL scheme.
+	GrpcTLS bool
+	// KeepaliveTime is the interval of the grpc keepalive pings, 0 disables them.
+	KeepaliveTime time.Duration
+	// KeepaliveTimeout is the time to wait for a grpc keepalive ping acknowledgement before closing the connection.
+	KeepaliveTimeout time.Duration
+	// BasicAuthUsername enables basic authentication with BasicAuthPassword.
+	BasicAuthUsername string
+	// BasicAuthPassword is the basic authentication password.
+	BasicAuthPassword string
+	// BearerToken is sent as a bearer token.
+	BearerToken string
+	// BearerTokenFile is a file that holds the bearer token, it's read again when it changes.
+	BearerTokenFile string
+	// Headers are extra headers sent with every push request.
+	Headers map[string]string
+}
+
 // LokiClientFactoryCreate is a factory for creating Loki clients.
-func LokiClientFactoryCreate(clientName string, lokiUrl string) ISpeedySink {
-	if clientName == "http" {
-		return NewLokiHttpClient(lokiUrl)
-	} else if clientName == "proto" {
-		return NewLokiProtoClient(lokiUrl)
+func LokiClientFactoryCreate(clientName string, lokiUrl string, options LokiClientOptions) (ISpeedySink, error) {
+	switch clientName {
+	case "http", "proto":
+		httpClient, err := newLokiHttpClientFromOptions(options)
+		if err != nil {
+			return nil, err
+		}
+		if clientName == "http" {
+			return &LokiHttpClient{lokiUrl: lokiUrl, HttpClient: httpClient}, nil
+		}
+		return &LokiProtoClient{lokiUrl: lokiUrl, HttpClient: httpClient}, nil
+	case "grpc":
+		return NewLokiGrpcClient(lokiUrl, options)
+	}
+	return nil, fmt.Errorf("invalid loki push mode %s", clientName)
+}
+
+// LokiPushError is returned by the Loki clients when Loki doesn't accept a push request.
+type LokiPushError struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// RetryAfter is the delay requested by Loki through the Retry-After header, if any.
+	RetryAfter time.Duration
+	// Body is the body of the response.
+	Body string
+}
+
+func (e *LokiPushError) Error() string {
+	return fmt.Sprintf("loki push failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+// Retryable returns whether the push can be retried. Only the invalid (400) and too large (413) batches are rejected,
+// the other failures, e.g. authentication (401, 403), a missing endpoint (404), rate limiting (429) or server errors,
+// may be fixed without changing the batch.
+func (e *LokiPushError) Retryable() bool {
+	return e.StatusCode != http.StatusBadRequest && e.StatusCode != http.StatusRequestEntityTooLarge
+}
+
+// checkPushResponse returns a LokiPushError if the response is not successful.
+func checkPushResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		SugaredLogger.Debugf("{%d}", resp.StatusCode)
+		return nil
+	}
+
+	pushError := &LokiPushError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		pushError.Body = strings.TrimSpace(string(responseBody))
+	} else {
+		SugaredLogger.Debugf("%v", err)
 	}
-	return nil
+	SugaredLogger.Debugf("{%d} - {%s}", resp.StatusCode, pushError.Body)
+	return pushError
+}
+
+// parseRetryAfter parses the value of the Retry-After header, either in seconds or as an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
 }
 
 // LokiHttpClient is a simple ISpeedySink that sends data to Loki via HTTP protocol.
@@ -53,6 +148,9 @@ func (l *LokiHttpClient) SendData(ctx context.Context, data *LokiStreams) error
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if data.Tenant != "" {
+		req.Header.Set(TenantHeader, data.Tenant)
+	}
 
 	resp, err := l.HttpClient.Do(req)
 	if err != nil {
@@ -68,19 +166,7 @@ func (l *LokiHttpClient) SendData(ctx context.Context, data *LokiStreams) error
 		}
 	}(resp.Body)
 
-	if resp.StatusCode != 204 {
-		responseBody, err := ioutil.ReadAll(resp.Body)
-		if err == nil {
-			SugaredLogger.Debugf("{%d} - {%s}", resp.StatusCode, string(responseBody))
-		} else {
-			SugaredLogger.Debugf("%v", err)
-		}
-		sentry.CaptureException(err)
-	} else {
-		SugaredLogger.Debugf("{%d}", resp.StatusCode)
-	}
-
-	return nil
+	return checkPushResponse(resp)
 }
 
 // SetHttpClient replaces the default http speedySink.
@@ -93,6 +179,34 @@ func (l *LokiHttpClient) Shutdown() {
 	l.HttpClient.CloseIdleConnections()
 }
 
+// newPushRequest converts LokiStreams into a protocol buffers push request.
+func newPushRequest(data *LokiStreams) logproto.PushRequest {
+	pushRequest := logproto.PushRequest{
+		Streams: make([]logproto.Stream, 0, len(data.Streams)),
+	}
+
+	// Format labels and append data to stream.
+	for _, stream := range data.Streams {
+		entries := make([]logproto.Entry, 0, len(stream.Values))
+		for _, value := range stream.Values {
+			timestamp := time.Now().UTC()
+			if nanoseconds, err := strconv.ParseInt(value[0], 10, 64); err == nil {
+				timestamp = time.Unix(0, nanoseconds).UTC()
+			}
+			entries = append(entries, logproto.Entry{
+				Timestamp: timestamp,
+				Line:      value[1],
+			})
+		}
+
+		pushRequest.Streams = append(pushRequest.Streams, logproto.Stream{
+			Labels:  stream.LabelsKey(),
+			Entries: entries,
+		})
+	}
+	return pushRequest
+}
+
 // LokiProtoClient is a simple ISpeedySink that sends data to Loki via snappy-compressed protocol buffers protocol.
 type LokiProtoClient struct {
 	lokiUrl    string
@@ -106,26 +220,7 @@ func NewLokiProtoClient(lokiUrl string) ISpeedySink {
 
 // SendData sends LokiStreams to Loki over protocol buffers.
 func (l *LokiProtoClient) SendData(ctx context.Context, data *LokiStreams) error {
-	pushRequest := logproto.PushRequest{
-		Streams: make([]logproto.Stream, 0, data.Count),
-	}
-
-	// Format labels and append data to stream.
-	for _, entry := range data.Streams {
-		tmpLabels := make([]string, 0, 2)
-		for k, v := range entry.Labels {
-			tmpLabels = append(tmpLabels, fmt.Sprintf("%s=%q", k, v))
-		}
-		labels := fmt.Sprintf("{%s}", strings.Join(tmpLabels, ", "))
-
-		pushRequest.Streams = append(pushRequest.Streams, logproto.Stream{
-			Labels: labels,
-			Entries: []logproto.Entry{{
-				Timestamp: time.Now().UTC(),
-				Line:      entry.Values[0][1],
-			}},
-		})
-	}
+	pushRequest := newPushRequest(data)
 
 	// Marshall into protobuf and snappy encode.
 	buf, err := proto.Marshal(&pushRequest)
@@ -143,6 +238,9 @@ func (l *LokiProtoClient) SendData(ctx context.Context, data *LokiStreams) error
 		return err
 	}
 	req.Header.Set("Content-Type", "application/x-protobuf")
+	if data.Tenant != "" {
+		req.Header.Set(TenantHeader, data.Tenant)
+	}
 
 	resp, err := l.HttpClient.Do(req)
 	if err != nil {
@@ -158,19 +256,7 @@ func (l *LokiProtoClient) SendData(ctx context.Context, data *LokiStreams) error
 		}
 	}(resp.Body)
 
-	if resp.StatusCode != 204 {
-		responseBody, err := ioutil.ReadAll(resp.Body)
-		if err == nil {
-			SugaredLogger.Debugf("{%d} - {%s}", resp.StatusCode, string(responseBody))
-		} else {
-			SugaredLogger.Debugf("%v", err)
-		}
-		sentry.CaptureException(err)
-	} else {
-		SugaredLogger.Debugf("{%d}", resp.StatusCode)
-	}
-
-	return nil
+	return checkPushResponse(resp)
 }
 
 // SetHttpClient replaces the default http speedySink.
@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
 	"io/ioutil"
 	"math"
 	"net/http"
+	"speedy/pkg/logproto"
 	speedyTesting "speedy/pkg/testing"
 	"testing"
+	"time"
 )
 import "github.com/stretchr/testify/assert"
 
@@ -16,12 +20,48 @@ import "github.com/stretchr/testify/assert"
 func Test_NewLokiStreams(t *testing.T) {
 	streams := NewLokiStreams(1000, math.MaxInt32)
 	assert.NotNil(t, streams)
-	assert.Equal(t, 1000, cap(streams.Streams))
+	assert.Equal(t, initialStreamsCapacity, cap(streams.Streams))
 	assert.Equal(t, 0, len(streams.Streams))
 	assert.Equal(t, math.MaxInt32, streams.bufferMaxByteSize)
 	assert.Equal(t, 1000, streams.bufferMaxBatchSize)
 }
 
+// Test_LokiStreams_AddData ensures that entries with the same label set are grouped into the same stream.
+func Test_LokiStreams_AddData(t *testing.T) {
+	streams := NewLokiStreams(1000, math.MaxInt32)
+	streams.AddData(LokiStream{
+		Labels: map[string]string{"key": "topic", "clientId": "1"},
+		Values: [][]string{{"0", "line-0"}},
+		Size:   20,
+	})
+	streams.AddData(LokiStream{
+		Labels: map[string]string{"key": "topic", "clientId": "2"},
+		Values: [][]string{{"1", "line-1"}},
+		Size:   20,
+	})
+	streams.AddData(LokiStream{
+		Labels: map[string]string{"clientId": "1", "key": "topic"},
+		Values: [][]string{{"2", "line-2"}},
+		Size:   20,
+	})
+
+	assert.Equal(t, 3, streams.Count)
+	// Labels are 17 bytes, they are accounted once per label set.
+	assert.Equal(t, 43, streams.TotalSize)
+	assert.Equal(t, []LokiStream{
+		{
+			Labels: map[string]string{"key": "topic", "clientId": "1"},
+			Values: [][]string{{"0", "line-0"}, {"2", "line-2"}},
+			Size:   23,
+		},
+		{
+			Labels: map[string]string{"key": "topic", "clientId": "2"},
+			Values: [][]string{{"1", "line-1"}},
+			Size:   20,
+		},
+	}, withoutKeys(streams.Streams))
+}
+
 func Test_LokiClientFactoryCreate(t *testing.T) {
 	var tests = []struct {
 		clientName  string
@@ -35,6 +75,10 @@ func Test_LokiClientFactoryCreate(t *testing.T) {
 			"http",
 			false,
 		},
+		{
+			"grpc",
+			false,
+		},
 		{
 			"batman",
 			true,
@@ -42,11 +86,14 @@ func Test_LokiClientFactoryCreate(t *testing.T) {
 	}
 	for index, tt := range tests {
 		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
-			lokiClient := LokiClientFactoryCreate(tt.clientName, "https://loki.com/loki/api/v1/push")
+			lokiClient, err := LokiClientFactoryCreate(tt.clientName, "https://loki.com/loki/api/v1/push", LokiClientOptions{})
 			if tt.expectedNil {
 				assert.Nil(t, lokiClient)
+				assert.Error(t, err)
 			} else {
 				assert.NotNil(t, lokiClient)
+				assert.Nil(t, err)
+				lokiClient.Shutdown()
 			}
 		})
 
@@ -87,13 +134,19 @@ func Test_NewLokiHttpClient_SendData(t *testing.T) {
 	assert.Nil(t, err)
 
 	assert.Equal(t, "{\"streams\":[{\"stream\":{\"label1\":\"value\"},\"values\":[[\"0\",\"log-line\"]]}]}", string(requestBody))
+	assert.Equal(t, "", lastRequest.Header.Get("X-Scope-OrgID"))
+
+	dummyData.Tenant = "team-a"
+	err = client.SendData(context.Background(), &dummyData)
+	assert.Nil(t, err)
+	assert.Equal(t, "team-a", lastRequest.Header.Get("X-Scope-OrgID"))
 }
 
-// Test_NewLokiProtoClient_SendData ensures that SendData from LokiHttpClient works as expected.
+// Test_NewLokiProtoClient_SendData ensures that SendData from LokiProtoClient works as expected.
 func Test_NewLokiProtoClient_SendData(t *testing.T) {
 	var lastRequest *http.Request = nil
 
-	client := &LokiHttpClient{lokiUrl: "https://loki.com/loki/api/v1/push", HttpClient: &http.Client{}}
+	client := &LokiProtoClient{lokiUrl: "https://loki.com/loki/api/v1/push", HttpClient: &http.Client{}}
 	client.SetHttpClient(speedyTesting.NewTestClient(func(req *http.Request) *http.Response {
 		lastRequest = req
 		return &http.Response{
@@ -106,19 +159,57 @@ func Test_NewLokiProtoClient_SendData(t *testing.T) {
 	}))
 	assert.NotNil(t, client)
 
-	dummyData := LokiStreams{
-		Streams: []LokiStream{{
-			Labels: map[string]string{
-				"label1": "value",
-			},
-			Values: [][]string{{"0", "log-line"}},
-		}},
-		Count: 0,
-	}
-	err := client.SendData(context.Background(), &dummyData)
+	dummyData := NewLokiStreams(10, math.MaxInt32)
+	dummyData.AddData(LokiStream{
+		Labels: map[string]string{"label2": "value", "label1": "value"},
+		Values: [][]string{{"0", "log-line-0"}},
+	})
+	dummyData.AddData(LokiStream{
+		Labels: map[string]string{"label1": "value", "label2": "value"},
+		Values: [][]string{{"1", "log-line-1"}},
+	})
+	err := client.SendData(context.Background(), dummyData)
 	assert.Nil(t, err)
 
 	requestBody, err := ioutil.ReadAll(lastRequest.Body)
 	assert.Nil(t, err)
 	assert.NotEmpty(t, requestBody)
+
+	decodedBody, err := snappy.Decode(nil, requestBody)
+	assert.Nil(t, err)
+	var pushRequest logproto.PushRequest
+	assert.Nil(t, proto.Unmarshal(decodedBody, &pushRequest))
+	assert.Len(t, pushRequest.Streams, 1)
+	assert.Equal(t, `{label1="value", label2="value"}`, pushRequest.Streams[0].Labels)
+	assert.Len(t, pushRequest.Streams[0].Entries, 2)
+	assert.Equal(t, "log-line-0", pushRequest.Streams[0].Entries[0].Line)
+	assert.Equal(t, "log-line-1", pushRequest.Streams[0].Entries[1].Line)
+	assert.Equal(t, "", lastRequest.Header.Get("X-Scope-OrgID"))
+
+	dummyData.Tenant = "team-a"
+	err = client.SendData(context.Background(), dummyData)
+	assert.Nil(t, err)
+	assert.Equal(t, "team-a", lastRequest.Header.Get("X-Scope-OrgID"))
+}
+
+// Test_LokiHttpClient_SendData_Error ensures that unsuccessful responses are returned as LokiPushError.
+func Test_LokiHttpClient_SendData_Error(t *testing.T) {
+	client := NewLokiHttpClient("https://loki.com/loki/api/v1/push").(*LokiHttpClient)
+	client.SetHttpClient(speedyTesting.NewTestClient(func(req *http.Request) *http.Response {
+		header := make(http.Header)
+		header.Set("Retry-After", "3")
+		return &http.Response{
+			StatusCode: 429,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("rate limited\n")),
+			Header:     header,
+		}
+	}))
+
+	err := client.SendData(context.Background(), NewLokiStreams(1, math.MaxInt32))
+	pushError, ok := err.(*LokiPushError)
+	assert.True(t, ok)
+	assert.Equal(t, 429, pushError.StatusCode)
+	assert.Equal(t, 3*time.Second, pushError.RetryAfter)
+	assert.Equal(t, "rate limited", pushError.Body)
+	assert.True(t, pushError.Retryable())
 }
@@ -0,0 +1,204 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"strconv"
+	"time"
+)
+
+const (
+	// FlushReasonSize is a flush of a batch that reached buffer_max_batch_size.
+	FlushReasonSize = "size"
+	// FlushReasonBytes is a flush of a batch that reached buffer_max_bytes_size.
+	FlushReasonBytes = "bytes"
+	// FlushReasonTimer is a periodical flush of a stale batch.
+	FlushReasonTimer = "timer"
+	// FlushReasonShutdown is the flush of the pusher shutdown.
+	FlushReasonShutdown = "shutdown"
+	// FlushReasonFlush is a flush requested with Flush, e.g. before a rebalance.
+	FlushReasonFlush = "flush"
+)
+
+var (
+	messagesConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "speedy_messages_consumed_total",
+		Help: "Number of messages consumed from Kafka.",
+	}, []string{"topic"})
+	decodeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "speedy_decode_failures_total",
+		Help: "Number of messages that couldn't be decoded.",
+	}, []string{"topic"})
+	decodeRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "speedy_decode_retries_total",
+		Help: "Number of decodings retried because the schema registry was unavailable.",
+	}, []string{"topic"})
+	messagesFiltered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "speedy_messages_filtered_total",
+		Help: "Number of messages dropped by the filter rules, by rule.",
+	}, []string{"rule"})
+	redactions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "speedy_redactions_total",
+		Help: "Number of values redacted, by pattern or fields for the redacted fields.",
+	}, []string{"rule"})
+	entriesPushed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "speedy_entries_pushed_total",
+		Help: "Number of entries pushed to Loki.",
+	})
+	bytesPushed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "speedy_bytes_pushed_total",
+		Help: "Number of bytes pushed to Loki, uncompressed and unserialized.",
+	})
+	pushDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "speedy_push_duration_seconds",
+		Help:    "Duration of the push requests to Loki by status: ok, the HTTP status code, canceled or error.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"status"})
+	batchEntries = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "speedy_batch_entries",
+		Help:    "Number of entries of the flushed batches.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+	})
+	batchBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "speedy_batch_bytes",
+		Help:    "Size in bytes of the flushed batches.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+	flushes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "speedy_flushes_total",
+		Help: "Number of batch flushes by reason: size, bytes, timer, shutdown or flush.",
+	}, []string{"reason"})
+	inflightRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "speedy_inflight_requests",
+		Help: "Number of batches handed to the send workers that are not sent yet.",
+	})
+	pendingOffsets = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "speedy_pending_offsets",
+		Help: "Number of consumed messages whose offsets can't be committed yet, per partition.",
+	}, []string{"topic", "partition"})
+	walBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "speedy_wal_bytes",
+		Help: "Size in bytes of the segments of the write-ahead log.",
+	})
+	walCorruptedSegments = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "speedy_wal_corrupted_segments_total",
+		Help: "Number of write-ahead log segments whose replay stopped at a corrupted record.",
+	})
+	walWriteErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "speedy_wal_write_errors_total",
+		Help: "Number of failed encodings, writes and syncs of the write-ahead log records.",
+	})
+)
+
+// topicName returns the topic of the message, empty if unknown.
+func topicName(topicPartition kafka.TopicPartition) string {
+	if topicPartition.Topic == nil {
+		return ""
+	}
+	return *topicPartition.Topic
+}
+
+// pushStatus returns the status label of a push result.
+func pushStatus(err error) string {
+	var pushError *LokiPushError
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.As(err, &pushError):
+		return strconv.Itoa(pushError.StatusCode)
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	return "error"
+}
+
+// InstrumentedSink is an ISpeedySink that reports the metrics of the pushes of the wrapped sink.
+type InstrumentedSink struct {
+	sink ISpeedySink
+}
+
+// NewInstrumentedSink creates a new InstrumentedSink.
+func NewInstrumentedSink(sink ISpeedySink) *InstrumentedSink {
+	if sink == nil {
+		panic("Speedy sink is nil")
+	}
+	return &InstrumentedSink{sink: sink}
+}
+
+// SendData sends the data with the wrapped sink and records the duration, the entries and the bytes pushed.
+func (s *InstrumentedSink) SendData(ctx context.Context, data *LokiStreams) error {
+	start := time.Now()
+	err := s.sink.SendData(ctx, data)
+	pushDuration.WithLabelValues(pushStatus(err)).Observe(time.Since(start).Seconds())
+	if err == nil {
+		entriesPushed.Add(float64(data.Count))
+		bytesPushed.Add(float64(data.TotalSize))
+	}
+	return err
+}
+
+// Shutdown shuts down the wrapped sink.
+func (s *InstrumentedSink) Shutdown() {
+	s.sink.Shutdown()
+}
+
+// IKafkaLagSource provides the data needed to compute the consumer lag, kafka.Consumer implements it.
+type IKafkaLagSource interface {
+	Assignment() ([]kafka.TopicPartition, error)
+	Position(partitions []kafka.TopicPartition) ([]kafka.TopicPartition, error)
+	GetWatermarkOffsets(topic string, partition int32) (low, high int64, err error)
+}
+
+// ConsumerLagCollector is a prometheus.Collector that reports the lag of the assigned partitions.
+// The lag is the difference between the high watermark and the position of the consumer.
+type ConsumerLagCollector struct {
+	source      IKafkaLagSource
+	description *prometheus.Desc
+}
+
+// NewConsumerLagCollector creates a new ConsumerLagCollector.
+func NewConsumerLagCollector(source IKafkaLagSource) *ConsumerLagCollector {
+	return &ConsumerLagCollector{
+		source: source,
+		description: prometheus.NewDesc(
+			"speedy_consumer_lag",
+			"Number of messages of the partition that are not consumed yet.",
+			[]string{"topic", "partition"}, nil,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *ConsumerLagCollector) Describe(descriptions chan<- *prometheus.Desc) {
+	descriptions <- c.description
+}
+
+// Collect implements prometheus.Collector.
+func (c *ConsumerLagCollector) Collect(metrics chan<- prometheus.Metric) {
+	assignment, err := c.source.Assignment()
+	if err != nil || len(assignment) == 0 {
+		return
+	}
+	positions, err := c.source.Position(assignment)
+	if err != nil {
+		SugaredLogger.Debugf("failed to get the consumer positions: %s", err)
+		return
+	}
+	for _, position := range positions {
+		topic := topicName(position)
+		_, high, err := c.source.GetWatermarkOffsets(topic, position.Partition)
+		// Partitions without a position or watermark yet have no lag to report.
+		if err != nil || position.Offset < 0 || high < 0 {
+			continue
+		}
+		lag := high - int64(position.Offset)
+		if lag < 0 {
+			lag = 0
+		}
+		metrics <- prometheus.MustNewConstMetric(c.description, prometheus.GaugeValue, float64(lag),
+			topic, strconv.Itoa(int(position.Partition)))
+	}
+}
@@ -0,0 +1,165 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"strings"
+	"testing"
+)
+
+// histogramCount returns the number of observations of a histogram.
+func histogramCount(t *testing.T, observer prometheus.Observer) uint64 {
+	metric := &dto.Metric{}
+	assert.Nil(t, observer.(prometheus.Metric).Write(metric))
+	return metric.GetHistogram().GetSampleCount()
+}
+
+// Test_pushStatus ensures that push results are turned into status labels.
+func Test_pushStatus(t *testing.T) {
+	var tests = []struct {
+		err      error
+		expected string
+	}{
+		{nil, "ok"},
+		{&LokiPushError{StatusCode: 429}, "429"},
+		{fmt.Errorf("wrapped: %w", &LokiPushError{StatusCode: 500}), "500"},
+		{context.Canceled, "canceled"},
+		{errors.New("connection refused"), "error"},
+	}
+	for index, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			assert.Equal(t, tt.expected, pushStatus(tt.err))
+		})
+	}
+}
+
+// Test_InstrumentedSink_SendData ensures that pushes are measured and delivered entries are counted.
+func Test_InstrumentedSink_SendData(t *testing.T) {
+	sink := &SpeedyTestSink{}
+	instrumentedSink := NewInstrumentedSink(sink)
+	streams := NewLokiStreams(10, math.MaxInt32)
+	streams.AddData(LokiStream{Labels: map[string]string{"a": "b"}, Values: [][]string{{"1", "line"}, {"2", "line"}}, Size: 10})
+
+	entries, bytes := testutil.ToFloat64(entriesPushed), testutil.ToFloat64(bytesPushed)
+	okCount, rejectedCount := histogramCount(t, pushDuration.WithLabelValues("ok")), histogramCount(t, pushDuration.WithLabelValues("400"))
+
+	assert.Nil(t, instrumentedSink.SendData(context.Background(), streams))
+	sink.sendDataError = &LokiPushError{StatusCode: 400}
+	assert.Error(t, instrumentedSink.SendData(context.Background(), streams))
+
+	assert.Equal(t, entries+2, testutil.ToFloat64(entriesPushed))
+	assert.Equal(t, bytes+10, testutil.ToFloat64(bytesPushed))
+	assert.Equal(t, okCount+1, histogramCount(t, pushDuration.WithLabelValues("ok")))
+	assert.Equal(t, rejectedCount+1, histogramCount(t, pushDuration.WithLabelValues("400")))
+
+	instrumentedSink.Shutdown()
+	assert.True(t, sink.shutdown)
+}
+
+// Test_Pusher_FlushReasons ensures that flushes are counted by reason.
+func Test_Pusher_FlushReasons(t *testing.T) {
+	before := make(map[string]float64)
+	for _, reason := range []string{FlushReasonSize, FlushReasonBytes, FlushReasonFlush, FlushReasonShutdown} {
+		before[reason] = testutil.ToFloat64(flushes.WithLabelValues(reason))
+	}
+	lokiPusher := NewPusher(&concurrentTestSink{}, 2, 100)
+	done := make(chan struct{})
+	go func() {
+		lokiPusher.RunForever()
+		close(done)
+	}()
+
+	lokiPusher.DataChannel <- LokiStream{Labels: map[string]string{"a": "b"}, Values: [][]string{{"1", "line"}}, Size: 1}
+	lokiPusher.DataChannel <- LokiStream{Labels: map[string]string{"a": "b"}, Values: [][]string{{"2", "line"}}, Size: 1}
+	lokiPusher.DataChannel <- LokiStream{Labels: map[string]string{"a": "b"}, Values: [][]string{{"3", "line"}}, Size: 200}
+	lokiPusher.DataChannel <- LokiStream{Labels: map[string]string{"a": "b"}, Values: [][]string{{"4", "line"}}, Size: 1}
+	lokiPusher.Flush()
+	lokiPusher.DataChannel <- LokiStream{Labels: map[string]string{"a": "b"}, Values: [][]string{{"5", "line"}}, Size: 1}
+	lokiPusher.Shutdown()
+	<-done
+
+	assert.Equal(t, before[FlushReasonSize]+1, testutil.ToFloat64(flushes.WithLabelValues(FlushReasonSize)))
+	assert.Equal(t, before[FlushReasonBytes]+1, testutil.ToFloat64(flushes.WithLabelValues(FlushReasonBytes)))
+	assert.Equal(t, before[FlushReasonFlush]+1, testutil.ToFloat64(flushes.WithLabelValues(FlushReasonFlush)))
+	assert.Equal(t, before[FlushReasonShutdown]+1, testutil.ToFloat64(flushes.WithLabelValues(FlushReasonShutdown)))
+}
+
+// Test_Dispatcher_Metrics ensures that consumed messages and decode failures are counted per topic.
+func Test_Dispatcher_Metrics(t *testing.T) {
+	pusher := NewShardedPusher(1, &concurrentTestSink{}, 1000, math.MaxInt32)
+	dispatcher := NewDispatcher(1, newTestMessageProcessor(t), pusher)
+	go pusher.RunForever()
+	dispatcher.Start()
+
+	assert.Nil(t, dispatcher.Dispatch(context.Background(), testMessage("metrics-topic", 0, 0, `{"a": 1}`)))
+	assert.Nil(t, dispatcher.Dispatch(context.Background(), testMessage("metrics-topic", 0, 1, "not json")))
+	dispatcher.Shutdown()
+	pusher.Shutdown()
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(messagesConsumed.WithLabelValues("metrics-topic")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(decodeFailures.WithLabelValues("metrics-topic")))
+}
+
+// Test_ShardedPusher_Collect ensures that the occupancy of the DataChannel of each shard is reported.
+func Test_ShardedPusher_Collect(t *testing.T) {
+	pusher := NewShardedPusher(2, &concurrentTestSink{}, 1000, math.MaxInt32)
+	pusher.Pushers()[1].DataChannel <- LokiStream{}
+
+	err := testutil.CollectAndCompare(pusher, strings.NewReader(`
+# HELP speedy_pusher_data_channel_length Number of streams waiting in the DataChannel of the pusher shard.
+# TYPE speedy_pusher_data_channel_length gauge
+speedy_pusher_data_channel_length{shard="0"} 0
+speedy_pusher_data_channel_length{shard="1"} 1
+`))
+	assert.Nil(t, err)
+}
+
+// testLagSource is an IKafkaLagSource used for internal testing.
+type testLagSource struct {
+	positions  []kafka.TopicPartition
+	watermarks map[string]int64
+}
+
+func (s *testLagSource) Assignment() ([]kafka.TopicPartition, error) {
+	return s.positions, nil
+}
+
+func (s *testLagSource) Position(_ []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	return s.positions, nil
+}
+
+func (s *testLagSource) GetWatermarkOffsets(topic string, partition int32) (int64, int64, error) {
+	high, ok := s.watermarks[fmt.Sprintf("%s[%d]", topic, partition)]
+	if !ok {
+		return 0, 0, errors.New("unknown partition")
+	}
+	return 0, high, nil
+}
+
+// Test_ConsumerLagCollector_Collect ensures that the lag of the assigned partitions is reported.
+func Test_ConsumerLagCollector_Collect(t *testing.T) {
+	source := &testLagSource{
+		positions: []kafka.TopicPartition{
+			testTopicPartition("topic", 0, 90),
+			testTopicPartition("topic", 1, 10),
+			testTopicPartition("topic", 2, int64(kafka.OffsetInvalid)),
+			testTopicPartition("other", 0, 5),
+		},
+		watermarks: map[string]int64{"topic[0]": 100, "topic[1]": 10, "topic[2]": 50},
+	}
+
+	err := testutil.CollectAndCompare(NewConsumerLagCollector(source), strings.NewReader(`
+# HELP speedy_consumer_lag Number of messages of the partition that are not consumed yet.
+# TYPE speedy_consumer_lag gauge
+speedy_consumer_lag{partition="0",topic="topic"} 10
+speedy_consumer_lag{partition="1",topic="topic"} 0
+`))
+	assert.Nil(t, err)
+}
@@ -0,0 +1,206 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/getsentry/sentry-go"
+	"strconv"
+	"sync"
+)
+
+// IOffsetCommitter is the interface for committing Kafka offsets, it's implemented by kafka.Consumer.
+type IOffsetCommitter interface {
+	CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error)
+}
+
+// partitionID identifies a Kafka partition.
+type partitionID struct {
+	topic     string
+	partition int32
+}
+
+// String returns the partition as topic[partition].
+func (p partitionID) String() string {
+	return fmt.Sprintf("%s[%d]", p.topic, p.partition)
+}
+
+// partitionOffsets holds the state of the offsets of a partition.
+type partitionOffsets struct {
+	topic     string
+	partition int32
+	// tracked are the tracked offsets in the order they were consumed, from the lowest one that's not committable.
+	tracked []int64
+	// done maps the tracked offsets to whether they're done.
+	done map[int64]bool
+	// committable is the next offset to consume once all the done offsets are committed.
+	committable int64
+	// committed is the next offset to consume, as committed to Kafka.
+	committed int64
+}
+
+// advance moves the committable offset past the done offsets at the start of the tracked offsets.
+func (p *partitionOffsets) advance() {
+	for len(p.tracked) > 0 && p.done[p.tracked[0]] {
+		p.committable = p.tracked[0] + 1
+		delete(p.done, p.tracked[0])
+		p.tracked = p.tracked[1:]
+	}
+}
+
+// OffsetTracker keeps track of the consumed Kafka messages and commits their offsets once they've been delivered.
+// An offset is committed only when it and all the offsets tracked before it on the same partition are done,
+// so messages can be delivered out of order without committing past undelivered messages.
+type OffsetTracker struct {
+	committer  IOffsetCommitter
+	mutex      sync.Mutex
+	partitions map[partitionID]*partitionOffsets
+	// commitMutex is held during the commits to Kafka, without holding mutex, so that tracking isn't blocked.
+	commitMutex sync.Mutex
+	// committing is set while a commit runs, the commits requested meanwhile are coalesced into a single one.
+	committing      bool
+	commitRequested bool
+}
+
+// NewOffsetTracker creates a new OffsetTracker.
+func NewOffsetTracker(committer IOffsetCommitter) *OffsetTracker {
+	if committer == nil {
+		panic("Offset committer is nil")
+	}
+	return &OffsetTracker{
+		committer:  committer,
+		partitions: make(map[partitionID]*partitionOffsets),
+	}
+}
+
+// partitionKey returns the key of the partition of the given TopicPartition.
+func partitionKey(tp kafka.TopicPartition) partitionID {
+	topic := ""
+	if tp.Topic != nil {
+		topic = *tp.Topic
+	}
+	return partitionID{topic: topic, partition: tp.Partition}
+}
+
+// Track marks the offset of the given message as pending. It must be called in the order the messages are consumed.
+func (t *OffsetTracker) Track(tp kafka.TopicPartition) {
+	if tp.Topic == nil || tp.Offset < 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := partitionKey(tp)
+	offsets, ok := t.partitions[key]
+	if !ok {
+		offsets = &partitionOffsets{
+			topic:       *tp.Topic,
+			partition:   tp.Partition,
+			done:        make(map[int64]bool),
+			committable: int64(kafka.OffsetInvalid),
+			committed:   int64(kafka.OffsetInvalid),
+		}
+		t.partitions[key] = offsets
+	}
+	if _, ok := offsets.done[int64(tp.Offset)]; !ok {
+		offsets.tracked = append(offsets.tracked, int64(tp.Offset))
+	}
+	offsets.done[int64(tp.Offset)] = false
+}
+
+// MarkDone marks the given offsets as done, offsets that are not tracked are ignored.
+func (t *OffsetTracker) MarkDone(tps ...kafka.TopicPartition) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, tp := range tps {
+		offsets, ok := t.partitions[partitionKey(tp)]
+		if !ok {
+			continue
+		}
+		if _, ok := offsets.done[int64(tp.Offset)]; ok {
+			offsets.done[int64(tp.Offset)] = true
+			offsets.advance()
+		}
+	}
+}
+
+// Commit commits, for every partition, the offset following the last contiguous done offset.
+// The commits requested while one runs are coalesced, the running one commits their offsets once it's done.
+func (t *OffsetTracker) Commit() error {
+	t.mutex.Lock()
+	if t.committing {
+		t.commitRequested = true
+		t.mutex.Unlock()
+		return nil
+	}
+	t.committing = true
+	t.mutex.Unlock()
+
+	for {
+		err := t.commitOnce()
+		t.mutex.Lock()
+		if !t.commitRequested {
+			t.committing = false
+			t.mutex.Unlock()
+			return err
+		}
+		t.commitRequested = false
+		t.mutex.Unlock()
+	}
+}
+
+// commitOnce commits the committable offsets, the commit to Kafka is done without holding mutex.
+func (t *OffsetTracker) commitOnce() error {
+	t.commitMutex.Lock()
+	defer t.commitMutex.Unlock()
+
+	t.mutex.Lock()
+	toCommit := make([]kafka.TopicPartition, 0, len(t.partitions))
+	committedPartitions := make([]*partitionOffsets, 0, len(t.partitions))
+	for _, offsets := range t.partitions {
+		pendingOffsets.WithLabelValues(offsets.topic, strconv.Itoa(int(offsets.partition))).Set(float64(len(offsets.tracked)))
+		if offsets.committable > offsets.committed {
+			topic := offsets.topic
+			toCommit = append(toCommit, kafka.TopicPartition{
+				Topic:     &topic,
+				Partition: offsets.partition,
+				Offset:    kafka.Offset(offsets.committable),
+			})
+			committedPartitions = append(committedPartitions, offsets)
+		}
+	}
+	t.mutex.Unlock()
+
+	if len(toCommit) == 0 {
+		return nil
+	}
+	_, err := t.committer.CommitOffsets(toCommit)
+	if err != nil {
+		SugaredLogger.Errorf("failed to commit offsets: %s", err)
+		sentry.CaptureException(err)
+		return err
+	}
+	t.mutex.Lock()
+	for index, offsets := range committedPartitions {
+		offsets.committed = int64(toCommit[index].Offset)
+	}
+	t.mutex.Unlock()
+	SugaredLogger.Debugf("committed offsets %v", toCommit)
+	return nil
+}
+
+// Revoke forgets the state of the given partitions, so that their offsets are no longer committed.
+// It waits for the running commit, so that nothing is committed for the partitions once it returns.
+func (t *OffsetTracker) Revoke(tps []kafka.TopicPartition) {
+	t.commitMutex.Lock()
+	defer t.commitMutex.Unlock()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, tp := range tps {
+		if offsets, ok := t.partitions[partitionKey(tp)]; ok {
+			pendingOffsets.DeleteLabelValues(offsets.topic, strconv.Itoa(int(offsets.partition)))
+		}
+		delete(t.partitions, partitionKey(tp))
+	}
+}
@@ -0,0 +1,185 @@
+package pkg
+
+import (
+	"errors"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testOffsetCommitter is an IOffsetCommitter used for internal testing.
+type testOffsetCommitter struct {
+	committed []kafka.TopicPartition
+	err       error
+}
+
+func (c *testOffsetCommitter) CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.committed = append(c.committed, offsets...)
+	return offsets, nil
+}
+
+// testTopicPartition creates a new TopicPartition.
+func testTopicPartition(topic string, partition int32, offset int64) kafka.TopicPartition {
+	return kafka.TopicPartition{Topic: &topic, Partition: partition, Offset: kafka.Offset(offset)}
+}
+
+// committedOffsets returns the committed offsets keyed by partition.
+func committedOffsets(committer *testOffsetCommitter) map[string]int64 {
+	offsets := make(map[string]int64)
+	for _, tp := range committer.committed {
+		offsets[partitionKey(tp).String()] = int64(tp.Offset)
+	}
+	return offsets
+}
+
+// Test_OffsetTracker_Commit ensures that offsets are committed only up to the first undelivered message.
+func Test_OffsetTracker_Commit(t *testing.T) {
+	committer := &testOffsetCommitter{}
+	tracker := NewOffsetTracker(committer)
+
+	for offset := int64(0); offset < 5; offset++ {
+		tracker.Track(testTopicPartition("topic", 0, offset))
+	}
+	tracker.Track(testTopicPartition("topic", 1, 10))
+
+	// Nothing delivered, nothing committed.
+	assert.Nil(t, tracker.Commit())
+	assert.Empty(t, committer.committed)
+
+	tracker.MarkDone(testTopicPartition("topic", 0, 0), testTopicPartition("topic", 0, 1), testTopicPartition("topic", 0, 3))
+	assert.Nil(t, tracker.Commit())
+	assert.Equal(t, map[string]int64{"topic[0]": 2}, committedOffsets(committer))
+
+	tracker.MarkDone(testTopicPartition("topic", 0, 2), testTopicPartition("topic", 1, 10))
+	assert.Nil(t, tracker.Commit())
+	assert.Equal(t, map[string]int64{"topic[0]": 4, "topic[1]": 11}, committedOffsets(committer))
+
+	// Committing again without progress is a no-op.
+	committer.committed = nil
+	assert.Nil(t, tracker.Commit())
+	assert.Empty(t, committer.committed)
+}
+
+// Test_OffsetTracker_CommitError ensures that offsets are committed again after a failed commit.
+func Test_OffsetTracker_CommitError(t *testing.T) {
+	committer := &testOffsetCommitter{err: errors.New("commit failed")}
+	tracker := NewOffsetTracker(committer)
+
+	tracker.Track(testTopicPartition("topic", 0, 0))
+	tracker.MarkDone(testTopicPartition("topic", 0, 0))
+	assert.Error(t, tracker.Commit())
+
+	committer.err = nil
+	assert.Nil(t, tracker.Commit())
+	assert.Equal(t, map[string]int64{"topic[0]": 1}, committedOffsets(committer))
+}
+
+// Test_OffsetTracker_Revoke ensures that revoked partitions are never committed.
+func Test_OffsetTracker_Revoke(t *testing.T) {
+	committer := &testOffsetCommitter{}
+	tracker := NewOffsetTracker(committer)
+
+	tracker.Track(testTopicPartition("topic", 0, 0))
+	tracker.Track(testTopicPartition("topic", 1, 0))
+	tracker.Revoke([]kafka.TopicPartition{testTopicPartition("topic", 0, 0)})
+	tracker.MarkDone(testTopicPartition("topic", 0, 0), testTopicPartition("topic", 1, 0))
+	assert.Nil(t, tracker.Commit())
+
+	keys := make([]string, 0)
+	for key := range committedOffsets(committer) {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	assert.Equal(t, []string{"topic[1]"}, keys)
+}
+
+// blockingOffsetCommitter is an IOffsetCommitter whose commits wait to be released, like a slow broker round trip.
+type blockingOffsetCommitter struct {
+	started chan struct{}
+	release chan struct{}
+	mutex   sync.Mutex
+	commits int
+	offsets map[string]int64
+}
+
+func newBlockingOffsetCommitter() *blockingOffsetCommitter {
+	return &blockingOffsetCommitter{
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}, 10),
+		offsets: make(map[string]int64),
+	}
+}
+
+func (c *blockingOffsetCommitter) CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	c.started <- struct{}{}
+	<-c.release
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.commits++
+	for _, tp := range offsets {
+		c.offsets[partitionKey(tp).String()] = int64(tp.Offset)
+	}
+	return offsets, nil
+}
+
+// Test_OffsetTracker_Commit_Coalesced ensures that tracking isn't blocked by a running commit, and that the commits
+// requested meanwhile are coalesced into a single one.
+func Test_OffsetTracker_Commit_Coalesced(t *testing.T) {
+	committer := newBlockingOffsetCommitter()
+	tracker := NewOffsetTracker(committer)
+	tracker.Track(testTopicPartition("topic", 0, 0))
+	tracker.MarkDone(testTopicPartition("topic", 0, 0))
+
+	committed := make(chan error)
+	go func() {
+		committed <- tracker.Commit()
+	}()
+	<-committer.started
+	// The commit to Kafka is running, the tracker is still usable and the other commits are coalesced.
+	for offset := int64(1); offset < 10; offset++ {
+		tracker.Track(testTopicPartition("topic", 0, offset))
+		tracker.MarkDone(testTopicPartition("topic", 0, offset))
+		assert.Nil(t, tracker.Commit())
+	}
+	committer.release <- struct{}{}
+	<-committer.started
+	committer.release <- struct{}{}
+	assert.Nil(t, <-committed)
+
+	assert.Equal(t, 2, committer.commits)
+	assert.Equal(t, map[string]int64{"topic[0]": 10}, committer.offsets)
+}
+
+// Test_OffsetTracker_Revoke_RunningCommit ensures that Revoke waits for the running commit.
+func Test_OffsetTracker_Revoke_RunningCommit(t *testing.T) {
+	committer := newBlockingOffsetCommitter()
+	tracker := NewOffsetTracker(committer)
+	tp := testTopicPartition("topic", 0, 0)
+	tracker.Track(tp)
+	tracker.MarkDone(tp)
+
+	go func() {
+		_ = tracker.Commit()
+	}()
+	<-committer.started
+	revoked := make(chan struct{})
+	go func() {
+		tracker.Revoke([]kafka.TopicPartition{tp})
+		close(revoked)
+	}()
+	select {
+	case <-revoked:
+		t.Fatal("Revoke returned during the commit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	committer.release <- struct{}{}
+	<-revoked
+	assert.Empty(t, tracker.partitions)
+	assert.Equal(t, 1, committer.commits)
+}
@@ -0,0 +1,194 @@
+package pkg
+
+import (
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"sync"
+)
+
+// MessageProcessor turns Kafka messages into LokiStream entries.
+type MessageProcessor struct {
+	decoders           *TopicDecoders
+	timestampExtractor *TimestampExtractor
+	labelExtractor     *LabelExtractor
+	tenantExtractor    *TenantExtractor
+	filter             *MessageFilter
+	redactor           *Redactor
+	lineFormatters     *TopicLineFormatters
+	flattenOptions     FlattenOptions
+	streamingFields    []string
+}
+
+// NewMessageProcessor creates a new MessageProcessor.
+func NewMessageProcessor(decoders *TopicDecoders, timestampExtractor *TimestampExtractor, labelExtractor *LabelExtractor) *MessageProcessor {
+	if decoders == nil || timestampExtractor == nil || labelExtractor == nil {
+		panic("Decoders, timestamp or label extractor is nil")
+	}
+	processor := &MessageProcessor{
+		decoders:           decoders,
+		timestampExtractor: timestampExtractor,
+		labelExtractor:     labelExtractor,
+		lineFormatters:     &TopicLineFormatters{fallback: &FlattenedJsonLineFormatter{}},
+		flattenOptions:     DefaultFlattenOptions(),
+	}
+	processor.updateStreamingFields()
+	return processor
+}
+
+// Process decodes the given message and builds the LokiStream entry for it.
+// It returns ErrMessageFiltered when the message is dropped by the filter rules.
+func (p *MessageProcessor) Process(message *kafka.Message) (LokiStream, error) {
+	topic := topicName(message.TopicPartition)
+	formatter := p.lineFormatters.Formatter(topic)
+	if p.streamingFlatten(topic, formatter) {
+		// The line and the fields read by the filters and extractors are taken straight from the JSON, the
+		// messages the JsonFlattener can't flatten are decoded below.
+		flattener := jsonFlatteners.Get().(*JsonFlattener)
+		defer jsonFlatteners.Put(flattener)
+		if line, ok := p.flattenJson(flattener, message.Value); ok {
+			fields := make(map[string]interface{}, len(p.streamingFields))
+			flattener.Fields(fields)
+			if err := p.filterMessage(message, fields); err != nil {
+				return LokiStream{}, err
+			}
+			return p.stream(message, fields, line)
+		}
+	}
+
+	decoded, err := p.decoders.Decode(message)
+	if err != nil {
+		return LokiStream{}, err
+	}
+	flattenMap := Flatten(decoded.Fields, p.flattenOptions)
+	if err := p.filterMessage(message, *flattenMap); err != nil {
+		return LokiStream{}, err
+	}
+	if p.redactor != nil {
+		p.redactor.Redact(*flattenMap)
+	}
+	// Messages with fields are formatted according to their topic, the others are sent as their original line.
+	line := decoded.Line
+	if len(decoded.Fields) > 0 {
+		line, err = formatter.Format(decoded, *flattenMap)
+		if err != nil {
+			return LokiStream{}, err
+		}
+	} else {
+		formatter = &OriginalLineFormatter{}
+	}
+	// The original line isn't built from the redacted fields, the patterns are redacted from it instead.
+	if _, original := formatter.(*OriginalLineFormatter); original && p.redactor != nil {
+		line = p.redactor.RedactString(line)
+	}
+	return p.stream(message, *flattenMap, line)
+}
+
+// filterMessage returns ErrMessageFiltered when the message is dropped by the filter rules.
+func (p *MessageProcessor) filterMessage(message *kafka.Message, fields map[string]interface{}) error {
+	if p.filter == nil {
+		return nil
+	}
+	if rule := p.filter.Filter(message, fields); rule != "" {
+		messagesFiltered.WithLabelValues(rule).Inc()
+		return ErrMessageFiltered
+	}
+	return nil
+}
+
+// stream builds the LokiStream entry of the message from its flattened fields and its line.
+func (p *MessageProcessor) stream(message *kafka.Message, fields map[string]interface{}, line string) (LokiStream, error) {
+	labelsMap := p.labelExtractor.Extract(message, fields)
+
+	tenant := ""
+	if p.tenantExtractor != nil {
+		var err error
+		tenant, err = p.tenantExtractor.Extract(message, fields)
+		if err != nil {
+			return LokiStream{}, err
+		}
+	}
+
+	return LokiStream{
+		Labels:  labelsMap,
+		Values:  [][]string{{p.timestampExtractor.Extract(message, fields), line}},
+		Size:    len(line) + LabelsSize(labelsMap),
+		Sources: []kafka.TopicPartition{message.TopicPartition},
+		Tenant:  tenant,
+	}, nil
+}
+
+// streamingFlatten returns whether the flattened JSON line of the messages of the topic can be built straight from
+// their JSON, without decoding them.
+func (p *MessageProcessor) streamingFlatten(topic string, formatter LineFormatter) bool {
+	if _, flattened := formatter.(*FlattenedJsonLineFormatter); !flattened || p.redactor != nil {
+		return false
+	}
+	if _, isJson := p.decoders.Decoder(topic).(*JsonDecoder); !isJson {
+		return false
+	}
+	return p.flattenOptions == DefaultFlattenOptions()
+}
+
+// updateStreamingFields updates the flattened fields read by the filters and extractors, they're the only fields
+// decoded by the JsonFlattener.
+func (p *MessageProcessor) updateStreamingFields() {
+	fields := append(p.labelExtractor.Fields(), p.timestampExtractor.Fields()...)
+	if p.tenantExtractor != nil {
+		fields = append(fields, p.tenantExtractor.Fields()...)
+	}
+	if p.filter != nil {
+		fields = append(fields, p.filter.Fields()...)
+	}
+	p.streamingFields = fields
+}
+
+// jsonFlatteners are the JsonFlattener of the dispatcher workers.
+var jsonFlatteners = sync.Pool{
+	New: func() interface{} {
+		return NewJsonFlattener()
+	},
+}
+
+// flattenJson returns the flattened JSON of the given JSON object, and false when it can't be flattened, e.g. with
+// ambiguous keys, or when it has no fields. The values of the streaming fields are left in the flattener.
+func (p *MessageProcessor) flattenJson(flattener *JsonFlattener, data []byte) (string, bool) {
+	flattener.SetFields(p.streamingFields)
+	line, err := flattener.FlattenString(data)
+	// Objects without fields are sent as their original line.
+	if err != nil || line == "{}" {
+		return "", false
+	}
+	return line, true
+}
+
+// SetTenantExtractor sets the TenantExtractor used to find the Loki tenant of the messages.
+// Without one, the streams have no tenant.
+func (p *MessageProcessor) SetTenantExtractor(extractor *TenantExtractor) {
+	p.tenantExtractor = extractor
+	p.updateStreamingFields()
+}
+
+// SetMessageFilter sets the MessageFilter that drops messages before they're turned into LokiStream entries.
+func (p *MessageProcessor) SetMessageFilter(filter *MessageFilter) {
+	p.filter = filter
+	p.updateStreamingFields()
+}
+
+// SetRedactor sets the Redactor that removes sensitive data from the messages, after the filters.
+func (p *MessageProcessor) SetRedactor(redactor *Redactor) {
+	p.redactor = redactor
+}
+
+// SetLineFormatters sets the TopicLineFormatters that build the lines of the messages with fields.
+// Without them, the lines are flattened JSON.
+func (p *MessageProcessor) SetLineFormatters(formatters *TopicLineFormatters) {
+	p.lineFormatters = formatters
+}
+
+// SetFlattenOptions sets the options used to flatten the message fields, they're validated.
+func (p *MessageProcessor) SetFlattenOptions(options FlattenOptions) error {
+	if err := options.Validate(); err != nil {
+		return err
+	}
+	p.flattenOptions = options
+	return nil
+}
@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// testMessage creates a new Kafka message.
+func testMessage(topic string, partition int32, offset int64, value string) *kafka.Message {
+	return &kafka.Message{
+		TopicPartition: testTopicPartition(topic, partition, offset),
+		Value:          []byte(value),
+		Timestamp:      time.Unix(1, 0),
+		TimestampType:  kafka.TimestampCreateTime,
+	}
+}
+
+// newTestMessageProcessor creates a MessageProcessor that uses the Kafka timestamp.
+func newTestMessageProcessor(t *testing.T) *MessageProcessor {
+	extractor, err := NewTimestampExtractor(TimestampSourceKafka, "", "")
+	assert.Nil(t, err)
+	labelExtractor, err := NewLabelExtractor(DefaultLabelRules)
+	assert.Nil(t, err)
+	decoders, err := NewTopicDecoders([]DecoderRule{{Topic: "^raw", Type: DecoderRaw}})
+	assert.Nil(t, err)
+	return NewMessageProcessor(decoders, extractor, labelExtractor)
+}
+
+// Test_MessageProcessor_Process ensures that messages are turned into LokiStream entries.
+func Test_MessageProcessor_Process(t *testing.T) {
+	processor := newTestMessageProcessor(t)
+	message := testMessage("topic", 2, 5, `{"clientID": "client", "nested": {"key": "value"}}`)
+
+	stream, err := processor.Process(message)
+	assert.Nil(t, err)
+	assert.Equal(t, LokiStream{
+		Labels:  map[string]string{"key": "topic", "clientId": "client"},
+		Values:  [][]string{{"1000000000", `{"clientID":"client","nested.key":"value"}`}},
+		Size:    len(`{"clientID":"client","nested.key":"value"}`) + 22,
+		Sources: []kafka.TopicPartition{message.TopicPartition},
+	}, stream)
+
+	_, err = processor.Process(testMessage("topic", 2, 6, "not json"))
+	assert.Error(t, err)
+
+	stream, err = processor.Process(testMessage("raw-topic", 0, 1, "plain text\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "plain text", stream.Values[0][1])
+	assert.Equal(t, map[string]string{"key": "raw-topic"}, stream.Labels)
+}
+
+// Test_MessageProcessor_Process_Tenant ensures that the tenant of the messages is extracted.
+func Test_MessageProcessor_Process_Tenant(t *testing.T) {
+	processor := newTestMessageProcessor(t)
+	tenantExtractor, err := NewTenantExtractor(ValueRule{Source: ValueSourceField, Path: "tenant"})
+	assert.Nil(t, err)
+	processor.SetTenantExtractor(tenantExtractor)
+
+	stream, err := processor.Process(testMessage("topic", 0, 1, `{"tenant": "team-a"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "team-a", stream.Tenant)
+
+	_, err = processor.Process(testMessage("topic", 0, 2, `{"message": "no tenant"}`))
+	assert.Error(t, err)
+}
+
+// Test_MessageProcessor_Process_UnixNanoTimestamp ensures that the timestamps in nanoseconds keep their precision,
+// with the JsonFlattener and without it.
+func Test_MessageProcessor_Process_UnixNanoTimestamp(t *testing.T) {
+	for _, streaming := range []bool{true, false} {
+		extractor, err := NewTimestampExtractor(TimestampSourceField, "time", "unix_ns")
+		assert.Nil(t, err)
+		labelExtractor, err := NewLabelExtractor(DefaultLabelRules)
+		assert.Nil(t, err)
+		decoders, err := NewTopicDecoders(nil)
+		assert.Nil(t, err)
+		processor := NewMessageProcessor(decoders, extractor, labelExtractor)
+		if !streaming {
+			assert.Nil(t, processor.SetFlattenOptions(FlattenOptions{MaxDepth: 100}))
+		}
+
+		stream, err := processor.Process(testMessage("topic", 0, 1, `{"time": 1700000000123456789}`))
+		assert.Nil(t, err)
+		assert.Equal(t, "1700000000123456789", stream.Values[0][0])
+	}
+}
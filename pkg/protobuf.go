@@ -0,0 +1,153 @@
+package pkg
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/goccy/go-json"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
+	"sync"
+)
+
+// protobufSchemaFileName is the file name under which the schema of a message is parsed.
+const protobufSchemaFileName = "speedy_schema.proto"
+
+// ProtobufDecoder decodes Protobuf messages in the Confluent wire format, fetching the schemas from a schema registry.
+type ProtobufDecoder struct {
+	registry *SchemaRegistryClient
+	mutex    sync.Mutex
+	files    map[int]*desc.FileDescriptor
+}
+
+// NewProtobufDecoder creates a new ProtobufDecoder.
+func NewProtobufDecoder(registry *SchemaRegistryClient) *ProtobufDecoder {
+	return &ProtobufDecoder{registry: registry, files: make(map[int]*desc.FileDescriptor)}
+}
+
+// Decode decodes the Protobuf message, the line is the message as JSON with the original field names.
+func (d *ProtobufDecoder) Decode(message *kafka.Message) (DecodedMessage, error) {
+	schemaId, payload, err := parseConfluentWireFormat(message.Value)
+	if err != nil {
+		return DecodedMessage{}, err
+	}
+	indexes, payload, err := parseProtobufMessageIndexes(payload)
+	if err != nil {
+		return DecodedMessage{}, err
+	}
+	file, err := d.file(schemaId)
+	if err != nil {
+		return DecodedMessage{}, err
+	}
+	descriptor, err := protobufMessageDescriptor(file, indexes)
+	if err != nil {
+		return DecodedMessage{}, err
+	}
+
+	protoMessage := dynamic.NewMessage(descriptor)
+	err = protoMessage.Unmarshal(payload)
+	if err != nil {
+		return DecodedMessage{}, err
+	}
+	jsonMessage, err := protoMessage.MarshalJSONPB(&jsonpb.Marshaler{OrigName: true})
+	if err != nil {
+		return DecodedMessage{}, err
+	}
+	fields := make(map[string]interface{})
+	err = json.Unmarshal(jsonMessage, &fields)
+	if err != nil {
+		return DecodedMessage{}, err
+	}
+	return DecodedMessage{Fields: fields, Line: string(jsonMessage)}, nil
+}
+
+// file returns the parsed schema with the given id.
+func (d *ProtobufDecoder) file(id int) (*desc.FileDescriptor, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if file, ok := d.files[id]; ok {
+		return file, nil
+	}
+	registrySchema, err := d.registry.SchemaById(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+	if registrySchema.SchemaType != "PROTOBUF" {
+		return nil, fmt.Errorf("schema %d is not a protobuf schema", id)
+	}
+
+	// The schema and the schemas it imports are parsed from memory.
+	contents := map[string]string{protobufSchemaFileName: registrySchema.Schema}
+	err = d.fetchReferences(registrySchema.References, contents)
+	if err != nil {
+		return nil, err
+	}
+	parser := protoparse.Parser{Accessor: protoparse.FileContentsFromMap(contents)}
+	files, err := parser.ParseFiles(protobufSchemaFileName)
+	if err != nil {
+		return nil, err
+	}
+	d.files[id] = files[0]
+	return files[0], nil
+}
+
+// fetchReferences fetches the referenced schemas, and their own references, into contents by import name.
+func (d *ProtobufDecoder) fetchReferences(references []SchemaReference, contents map[string]string) error {
+	for _, reference := range references {
+		if _, ok := contents[reference.Name]; ok {
+			continue
+		}
+		referenced, err := d.registry.SchemaBySubject(context.Background(), reference.Subject, reference.Version)
+		if err != nil {
+			return err
+		}
+		contents[reference.Name] = referenced.Schema
+		err = d.fetchReferences(referenced.References, contents)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseProtobufMessageIndexes returns the message indexes that prefix a Protobuf payload and the remaining payload.
+// The indexes locate the message type in the schema, a single 0 is the first message of the schema.
+func parseProtobufMessageIndexes(payload []byte) ([]int, []byte, error) {
+	count, read := binary.Varint(payload)
+	if read <= 0 || count < 0 {
+		return nil, nil, fmt.Errorf("invalid protobuf message indexes")
+	}
+	payload = payload[read:]
+	if count == 0 {
+		return []int{0}, payload, nil
+	}
+	indexes := make([]int, 0, count)
+	for ; count > 0; count-- {
+		index, read := binary.Varint(payload)
+		if read <= 0 || index < 0 {
+			return nil, nil, fmt.Errorf("invalid protobuf message indexes")
+		}
+		indexes = append(indexes, int(index))
+		payload = payload[read:]
+	}
+	return indexes, payload, nil
+}
+
+// protobufMessageDescriptor returns the message type located by the indexes, the first index is a top level message
+// and the next ones are nested messages.
+func protobufMessageDescriptor(file *desc.FileDescriptor, indexes []int) (*desc.MessageDescriptor, error) {
+	messages := file.GetMessageTypes()
+	var descriptor *desc.MessageDescriptor
+	for _, index := range indexes {
+		if index >= len(messages) {
+			return nil, fmt.Errorf("invalid protobuf message index %v for %s", indexes, file.GetName())
+		}
+		descriptor = messages[index]
+		messages = descriptor.GetNestedMessageTypes()
+	}
+	return descriptor, nil
+}
@@ -0,0 +1,84 @@
+package pkg
+
+import (
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const testProtobufCommonSchema = `syntax = "proto3";
+package common;
+message Client {
+  string client_id = 1;
+}`
+
+const testProtobufEventSchema = `syntax = "proto3";
+package events;
+import "common/client.proto";
+message Ignored {
+  string name = 1;
+}
+message Envelope {
+  message Event {
+    string message = 1;
+    int32 count = 2;
+    repeated string tags = 3;
+    common.Client client = 4;
+  }
+}`
+
+// Test_ProtobufDecoder_Decode ensures that Protobuf messages are decoded into maps.
+func Test_ProtobufDecoder_Decode(t *testing.T) {
+	registry := newTestSchemaRegistry(t, map[string]RegistrySchema{
+		"/schemas/ids/1": {Schema: testProtobufEventSchema, SchemaType: "PROTOBUF", References: []SchemaReference{
+			{Name: "common/client.proto", Subject: "common", Version: 1},
+		}},
+		"/subjects/common/versions/1": {Schema: testProtobufCommonSchema, SchemaType: "PROTOBUF"},
+		"/schemas/ids/2":              {Schema: `"string"`},
+	})
+	decoder := NewProtobufDecoder(NewSchemaRegistryClient(registry.server.URL))
+
+	// Build the payload with the same schema.
+	parser := protoparse.Parser{Accessor: protoparse.FileContentsFromMap(map[string]string{
+		"event.proto":         testProtobufEventSchema,
+		"common/client.proto": testProtobufCommonSchema,
+	})}
+	files, err := parser.ParseFiles("event.proto")
+	assert.Nil(t, err)
+	event := dynamic.NewMessage(files[0].FindMessage("events.Envelope.Event"))
+	client := dynamic.NewMessage(files[0].GetDependencies()[0].FindMessage("common.Client"))
+	client.SetFieldByName("client_id", "c1")
+	event.SetFieldByName("message", "hello")
+	event.SetFieldByName("count", int32(3))
+	event.SetFieldByName("tags", []string{"a", "b"})
+	event.SetFieldByName("client", client)
+	payload, err := event.Marshal()
+	assert.Nil(t, err)
+
+	// The message indexes [1, 0] locate Envelope.Event.
+	decoded, err := decoder.Decode(&kafka.Message{Value: confluentWireFormat(1, append([]byte{4, 2, 0}, payload...))})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"message": "hello",
+		"count":   float64(3),
+		"tags":    []interface{}{"a", "b"},
+		"client":  map[string]interface{}{"client_id": "c1"},
+	}, decoded.Fields)
+	assert.Equal(t, `{"message":"hello","count":3,"tags":["a","b"],"client":{"client_id":"c1"}}`, decoded.Line)
+
+	// A single 0 index is the first message.
+	decoded, err = decoder.Decode(&kafka.Message{Value: confluentWireFormat(1, []byte{0, 10, 1, 'x'})})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "x"}, decoded.Fields)
+
+	_, err = decoder.Decode(&kafka.Message{Value: confluentWireFormat(1, append([]byte{2, 10}, payload...))})
+	assert.Error(t, err)
+
+	_, err = decoder.Decode(&kafka.Message{Value: confluentWireFormat(2, []byte{0})})
+	assert.Error(t, err)
+
+	_, err = decoder.Decode(&kafka.Message{Value: confluentWireFormat(1, []byte{0, 0xff})})
+	assert.Error(t, err)
+}
@@ -2,6 +2,11 @@ package pkg
 
 import (
 	"context"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"hash/crc32"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -19,26 +24,99 @@ type LokiStream struct {
 	Labels map[string]string `json:"stream"`
 	// Values an array of values.
 	Values [][]string `json:"values"`
-	// Size is the size of the current struct in bytes.
+	// Size is the size of the current struct in bytes, labels included.
 	Size int `json:"-"`
+	// Sources holds the Kafka messages the values were consumed from, if known.
+	Sources []kafka.TopicPartition `json:"-"`
+	// Tenant is the Loki tenant of the stream, empty when Loki runs without authentication.
+	Tenant string `json:"-"`
+	// labelsKey and streamKey cache LabelsKey and StreamKey, the labels and the tenant must not change once they're
+	// computed.
+	labelsKey string
+	streamKey string
+}
+
+// LabelsKey returns the canonical representation of the stream's label set, e.g. {a="1", b="2"}.
+func (s *LokiStream) LabelsKey() string {
+	if s.labelsKey == "" {
+		s.labelsKey = labels.FromMap(s.Labels).String()
+	}
+	return s.labelsKey
+}
+
+// StreamKey identifies the stream in Loki, its tenant followed by its label set.
+func (s *LokiStream) StreamKey() string {
+	if s.streamKey == "" {
+		s.streamKey = s.Tenant + s.LabelsKey()
+	}
+	return s.streamKey
+}
+
+// LabelsSize returns the size of the labels in bytes.
+func LabelsSize(labels map[string]string) int {
+	size := 0
+	for k, v := range labels {
+		size += len(k) + len(v)
+	}
+	return size
 }
 
 // LokiStreams represents a list of LokiStream that Loki push API accepts.
+// Entries that share the same label set are grouped into a single LokiStream.
+// A push request targets a single tenant, so all the streams must belong to Tenant.
 type LokiStreams struct {
-	// Streams is an array of LokiStream.
+	// Streams is an array of LokiStream, one for each distinct label set.
 	Streams []LokiStream `json:"streams"`
-	// Count represents the number of LokiStream's in the struct.
+	// Tenant is the Loki tenant the streams are pushed to, sent as the X-Scope-OrgID header when not empty.
+	Tenant string `json:"-"`
+	// Count represents the number of entries in the struct.
 	Count int `json:"-"`
 	// TotalSize is the total size if the LokiStreams from struct.
 	TotalSize          int `json:"-"`
 	bufferMaxBatchSize int
 	bufferMaxByteSize  int
+	streamIndex        map[string]int
+	// oldestEntry is the time the first entry was added to the batch.
+	oldestEntry time.Time
+	// worker is the index of the send worker that pushes the batch.
+	worker int
 }
 
+// AddData adds the entries of the given LokiStream to the stream with the same label set.
+// The labels are accounted for in TotalSize only once per label set.
 func (ls *LokiStreams) AddData(s LokiStream) {
-	ls.Count += 1
-	ls.Streams = append(ls.Streams, s)
-	ls.TotalSize += s.Size
+	if ls.streamIndex == nil {
+		ls.streamIndex = make(map[string]int)
+	}
+	ls.Count += len(s.Values)
+	key := s.LabelsKey()
+	index, ok := ls.streamIndex[key]
+	if !ok {
+		// Copy the values so that appending to the stream never writes into the caller's slice.
+		s.Values = append(make([][]string, 0, len(s.Values)), s.Values...)
+		s.Sources = append([]kafka.TopicPartition(nil), s.Sources...)
+		ls.streamIndex[key] = len(ls.Streams)
+		ls.Streams = append(ls.Streams, s)
+		ls.TotalSize += s.Size
+		return
+	}
+	entriesSize := s.Size - LabelsSize(s.Labels)
+	if entriesSize < 0 {
+		entriesSize = 0
+	}
+	ls.Streams[index].Values = append(ls.Streams[index].Values, s.Values...)
+	ls.Streams[index].Sources = append(ls.Streams[index].Sources, s.Sources...)
+	ls.Streams[index].Size += entriesSize
+	ls.TotalSize += entriesSize
+}
+
+// Sources returns the Kafka messages the entries were consumed from.
+func (ls *LokiStreams) Sources() []kafka.TopicPartition {
+	sources := make([]kafka.TopicPartition, 0, ls.Count)
+	for _, stream := range ls.Streams {
+		sources = append(sources, stream.Sources...)
+	}
+	return sources
 }
 
 // IsFull returns whether the LokiStreams is full by checking against buffer_max_bytes and then buffer_max_batch_size.
@@ -53,28 +131,76 @@ func (ls *LokiStreams) IsFull() bool {
 	return false
 }
 
+// initialStreamsCapacity is the initial capacity of the streams of a LokiStreams, a batch usually holds few label sets.
+const initialStreamsCapacity = 8
+
 // NewLokiStreams creates a new instance of LokiStreams of max capacity
 func NewLokiStreams(maxCapacity int, maxSizeBytes int) *LokiStreams {
 	return &LokiStreams{
-		Streams:            make([]LokiStream, 0, maxCapacity),
+		Streams:            make([]LokiStream, 0, initialStreamsCapacity),
 		Count:              0,
 		bufferMaxBatchSize: maxCapacity,
 		bufferMaxByteSize:  maxSizeBytes,
+		streamIndex:        make(map[string]int),
 	}
 }
 
 // Pusher ensures that messages are efficiently pushed into Sinks.
 type Pusher struct {
 	// DataChannel is a LokiStream channel that is used to send data to the pusher.
-	DataChannel       chan LokiStream
-	TimeProvider      func() string
-	speedySink        ISpeedySink
-	lastFlush         time.Time
-	SecondsToFlush    time.Duration
-	currentStreams    *LokiStreams
+	DataChannel chan LokiStream
+	// TimeProvider provides the timestamp of entries that don't have one.
+	TimeProvider func() string
+	speedySink   ISpeedySink
+	// lastFlush is the time of the last flush of all the batches, lastFlushMutex guards it against LastFlush.
+	lastFlush      time.Time
+	lastFlushMutex sync.Mutex
+	// SecondsToFlush is the maximum age of the oldest entry of a batch, older batches are flushed.
+	SecondsToFlush time.Duration
+	// MinFlushInterval is the minimum time between two timer flushes of the batches of a tenant and worker, it protects
+	// Loki from the low-volume streams that would otherwise be pushed one entry at a time.
+	MinFlushInterval time.Duration
+	clock            Clock
+	// lastFlushes holds the time of the last flush of each batch.
+	lastFlushes map[batchKey]time.Time
+	// currentStreams holds the current batch of each tenant and send worker.
+	currentStreams    map[batchKey]*LokiStreams
 	maxBatchSize      int
 	maxBatchSizeBytes int
 	shutdownChannel   chan int
+	flushChannel      chan chan struct{}
+	// doneChannel is closed once RunForever returned.
+	doneChannel chan struct{}
+	// sendContext is the context of the pushes, cancelSends aborts them when the shutdown deadline is exceeded.
+	sendContext     context.Context
+	cancelSends     context.CancelFunc
+	offsetTracker   *OffsetTracker
+	deadLetterQueue IDeadLetterQueue
+	// lastTimestamps holds the latest timestamp of each stream, keyed by StreamKey, the idle streams are pruned
+	// every SecondsToFlush.
+	lastTimestamps map[string]streamTimestamp
+	lastPrune      time.Time
+	// workers holds the batch channels of the send workers, every stream is pushed by the same worker.
+	workers     []chan *LokiStreams
+	workerGroup sync.WaitGroup
+	// inflight counts the batches handed to the workers that are not sent yet.
+	inflight sync.WaitGroup
+}
+
+// streamTimestamp is the latest timestamp in unix nanoseconds of a stream, and when the stream was last seen.
+type streamTimestamp struct {
+	timestamp int64
+	seen      time.Time
+}
+
+// idleStreamFlushIntervals is the number of flush intervals without entries after which the latest timestamp of a
+// stream is forgotten.
+const idleStreamFlushIntervals = 3
+
+// batchKey identifies a batch of the Pusher.
+type batchKey struct {
+	tenant string
+	worker int
 }
 
 // UnixNanoTimeProvider provides time as a string in unix nanoseconds.
@@ -88,35 +214,46 @@ func NewPusher(sink ISpeedySink, maxBatchSize int, maxBatchSizeBytes int) *Pushe
 		panic("Speedy sink is nil")
 	}
 
+	sendContext, cancelSends := context.WithCancel(context.Background())
 	return &Pusher{
 		DataChannel:       make(chan LokiStream, 1000),
 		TimeProvider:      UnixNanoTimeProvider,
 		SecondsToFlush:    1 * time.Minute,
+		MinFlushInterval:  1 * time.Second,
+		clock:             SystemClock,
+		lastFlushes:       make(map[batchKey]time.Time),
 		speedySink:        sink,
 		lastFlush:         time.Now(),
 		maxBatchSize:      maxBatchSize,
 		maxBatchSizeBytes: maxBatchSizeBytes,
-		currentStreams:    NewLokiStreams(maxBatchSize, maxBatchSizeBytes),
+		currentStreams:    make(map[batchKey]*LokiStreams),
 		shutdownChannel:   make(chan int),
+		flushChannel:      make(chan chan struct{}),
+		doneChannel:       make(chan struct{}),
+		sendContext:       sendContext,
+		cancelSends:       cancelSends,
+		lastTimestamps:    make(map[string]streamTimestamp),
+		workers:           make([]chan *LokiStreams, 1),
 	}
 }
 
 // RunForever runs the pusher forever, or until Shutdown is called.
 func (lp *Pusher) RunForever() {
 	var mutex = &sync.Mutex{}
-	tick := time.Tick(lp.SecondsToFlush)
+	// Check the age of the batches a few times per interval, so that they're flushed soon after they're due.
+	checkInterval := lp.SecondsToFlush / 4
+	if checkInterval < time.Millisecond {
+		checkInterval = time.Millisecond
+	}
+	tick, stopTicker := lp.clock.NewTicker(checkInterval)
+	defer stopTicker()
+	lp.startWorkers()
 
 	for {
 		select {
 		case data := <-lp.DataChannel:
 			mutex.Lock()
-			// This is sort of bad but Loki does not support out of order messages, since have N goroutines
-			// we will have to override the timestamp here, otherwise the timestamps may clash or be out of order.
-			data.Values[0][0] = lp.TimeProvider()
-			lp.currentStreams.AddData(data)
-			if lp.currentStreams.IsFull() {
-				lp.flushCurrentBatch()
-			}
+			lp.addData(data)
 			mutex.Unlock()
 		case <-lp.shutdownChannel:
 			// Ensure clean shutdown.
@@ -124,52 +261,339 @@ func (lp *Pusher) RunForever() {
 			//goland:noinspection ALL
 			defer mutex.Unlock()
 			SugaredLogger.Info("Shutting down Pusher. Draining")
-			for {
-				isDone := false
-				select {
-				case data := <-lp.DataChannel:
-					data.Values[0][0] = lp.TimeProvider()
-					lp.currentStreams.AddData(data)
-					if lp.currentStreams.IsFull() {
-						lp.flushCurrentBatch()
-					}
-				default:
-					isDone = true
-				}
-				if isDone {
-					break
-				}
-			}
+			lp.drainDataChannel()
 			SugaredLogger.Info("Drained.")
-			lp.flushCurrentBatch()
+			lp.flushCurrentBatch(FlushReasonShutdown)
+			lp.stopWorkers()
 			lp.speedySink.Shutdown()
+			lp.cancelSends()
+			close(lp.doneChannel)
 			return
+		case done := <-lp.flushChannel:
+			mutex.Lock()
+			lp.drainDataChannel()
+			lp.flushCurrentBatch(FlushReasonFlush)
+			lp.inflight.Wait()
+			mutex.Unlock()
+			close(done)
 		case <-tick:
 			// This branch will handle periodical flushes so that the pipeline won't remain stale.
 			mutex.Lock()
-			if time.Now().Sub(lp.lastFlush).Milliseconds() >= lp.SecondsToFlush.Milliseconds() {
-				lp.flushCurrentBatch()
-			}
+			lp.flushOldBatches()
 			mutex.Unlock()
 		}
 	}
 }
 
-// flushCurrentBatch flushes the current batch.
-func (lp *Pusher) flushCurrentBatch() {
+// drainDataChannel adds all the data that is waiting in DataChannel to the current batch.
+func (lp *Pusher) drainDataChannel() {
+	for {
+		select {
+		case data := <-lp.DataChannel:
+			lp.addData(data)
+		default:
+			return
+		}
+	}
+}
+
+// sendQueueLength is the number of flushed batches queued for each send worker while it's busy.
+const sendQueueLength = 1
+
+// startWorkers starts the send workers.
+func (lp *Pusher) startWorkers() {
+	for index := range lp.workers {
+		// A busy worker queues the next batch of its streams, the flushes only block once its queue is full.
+		lp.workers[index] = make(chan *LokiStreams, sendQueueLength)
+		lp.workerGroup.Add(1)
+		go func(batches chan *LokiStreams) {
+			defer lp.workerGroup.Done()
+			for batch := range batches {
+				lp.sendBatch(batch)
+				inflightRequests.Dec()
+				lp.inflight.Done()
+			}
+		}(lp.workers[index])
+	}
+}
+
+// stopWorkers stops the send workers once they sent the batches handed to them.
+func (lp *Pusher) stopWorkers() {
+	for _, batches := range lp.workers {
+		close(batches)
+	}
+	lp.workerGroup.Wait()
+}
+
+// worker returns the index of the send worker of the given stream key.
+func (lp *Pusher) worker(streamKey string) int {
+	if len(lp.workers) == 1 {
+		return 0
+	}
+	// The ShardedPusher shards the streams with FNV, a different hash spreads the streams of a shard over the workers.
+	return int(crc32.ChecksumIEEE([]byte(streamKey)) % uint32(len(lp.workers)))
+}
+
+// addData adds data to the current batch of its tenant and worker and flushes the batch if it's full.
+func (lp *Pusher) addData(data LokiStream) {
+	lp.adjustTimestamps(&data)
+	key := batchKey{tenant: data.Tenant, worker: lp.worker(data.StreamKey())}
+	batch, ok := lp.currentStreams[key]
+	if !ok {
+		batch = NewLokiStreams(lp.maxBatchSize, lp.maxBatchSizeBytes)
+		batch.Tenant = data.Tenant
+		batch.oldestEntry = lp.clock.Now()
+		batch.worker = key.worker
+		lp.currentStreams[key] = batch
+	}
+	batch.AddData(data)
+	if batch.IsFull() {
+		reason := FlushReasonSize
+		if batch.TotalSize >= batch.bufferMaxByteSize {
+			reason = FlushReasonBytes
+		}
+		lp.flushBatch(batch, reason)
+	}
+}
+
+// adjustTimestamps fills in missing timestamps and ensures that the timestamps of a stream never go back in time,
+// Loki rejects entries that are older than the latest entry of the stream.
+func (lp *Pusher) adjustTimestamps(data *LokiStream) {
+	key := data.StreamKey()
+	lastTimestamp := lp.lastTimestamps[key].timestamp
+	for _, value := range data.Values {
+		if value[0] == "" {
+			value[0] = lp.TimeProvider()
+		}
+		timestamp, err := strconv.ParseInt(value[0], 10, 64)
+		if err != nil {
+			SugaredLogger.Debugf("invalid timestamp %s, using current time: %s", value[0], err)
+			value[0] = lp.TimeProvider()
+			timestamp, _ = strconv.ParseInt(value[0], 10, 64)
+		}
+		if timestamp < lastTimestamp {
+			value[0] = strconv.FormatInt(lastTimestamp, 10)
+		} else {
+			lastTimestamp = timestamp
+		}
+	}
+	lp.lastTimestamps[key] = streamTimestamp{timestamp: lastTimestamp, seen: lp.clock.Now()}
+}
+
+// pruneTimestamps forgets the latest timestamps of the streams without entries for idleStreamFlushIntervals flush
+// intervals, at most once per flush interval.
+func (lp *Pusher) pruneTimestamps(now time.Time) {
+	if now.Sub(lp.lastPrune) < lp.SecondsToFlush {
+		return
+	}
+	lp.lastPrune = now
+	for key, last := range lp.lastTimestamps {
+		if now.Sub(last.seen) >= idleStreamFlushIntervals*lp.SecondsToFlush {
+			delete(lp.lastTimestamps, key)
+		}
+	}
+}
+
+// sortBatchKeys sorts the batch keys by tenant, then by worker.
+func sortBatchKeys(keys []batchKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].tenant != keys[j].tenant {
+			return keys[i].tenant < keys[j].tenant
+		}
+		return keys[i].worker < keys[j].worker
+	})
+}
+
+// flushCurrentBatch flushes the current batch of every tenant, in tenant order.
+func (lp *Pusher) flushCurrentBatch(reason string) {
+	keys := make([]batchKey, 0, len(lp.currentStreams))
+	for key := range lp.currentStreams {
+		keys = append(keys, key)
+	}
+	sortBatchKeys(keys)
+	for _, key := range keys {
+		lp.flushBatch(lp.currentStreams[key], reason)
+	}
+	lp.setLastFlush(lp.clock.Now())
+}
+
+// flushOldBatches flushes the batches whose oldest entry is older than SecondsToFlush, unless the previous batch of
+// the same tenant and worker was flushed less than MinFlushInterval ago.
+func (lp *Pusher) flushOldBatches() {
+	now := lp.clock.Now()
+	keys := make([]batchKey, 0, len(lp.currentStreams))
+	for key, batch := range lp.currentStreams {
+		if now.Sub(batch.oldestEntry) >= lp.SecondsToFlush && now.Sub(lp.lastFlushes[key]) >= lp.MinFlushInterval {
+			keys = append(keys, key)
+		}
+	}
+	sortBatchKeys(keys)
+	for _, key := range keys {
+		lp.flushBatch(lp.currentStreams[key], FlushReasonTimer)
+	}
+	lp.pruneTimestamps(now)
+	// No batch is older than due, the pusher is keeping up.
+	lp.setLastFlush(now)
+}
+
+// setLastFlush sets the time of the last flush of all the batches.
+func (lp *Pusher) setLastFlush(lastFlush time.Time) {
+	lp.lastFlushMutex.Lock()
+	lp.lastFlush = lastFlush
+	lp.lastFlushMutex.Unlock()
+}
+
+// LastFlush returns the last time the batches were checked and flushed when due, flushes of single full batches
+// are not counted.
+func (lp *Pusher) LastFlush() time.Time {
+	lp.lastFlushMutex.Lock()
+	defer lp.lastFlushMutex.Unlock()
+	return lp.lastFlush
+}
+
+// flushBatch hands the batch to its send worker for the given reason and removes it from the current batches.
+// It blocks while the queue of the worker is full.
+func (lp *Pusher) flushBatch(batch *LokiStreams, reason string) {
+	key := batchKey{tenant: batch.Tenant, worker: batch.worker}
+	delete(lp.currentStreams, key)
 	// Skip flushing, no data.
-	if lp.currentStreams.Count == 0 {
+	if batch.Count == 0 {
 		return
 	}
-	err := lp.speedySink.SendData(context.Background(), lp.currentStreams)
+	lp.lastFlushes[key] = lp.clock.Now()
+	flushes.WithLabelValues(reason).Inc()
+	batchEntries.Observe(float64(batch.Count))
+	batchBytes.Observe(float64(batch.TotalSize))
+	lp.inflight.Add(1)
+	inflightRequests.Inc()
+	lp.workers[batch.worker] <- batch
+}
+
+// sendBatch sends the batch to the sink, the batches of a worker are sent one at a time.
+// Batches of different workers complete in any order, the OffsetTracker only commits the offsets once all the
+// previous ones are delivered too.
+func (lp *Pusher) sendBatch(batch *LokiStreams) {
+	err := lp.speedySink.SendData(lp.sendContext, batch)
 	if err != nil {
 		SugaredLogger.Error(err)
 	}
-	lp.lastFlush = time.Now()
-	lp.currentStreams = NewLokiStreams(lp.maxBatchSize, lp.maxBatchSizeBytes)
+	// The batch is done when it was delivered or when Loki rejected it, retrying a rejected batch won't help.
+	done := err == nil
+	if IsRejectedError(err) {
+		lp.sendToDeadLetterQueue(batch, DeadLetterReasonRejected, err)
+		done = true
+	}
+	// A batch that ran out of retries is done once it's in the dead letter queue, otherwise its offsets stall the
+	// commits of its partitions until the restart, which consumes it again.
+	if IsRetriesExhaustedError(err) {
+		done = lp.sendToDeadLetterQueue(batch, DeadLetterReasonRetriesExhausted, err)
+	}
+	if lp.offsetTracker != nil && done {
+		lp.offsetTracker.MarkDone(batch.Sources()...)
+		_ = lp.offsetTracker.Commit()
+	}
+}
+
+// sendToDeadLetterQueue sends every entry of the batch to the dead letter queue, if one is set.
+// It returns whether all the entries were sent.
+func (lp *Pusher) sendToDeadLetterQueue(batch *LokiStreams, reason string, err error) bool {
+	if lp.deadLetterQueue == nil {
+		return false
+	}
+	letters := make([]DeadLetter, 0, batch.Count)
+	for _, stream := range batch.Streams {
+		for index, value := range stream.Values {
+			letter := DeadLetter{
+				Value:  []byte(value[1]),
+				Labels: stream.Labels,
+				Reason: reason,
+				Err:    err,
+			}
+			if len(stream.Sources) == len(stream.Values) {
+				letter.Source = stream.Sources[index]
+			}
+			letters = append(letters, letter)
+		}
+	}
+	// The letters of the batch are sent at once, the send is aborted with the pushes when the shutdown times out.
+	if dlqErr := lp.deadLetterQueue.Send(lp.sendContext, letters...); dlqErr != nil {
+		SugaredLogger.Errorf("failed to send %d entries to the dead letter queue: %s", len(letters), dlqErr)
+		sentry.CaptureException(dlqErr)
+		return false
+	}
+	return true
+}
+
+// SetDeadLetterQueue sets the IDeadLetterQueue that receives the entries rejected by Loki or out of retries.
+func (lp *Pusher) SetDeadLetterQueue(queue IDeadLetterQueue) {
+	lp.deadLetterQueue = queue
+}
+
+// SetFlushIntervals sets the maximum age of the batches and the minimum interval between the timer flushes of a
+// batch, it must be called before RunForever.
+func (lp *Pusher) SetFlushIntervals(interval time.Duration, minInterval time.Duration) {
+	lp.SecondsToFlush = interval
+	lp.MinFlushInterval = minInterval
+}
+
+// SetMaxInflightRequests sets the number of send workers, and so the maximum number of batches the Pusher pushes
+// concurrently. Every stream is pushed by the same worker so that its entries stay in order. It must be called
+// before RunForever.
+func (lp *Pusher) SetMaxInflightRequests(maxInflightRequests int) {
+	if maxInflightRequests < 1 {
+		maxInflightRequests = 1
+	}
+	lp.workers = make([]chan *LokiStreams, maxInflightRequests)
+}
+
+// SetClock sets the Clock of the flush timer, it must be called before RunForever.
+func (lp *Pusher) SetClock(clock Clock) {
+	lp.clock = clock
+	lp.setLastFlush(clock.Now())
+}
+
+// SetOffsetTracker sets the OffsetTracker that is notified when batches are delivered.
+func (lp *Pusher) SetOffsetTracker(tracker *OffsetTracker) {
+	lp.offsetTracker = tracker
+}
+
+// Flush flushes the current batch and waits for it to be sent.
+func (lp *Pusher) Flush() {
+	done := make(chan struct{})
+	lp.flushChannel <- done
+	<-done
+}
+
+// CancelSends aborts the pushes in flight and the ones to come, the data that wasn't delivered is dropped and its
+// offsets aren't committed. It's used when the shutdown deadline is exceeded.
+func (lp *Pusher) CancelSends() {
+	lp.cancelSends()
 }
 
-// Shutdown shutdowns the Loki pusher.
+// Shutdown shutdowns the Loki pusher and waits until the remaining data is flushed.
 func (lp *Pusher) Shutdown() {
-	lp.shutdownChannel <- 1
+	_ = lp.ShutdownContext(context.Background())
+}
+
+// ShutdownContext shutdowns the Loki pusher and waits until the remaining data is flushed or the context is done.
+// When the context is done, the pushes in flight are aborted and the data that wasn't delivered yet is dropped,
+// its offsets aren't committed so it will be consumed again.
+func (lp *Pusher) ShutdownContext(ctx context.Context) error {
+	select {
+	case lp.shutdownChannel <- 1:
+	case <-ctx.Done():
+		// The pusher may be stuck retrying a push, abort it so that the shutdown is handled.
+		lp.cancelSends()
+		lp.shutdownChannel <- 1
+		<-lp.doneChannel
+		return ctx.Err()
+	}
+	select {
+	case <-lp.doneChannel:
+		return nil
+	case <-ctx.Done():
+		lp.cancelSends()
+		<-lp.doneChannel
+		return ctx.Err()
+	}
 }
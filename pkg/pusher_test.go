@@ -2,6 +2,9 @@ package pkg
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/stretchr/testify/assert"
 	"math"
 	speedyTesting "speedy/pkg/testing"
@@ -13,19 +16,42 @@ import (
 type SpeedyTestSink struct {
 	savedData       *LokiStreams
 	sendDataCounter int
+	sendDataError   error
 	shutdown        bool
 }
 
 func (p *SpeedyTestSink) SendData(_ context.Context, data *LokiStreams) error {
 	p.sendDataCounter += 1
 	p.savedData = data
-	return nil
+	return p.sendDataError
 }
 
 func (p *SpeedyTestSink) Shutdown() {
 	p.shutdown = true
 }
 
+// withoutKeys returns a copy of the streams without their cached keys, to compare them with the expected streams.
+func withoutKeys(streams []LokiStream) []LokiStream {
+	copied := make([]LokiStream, len(streams))
+	for index, stream := range streams {
+		stream.labelsKey, stream.streamKey = "", ""
+		copied[index] = stream
+	}
+	return copied
+}
+
+// Test_LokiStream_StreamKey ensures that the keys of the streams are computed once and kept by their copies.
+func Test_LokiStream_StreamKey(t *testing.T) {
+	stream := LokiStream{Labels: map[string]string{"b": "2", "a": "1"}, Tenant: "team-a"}
+	assert.Equal(t, `team-a{a="1", b="2"}`, stream.StreamKey())
+
+	copied := stream
+	copied.Labels["a"] = "changed"
+	assert.Equal(t, `{a="1", b="2"}`, copied.LabelsKey())
+	assert.Equal(t, `team-a{a="1", b="2"}`, copied.StreamKey())
+	assert.Equal(t, `{a="changed", b="2"}`, (&LokiStream{Labels: copied.Labels}).LabelsKey())
+}
+
 // Test_Pusher_RunForever_Batch ensure that the pushes batches items correctly.
 func Test_Pusher_RunForever_Batch(t *testing.T) {
 	client := &SpeedyTestSink{}
@@ -60,12 +86,18 @@ func Test_Pusher_RunForever_Batch(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 	lokiPusher.Shutdown()
 
-	assert.Equal(t, data, client.savedData.Streams)
+	assert.Equal(t, []LokiStream{{
+		Labels: map[string]string{
+			"label1": "value",
+		},
+		Values: [][]string{{"0", "log-line-0"}, {"1", "log-line-1"}, {"2", "log-line-2"}},
+	}}, withoutKeys(client.savedData.Streams))
+	assert.Equal(t, 3, client.savedData.Count)
 }
 
 // Test_Pusher_RunForever_Ticker ensure that the pusher flushes on stale batches and on shutdown.
 func Test_Pusher_RunForever_Ticker(t *testing.T) {
-	client := &SpeedyTestSink{}
+	client := &concurrentTestSink{}
 	lokiPusher := NewPusher(client, 3, math.MaxInt32)
 	lokiPusher.TimeProvider = speedyTesting.ZeroNanoTimeProvider
 	lokiPusher.SecondsToFlush = 50 * time.Millisecond
@@ -83,7 +115,8 @@ func Test_Pusher_RunForever_Ticker(t *testing.T) {
 
 	time.Sleep(100 * time.Millisecond)
 
-	assert.Equal(t, first, client.savedData.Streams)
+	assert.Len(t, client.sentBatches(), 1)
+	assert.Equal(t, first, withoutKeys(client.sentBatches()[0].Streams))
 
 	second := []LokiStream{
 		{
@@ -99,13 +132,14 @@ func Test_Pusher_RunForever_Ticker(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 	lokiPusher.Shutdown()
 
-	assert.Equal(t, second, client.savedData.Streams)
+	assert.Len(t, client.sentBatches(), 2)
+	assert.Equal(t, second, withoutKeys(client.sentBatches()[1].Streams))
 }
 
 // Test_Pusher_RunForever_BatchBytes ensure that it pushes batches items correctly according to their size.
 func Test_Pusher_RunForever_BatchBytes(t *testing.T) {
-	sink := &SpeedyTestSink{}
-	lokiPusher := NewPusher(sink, 3, 16)
+	sink := &concurrentTestSink{}
+	lokiPusher := NewPusher(sink, 3, 31)
 	lokiPusher.TimeProvider = speedyTesting.ZeroNanoTimeProvider
 	go lokiPusher.RunForever()
 
@@ -115,21 +149,21 @@ func Test_Pusher_RunForever_BatchBytes(t *testing.T) {
 				"label1": "value",
 			},
 			Values: [][]string{{"0", "log-line-0"}},
-			Size:   10,
+			Size:   21,
 		},
 		{
 			Labels: map[string]string{
 				"label1": "value",
 			},
 			Values: [][]string{{"1", "log-line-1"}},
-			Size:   10,
+			Size:   21,
 		},
 		{
 			Labels: map[string]string{
 				"label1": "value",
 			},
 			Values: [][]string{{"2", "log-line-2"}},
-			Size:   10,
+			Size:   21,
 		},
 	}
 	lokiPusher.DataChannel <- data[0]
@@ -137,16 +171,27 @@ func Test_Pusher_RunForever_BatchBytes(t *testing.T) {
 	lokiPusher.DataChannel <- data[2]
 
 	time.Sleep(100 * time.Millisecond)
-	lokiPusher.Shutdown()
 
-	assert.Equal(t, []LokiStream{data[0], data[1]}, sink.savedData.Streams)
+	// The labels are accounted only once per stream, 21 + 10 bytes fill the buffer.
+	assert.Len(t, sink.sentBatches(), 1)
+	// Shutdown waits for the remaining entry to be flushed.
+	lokiPusher.Shutdown()
+	batches := sink.sentBatches()
+	assert.Len(t, batches, 2)
+	assert.Equal(t, []LokiStream{{
+		Labels: map[string]string{
+			"label1": "value",
+		},
+		Values: [][]string{{"0", "log-line-0"}, {"1", "log-line-1"}},
+		Size:   31,
+	}}, withoutKeys(batches[0].Streams))
 }
 
 // Test_Pusher_RunForever_Shutdown ensures a clean shutdown and flush regardless of batch size.
 func Test_Pusher_RunForever_Shutdown(t *testing.T) {
 	sink := &SpeedyTestSink{}
 
-	lokiPusher := NewPusher(sink, 3, 16)
+	lokiPusher := NewPusher(sink, 3, 31)
 	lokiPusher.TimeProvider = speedyTesting.ZeroNanoTimeProvider
 	go lokiPusher.RunForever()
 
@@ -156,21 +201,21 @@ func Test_Pusher_RunForever_Shutdown(t *testing.T) {
 				"label1": "value",
 			},
 			Values: [][]string{{"0", "log-line-0"}},
-			Size:   10,
+			Size:   21,
 		},
 		{
 			Labels: map[string]string{
 				"label1": "value",
 			},
 			Values: [][]string{{"1", "log-line-1"}},
-			Size:   10,
+			Size:   21,
 		},
 		{
 			Labels: map[string]string{
 				"label1": "value",
 			},
 			Values: [][]string{{"2", "log-line-2"}},
-			Size:   10,
+			Size:   21,
 		},
 	}
 
@@ -182,5 +227,385 @@ func Test_Pusher_RunForever_Shutdown(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	assert.Equal(t, 2, sink.sendDataCounter)
-	assert.Equal(t, []LokiStream{data[2]}, sink.savedData.Streams)
+	assert.Equal(t, []LokiStream{data[2]}, withoutKeys(sink.savedData.Streams))
+}
+
+// Test_Pusher_RunForever_MonotonicTimestamps ensures that the timestamps of a stream never go back in time.
+func Test_Pusher_RunForever_MonotonicTimestamps(t *testing.T) {
+	sink := &SpeedyTestSink{}
+	lokiPusher := NewPusher(sink, 4, math.MaxInt32)
+	lokiPusher.TimeProvider = func() string {
+		return "25"
+	}
+	go lokiPusher.RunForever()
+
+	lokiPusher.DataChannel <- LokiStream{
+		Labels: map[string]string{"label1": "value"},
+		Values: [][]string{{"20", "log-line-0"}},
+	}
+	lokiPusher.DataChannel <- LokiStream{
+		Labels: map[string]string{"label1": "value"},
+		Values: [][]string{{"10", "log-line-1"}},
+	}
+	lokiPusher.DataChannel <- LokiStream{
+		Labels: map[string]string{"label1": "other"},
+		Values: [][]string{{"10", "log-line-2"}},
+	}
+	lokiPusher.DataChannel <- LokiStream{
+		Labels: map[string]string{"label1": "value"},
+		Values: [][]string{{"", "log-line-3"}},
+	}
+	time.Sleep(100 * time.Millisecond)
+	lokiPusher.Shutdown()
+
+	assert.Equal(t, []LokiStream{
+		{
+			Labels: map[string]string{"label1": "value"},
+			Values: [][]string{{"20", "log-line-0"}, {"20", "log-line-1"}, {"25", "log-line-3"}},
+		},
+		{
+			Labels: map[string]string{"label1": "other"},
+			Values: [][]string{{"10", "log-line-2"}},
+		},
+	}, withoutKeys(sink.savedData.Streams))
+}
+
+// Test_Pusher_Flush_CommitsOffsets ensures that offsets are committed only once the batch is delivered.
+func Test_Pusher_Flush_CommitsOffsets(t *testing.T) {
+	sink := &SpeedyTestSink{sendDataError: errors.New("loki is down")}
+	committer := &testOffsetCommitter{}
+	tracker := NewOffsetTracker(committer)
+	lokiPusher := NewPusher(sink, 10, math.MaxInt32)
+	lokiPusher.SetOffsetTracker(tracker)
+	go lokiPusher.RunForever()
+
+	source := testTopicPartition("topic", 0, 7)
+	tracker.Track(source)
+	lokiPusher.DataChannel <- LokiStream{
+		Labels:  map[string]string{"label1": "value"},
+		Values:  [][]string{{"0", "log-line-0"}},
+		Sources: []kafka.TopicPartition{source},
+	}
+	lokiPusher.Flush()
+	assert.Equal(t, 1, sink.sendDataCounter)
+	assert.Empty(t, committer.committed)
+
+	sink.sendDataError = nil
+	source = testTopicPartition("topic", 0, 8)
+	tracker.Track(source)
+	lokiPusher.DataChannel <- LokiStream{
+		Labels:  map[string]string{"label1": "value"},
+		Values:  [][]string{{"0", "log-line-1"}},
+		Sources: []kafka.TopicPartition{source},
+	}
+	lokiPusher.Flush()
+	lokiPusher.Shutdown()
+
+	// Offset 7 was never delivered, so nothing can be committed.
+	assert.Equal(t, 2, sink.sendDataCounter)
+	assert.Empty(t, committer.committed)
+
+	tracker.MarkDone(testTopicPartition("topic", 0, 7))
+	assert.Nil(t, tracker.Commit())
+	assert.Equal(t, map[string]int64{"topic[0]": 9}, committedOffsets(committer))
+}
+
+// Test_Pusher_RunForever_Tenants ensures that each tenant has its own batch, so tenants never share a push request.
+func Test_Pusher_RunForever_Tenants(t *testing.T) {
+	client := &concurrentTestSink{}
+	lokiPusher := NewPusher(client, 2, math.MaxInt32)
+	go lokiPusher.RunForever()
+
+	lokiPusher.DataChannel <- LokiStream{Labels: map[string]string{"a": "b"}, Values: [][]string{{"1", "a-1"}}, Tenant: "a"}
+	lokiPusher.DataChannel <- LokiStream{Labels: map[string]string{"a": "b"}, Values: [][]string{{"1", "b-1"}}, Tenant: "b"}
+	lokiPusher.DataChannel <- LokiStream{Labels: map[string]string{"a": "b"}, Values: [][]string{{"2", "a-2"}}, Tenant: "a"}
+	lokiPusher.DataChannel <- LokiStream{Labels: map[string]string{"a": "b"}, Values: [][]string{{"1", "none"}}}
+	lokiPusher.Flush()
+	lokiPusher.Shutdown()
+
+	// The batch of tenant a is full first, the others are flushed in tenant order.
+	assert.Len(t, client.batches, 3)
+	var tenants []string
+	for _, batch := range client.batches {
+		tenants = append(tenants, batch.Tenant)
+		for _, stream := range batch.Streams {
+			assert.Equal(t, batch.Tenant, stream.Tenant)
+		}
+	}
+	assert.Equal(t, []string{"a", "", "b"}, tenants)
+	assert.Equal(t, [][]string{{"1", "a-1"}, {"2", "a-2"}}, client.batches[0].Streams[0].Values)
+	assert.Equal(t, [][]string{{"1", "none"}}, client.batches[1].Streams[0].Values)
+	assert.Equal(t, [][]string{{"1", "b-1"}}, client.batches[2].Streams[0].Values)
+}
+
+// blockingTestSink blocks every push until its context is done, like a push retried while Loki is down.
+type blockingTestSink struct {
+	started chan struct{}
+	errors  chan error
+}
+
+// newBlockingTestSink creates a new blockingTestSink.
+func newBlockingTestSink() *blockingTestSink {
+	return &blockingTestSink{started: make(chan struct{}, 10), errors: make(chan error, 10)}
+}
+
+func (s *blockingTestSink) SendData(ctx context.Context, _ *LokiStreams) error {
+	s.started <- struct{}{}
+	<-ctx.Done()
+	s.errors <- ctx.Err()
+	return ctx.Err()
+}
+
+func (s *blockingTestSink) Shutdown() {
+}
+
+// Test_Pusher_ShutdownContext ensures that the shutdown aborts the pushes in flight once its deadline is exceeded,
+// without marking their offsets as done.
+func Test_Pusher_ShutdownContext(t *testing.T) {
+	topic := "topic"
+	committer := &testOffsetCommitter{}
+	tracker := NewOffsetTracker(committer)
+	sink := newBlockingTestSink()
+	lokiPusher := NewPusher(sink, 1, math.MaxInt32)
+	lokiPusher.SetOffsetTracker(tracker)
+	go lokiPusher.RunForever()
+
+	source := kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: 5}
+	tracker.Track(source)
+	lokiPusher.DataChannel <- LokiStream{Labels: map[string]string{"a": "b"}, Values: [][]string{{"1", "line"}}, Sources: []kafka.TopicPartition{source}}
+	<-sink.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, lokiPusher.ShutdownContext(ctx))
+	assert.Equal(t, context.Canceled, <-sink.errors)
+	assert.Nil(t, tracker.Commit())
+	assert.Empty(t, committedOffsets(committer))
+}
+
+// Test_Pusher_flushOldBatches ensures that the batches are flushed once their oldest entry is too old, at most once per
+// MinFlushInterval for each tenant.
+func Test_Pusher_flushOldBatches(t *testing.T) {
+	client := &SpeedyTestSink{}
+	clock := speedyTesting.NewFakeClock(time.Unix(1_000_000, 0))
+	lokiPusher := NewPusher(client, 100, math.MaxInt32)
+	lokiPusher.TimeProvider = speedyTesting.ZeroNanoTimeProvider
+	lokiPusher.SetClock(clock)
+	lokiPusher.SetFlushIntervals(10*time.Second, 30*time.Second)
+	stream := func(tenant string, line string) LokiStream {
+		return LokiStream{Labels: map[string]string{"label1": "value"}, Values: [][]string{{"0", line}}, Tenant: tenant}
+	}
+	lokiPusher.startWorkers()
+	defer lokiPusher.stopWorkers()
+	// flushOldBatches waits for the flushed batches to be sent.
+	flushOldBatches := func() {
+		lokiPusher.flushOldBatches()
+		lokiPusher.inflight.Wait()
+	}
+
+	lokiPusher.addData(stream("a", "log-line-0"))
+	clock.Advance(5 * time.Second)
+	lokiPusher.addData(stream("a", "log-line-1"))
+	lokiPusher.addData(stream("b", "log-line-2"))
+	clock.Advance(4 * time.Second)
+	flushOldBatches()
+	assert.Equal(t, 0, client.sendDataCounter)
+
+	// The batch of a is due, the batch of b is 5 seconds younger.
+	clock.Advance(time.Second)
+	flushOldBatches()
+	assert.Equal(t, 1, client.sendDataCounter)
+	assert.Equal(t, "a", client.savedData.Tenant)
+	assert.Equal(t, 2, client.savedData.Count)
+	assert.Equal(t, clock.Now(), lokiPusher.LastFlush())
+
+	clock.Advance(5 * time.Second)
+	flushOldBatches()
+	assert.Equal(t, 2, client.sendDataCounter)
+	assert.Equal(t, "b", client.savedData.Tenant)
+
+	// The next batch of a is due but a was flushed less than 30 seconds ago.
+	lokiPusher.addData(stream("a", "log-line-3"))
+	clock.Advance(10 * time.Second)
+	flushOldBatches()
+	assert.Equal(t, 2, client.sendDataCounter)
+	clock.Advance(15 * time.Second)
+	flushOldBatches()
+	assert.Equal(t, 3, client.sendDataCounter)
+	assert.Equal(t, [][]string{{"0", "log-line-3"}}, client.savedData.Streams[0].Values)
+}
+
+// Test_Pusher_pruneTimestamps ensures that the latest timestamps of the idle streams are forgotten.
+func Test_Pusher_pruneTimestamps(t *testing.T) {
+	client := &SpeedyTestSink{}
+	clock := speedyTesting.NewFakeClock(time.Unix(1_000_000, 0))
+	lokiPusher := NewPusher(client, 100, math.MaxInt32)
+	lokiPusher.SetClock(clock)
+	lokiPusher.SetFlushIntervals(10*time.Second, time.Second)
+	stream := func(label string, timestamp string) LokiStream {
+		return LokiStream{Labels: map[string]string{"label1": label}, Values: [][]string{{timestamp, "log-line"}}}
+	}
+	lokiPusher.startWorkers()
+	defer lokiPusher.stopWorkers()
+
+	lokiPusher.addData(stream("a", "20"))
+	lokiPusher.addData(stream("b", "20"))
+	clock.Advance(20 * time.Second)
+	lokiPusher.addData(stream("b", "30"))
+	lokiPusher.flushOldBatches()
+	assert.Len(t, lokiPusher.lastTimestamps, 2)
+
+	// a has no entries for 3 flush intervals, b for 1.
+	clock.Advance(10 * time.Second)
+	lokiPusher.flushOldBatches()
+	assert.Len(t, lokiPusher.lastTimestamps, 1)
+	b := stream("b", "")
+	assert.Equal(t, int64(30), lokiPusher.lastTimestamps[b.StreamKey()].timestamp)
+
+	// The timestamps of a are not adjusted to the forgotten one.
+	data := stream("a", "10")
+	lokiPusher.addData(data)
+	assert.Equal(t, "10", data.Values[0][0])
+	lokiPusher.inflight.Wait()
+}
+
+// channelTestSink sends the pushed batches to a channel.
+type channelTestSink struct {
+	batches chan *LokiStreams
+}
+
+func (s *channelTestSink) SendData(_ context.Context, data *LokiStreams) error {
+	s.batches <- data
+	return nil
+}
+
+func (s *channelTestSink) Shutdown() {
+}
+
+// Test_Pusher_RunForever_FakeClock ensures that the ticker of the pusher's clock triggers the age-based flushes.
+func Test_Pusher_RunForever_FakeClock(t *testing.T) {
+	sink := &channelTestSink{batches: make(chan *LokiStreams, 10)}
+	clock := speedyTesting.NewFakeClock(time.Unix(1_000_000, 0))
+	lokiPusher := NewPusher(sink, 100, math.MaxInt32)
+	lokiPusher.TimeProvider = speedyTesting.ZeroNanoTimeProvider
+	lokiPusher.SetClock(clock)
+	lokiPusher.SetFlushIntervals(time.Minute, 0)
+	go lokiPusher.RunForever()
+	clock.WaitForTickers(1)
+
+	lokiPusher.DataChannel <- LokiStream{Labels: map[string]string{"label1": "value"}, Values: [][]string{{"0", "log-line-0"}}}
+	// The data may be received after a tick, keep ticking until the batch is due.
+	var batch *LokiStreams
+	for batch == nil {
+		clock.Advance(15 * time.Second)
+		select {
+		case batch = <-sink.batches:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	lokiPusher.Shutdown()
+	assert.Equal(t, 1, batch.Count)
+	assert.Len(t, sink.batches, 0)
+}
+
+// gatedTestSink reports the lines it's sent and blocks the batches of the gated label set until released.
+type gatedTestSink struct {
+	sent    chan string
+	gated   string
+	release chan struct{}
+}
+
+func newGatedTestSink(gated string) *gatedTestSink {
+	return &gatedTestSink{sent: make(chan string, 10), gated: gated, release: make(chan struct{})}
+}
+
+func (s *gatedTestSink) SendData(ctx context.Context, data *LokiStreams) error {
+	for _, stream := range data.Streams {
+		for _, value := range stream.Values {
+			s.sent <- value[1]
+		}
+		if stream.LabelsKey() == s.gated {
+			select {
+			case <-s.release:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+func (s *gatedTestSink) Shutdown() {
+}
+
+// Test_Pusher_RunForever_Backpressure ensures that the pusher stops consuming data while the worker of a flushed
+// batch is busy, and that the entries of a stream are pushed in order.
+func Test_Pusher_RunForever_Backpressure(t *testing.T) {
+	labels := map[string]string{"label1": "value"}
+	sink := newGatedTestSink((&LokiStream{Labels: labels}).LabelsKey())
+	lokiPusher := NewPusher(sink, 1, math.MaxInt32)
+	lokiPusher.TimeProvider = speedyTesting.ZeroNanoTimeProvider
+	go lokiPusher.RunForever()
+
+	for index := 0; index < 4; index++ {
+		lokiPusher.DataChannel <- LokiStream{Labels: labels, Values: [][]string{{"0", fmt.Sprintf("log-line-%d", index)}}}
+	}
+	assert.Equal(t, "log-line-0", <-sink.sent)
+	// The second batch waits in the queue of the worker, the third one for a free slot and the fourth entry waits in
+	// the channel.
+	assert.Eventually(t, func() bool { return len(lokiPusher.DataChannel) == 1 }, time.Second, time.Millisecond)
+	assert.Len(t, sink.sent, 0)
+
+	close(sink.release)
+	lokiPusher.Shutdown()
+	assert.Equal(t, "log-line-1", <-sink.sent)
+	assert.Equal(t, "log-line-2", <-sink.sent)
+	assert.Equal(t, "log-line-3", <-sink.sent)
+}
+
+// Test_Pusher_RunForever_MaxInflightRequests ensures that the batches of different workers are pushed concurrently and
+// that the offsets are committed in order when the pushes complete out of order.
+func Test_Pusher_RunForever_MaxInflightRequests(t *testing.T) {
+	lokiPusher := NewPusher(&SpeedyTestSink{}, 1, math.MaxInt32)
+	lokiPusher.SetMaxInflightRequests(2)
+	// Find two label sets pushed by different workers.
+	slow := map[string]string{"label1": "slow"}
+	fast := map[string]string{"label1": "fast-0"}
+	worker := func(labels map[string]string) int {
+		return lokiPusher.worker((&LokiStream{Labels: labels}).StreamKey())
+	}
+	for index := 1; worker(fast) == worker(slow); index++ {
+		fast = map[string]string{"label1": fmt.Sprintf("fast-%d", index)}
+	}
+
+	sink := newGatedTestSink((&LokiStream{Labels: slow}).LabelsKey())
+	committer := &testOffsetCommitter{}
+	tracker := NewOffsetTracker(committer)
+	lokiPusher.speedySink = sink
+	lokiPusher.TimeProvider = speedyTesting.ZeroNanoTimeProvider
+	lokiPusher.SetOffsetTracker(tracker)
+	go lokiPusher.RunForever()
+
+	push := func(labels map[string]string, offset int64) {
+		source := testTopicPartition("topic", 0, offset)
+		tracker.Track(source)
+		lokiPusher.DataChannel <- LokiStream{
+			Labels:  labels,
+			Values:  [][]string{{"0", fmt.Sprintf("log-line-%d", offset)}},
+			Sources: []kafka.TopicPartition{source},
+		}
+	}
+	push(slow, 1)
+	assert.Equal(t, "log-line-1", <-sink.sent)
+	push(fast, 2)
+	push(fast, 3)
+	assert.Equal(t, "log-line-2", <-sink.sent)
+	// The worker took the third batch, so the second one was delivered and its offset marked done.
+	assert.Equal(t, "log-line-3", <-sink.sent)
+	assert.Empty(t, committer.committed)
+
+	close(sink.release)
+	lokiPusher.Flush()
+	lokiPusher.Shutdown()
+	assert.Equal(t, map[string]int64{"topic[0]": 4}, committedOffsets(committer))
 }
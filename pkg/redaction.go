@@ -0,0 +1,241 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// RedactionModeMask replaces the redacted values with a mask.
+	RedactionModeMask = "mask"
+	// RedactionModeHash replaces the redacted values with their salted hash, so they can still be correlated.
+	RedactionModeHash = "hash"
+)
+
+// DefaultRedactionMask is the default replacement of the masked values.
+const DefaultRedactionMask = "[REDACTED]"
+
+// redactionFieldsRule is the metric rule of the values redacted by the field globs.
+const redactionFieldsRule = "fields"
+
+// RedactionPattern masks the parts of the string values that match Regex. Name alone selects a built-in pattern:
+// email, ipv4, jwt or credit_card.
+type RedactionPattern struct {
+	// Name identifies the pattern in the metrics.
+	Name string `json:"name" mapstructure:"name"`
+	// Regex is the regular expression of the values to redact, empty for the built-in patterns.
+	Regex string `json:"regex,omitempty" mapstructure:"regex"`
+}
+
+// builtinRedactionPattern is a built-in pattern, with an optional check of the matches.
+type builtinRedactionPattern struct {
+	regex string
+	check func(match string) bool
+}
+
+// builtinRedactionPatterns are the built-in patterns by name.
+var builtinRedactionPatterns = map[string]builtinRedactionPattern{
+	"email": {regex: `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`},
+	"ipv4":  {regex: `\b(?:(?:25[0-5]|2[0-4][0-9]|1[0-9][0-9]|[1-9]?[0-9])\.){3}(?:25[0-5]|2[0-4][0-9]|1[0-9][0-9]|[1-9]?[0-9])\b`},
+	"jwt":   {regex: `\beyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`},
+	// Card numbers have 13 to 19 digits, optionally grouped by spaces or dashes, and a valid Luhn checksum.
+	"credit_card": {regex: `\b[0-9](?:[ -]?[0-9]){12,18}\b`, check: luhnValid},
+}
+
+// luhnValid returns whether the digits of the given number have a valid Luhn checksum.
+func luhnValid(number string) bool {
+	sum := 0
+	double := false
+	for index := len(number) - 1; index >= 0; index-- {
+		character := number[index]
+		if character < '0' || character > '9' {
+			continue
+		}
+		digit := int(character - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// RedactionOptions configures a Redactor.
+type RedactionOptions struct {
+	// Fields are the globs of the flattened field paths whose values are redacted, including the fields below them.
+	// They're written with the separator of Flatten, a * matches within a path segment and a ** matches any number of
+	// segments.
+	Fields []string
+	// Flatten are the options the fields were flattened with, the defaults when empty.
+	Flatten FlattenOptions
+	// Patterns are the patterns redacted from the string values.
+	Patterns []RedactionPattern
+	// Mode is mask or hash.
+	Mode string
+	// Mask is the replacement of the masked values.
+	Mask string
+	// HashSalt is the key of the HMAC-SHA256 used by the hash mode.
+	HashSalt string
+}
+
+// compiledRedactionPattern is a compiled RedactionPattern.
+type compiledRedactionPattern struct {
+	name  string
+	regex *regexp.Regexp
+	check func(match string) bool
+}
+
+// Redactor removes sensitive data from the messages before they're pushed to Loki.
+type Redactor struct {
+	fields   []*regexp.Regexp
+	patterns []compiledRedactionPattern
+	replace  func(value string) string
+}
+
+// NewRedactor creates a new Redactor, the field globs and patterns are compiled.
+func NewRedactor(options RedactionOptions) (*Redactor, error) {
+	redactor := &Redactor{}
+	switch options.Mode {
+	case "", RedactionModeMask:
+		mask := options.Mask
+		if mask == "" {
+			mask = DefaultRedactionMask
+		}
+		redactor.replace = func(string) string {
+			return mask
+		}
+	case RedactionModeHash:
+		if options.HashSalt == "" {
+			return nil, fmt.Errorf("a salt is required by the hash redaction mode")
+		}
+		salt := []byte(options.HashSalt)
+		redactor.replace = func(value string) string {
+			mac := hmac.New(sha256.New, salt)
+			mac.Write([]byte(value))
+			return hex.EncodeToString(mac.Sum(nil))
+		}
+	default:
+		return nil, fmt.Errorf("invalid redaction mode %s", options.Mode)
+	}
+
+	flattenOptions := options.Flatten
+	if err := flattenOptions.Validate(); err != nil {
+		return nil, err
+	}
+	for _, glob := range options.Fields {
+		regex, err := compileFieldGlob(glob, flattenOptions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction field %s: %w", glob, err)
+		}
+		redactor.fields = append(redactor.fields, regex)
+	}
+
+	for _, pattern := range options.Patterns {
+		if pattern.Name == "" {
+			return nil, fmt.Errorf("redaction patterns need a name")
+		}
+		compiled := compiledRedactionPattern{name: pattern.Name}
+		expression := pattern.Regex
+		if expression == "" {
+			builtin, ok := builtinRedactionPatterns[pattern.Name]
+			if !ok {
+				return nil, fmt.Errorf("unknown built-in redaction pattern %s", pattern.Name)
+			}
+			expression = builtin.regex
+			compiled.check = builtin.check
+		}
+		regex, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %s: %w", pattern.Name, err)
+		}
+		compiled.regex = regex
+		redactor.patterns = append(redactor.patterns, compiled)
+	}
+	return redactor, nil
+}
+
+// compileFieldGlob compiles a field path glob to a regular expression that matches the path and the paths below it.
+// A * never matches the first byte of the separator, unless it's escaped with the EscapeKeys option.
+func compileFieldGlob(glob string, options FlattenOptions) (*regexp.Regexp, error) {
+	if glob == "" {
+		return nil, fmt.Errorf("empty glob")
+	}
+	separator := regexp.QuoteMeta(options.Separator)
+	segment := fmt.Sprintf(`[^\x{%x}]*`, options.Separator[0])
+	if options.EscapeKeys {
+		// The escaped bytes belong to the key, the unescaped separators end it.
+		segment = fmt.Sprintf(`(?:\\.|[^\\\x{%x}])*`, options.Separator[0])
+	}
+	var expression strings.Builder
+	expression.WriteString("^")
+	for index := 0; index < len(glob); index++ {
+		if glob[index] != '*' {
+			expression.WriteString(regexp.QuoteMeta(glob[index : index+1]))
+		} else if index+1 < len(glob) && glob[index+1] == '*' {
+			expression.WriteString(".*")
+			index++
+		} else {
+			expression.WriteString(segment)
+		}
+	}
+	// Redacting a field redacts its array items and nested fields.
+	expression.WriteString(`(?:` + separator + `.*|\[.*)?$`)
+	return regexp.Compile(expression.String())
+}
+
+// Redact redacts the given flattened fields in place. The patterns are redacted from the strings, and from the
+// numbers as they're formatted, e.g. a card number, the numbers matching a pattern are replaced by the redacted string.
+func (r *Redactor) Redact(fields map[string]interface{}) {
+	for key, value := range fields {
+		if value == nil {
+			continue
+		}
+		if r.deniedField(key) {
+			fields[key] = r.replace(stringValue(value))
+			redactions.WithLabelValues(redactionFieldsRule).Inc()
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			fields[key] = r.RedactString(v)
+		case bool:
+		default:
+			text := stringValue(v)
+			if redacted := r.RedactString(text); redacted != text {
+				fields[key] = redacted
+			}
+		}
+	}
+}
+
+// RedactString redacts the patterns from the given string.
+func (r *Redactor) RedactString(text string) string {
+	for _, pattern := range r.patterns {
+		text = pattern.regex.ReplaceAllStringFunc(text, func(match string) string {
+			if pattern.check != nil && !pattern.check(match) {
+				return match
+			}
+			redactions.WithLabelValues(pattern.name).Inc()
+			return r.replace(match)
+		})
+	}
+	return text
+}
+
+// deniedField returns whether the given field path matches a field glob.
+func (r *Redactor) deniedField(key string) bool {
+	for _, regex := range r.fields {
+		if regex.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Test_NewRedactor ensures that invalid options are rejected.
+func Test_NewRedactor(t *testing.T) {
+	var tests = []RedactionOptions{
+		{Mode: "erase"},
+		{Mode: RedactionModeHash},
+		{Fields: []string{""}},
+		{Patterns: []RedactionPattern{{Regex: "[0-9]+"}}},
+		{Patterns: []RedactionPattern{{Name: "phone"}}},
+		{Patterns: []RedactionPattern{{Name: "broken", Regex: "("}}},
+	}
+	for index, options := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			_, err := NewRedactor(options)
+			assert.Error(t, err)
+		})
+	}
+}
+
+// Test_luhnValid ensures that the Luhn checksum of card numbers is checked.
+func Test_luhnValid(t *testing.T) {
+	assert.True(t, luhnValid("4111111111111111"))
+	assert.True(t, luhnValid("4111-1111-1111-1111"))
+	assert.True(t, luhnValid("5500 0000 0000 0004"))
+	assert.False(t, luhnValid("4111111111111112"))
+}
+
+// Test_Redactor_Redact ensures that the denied fields and the patterns are masked.
+func Test_Redactor_Redact(t *testing.T) {
+	redactor, err := NewRedactor(RedactionOptions{
+		Fields: []string{"user.*.password", "token", "secrets.**.key"},
+		Patterns: []RedactionPattern{
+			{Name: "email"}, {Name: "ipv4"}, {Name: "jwt"}, {Name: "credit_card"},
+			{Name: "order", Regex: `ORD-[0-9]+`},
+		},
+	})
+	assert.Nil(t, err)
+
+	var tests = []struct {
+		key      string
+		value    interface{}
+		expected interface{}
+	}{
+		{"user.admin.password", "hunter2", DefaultRedactionMask},
+		{"user.admin.password[0]", "hunter2", DefaultRedactionMask},
+		{"user.admin.name", "admin", "admin"},
+		{"user.password", "hunter2", "hunter2"},
+		{"token", float64(42), DefaultRedactionMask},
+		{"token.value", "abc", DefaultRedactionMask},
+		{"tokens", "abc", "abc"},
+		{"secrets.a.b.key", "abc", DefaultRedactionMask},
+		{"message", "mail john.doe@example.com now", "mail [REDACTED] now"},
+		{"message", "from 10.0.0.1 to 256.1.1.1", "from [REDACTED] to 256.1.1.1"},
+		{"message", "bearer eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.abc_DEF-1", "bearer [REDACTED]"},
+		{"message", "card 4111 1111 1111 1111 paid", "card [REDACTED] paid"},
+		{"message", "card 4111 1111 1111 1112 paid", "card 4111 1111 1111 1112 paid"},
+		{"message", "order ORD-1234 shipped", "order [REDACTED] shipped"},
+		{"card", float64(4111111111111111), DefaultRedactionMask},
+		{"card", json.Number("4111111111111111"), DefaultRedactionMask},
+		{"card", int64(4111111111111111), DefaultRedactionMask},
+		{"count", float64(4111111111111112), float64(4111111111111112)},
+		{"cached", true, true},
+		{"empty", nil, nil},
+	}
+	for index, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			fields := map[string]interface{}{tt.key: tt.value}
+			redactor.Redact(fields)
+			assert.Equal(t, map[string]interface{}{tt.key: tt.expected}, fields)
+		})
+	}
+}
+
+// Test_Redactor_Redact_FlattenOptions ensures that the field globs follow the separator and the escaping of the
+// flattened keys.
+func Test_Redactor_Redact_FlattenOptions(t *testing.T) {
+	var tests = []struct {
+		options  FlattenOptions
+		glob     string
+		key      string
+		redacted bool
+	}{
+		{FlattenOptions{Separator: "_"}, "user_*_password", "user_admin_password", true},
+		{FlattenOptions{Separator: "_"}, "user_*_password", "user_admin_password_hash", true},
+		{FlattenOptions{Separator: "_"}, "user_*_password", "user_password", false},
+		{FlattenOptions{Separator: "_"}, "user_*_password", "user_a_b_password", false},
+		{FlattenOptions{Separator: "_"}, "user.*.password", "user_admin_password", false},
+		{FlattenOptions{Separator: "::"}, "user::*::password", "user::admin::password", true},
+		{FlattenOptions{Separator: "::"}, "secrets::**::key", "secrets::a::b::key", true},
+		{FlattenOptions{Separator: "::", EscapeKeys: true}, "user::*::password", `user::a\:b::password`, true},
+		{FlattenOptions{Separator: "::", EscapeKeys: true}, "user::*::password", "user::a::b::password", false},
+		{FlattenOptions{Separator: ".", EscapeKeys: true}, "user.*.password", `user.my\.name.password`, true},
+		{FlattenOptions{Separator: ".", EscapeKeys: true}, "user.*.password", `user.list\[0].password`, true},
+		{FlattenOptions{Separator: ".", EscapeKeys: true}, "user", `user\.name`, false},
+		{FlattenOptions{Separator: ".", EscapeKeys: true}, `my\.key`, `my\.key`, true},
+		{FlattenOptions{Separator: ".", EscapeKeys: true}, `my\.key`, `my\.key[0]`, true},
+	}
+	for index, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			redactor, err := NewRedactor(RedactionOptions{Fields: []string{tt.glob}, Flatten: tt.options})
+			assert.Nil(t, err)
+			fields := map[string]interface{}{tt.key: "secret"}
+			redactor.Redact(fields)
+			assert.Equal(t, tt.redacted, fields[tt.key] == DefaultRedactionMask)
+		})
+	}
+
+	_, err := NewRedactor(RedactionOptions{Fields: []string{"user"}, Flatten: FlattenOptions{Separator: "["}})
+	assert.Error(t, err)
+}
+
+// Test_MessageProcessor_Process_Redactor_EscapeKeys ensures that the fields flattened with a custom separator and
+// escaped keys are redacted.
+func Test_MessageProcessor_Process_Redactor_EscapeKeys(t *testing.T) {
+	options := FlattenOptions{Separator: "_", EscapeKeys: true}
+	processor := newTestMessageProcessor(t)
+	assert.Nil(t, processor.SetFlattenOptions(options))
+	redactor, err := NewRedactor(RedactionOptions{Fields: []string{"user_*_password"}, Flatten: options, Mask: "***"})
+	assert.Nil(t, err)
+	processor.SetRedactor(redactor)
+
+	stream, err := processor.Process(testMessage("topic", 0, 1,
+		`{"user": {"first_admin": {"password": "hunter2"}, "name": "admin"}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"user_first\\_admin_password":"***","user_name":"admin"}`, stream.Values[0][1])
+}
+
+// Test_Redactor_Hash ensures that the hash mode replaces the values with their salted hash.
+func Test_Redactor_Hash(t *testing.T) {
+	redactor, err := NewRedactor(RedactionOptions{
+		Fields:   []string{"password"},
+		Patterns: []RedactionPattern{{Name: "email"}},
+		Mode:     RedactionModeHash,
+		HashSalt: "salt",
+	})
+	assert.Nil(t, err)
+	hash := func(value string) string {
+		mac := hmac.New(sha256.New, []byte("salt"))
+		mac.Write([]byte(value))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	redacted := testutil.ToFloat64(redactions.WithLabelValues("email"))
+	fields := map[string]interface{}{"password": "hunter2", "message": "sent to a@example.com"}
+	redactor.Redact(fields)
+	assert.Equal(t, map[string]interface{}{
+		"password": hash("hunter2"),
+		"message":  "sent to " + hash("a@example.com"),
+	}, fields)
+	assert.Equal(t, redacted+1, testutil.ToFloat64(redactions.WithLabelValues("email")))
+	// The same value always has the same hash.
+	assert.Equal(t, "sent to "+hash("a@example.com"), redactor.RedactString("sent to a@example.com"))
+}
+
+// Test_MessageProcessor_Process_Redactor ensures that the messages are redacted before they're marshalled.
+func Test_MessageProcessor_Process_Redactor(t *testing.T) {
+	processor := newTestMessageProcessor(t)
+	redactor, err := NewRedactor(RedactionOptions{
+		Fields:   []string{"user.password"},
+		Patterns: []RedactionPattern{{Name: "email"}},
+		Mask:     "***",
+	})
+	assert.Nil(t, err)
+	processor.SetRedactor(redactor)
+
+	stream, err := processor.Process(testMessage("topic", 0, 1,
+		`{"user": {"password": "hunter2", "email": "a@example.com"}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"user.email":"***","user.password":"***"}`, stream.Values[0][1])
+
+	stream, err = processor.Process(testMessage("raw-topic", 0, 2, "login a@example.com"))
+	assert.Nil(t, err)
+	assert.Equal(t, "login ***", stream.Values[0][1])
+}
@@ -0,0 +1,150 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy configures how failed pushes are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, 0 means unlimited.
+	MaxAttempts int
+	// MaxElapsedTime is the maximum time spent retrying a push, 0 means unlimited.
+	MaxElapsedTime time.Duration
+	// InitialBackoff is the backoff before the first retry, it doubles on every attempt.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the backoff between two attempts.
+	MaxBackoff time.Duration
+}
+
+// IsRetryableError returns whether a push that failed with the given error can be retried.
+// Network errors and the failed pushes are retryable, the requests rejected as invalid or too large are not.
+func IsRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pushError *LokiPushError
+	if errors.As(err, &pushError) {
+		return pushError.Retryable()
+	}
+	return !errors.Is(err, context.Canceled)
+}
+
+// IsRejectedError returns whether the error means that Loki rejected the data, retrying won't help.
+func IsRejectedError(err error) bool {
+	var pushError *LokiPushError
+	return errors.As(err, &pushError) && !pushError.Retryable()
+}
+
+// RetriesExhaustedError is returned by RetryingSink when it gives up retrying a push.
+type RetriesExhaustedError struct {
+	// Err is the error of the last attempt.
+	Err error
+}
+
+// Error returns the error message.
+func (e *RetriesExhaustedError) Error() string {
+	return "retries exhausted: " + e.Err.Error()
+}
+
+// Unwrap returns the error of the last attempt.
+func (e *RetriesExhaustedError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetriesExhaustedError returns whether the error means that the push was retried for as long as allowed.
+func IsRetriesExhaustedError(err error) bool {
+	var exhaustedError *RetriesExhaustedError
+	return errors.As(err, &exhaustedError)
+}
+
+// RetryingSink is an ISpeedySink that retries failed pushes of the wrapped sink with jittered exponential backoff.
+// SendData blocks while retrying, so that backpressure reaches the Kafka consumer instead of losing data.
+type RetryingSink struct {
+	sink   ISpeedySink
+	policy RetryPolicy
+	// sleep waits for the given duration or until the context is done.
+	sleep func(ctx context.Context, duration time.Duration) error
+	now   func() time.Time
+}
+
+// NewRetryingSink creates a new RetryingSink.
+func NewRetryingSink(sink ISpeedySink, policy RetryPolicy) *RetryingSink {
+	if sink == nil {
+		panic("Speedy sink is nil")
+	}
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = 500 * time.Millisecond
+	}
+	if policy.MaxBackoff < policy.InitialBackoff {
+		policy.MaxBackoff = policy.InitialBackoff
+	}
+	return &RetryingSink{sink: sink, policy: policy, sleep: sleepContext, now: time.Now}
+}
+
+// SendData sends the data to the wrapped sink, retrying for as long as the policy allows.
+func (r *RetryingSink) SendData(ctx context.Context, data *LokiStreams) error {
+	start := r.now()
+	for attempt := 1; ; attempt++ {
+		err := r.sink.SendData(ctx, data)
+		if !IsRetryableError(err) {
+			return err
+		}
+		if r.policy.MaxAttempts > 0 && attempt >= r.policy.MaxAttempts {
+			SugaredLogger.Errorf("giving up push after %d attempts: %s", attempt, err)
+			return &RetriesExhaustedError{Err: err}
+		}
+
+		backoff := r.backoff(attempt, err)
+		if r.policy.MaxElapsedTime > 0 && r.now().Add(backoff).Sub(start) > r.policy.MaxElapsedTime {
+			SugaredLogger.Errorf("giving up push after %s: %s", r.now().Sub(start), err)
+			return &RetriesExhaustedError{Err: err}
+		}
+		SugaredLogger.Warnf("push attempt %d failed, retrying in %s: %s", attempt, backoff, err)
+		if sleepErr := r.sleep(ctx, backoff); sleepErr != nil {
+			return err
+		}
+	}
+}
+
+// backoff returns the delay before the next attempt, honoring the Retry-After requested by Loki.
+func (r *RetryingSink) backoff(attempt int, err error) time.Duration {
+	var pushError *LokiPushError
+	if errors.As(err, &pushError) && pushError.RetryAfter > 0 {
+		return pushError.RetryAfter
+	}
+
+	return r.policy.backoff(attempt)
+}
+
+// backoff returns the jittered exponential delay before the given attempt.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.MaxBackoff
+	// Guard against overflowing the shift on large attempts.
+	if attempt < 32 {
+		if exponential := p.InitialBackoff << uint(attempt-1); exponential > 0 && exponential < backoff {
+			backoff = exponential
+		}
+	}
+	// Equal jitter: pick a random delay between half and the whole backoff.
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// Shutdown shuts down the wrapped sink.
+func (r *RetryingSink) Shutdown() {
+	r.sink.Shutdown()
+}
+
+// sleepContext waits for the given duration or until the context is done.
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// failingTestSink is a sink that returns the given errors in order, then succeeds.
+type failingTestSink struct {
+	errors   []error
+	attempts int
+	shutdown bool
+}
+
+func (s *failingTestSink) SendData(_ context.Context, _ *LokiStreams) error {
+	s.attempts += 1
+	if s.attempts <= len(s.errors) {
+		return s.errors[s.attempts-1]
+	}
+	return nil
+}
+
+func (s *failingTestSink) Shutdown() {
+	s.shutdown = true
+}
+
+// newTestRetryingSink creates a RetryingSink that records its sleeps instead of sleeping.
+func newTestRetryingSink(sink ISpeedySink, policy RetryPolicy, sleeps *[]time.Duration) *RetryingSink {
+	retryingSink := NewRetryingSink(sink, policy)
+	retryingSink.sleep = func(_ context.Context, duration time.Duration) error {
+		*sleeps = append(*sleeps, duration)
+		return nil
+	}
+	return retryingSink
+}
+
+// Test_IsRetryableError ensures that errors are classified correctly.
+func Test_IsRetryableError(t *testing.T) {
+	var tests = []struct {
+		err       error
+		retryable bool
+		rejected  bool
+	}{
+		{nil, false, false},
+		{&LokiPushError{StatusCode: 400}, false, true},
+		{&LokiPushError{StatusCode: 413}, false, true},
+		{&LokiPushError{StatusCode: 401}, true, false},
+		{&LokiPushError{StatusCode: 403}, true, false},
+		{&LokiPushError{StatusCode: 404}, true, false},
+		{&LokiPushError{StatusCode: 429}, true, false},
+		{&LokiPushError{StatusCode: 500}, true, false},
+		{&LokiPushError{StatusCode: 503}, true, false},
+		{fmt.Errorf("wrapped: %w", &LokiPushError{StatusCode: 502}), true, false},
+		{errors.New("connection refused"), true, false},
+		{context.Canceled, false, false},
+	}
+	for index, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			assert.Equal(t, tt.retryable, IsRetryableError(tt.err))
+			assert.Equal(t, tt.rejected, IsRejectedError(tt.err))
+		})
+	}
+}
+
+// Test_RetryingSink_SendData ensures that retryable errors are retried with exponential backoff.
+func Test_RetryingSink_SendData(t *testing.T) {
+	sink := &failingTestSink{errors: []error{
+		errors.New("connection refused"),
+		&LokiPushError{StatusCode: 500},
+		&LokiPushError{StatusCode: 503},
+	}}
+	var sleeps []time.Duration
+	retryingSink := newTestRetryingSink(sink, RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     300 * time.Millisecond,
+	}, &sleeps)
+
+	err := retryingSink.SendData(context.Background(), NewLokiStreams(1, 1))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, sink.attempts)
+	assert.Len(t, sleeps, 3)
+	for index, maxSleep := range []time.Duration{100, 200, 300} {
+		assert.GreaterOrEqual(t, int64(sleeps[index]), int64(maxSleep*time.Millisecond/2))
+		assert.LessOrEqual(t, int64(sleeps[index]), int64(maxSleep*time.Millisecond))
+	}
+
+	retryingSink.Shutdown()
+	assert.True(t, sink.shutdown)
+}
+
+// Test_RetryingSink_SendData_RetryAfter ensures that the Retry-After requested by Loki is honored.
+func Test_RetryingSink_SendData_RetryAfter(t *testing.T) {
+	sink := &failingTestSink{errors: []error{&LokiPushError{StatusCode: 429, RetryAfter: 7 * time.Second}}}
+	var sleeps []time.Duration
+	retryingSink := newTestRetryingSink(sink, RetryPolicy{}, &sleeps)
+
+	assert.Nil(t, retryingSink.SendData(context.Background(), NewLokiStreams(1, 1)))
+	assert.Equal(t, []time.Duration{7 * time.Second}, sleeps)
+}
+
+// Test_RetryingSink_SendData_Rejected ensures that rejected pushes are not retried.
+func Test_RetryingSink_SendData_Rejected(t *testing.T) {
+	sink := &failingTestSink{errors: []error{&LokiPushError{StatusCode: 400}}}
+	var sleeps []time.Duration
+	retryingSink := newTestRetryingSink(sink, RetryPolicy{}, &sleeps)
+
+	err := retryingSink.SendData(context.Background(), NewLokiStreams(1, 1))
+	assert.True(t, IsRejectedError(err))
+	assert.Equal(t, 1, sink.attempts)
+	assert.Empty(t, sleeps)
+}
+
+// Test_RetryingSink_SendData_Limits ensures that the retries stop at the configured limits.
+func Test_RetryingSink_SendData_Limits(t *testing.T) {
+	serverError := &LokiPushError{StatusCode: 500}
+	sink := &failingTestSink{errors: []error{serverError, serverError, serverError, serverError}}
+	var sleeps []time.Duration
+	retryingSink := newTestRetryingSink(sink, RetryPolicy{MaxAttempts: 3}, &sleeps)
+
+	err := retryingSink.SendData(context.Background(), NewLokiStreams(1, 1))
+	assert.True(t, IsRetriesExhaustedError(err))
+	assert.True(t, errors.Is(err, serverError))
+	assert.Equal(t, 3, sink.attempts)
+
+	rateLimited := &LokiPushError{StatusCode: 429, RetryAfter: 4 * time.Second}
+	sink = &failingTestSink{errors: []error{rateLimited, rateLimited, rateLimited, rateLimited}}
+	sleeps = nil
+	retryingSink = newTestRetryingSink(sink, RetryPolicy{MaxElapsedTime: 10 * time.Second}, &sleeps)
+	elapsed := time.Duration(0)
+	retryingSink.now = func() time.Time {
+		return time.Unix(0, 0).Add(elapsed)
+	}
+	retryingSink.sleep = func(_ context.Context, duration time.Duration) error {
+		elapsed += duration
+		return nil
+	}
+
+	// The third retry would end after 12 seconds, so the sink gives up after the third attempt.
+	err = retryingSink.SendData(context.Background(), NewLokiStreams(1, 1))
+	assert.True(t, IsRetriesExhaustedError(err))
+	assert.True(t, errors.Is(err, rateLimited))
+	assert.Equal(t, 3, sink.attempts)
+	assert.Equal(t, 8*time.Second, elapsed)
+}
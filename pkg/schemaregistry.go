@@ -0,0 +1,143 @@
+package pkg
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/goccy/go-json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// confluentMagicByte is the first byte of messages in the Confluent wire format.
+const confluentMagicByte = 0
+
+// RegistrySchema is a schema stored in a Confluent compatible schema registry.
+type RegistrySchema struct {
+	// Schema is the schema definition.
+	Schema string `json:"schema"`
+	// SchemaType is the type of the schema: AVRO, PROTOBUF or JSON. An empty type means AVRO.
+	SchemaType string `json:"schemaType"`
+	// References are the schemas imported by the schema.
+	References []SchemaReference `json:"references"`
+}
+
+// SchemaReference is a reference from a schema to another schema of the registry.
+type SchemaReference struct {
+	// Name is the name under which the schema is imported.
+	Name string `json:"name"`
+	// Subject is the subject of the referenced schema.
+	Subject string `json:"subject"`
+	// Version is the version of the referenced schema.
+	Version int `json:"version"`
+}
+
+// SchemaRegistryUnavailableError is returned when the schema registry can't be reached, fails or rate limits the
+// requests. Unlike a malformed message, the message can be decoded once the registry is back.
+type SchemaRegistryUnavailableError struct {
+	// Err is the error of the request.
+	Err error
+}
+
+// Error returns the error message.
+func (e *SchemaRegistryUnavailableError) Error() string {
+	return "schema registry unavailable: " + e.Err.Error()
+}
+
+// Unwrap returns the error of the request.
+func (e *SchemaRegistryUnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// IsSchemaRegistryUnavailableError returns whether the error means that the schema registry is unavailable, so that
+// the decoding can be retried.
+func IsSchemaRegistryUnavailableError(err error) bool {
+	var unavailableError *SchemaRegistryUnavailableError
+	return errors.As(err, &unavailableError)
+}
+
+// SchemaRegistryClient fetches schemas from a Confluent compatible schema registry and caches them.
+type SchemaRegistryClient struct {
+	registryUrl string
+	HttpClient  *http.Client
+	mutex       sync.Mutex
+	schemas     map[string]*RegistrySchema
+}
+
+// NewSchemaRegistryClient constructs a new instance of SchemaRegistryClient.
+func NewSchemaRegistryClient(registryUrl string) *SchemaRegistryClient {
+	return &SchemaRegistryClient{
+		registryUrl: strings.TrimRight(registryUrl, "/"),
+		HttpClient:  &http.Client{Timeout: 30 * time.Second},
+		schemas:     make(map[string]*RegistrySchema),
+	}
+}
+
+// SchemaById returns the schema with the given id.
+func (c *SchemaRegistryClient) SchemaById(ctx context.Context, id int) (*RegistrySchema, error) {
+	return c.schema(ctx, fmt.Sprintf("/schemas/ids/%d", id))
+}
+
+// SchemaBySubject returns the given version of the schema of a subject.
+func (c *SchemaRegistryClient) SchemaBySubject(ctx context.Context, subject string, version int) (*RegistrySchema, error) {
+	return c.schema(ctx, fmt.Sprintf("/subjects/%s/versions/%d", url.PathEscape(subject), version))
+}
+
+// schema returns the schema at the given registry path, from the cache if possible.
+func (c *SchemaRegistryClient) schema(ctx context.Context, path string) (*RegistrySchema, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if schema, ok := c.schemas[path]; ok {
+		return schema, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.registryUrl+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	resp, err := c.HttpClient.Do(req)
+	if err != nil {
+		return nil, &SchemaRegistryUnavailableError{Err: err}
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			SugaredLogger.Error(err)
+		}
+	}(resp.Body)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &SchemaRegistryUnavailableError{Err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("schema registry returned status %d for %s: %s", resp.StatusCode, path, body)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return nil, &SchemaRegistryUnavailableError{Err: err}
+		}
+		return nil, err
+	}
+	var schema RegistrySchema
+	err = json.Unmarshal(body, &schema)
+	if err != nil {
+		return nil, err
+	}
+	c.schemas[path] = &schema
+	return &schema, nil
+}
+
+// parseConfluentWireFormat returns the schema id and the payload of a message in the Confluent wire format.
+func parseConfluentWireFormat(value []byte) (int, []byte, error) {
+	if len(value) < 5 || value[0] != confluentMagicByte {
+		return 0, nil, fmt.Errorf("message is not in the confluent wire format")
+	}
+	return int(binary.BigEndian.Uint32(value[1:5])), value[5:], nil
+}
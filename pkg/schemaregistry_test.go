@@ -0,0 +1,111 @@
+package pkg
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// testSchemaRegistry is a fake schema registry serving the given schemas by path.
+type testSchemaRegistry struct {
+	server   *httptest.Server
+	requests int32
+}
+
+func newTestSchemaRegistry(t *testing.T, schemas map[string]RegistrySchema) *testSchemaRegistry {
+	registry := &testSchemaRegistry{}
+	registry.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&registry.requests, 1)
+		schema, ok := schemas[r.URL.EscapedPath()]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error_code":40403,"message":"Schema not found"}`))
+			return
+		}
+		body, _ := json.Marshal(schema)
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(registry.server.Close)
+	return registry
+}
+
+// confluentWireFormat prefixes the payload with the magic byte and the schema id.
+func confluentWireFormat(schemaId int, payload []byte) []byte {
+	value := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(value[1:], uint32(schemaId))
+	return append(value, payload...)
+}
+
+// Test_SchemaRegistryClient_SchemaById ensures that schemas are fetched once and then served from the cache.
+func Test_SchemaRegistryClient_SchemaById(t *testing.T) {
+	registry := newTestSchemaRegistry(t, map[string]RegistrySchema{
+		"/schemas/ids/1":             {Schema: `"string"`},
+		"/subjects/a%2Fb/versions/2": {Schema: `"int"`, SchemaType: "AVRO"},
+	})
+	client := NewSchemaRegistryClient(registry.server.URL + "/")
+
+	for i := 0; i < 2; i++ {
+		schema, err := client.SchemaById(context.Background(), 1)
+		assert.Nil(t, err)
+		assert.Equal(t, &RegistrySchema{Schema: `"string"`}, schema)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&registry.requests))
+
+	schema, err := client.SchemaBySubject(context.Background(), "a/b", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, `"int"`, schema.Schema)
+
+	_, err = client.SchemaById(context.Background(), 2)
+	assert.Error(t, err)
+}
+
+// Test_SchemaRegistryClient_Unavailable ensures that the network errors, server errors and rate limiting are
+// classified as unavailability, unlike the missing schemas.
+func Test_SchemaRegistryClient_Unavailable(t *testing.T) {
+	var tests = []struct {
+		status      int
+		unavailable bool
+	}{
+		{http.StatusServiceUnavailable, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusNotFound, false},
+		{http.StatusUnprocessableEntity, false},
+	}
+	for index, test := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+			_, err := NewSchemaRegistryClient(server.URL).SchemaById(context.Background(), 1)
+			assert.Error(t, err)
+			assert.Equal(t, test.unavailable, IsSchemaRegistryUnavailableError(err))
+		})
+	}
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	_, err := NewSchemaRegistryClient(server.URL).SchemaById(context.Background(), 1)
+	assert.True(t, IsSchemaRegistryUnavailableError(err))
+}
+
+// Test_parseConfluentWireFormat ensures that the schema id and the payload are extracted from messages.
+func Test_parseConfluentWireFormat(t *testing.T) {
+	schemaId, payload, err := parseConfluentWireFormat(confluentWireFormat(258, []byte("data")))
+	assert.Nil(t, err)
+	assert.Equal(t, 258, schemaId)
+	assert.Equal(t, []byte("data"), payload)
+
+	_, _, err = parseConfluentWireFormat([]byte(`{"a": 1}`))
+	assert.Error(t, err)
+
+	_, _, err = parseConfluentWireFormat([]byte{0, 0, 1})
+	assert.Error(t, err)
+}
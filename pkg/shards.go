@@ -0,0 +1,174 @@
+package pkg
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ShardedPusher spreads the streams over several Pushers, each batching and flushing on its own.
+// Streams are sharded by their tenant and label set, so all the entries of a stream go through the same Pusher in order.
+// It's a prometheus.Collector that reports the occupancy of the DataChannel of each shard.
+type ShardedPusher struct {
+	pushers            []*Pusher
+	channelDescription *prometheus.Desc
+}
+
+// NewShardedPusher creates a new ShardedPusher with the given number of shards, all sending data to the same sink.
+func NewShardedPusher(shards int, sink ISpeedySink, maxBatchSize int, maxBatchSizeBytes int) *ShardedPusher {
+	if shards < 1 {
+		shards = 1
+	}
+	pushers := make([]*Pusher, shards)
+	for index := range pushers {
+		pushers[index] = NewPusher(sink, maxBatchSize, maxBatchSizeBytes)
+	}
+	return &ShardedPusher{
+		pushers: pushers,
+		channelDescription: prometheus.NewDesc(
+			"speedy_pusher_data_channel_length",
+			"Number of streams waiting in the DataChannel of the pusher shard.",
+			[]string{"shard"}, nil,
+		),
+	}
+}
+
+// Pushers returns the Pushers of the shards.
+func (sp *ShardedPusher) Pushers() []*Pusher {
+	return sp.pushers
+}
+
+// Push sends the stream to the Pusher of its shard.
+func (sp *ShardedPusher) Push(stream LokiStream) {
+	sp.pushers[sp.shard(stream.StreamKey())].DataChannel <- stream
+}
+
+// shard returns the shard index of the given stream key.
+func (sp *ShardedPusher) shard(streamKey string) int {
+	if len(sp.pushers) == 1 {
+		return 0
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(streamKey))
+	return int(hash.Sum32() % uint32(len(sp.pushers)))
+}
+
+// RunForever runs all the Pushers until Shutdown is called.
+func (sp *ShardedPusher) RunForever() {
+	var waitGroup sync.WaitGroup
+	for _, pusher := range sp.pushers {
+		waitGroup.Add(1)
+		go func(pusher *Pusher) {
+			defer waitGroup.Done()
+			pusher.RunForever()
+		}(pusher)
+	}
+	waitGroup.Wait()
+}
+
+// SetFlushIntervals sets the flush intervals of all the Pushers, see Pusher.SetFlushIntervals.
+func (sp *ShardedPusher) SetFlushIntervals(interval time.Duration, minInterval time.Duration) {
+	for _, pusher := range sp.pushers {
+		pusher.SetFlushIntervals(interval, minInterval)
+	}
+}
+
+// SetMaxInflightRequests sets the number of batches each Pusher sends concurrently, see Pusher.SetMaxInflightRequests.
+// The bound is per shard, up to shards × maxInflightRequests batches are pushed concurrently.
+func (sp *ShardedPusher) SetMaxInflightRequests(maxInflightRequests int) {
+	for _, pusher := range sp.pushers {
+		pusher.SetMaxInflightRequests(maxInflightRequests)
+	}
+}
+
+// SetOffsetTracker sets the OffsetTracker of all the Pushers.
+func (sp *ShardedPusher) SetOffsetTracker(tracker *OffsetTracker) {
+	for _, pusher := range sp.pushers {
+		pusher.SetOffsetTracker(tracker)
+	}
+}
+
+// SetDeadLetterQueue sets the IDeadLetterQueue of all the Pushers.
+func (sp *ShardedPusher) SetDeadLetterQueue(queue IDeadLetterQueue) {
+	for _, pusher := range sp.pushers {
+		pusher.SetDeadLetterQueue(queue)
+	}
+}
+
+// Flush flushes all the Pushers concurrently and waits for them.
+func (sp *ShardedPusher) Flush() {
+	var waitGroup sync.WaitGroup
+	for _, pusher := range sp.pushers {
+		waitGroup.Add(1)
+		go func(pusher *Pusher) {
+			defer waitGroup.Done()
+			pusher.Flush()
+		}(pusher)
+	}
+	waitGroup.Wait()
+}
+
+// CancelSends aborts the pushes in flight of all the Pushers, see Pusher.CancelSends.
+func (sp *ShardedPusher) CancelSends() {
+	for _, pusher := range sp.pushers {
+		pusher.CancelSends()
+	}
+}
+
+// Shutdown shuts down all the Pushers and waits until they flushed the remaining data.
+func (sp *ShardedPusher) Shutdown() {
+	_ = sp.ShutdownContext(context.Background())
+}
+
+// ShutdownContext shuts down all the Pushers concurrently and waits until they flushed the remaining data
+// or the context is done, see Pusher.ShutdownContext.
+func (sp *ShardedPusher) ShutdownContext(ctx context.Context) error {
+	var waitGroup sync.WaitGroup
+	errs := make([]error, len(sp.pushers))
+	for index, pusher := range sp.pushers {
+		waitGroup.Add(1)
+		go func(index int, pusher *Pusher) {
+			defer waitGroup.Done()
+			errs[index] = pusher.ShutdownContext(ctx)
+		}(index, pusher)
+	}
+	waitGroup.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FlushInterval returns the maximum age of the batches of the Pushers.
+func (sp *ShardedPusher) FlushInterval() time.Duration {
+	return sp.pushers[0].SecondsToFlush
+}
+
+// LastFlush returns the oldest last flush of the Pushers, a stuck Pusher stops flushing.
+func (sp *ShardedPusher) LastFlush() time.Time {
+	lastFlush := sp.pushers[0].LastFlush()
+	for _, pusher := range sp.pushers[1:] {
+		if pusher.LastFlush().Before(lastFlush) {
+			lastFlush = pusher.LastFlush()
+		}
+	}
+	return lastFlush
+}
+
+// Describe implements prometheus.Collector.
+func (sp *ShardedPusher) Describe(descriptions chan<- *prometheus.Desc) {
+	descriptions <- sp.channelDescription
+}
+
+// Collect implements prometheus.Collector.
+func (sp *ShardedPusher) Collect(metrics chan<- prometheus.Metric) {
+	for index, pusher := range sp.pushers {
+		metrics <- prometheus.MustNewConstMetric(sp.channelDescription, prometheus.GaugeValue,
+			float64(len(pusher.DataChannel)), strconv.Itoa(index))
+	}
+}
@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"sync"
+	"testing"
+)
+
+// concurrentTestSink is a sink that records all the sent entries and is safe for concurrent use.
+type concurrentTestSink struct {
+	mutex   sync.Mutex
+	streams []LokiStream
+	// batches holds the sent batches.
+	batches []*LokiStreams
+}
+
+func (s *concurrentTestSink) SendData(_ context.Context, data *LokiStreams) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.streams = append(s.streams, data.Streams...)
+	s.batches = append(s.batches, data)
+	return nil
+}
+
+func (s *concurrentTestSink) Shutdown() {
+}
+
+// sentBatches returns the batches sent so far.
+func (s *concurrentTestSink) sentBatches() []*LokiStreams {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*LokiStreams(nil), s.batches...)
+}
+
+// lines returns the lines sent for each label set.
+func (s *concurrentTestSink) lines() map[string][]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lines := make(map[string][]string)
+	for _, stream := range s.streams {
+		for _, value := range stream.Values {
+			lines[stream.LabelsKey()] = append(lines[stream.LabelsKey()], value[1])
+		}
+	}
+	return lines
+}
+
+// Test_ShardedPusher_Push ensures that streams are sharded by labels and keep their order.
+func Test_ShardedPusher_Push(t *testing.T) {
+	sink := &concurrentTestSink{}
+	pusher := NewShardedPusher(4, sink, 7, math.MaxInt32)
+	assert.Len(t, pusher.Pushers(), 4)
+	go pusher.RunForever()
+
+	expected := make(map[string][]string)
+	for index := 0; index < 100; index++ {
+		stream := LokiStream{
+			Labels: map[string]string{"stream": fmt.Sprintf("%d", index%10)},
+			Values: [][]string{{"0", fmt.Sprintf("line-%d", index)}},
+		}
+		expected[stream.LabelsKey()] = append(expected[stream.LabelsKey()], stream.Values[0][1])
+		assert.Equal(t, pusher.shard(stream.LabelsKey()), pusher.shard(stream.LabelsKey()))
+		pusher.Push(stream)
+	}
+	pusher.Flush()
+	pusher.Shutdown()
+
+	assert.Equal(t, expected, sink.lines())
+}
+
+// Test_ShardedPusher_ShutdownContext ensures that the shutdown waits until every shard flushed its remaining data.
+func Test_ShardedPusher_ShutdownContext(t *testing.T) {
+	sink := &concurrentTestSink{}
+	pusher := NewShardedPusher(4, sink, 1000, math.MaxInt32)
+	go pusher.RunForever()
+
+	for index := 0; index < 20; index++ {
+		pusher.Push(LokiStream{
+			Labels: map[string]string{"stream": fmt.Sprintf("%d", index)},
+			Values: [][]string{{"0", "line"}},
+		})
+	}
+	assert.Nil(t, pusher.ShutdownContext(context.Background()))
+
+	assert.Len(t, sink.lines(), 20)
+}
@@ -0,0 +1,54 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"regexp"
+)
+
+// tenantIdRegex matches the tenant ids accepted by Loki.
+var tenantIdRegex = regexp.MustCompile(`^[a-zA-Z0-9!._*'()-]{1,150}$`)
+
+// ValidateTenantId returns an error if the id is not a valid Loki tenant id.
+func ValidateTenantId(id string) error {
+	if !tenantIdRegex.MatchString(id) || id == "." || id == ".." {
+		return fmt.Errorf("invalid tenant id %q", id)
+	}
+	return nil
+}
+
+// TenantExtractor extracts the Loki tenant of Kafka messages according to a ValueRule.
+type TenantExtractor struct {
+	extractor *valueExtractor
+}
+
+// NewTenantExtractor creates a new TenantExtractor, the rule is validated and compiled.
+func NewTenantExtractor(rule ValueRule) (*TenantExtractor, error) {
+	extractor, err := newValueExtractor(rule)
+	if err != nil {
+		return nil, fmt.Errorf("tenant: %w", err)
+	}
+	if rule.Default != "" {
+		if err := ValidateTenantId(rule.Default); err != nil {
+			return nil, err
+		}
+	}
+	return &TenantExtractor{extractor: extractor}, nil
+}
+
+// Fields returns the flattened field paths the tenant is taken from.
+func (t *TenantExtractor) Fields() []string {
+	if t.extractor.rule.Source != ValueSourceField {
+		return nil
+	}
+	return []string{t.extractor.rule.Path}
+}
+
+// Extract returns the tenant of the given message, an error if there's none or it's invalid.
+func (t *TenantExtractor) Extract(message *kafka.Message, fields map[string]interface{}) (string, error) {
+	tenant := t.extractor.Extract(message, fields)
+	if tenant == "" {
+		return "", fmt.Errorf("message has no tenant")
+	}
+	return tenant, ValidateTenantId(tenant)
+}
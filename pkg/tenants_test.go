@@ -0,0 +1,70 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// Test_ValidateTenantId ensures that only the tenant ids accepted by Loki are valid.
+func Test_ValidateTenantId(t *testing.T) {
+	var tests = []struct {
+		id    string
+		valid bool
+	}{
+		{"team-a", true},
+		{"Team_A.prod(1)*!'", true},
+		{strings.Repeat("a", 150), true},
+		{strings.Repeat("a", 151), false},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"team a", false},
+		{"team/a", false},
+	}
+	for index, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			assert.Equal(t, tt.valid, ValidateTenantId(tt.id) == nil)
+		})
+	}
+}
+
+// Test_TenantExtractor_Extract ensures that tenants are extracted from messages.
+func Test_TenantExtractor_Extract(t *testing.T) {
+	message := testMessage("logs.team-a.app", 0, 1, "")
+	message.Headers = []kafka.Header{{Key: "tenant", Value: []byte("team-b")}}
+	var tests = []struct {
+		rule     ValueRule
+		fields   map[string]interface{}
+		expected string
+		fails    bool
+	}{
+		{ValueRule{Source: ValueSourceStatic, Value: "team-c"}, nil, "team-c", false},
+		{ValueRule{Source: ValueSourceHeader, Path: "tenant"}, nil, "team-b", false},
+		{ValueRule{Source: ValueSourceTopic, Regex: `^logs\.([^.]+)\.`}, nil, "team-a", false},
+		{ValueRule{Source: ValueSourceField, Path: "org.id"}, map[string]interface{}{"org.id": "team-d"}, "team-d", false},
+		{ValueRule{Source: ValueSourceField, Path: "org.id", Default: "fallback"}, nil, "fallback", false},
+		{ValueRule{Source: ValueSourceField, Path: "org.id"}, nil, "", true},
+		{ValueRule{Source: ValueSourceField, Path: "org.id"}, map[string]interface{}{"org.id": "team/d"}, "", true},
+	}
+	for index, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			extractor, err := NewTenantExtractor(tt.rule)
+			assert.Nil(t, err)
+			tenant, err := extractor.Extract(message, tt.fields)
+			if tt.fails {
+				assert.Error(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tt.expected, tenant)
+			}
+		})
+	}
+
+	_, err := NewTenantExtractor(ValueRule{Source: "batman"})
+	assert.Error(t, err)
+	_, err = NewTenantExtractor(ValueRule{Source: ValueSourceHeader, Path: "tenant", Default: "in valid"})
+	assert.Error(t, err)
+}
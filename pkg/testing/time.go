@@ -1,6 +1,89 @@
 package testing
 
+import (
+	"sync"
+	"time"
+)
+
 // ZeroNanoTimeProvider always returns 0.
 func ZeroNanoTimeProvider() string {
 	return "0"
 }
+
+// FakeClock is a clock whose time only changes when it's advanced, it fires its tickers accordingly.
+type FakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// fakeTicker is a ticker of a FakeClock.
+type fakeTicker struct {
+	channel chan time.Time
+	period  time.Duration
+	next    time.Time
+	stopped bool
+}
+
+// NewFakeClock creates a new FakeClock at the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// NewTicker returns the channel of a ticker with the given period and the function that stops it.
+// Like a time.Ticker, ticks are dropped while the channel is full.
+func (c *FakeClock) NewTicker(period time.Duration) (<-chan time.Time, func()) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ticker := &fakeTicker{channel: make(chan time.Time, 1), period: period, next: c.now.Add(period)}
+	c.tickers = append(c.tickers, ticker)
+	return ticker.channel, func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		ticker.stopped = true
+	}
+}
+
+// Advance moves the clock forward and fires the tickers that are due.
+func (c *FakeClock) Advance(duration time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(duration)
+	for _, ticker := range c.tickers {
+		if ticker.stopped || ticker.next.After(c.now) {
+			continue
+		}
+		select {
+		case ticker.channel <- c.now:
+		default:
+		}
+		for !ticker.next.After(c.now) {
+			ticker.next = ticker.next.Add(ticker.period)
+		}
+	}
+}
+
+// WaitForTickers waits until the clock has the given number of running tickers.
+func (c *FakeClock) WaitForTickers(count int) {
+	for {
+		c.mutex.Lock()
+		running := 0
+		for _, ticker := range c.tickers {
+			if !ticker.stopped {
+				running++
+			}
+		}
+		c.mutex.Unlock()
+		if running >= count {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,152 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/goccy/go-json"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	// TimestampSourceKafka uses the Kafka message timestamp.
+	TimestampSourceKafka = "kafka"
+	// TimestampSourceField uses a field from the flattened message.
+	TimestampSourceField = "field"
+	// TimestampSourceNow uses the wall clock time.
+	TimestampSourceNow = "now"
+)
+
+// TimestampExtractor extracts the Loki entry timestamp from Kafka messages.
+type TimestampExtractor struct {
+	source string
+	field  string
+	format string
+	// Now provides the wall clock time, it's used as a fallback when a timestamp can't be extracted.
+	Now func() time.Time
+}
+
+// NewTimestampExtractor creates a new TimestampExtractor.
+// The format is only used with the field source and is one of rfc3339, unix, unix_ms, unix_ns or a Go time layout.
+func NewTimestampExtractor(source string, field string, format string) (*TimestampExtractor, error) {
+	switch source {
+	case TimestampSourceKafka, TimestampSourceNow:
+	case TimestampSourceField:
+		if field == "" {
+			return nil, fmt.Errorf("timestamp field is required for the %s timestamp source", source)
+		}
+	default:
+		return nil, fmt.Errorf("invalid timestamp source %s", source)
+	}
+	if format == "" {
+		format = "rfc3339"
+	}
+	return &TimestampExtractor{source: source, field: field, format: format, Now: time.Now}, nil
+}
+
+// Extract returns the timestamp of the given message as a string in unix nanoseconds.
+// The wall clock time is returned if the timestamp is not available.
+func (t *TimestampExtractor) Extract(message *kafka.Message, fields map[string]interface{}) string {
+	timestamp, err := t.extractTime(message, fields)
+	if err != nil {
+		SugaredLogger.Debugf("failed to extract timestamp, using wall clock: %s", err)
+		timestamp = t.Now()
+	}
+	return strconv.FormatInt(timestamp.UnixNano(), 10)
+}
+
+// Fields returns the flattened field paths the timestamp is taken from.
+func (t *TimestampExtractor) Fields() []string {
+	if t.source != TimestampSourceField {
+		return nil
+	}
+	return []string{t.field}
+}
+
+func (t *TimestampExtractor) extractTime(message *kafka.Message, fields map[string]interface{}) (time.Time, error) {
+	switch t.source {
+	case TimestampSourceKafka:
+		if message == nil || message.TimestampType == kafka.TimestampNotAvailable || message.Timestamp.IsZero() {
+			return time.Time{}, fmt.Errorf("message has no timestamp")
+		}
+		return message.Timestamp, nil
+	case TimestampSourceField:
+		value, ok := fields[t.field]
+		if !ok {
+			return time.Time{}, fmt.Errorf("field %s not found", t.field)
+		}
+		return ParseTimestamp(value, t.format)
+	default:
+		return t.Now(), nil
+	}
+}
+
+// ParseTimestamp parses the given value according to format.
+// The format is one of rfc3339, unix, unix_ms, unix_ns or a Go time layout.
+func ParseTimestamp(value interface{}, format string) (time.Time, error) {
+	switch format {
+	case "unix", "unix_ms", "unix_ns":
+		var number float64
+		switch v := value.(type) {
+		case float64:
+			number = v
+		case int64:
+			number = float64(v)
+		case int:
+			number = float64(v)
+		case json.Number:
+			// Parse integers directly to avoid losing precision on nanoseconds.
+			if integer, err := v.Int64(); err == nil {
+				return unixTime(integer, format), nil
+			}
+			parsed, err := v.Float64()
+			if err != nil {
+				return time.Time{}, err
+			}
+			number = parsed
+		case string:
+			if integer, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return unixTime(integer, format), nil
+			}
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			number = parsed
+		default:
+			return time.Time{}, fmt.Errorf("can't parse %v as a %s timestamp", value, format)
+		}
+		switch format {
+		case "unix":
+			seconds, fraction := math.Modf(number)
+			return time.Unix(int64(seconds), int64(fraction*1e9)), nil
+		case "unix_ms":
+			return time.Unix(0, int64(number*1e6)), nil
+		default:
+			return time.Unix(0, int64(number)), nil
+		}
+	default:
+		str, ok := value.(string)
+		if !ok {
+			return time.Time{}, fmt.Errorf("can't parse %v as a %s timestamp", value, format)
+		}
+		layout := format
+		if format == "rfc3339" {
+			layout = time.RFC3339Nano
+		}
+		return time.Parse(layout, str)
+	}
+}
+
+// unixTime converts an integer unix timestamp to time.Time.
+func unixTime(value int64, format string) time.Time {
+	switch format {
+	case "unix":
+		return time.Unix(value, 0)
+	case "unix_ms":
+		return time.Unix(0, value*int64(time.Millisecond))
+	default:
+		return time.Unix(0, value)
+	}
+}
@@ -0,0 +1,58 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Test_NewTimestampExtractor ensures that invalid timestamp settings are rejected.
+func Test_NewTimestampExtractor(t *testing.T) {
+	_, err := NewTimestampExtractor("batman", "", "")
+	assert.Error(t, err)
+	_, err = NewTimestampExtractor(TimestampSourceField, "", "")
+	assert.Error(t, err)
+	_, err = NewTimestampExtractor(TimestampSourceField, "time", "")
+	assert.Nil(t, err)
+	_, err = NewTimestampExtractor(TimestampSourceKafka, "", "")
+	assert.Nil(t, err)
+}
+
+// Test_TimestampExtractor_Extract ensures that the timestamp is taken from the configured source.
+func Test_TimestampExtractor_Extract(t *testing.T) {
+	wallClock := time.Unix(100, 0)
+	kafkaTime := time.Unix(50, 0)
+	var tests = []struct {
+		source   string
+		format   string
+		message  *kafka.Message
+		fields   map[string]interface{}
+		expected string
+	}{
+		{TimestampSourceNow, "", &kafka.Message{}, nil, "100000000000"},
+		{TimestampSourceKafka, "", &kafka.Message{Timestamp: kafkaTime, TimestampType: kafka.TimestampCreateTime}, nil, "50000000000"},
+		{TimestampSourceKafka, "", &kafka.Message{Timestamp: kafkaTime, TimestampType: kafka.TimestampNotAvailable}, nil, "100000000000"},
+		{TimestampSourceField, "rfc3339", nil, map[string]interface{}{"time": "1970-01-01T00:00:10.5Z"}, "10500000000"},
+		{TimestampSourceField, "unix", nil, map[string]interface{}{"time": float64(10)}, "10000000000"},
+		{TimestampSourceField, "unix", nil, map[string]interface{}{"time": "10.25"}, "10250000000"},
+		{TimestampSourceField, "unix_ms", nil, map[string]interface{}{"time": float64(10500)}, "10500000000"},
+		{TimestampSourceField, "unix_ns", nil, map[string]interface{}{"time": json.Number("1634000000123456789")}, "1634000000123456789"},
+		{TimestampSourceField, "unix_ns", nil, map[string]interface{}{"time": "1634000000123456789"}, "1634000000123456789"},
+		{TimestampSourceField, "2006-01-02 15:04:05", nil, map[string]interface{}{"time": "1970-01-01 00:00:20"}, "20000000000"},
+		{TimestampSourceField, "rfc3339", nil, map[string]interface{}{"time": "not a time"}, "100000000000"},
+		{TimestampSourceField, "rfc3339", nil, map[string]interface{}{"other": "1970-01-01T00:00:10Z"}, "100000000000"},
+	}
+	for index, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			extractor, err := NewTimestampExtractor(tt.source, "time", tt.format)
+			assert.Nil(t, err)
+			extractor.Now = func() time.Time {
+				return wallClock
+			}
+			assert.Equal(t, tt.expected, extractor.Extract(tt.message, tt.fields))
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package pkg
+
+import "regexp"
+
+// topicPattern matches Kafka topic names against a regular expression, an empty pattern matches every topic.
+type topicPattern struct {
+	regex *regexp.Regexp
+}
+
+// newTopicPattern compiles the given topic pattern.
+func newTopicPattern(pattern string) (topicPattern, error) {
+	if pattern == "" {
+		return topicPattern{}, nil
+	}
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return topicPattern{}, err
+	}
+	return topicPattern{regex: regex}, nil
+}
+
+// Match returns whether the topic matches the pattern.
+func (p topicPattern) Match(topic string) bool {
+	return p.regex == nil || p.regex.MatchString(topic)
+}
@@ -1,61 +1,333 @@
 package pkg
 
 import (
-	"container/list"
 	"fmt"
+	"github.com/goccy/go-json"
+	"strconv"
 	"strings"
 )
 
-type pair struct {
-	key    []string
-	isRoot bool
-	value  interface{}
+const (
+	// FlattenArrayIndex flattens the array items to keys suffixed by their index, e.g. tags[0].
+	FlattenArrayIndex = "index"
+	// FlattenArrayJoin joins the array items into a string.
+	FlattenArrayJoin = "join"
+	// FlattenArrayJson keeps the arrays as JSON strings.
+	FlattenArrayJson = "json"
+	// FlattenArrayDrop drops the arrays.
+	FlattenArrayDrop = "drop"
+)
+
+// FlattenOptions configures how maps are flattened.
+type FlattenOptions struct {
+	// Separator joins the keys of the nested maps, defaults to a dot.
+	Separator string
+	// MaxDepth is the maximum number of keys of a path, deeper maps and arrays are kept as JSON strings.
+	// 0 means unlimited.
+	MaxDepth int
+	// ArrayMode is index, join, json or drop, defaults to index.
+	ArrayMode string
+	// ArrayJoinSeparator joins the array items with the join mode, defaults to a comma.
+	ArrayJoinSeparator string
+	// EscapeKeys escapes the separators, brackets and backslashes of the keys with a backslash, so that the
+	// flattened paths are unambiguous.
+	EscapeKeys bool
+	// KeepEmpty keeps the empty maps and arrays as they are, they're dropped by default.
+	KeepEmpty bool
+}
+
+// DefaultFlattenOptions returns the options used by FlattenMap.
+func DefaultFlattenOptions() FlattenOptions {
+	return FlattenOptions{Separator: ".", ArrayMode: FlattenArrayIndex, ArrayJoinSeparator: ","}
+}
+
+// Validate checks the options and fills the defaults of the empty settings.
+func (o *FlattenOptions) Validate() error {
+	if o.Separator == "" {
+		o.Separator = "."
+	}
+	if o.Separator[0] == '[' || o.Separator[0] == '\\' {
+		return fmt.Errorf("invalid flatten separator %s", o.Separator)
+	}
+	if o.ArrayJoinSeparator == "" {
+		o.ArrayJoinSeparator = ","
+	}
+	if o.MaxDepth < 0 {
+		return fmt.Errorf("invalid flatten max depth %d", o.MaxDepth)
+	}
+	switch o.ArrayMode {
+	case "":
+		o.ArrayMode = FlattenArrayIndex
+	case FlattenArrayIndex, FlattenArrayJoin, FlattenArrayJson, FlattenArrayDrop:
+	default:
+		return fmt.Errorf("invalid flatten array mode %s", o.ArrayMode)
+	}
+	return nil
 }
 
 // FlattenMap flattens a given Map.
 func FlattenMap(input map[string]interface{}) *map[string]interface{} {
-	var returnValue = make(map[string]interface{})
+	return Flatten(input, DefaultFlattenOptions())
+}
+
+// Flatten flattens the given value according to the options, the options are expected to be valid.
+// Empty maps and arrays are dropped, unless KeepEmpty is set. Values that aren't maps, like top-level arrays, are flattened under an
+// empty key, their items are keyed [0], [1] and so on with the index mode.
+func Flatten(input interface{}, options FlattenOptions) *map[string]interface{} {
+	flattener := flattener{options: options, output: make(map[string]interface{})}
+	if root, ok := input.(map[string]interface{}); ok {
+		for key, value := range root {
+			flattener.flatten(flattener.escape(key), 1, value)
+		}
+	} else {
+		flattener.flatten("", 0, input)
+	}
+	return &flattener.output
+}
 
-	var stack = list.New()
-	stack.PushBack(pair{key: []string{}, isRoot: true, value: input})
+// flattener holds the state of a Flatten call.
+type flattener struct {
+	options FlattenOptions
+	output  map[string]interface{}
+}
 
-	for {
-		element := stack.Back()
-		if element == nil {
-			break
+// flatten adds the value of the given path and depth to the output.
+func (f *flattener) flatten(path string, depth int, value interface{}) {
+	switch v := value.(type) {
+	// Handle generic maps.
+	case map[string]interface{}:
+		if len(v) == 0 {
+			f.empty(path, v)
+			return
+		}
+		if f.tooDeep(depth) {
+			f.output[path] = f.leaf(v)
+			return
+		}
+		for key, val := range v {
+			f.flatten(path+f.options.Separator+f.escape(key), depth+1, val)
 		}
-		stack.Remove(element)
+	// Handle arrays.
+	case []interface{}:
+		switch {
+		case f.options.ArrayMode == FlattenArrayDrop:
+		case len(v) == 0:
+			f.empty(path, v)
+		case f.options.ArrayMode == FlattenArrayJoin:
+			items := make([]string, len(v))
+			for index, val := range v {
+				items[index] = stringValue(f.leaf(val))
+			}
+			f.output[path] = strings.Join(items, f.options.ArrayJoinSeparator)
+		case f.options.ArrayMode == FlattenArrayJson || f.tooDeep(depth):
+			f.output[path] = f.leaf(v)
+		default:
+			for index, val := range v {
+				f.flatten(path+"["+strconv.Itoa(index)+"]", depth+1, val)
+			}
+		}
+	// Handle simple values.
+	default:
+		f.output[path] = v
+	}
+}
+
+// empty adds the empty map or array of the given path to the output, when they're kept.
+func (f *flattener) empty(path string, value interface{}) {
+	if f.options.KeepEmpty {
+		f.output[path] = value
+	}
+}
+
+// tooDeep returns whether the maps and arrays of the given depth are kept as JSON strings.
+func (f *flattener) tooDeep(depth int) bool {
+	return f.options.MaxDepth > 0 && depth >= f.options.MaxDepth
+}
 
-		thePair, ok := element.Value.(pair)
-		if !ok {
-			panic("can't cast element to pair")
+// leaf returns the value as a flattened value, non-empty maps and arrays are turned to JSON strings.
+func (f *flattener) leaf(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			return v
 		}
+	case []interface{}:
+		if len(v) == 0 {
+			return v
+		}
+	default:
+		return v
+	}
+	marshalled, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(marshalled)
+}
 
-		switch v := thePair.value.(type) {
-		// Handle generic maps.
-		case map[string]interface{}:
-			for key, val := range v {
-				if thePair.isRoot {
-					stack.PushBack(pair{key: []string{key}, value: val})
-				} else {
-					newKeys := append(thePair.key, key)
-					stack.PushBack(pair{key: newKeys, value: val})
+// escape escapes the key when the options require it. Every byte that may start a separator is escaped, so that
+// separators that overlap with the end of a key stay unambiguous.
+func (f *flattener) escape(key string) string {
+	first := 0
+	for first < len(key) && !f.special(key[first]) {
+		first++
+	}
+	if !f.options.EscapeKeys || first == len(key) {
+		return key
+	}
+	var escaped strings.Builder
+	escaped.WriteString(key[:first])
+	for index := first; index < len(key); index++ {
+		if f.special(key[index]) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteByte(key[index])
+	}
+	return escaped.String()
+}
+
+// special returns whether the given byte of a key is escaped.
+func (f *flattener) special(character byte) bool {
+	return character == '\\' || character == '[' || character == f.options.Separator[0]
+}
+
+// unflattenNode is a node of the tree rebuilt by UnflattenMap.
+type unflattenNode struct {
+	// leaf is set for the flattened values, which have no children.
+	leaf   bool
+	value  interface{}
+	fields map[string]*unflattenNode
+	items  map[int]*unflattenNode
+}
+
+// child returns the child of the node for the given path element, it's created when missing.
+func (n *unflattenNode) child(element flattenedPathElement) (*unflattenNode, bool) {
+	if n.leaf || element.index >= 0 && n.fields != nil || element.index < 0 && n.items != nil {
+		return nil, false
+	}
+	if element.index >= 0 {
+		if n.items == nil {
+			n.items = make(map[int]*unflattenNode)
+		}
+		if n.items[element.index] == nil {
+			n.items[element.index] = &unflattenNode{}
+		}
+		return n.items[element.index], true
+	}
+	if n.fields == nil {
+		n.fields = make(map[string]*unflattenNode)
+	}
+	if n.fields[element.key] == nil {
+		n.fields[element.key] = &unflattenNode{}
+	}
+	return n.fields[element.key], true
+}
+
+// build turns the node into a map, an array or a value. Missing array items are nil.
+func (n *unflattenNode) build() interface{} {
+	switch {
+	case n.leaf:
+		return n.value
+	case n.fields != nil:
+		fields := make(map[string]interface{}, len(n.fields))
+		for key, child := range n.fields {
+			fields[key] = child.build()
+		}
+		return fields
+	default:
+		length := 0
+		for index := range n.items {
+			if index >= length {
+				length = index + 1
+			}
+		}
+		items := make([]interface{}, length)
+		for index, child := range n.items {
+			items[index] = child.build()
+		}
+		return items
+	}
+}
+
+// flattenedPathElement is a key, or an array index when index isn't negative.
+type flattenedPathElement struct {
+	key   string
+	index int
+}
+
+// parseFlattenedPath splits a flattened path into its keys and array indexes.
+func parseFlattenedPath(path string, options FlattenOptions) ([]flattenedPathElement, error) {
+	var elements []flattenedPathElement
+	var key strings.Builder
+	for position := 0; position <= len(path); {
+		if position == len(path) || strings.HasPrefix(path[position:], options.Separator) || path[position] == '[' {
+			elements = append(elements, flattenedPathElement{key: key.String(), index: -1})
+			key.Reset()
+			// Indexes follow the key, e.g. key[0][1].
+			for position < len(path) && path[position] == '[' {
+				end := strings.IndexByte(path[position:], ']')
+				if end < 0 {
+					return nil, fmt.Errorf("unclosed array index in flattened key %q", path)
 				}
+				index, err := strconv.Atoi(path[position+1 : position+end])
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("invalid array index in flattened key %q", path)
+				}
+				elements = append(elements, flattenedPathElement{index: index})
+				position += end + 1
 			}
-		// Handle arrays.
-		case []interface{}:
-			lastKey := thePair.key[len(thePair.key)-1]
-			for index, val := range v {
-				newKeys := make([]string, len(thePair.key))
-				itemsCopied := copy(newKeys, thePair.key)
-				newKeys[itemsCopied-1] = fmt.Sprintf("%s[%d]", lastKey, index)
-				stack.PushBack(pair{key: newKeys, value: val})
+			if position == len(path) {
+				break
 			}
-		// Handle simple values.
-		default:
-			returnValue[strings.Join(thePair.key, ".")] = v
+			if !strings.HasPrefix(path[position:], options.Separator) {
+				return nil, fmt.Errorf("missing separator after an array index in flattened key %q", path)
+			}
+			position += len(options.Separator)
+			continue
 		}
+		if options.EscapeKeys && path[position] == '\\' {
+			position++
+			if position == len(path) {
+				return nil, fmt.Errorf("unterminated escape in flattened key %q", path)
+			}
+		}
+		key.WriteByte(path[position])
+		position++
 	}
+	return elements, nil
+}
 
-	return &returnValue
+// UnflattenMap rebuilds the nested maps and arrays of a map flattened with the index array mode, it understands the
+// separator and the escaping of the options. Keys that conflict, like a key that is both a value and a map, are
+// reported as an error. Maps flattened with the same options and without MaxDepth are rebuilt losslessly when
+// EscapeKeys and KeepEmpty are set.
+func UnflattenMap(input map[string]interface{}, options FlattenOptions) (map[string]interface{}, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	root := &unflattenNode{fields: make(map[string]*unflattenNode)}
+	for path, value := range input {
+		elements, err := parseFlattenedPath(path, options)
+		if err != nil {
+			return nil, err
+		}
+		node := root
+		for _, element := range elements {
+			// Every item of an array has its own key, larger indexes can't be items.
+			if element.index >= len(input) {
+				return nil, fmt.Errorf("array index out of range in flattened key %q", path)
+			}
+			var ok bool
+			node, ok = node.child(element)
+			if !ok {
+				return nil, fmt.Errorf("flattened key %q conflicts with another key", path)
+			}
+		}
+		if node.leaf || node.fields != nil || node.items != nil {
+			return nil, fmt.Errorf("flattened key %q conflicts with another key", path)
+		}
+		node.leaf = true
+		node.value = value
+	}
+	return root.build().(map[string]interface{}), nil
 }
@@ -3,7 +3,10 @@ package pkg
 import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"reflect"
 	"testing"
+	"testing/quick"
 )
 
 // Test_FlattenMap ensure that FlattenMap works as expected by flattening maps.
@@ -119,6 +122,19 @@ func Test_FlattenMap(t *testing.T) {
 				"root.another_key[1][0].inside_list_key2[1]": "no",
 			},
 		},
+		{
+			map[string]interface{}{
+				"root": map[string]interface{}{
+					"testing": "1",
+					"empty":   map[string]interface{}{},
+					"none":    []interface{}{},
+					"nested":  map[string]interface{}{"empty": map[string]interface{}{}},
+				},
+			},
+			map[string]interface{}{
+				"root.testing": "1",
+			},
+		},
 	}
 	for index, tt := range tests {
 		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
@@ -127,3 +143,223 @@ func Test_FlattenMap(t *testing.T) {
 		})
 	}
 }
+
+// Test_Flatten ensures that Flatten applies the options.
+func Test_Flatten(t *testing.T) {
+	nested := map[string]interface{}{
+		"a": map[string]interface{}{
+			"b":     map[string]interface{}{"c": 1},
+			"tags":  []interface{}{"x", float64(2), map[string]interface{}{"y": true}},
+			"empty": map[string]interface{}{},
+			"none":  []interface{}{},
+		},
+		"dotted.key": "value",
+	}
+	var tests = []struct {
+		input    interface{}
+		options  FlattenOptions
+		expected map[string]interface{}
+	}{
+		{
+			nested,
+			FlattenOptions{},
+			map[string]interface{}{
+				"a.b.c": 1, "a.tags[0]": "x", "a.tags[1]": float64(2), "a.tags[2].y": true, "dotted.key": "value",
+			},
+		},
+		{
+			nested,
+			FlattenOptions{KeepEmpty: true},
+			map[string]interface{}{
+				"a.b.c": 1, "a.tags[0]": "x", "a.tags[1]": float64(2), "a.tags[2].y": true,
+				"a.empty": map[string]interface{}{}, "a.none": []interface{}{}, "dotted.key": "value",
+			},
+		},
+		{
+			nested,
+			FlattenOptions{Separator: "_", ArrayMode: FlattenArrayJoin, ArrayJoinSeparator: "|", KeepEmpty: true},
+			map[string]interface{}{
+				"a_b_c": 1, "a_tags": `x|2|{"y":true}`,
+				"a_empty": map[string]interface{}{}, "a_none": []interface{}{}, "dotted.key": "value",
+			},
+		},
+		{
+			nested,
+			FlattenOptions{ArrayMode: FlattenArrayJson, EscapeKeys: true, KeepEmpty: true},
+			map[string]interface{}{
+				"a.b.c": 1, "a.tags": `["x",2,{"y":true}]`,
+				"a.empty": map[string]interface{}{}, "a.none": []interface{}{}, `dotted\.key`: "value",
+			},
+		},
+		{
+			nested,
+			FlattenOptions{ArrayMode: FlattenArrayDrop, MaxDepth: 2},
+			map[string]interface{}{"a.b": `{"c":1}`, "dotted.key": "value"},
+		},
+		{
+			nested,
+			FlattenOptions{MaxDepth: 1},
+			map[string]interface{}{"a": `{"b":{"c":1},"empty":{},"none":[],"tags":["x",2,{"y":true}]}`, "dotted.key": "value"},
+		},
+		{
+			map[string]interface{}{`a[0]\`: map[string]interface{}{"b.c": 1}},
+			FlattenOptions{EscapeKeys: true},
+			map[string]interface{}{`a\[0]\\.b\.c`: 1},
+		},
+		{
+			[]interface{}{"x", map[string]interface{}{"y": 1}},
+			FlattenOptions{},
+			map[string]interface{}{"[0]": "x", "[1].y": 1},
+		},
+		{
+			[]interface{}{"x", "y"},
+			FlattenOptions{ArrayMode: FlattenArrayJoin},
+			map[string]interface{}{"": "x,y"},
+		},
+		{
+			[]interface{}{},
+			FlattenOptions{},
+			map[string]interface{}{},
+		},
+		{
+			[]interface{}{},
+			FlattenOptions{KeepEmpty: true},
+			map[string]interface{}{"": []interface{}{}},
+		},
+		{
+			"scalar",
+			FlattenOptions{},
+			map[string]interface{}{"": "scalar"},
+		},
+		{
+			map[string]interface{}(nil),
+			FlattenOptions{},
+			map[string]interface{}{},
+		},
+	}
+	for index, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			assert.Nil(t, tt.options.Validate())
+			assert.Equal(t, tt.expected, *Flatten(tt.input, tt.options))
+		})
+	}
+}
+
+// Test_FlattenOptions_Validate ensures that invalid options are rejected and that defaults are filled.
+func Test_FlattenOptions_Validate(t *testing.T) {
+	options := FlattenOptions{}
+	assert.Nil(t, options.Validate())
+	assert.Equal(t, DefaultFlattenOptions(), options)
+
+	options = FlattenOptions{ArrayMode: "split"}
+	assert.Error(t, options.Validate())
+	options = FlattenOptions{MaxDepth: -1}
+	assert.Error(t, options.Validate())
+}
+
+// quickJsonObject is a random JSON object for testing/quick, its keys are made of the characters that need escaping.
+type quickJsonObject map[string]interface{}
+
+// Generate implements quick.Generator.
+func (quickJsonObject) Generate(random *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(quickJsonObject(randomJsonObject(random, 4)))
+}
+
+// randomJsonKey returns a short random key.
+func randomJsonKey(random *rand.Rand) string {
+	const characters = "ab.[]\\_:0"
+	key := make([]byte, random.Intn(4))
+	for index := range key {
+		key[index] = characters[random.Intn(len(characters))]
+	}
+	return string(key)
+}
+
+// randomJsonObject returns a random JSON object nested at most depth times.
+func randomJsonObject(random *rand.Rand, depth int) map[string]interface{} {
+	object := make(map[string]interface{})
+	for count := random.Intn(4); count > 0; count-- {
+		object[randomJsonKey(random)] = randomJsonValue(random, depth-1)
+	}
+	return object
+}
+
+// randomJsonValue returns a random JSON value nested at most depth times.
+func randomJsonValue(random *rand.Rand, depth int) interface{} {
+	kinds := 4
+	if depth > 0 {
+		kinds = 6
+	}
+	switch random.Intn(kinds) {
+	case 0:
+		return nil
+	case 1:
+		return random.Intn(2) == 0
+	case 2:
+		return float64(random.Intn(1000)) / 10
+	case 3:
+		return randomJsonKey(random)
+	case 4:
+		items := make([]interface{}, random.Intn(4))
+		for index := range items {
+			items[index] = randomJsonValue(random, depth-1)
+		}
+		return items
+	default:
+		return randomJsonObject(random, depth)
+	}
+}
+
+// Test_UnflattenMap_RoundTrip ensures that UnflattenMap rebuilds the maps flattened with escaped keys.
+func Test_UnflattenMap_RoundTrip(t *testing.T) {
+	for _, separator := range []string{".", "_", "::"} {
+		t.Run(separator, func(t *testing.T) {
+			options := FlattenOptions{Separator: separator, EscapeKeys: true, KeepEmpty: true}
+			assert.Nil(t, options.Validate())
+			roundTrip := func(object quickJsonObject) bool {
+				unflattened, err := UnflattenMap(*Flatten(map[string]interface{}(object), options), options)
+				return err == nil && reflect.DeepEqual(map[string]interface{}(object), unflattened)
+			}
+			assert.Nil(t, quick.Check(roundTrip, &quick.Config{MaxCount: 2000}))
+		})
+	}
+}
+
+// Test_UnflattenMap ensures that the flattened paths are parsed and that invalid or conflicting keys are reported.
+func Test_UnflattenMap(t *testing.T) {
+	unflattened, err := UnflattenMap(map[string]interface{}{
+		"a.b[2].c":   1,
+		"a.b[0]":     "x",
+		`a\.b`:       true,
+		"list[0][1]": "y",
+		"empty":      map[string]interface{}{},
+	}, FlattenOptions{EscapeKeys: true})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": []interface{}{"x", nil, map[string]interface{}{"c": 1}},
+		},
+		"a.b":   true,
+		"list":  []interface{}{[]interface{}{nil, "y"}},
+		"empty": map[string]interface{}{},
+	}, unflattened)
+
+	var tests = []map[string]interface{}{
+		{"a": 1, "a.b": 2},
+		{"a[0]": 1, "a.b": 2},
+		{"a": map[string]interface{}{}, "a.b": 2},
+		{"a[0]": 1, "a[0].b": 2},
+		{"a[x]": 1},
+		{"a[0": 1},
+		{"a[0]b": 1},
+		{"a[-1]": 1},
+		{"a[5]": 1},
+		{`a\`: 1},
+	}
+	for index, input := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			_, err := UnflattenMap(input, FlattenOptions{EscapeKeys: true})
+			assert.Error(t, err)
+		})
+	}
+}
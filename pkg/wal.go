@@ -0,0 +1,633 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/getsentry/sentry-go"
+	"github.com/goccy/go-json"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// WalFsyncAlways syncs the write-ahead log to disk after every record.
+	WalFsyncAlways = "always"
+	// WalFsyncInterval syncs the write-ahead log to disk every sync interval.
+	WalFsyncInterval = "interval"
+	// WalFsyncNever writes the records to the segment files every sync interval and leaves the syncs to the system.
+	WalFsyncNever = "never"
+)
+
+const (
+	// walTopic is the topic of the sources of the replayed records, their partition is the segment id.
+	walTopic = "speedy-wal"
+	// walSegmentExtension is the extension of the segment files, named after the segment id.
+	walSegmentExtension = ".wal"
+	// walCheckpointFile holds the number of delivered records of each segment.
+	walCheckpointFile = "checkpoint.json"
+	// walHeaderSize is the size of the header of a record: the length and the CRC-32C of the payload.
+	walHeaderSize = 8
+)
+
+var walCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WriteAheadLogOptions are the options of the WriteAheadLog.
+type WriteAheadLogOptions struct {
+	// Directory holds the segment files.
+	Directory string
+	// SegmentMaxBytes is the size of a segment file before a new one is started.
+	SegmentMaxBytes int64
+	// MaxBytes is the maximum size of all the segment files, Push blocks while it's reached.
+	MaxBytes int64
+	// Fsync is the fsync policy, always, interval or never.
+	Fsync string
+	// SyncInterval is the interval of the syncs, the records are replayed and their Kafka messages committed once synced.
+	SyncInterval time.Duration
+}
+
+// walRecord is the persisted form of a LokiStream.
+type walRecord struct {
+	Labels map[string]string `json:"labels"`
+	Values [][]string        `json:"values"`
+	Size   int               `json:"size"`
+	Tenant string            `json:"tenant,omitempty"`
+}
+
+// walSegment holds the state of a segment file.
+type walSegment struct {
+	id   int32
+	path string
+	// size is the number of bytes written, synced is the number of bytes that can be replayed.
+	size   int64
+	synced int64
+	// records is the number of records, it's known for the segments written since the start and once replayed.
+	records int64
+	// committed is the number of records delivered to Loki, they are skipped on replay.
+	committed int64
+	sealed    bool
+	replayed  bool
+}
+
+// WriteAheadLog is a disk-backed queue between the decode workers and the pushers, so that Speedy keeps consuming
+// from Kafka while Loki is unavailable.
+//
+// The streams are appended as checksummed records to segment files, the Kafka messages of the synced records are
+// marked as done. The records are replayed in order to the pushers, a segment is deleted once all its records are
+// delivered. On startup the remaining segments are replayed, corrupted records end the replay of their segment.
+type WriteAheadLog struct {
+	options WriteAheadLogOptions
+	pusher  IStreamPusher
+	// kafkaTracker is notified of the Kafka messages that are safely written.
+	kafkaTracker *OffsetTracker
+	// tracker tracks the replayed records, it's committed by the pushers once the records are delivered.
+	tracker *OffsetTracker
+	mutex   sync.Mutex
+	// cond signals synced records, new segments, freed space and the close.
+	cond           *sync.Cond
+	segments       map[int32]*walSegment
+	active         *walSegment
+	file           *os.File
+	writer         *bufio.Writer
+	pendingSources []kafka.TopicPartition
+	// pendingRecords are the records that weren't synced yet, they're written again when a write fails.
+	pendingRecords [][]byte
+	// failed is set when a write fails, the active segment must be repaired before the next write.
+	failed      bool
+	retryPolicy RetryPolicy
+	totalSize   int64
+	closed      bool
+	stopChannel chan struct{}
+	syncDone    chan struct{}
+}
+
+// NewWriteAheadLog opens the write-ahead log in the directory, starts a new segment and replays the existing ones.
+func NewWriteAheadLog(options WriteAheadLogOptions, pusher IStreamPusher) (*WriteAheadLog, error) {
+	if pusher == nil {
+		panic("Write-ahead log pusher is nil")
+	}
+	if options.Directory == "" {
+		return nil, fmt.Errorf("the write-ahead log directory is not set")
+	}
+	switch options.Fsync {
+	case "":
+		options.Fsync = WalFsyncInterval
+	case WalFsyncAlways, WalFsyncInterval, WalFsyncNever:
+	default:
+		return nil, fmt.Errorf("invalid write-ahead log fsync policy %s", options.Fsync)
+	}
+	if options.SegmentMaxBytes <= 0 {
+		return nil, fmt.Errorf("the write-ahead log segment size must be positive")
+	}
+	// The active segment can't be deleted, the other segments need room to be written and replayed.
+	if options.MaxBytes < 2*options.SegmentMaxBytes {
+		return nil, fmt.Errorf("the write-ahead log size must be at least twice the segment size")
+	}
+	if options.SyncInterval <= 0 {
+		options.SyncInterval = time.Second
+	}
+	err := os.MkdirAll(options.Directory, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WriteAheadLog{
+		options:     options,
+		pusher:      pusher,
+		segments:    make(map[int32]*walSegment),
+		retryPolicy: RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: 10 * time.Second},
+		stopChannel: make(chan struct{}),
+		syncDone:    make(chan struct{}),
+	}
+	w.cond = sync.NewCond(&w.mutex)
+	w.tracker = NewOffsetTracker(w)
+	err = w.loadSegments()
+	if err != nil {
+		return nil, err
+	}
+	nextId := int32(0)
+	for id := range w.segments {
+		if id >= nextId {
+			nextId = id + 1
+		}
+	}
+	err = w.openSegment(nextId)
+	if err != nil {
+		return nil, err
+	}
+	go w.syncForever()
+	go w.replay()
+	return w, nil
+}
+
+// loadSegments loads the segments left by a previous run and the number of their records that were delivered.
+func (w *WriteAheadLog) loadSegments() error {
+	checkpoint := make(map[string]int64)
+	content, err := ioutil.ReadFile(filepath.Join(w.options.Directory, walCheckpointFile))
+	if err == nil {
+		err = json.Unmarshal(content, &checkpoint)
+		if err != nil {
+			SugaredLogger.Warnf("ignoring the invalid write-ahead log checkpoint: %s", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(w.options.Directory)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, walSegmentExtension) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(name, walSegmentExtension), 10, 32)
+		if err != nil {
+			SugaredLogger.Warnf("ignoring the unexpected write-ahead log file %s", name)
+			continue
+		}
+		w.segments[int32(id)] = &walSegment{
+			id:        int32(id),
+			path:      filepath.Join(w.options.Directory, name),
+			size:      file.Size(),
+			synced:    file.Size(),
+			committed: checkpoint[strconv.FormatInt(id, 10)],
+			sealed:    true,
+		}
+		w.totalSize += file.Size()
+	}
+	if len(w.segments) > 0 {
+		SugaredLogger.Infof("replaying %d write-ahead log segments, %d bytes", len(w.segments), w.totalSize)
+	}
+	walBytes.Set(float64(w.totalSize))
+	return nil
+}
+
+// openSegment creates the segment with the given id and makes it the active segment.
+func (w *WriteAheadLog) openSegment(id int32) error {
+	path := filepath.Join(w.options.Directory, fmt.Sprintf("%010d%s", id, walSegmentExtension))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.writer = bufio.NewWriterSize(file, 64*1024)
+	w.active = &walSegment{id: id, path: path}
+	w.segments[id] = w.active
+	w.cond.Broadcast()
+	return nil
+}
+
+// SetOffsetTracker sets the OffsetTracker that is notified of the Kafka messages once their records are synced.
+func (w *WriteAheadLog) SetOffsetTracker(tracker *OffsetTracker) {
+	w.kafkaTracker = tracker
+}
+
+// OffsetTracker returns the OffsetTracker of the replayed records, the pushers must mark them as done once delivered.
+func (w *WriteAheadLog) OffsetTracker() *OffsetTracker {
+	return w.tracker
+}
+
+// Push appends the stream to the write-ahead log, it blocks while the write-ahead log is full. The failed writes are
+// retried with backoff until the write-ahead log is closed, the Kafka messages of the stream are done once it's synced.
+func (w *WriteAheadLog) Push(stream LokiStream) {
+	record, err := encodeWalRecord(stream)
+	if err != nil {
+		// The stream will never be encoded, it's dropped so that its partition isn't stalled.
+		SugaredLogger.Errorf("dropping a stream that failed to be encoded as a write-ahead log record: %s", err)
+		sentry.CaptureException(err)
+		walWriteErrors.Inc()
+		if w.kafkaTracker != nil {
+			w.kafkaTracker.MarkDone(stream.Sources...)
+		}
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for attempt := 1; ; attempt++ {
+		for !w.closed && w.totalSize > 0 && w.totalSize+int64(len(record)) > w.options.MaxBytes {
+			w.cond.Wait()
+		}
+		if w.closed {
+			// The Kafka messages are not done, they're consumed again on the next start.
+			SugaredLogger.Errorf("dropping a stream pushed after the write-ahead log was closed")
+			return
+		}
+		err = w.write(record, stream.Sources)
+		if err == nil {
+			return
+		}
+		backoff := w.retryPolicy.backoff(attempt)
+		SugaredLogger.Errorf("failed to write to the write-ahead log, retrying in %s: %s", backoff, err)
+		sentry.CaptureException(err)
+		walWriteErrors.Inc()
+		w.waitRetry(backoff)
+	}
+}
+
+// write appends the record to the active segment, rotating it when it's full.
+func (w *WriteAheadLog) write(record []byte, sources []kafka.TopicPartition) error {
+	if w.failed {
+		err := w.repair()
+		if err != nil {
+			return err
+		}
+	}
+	if w.active.size > 0 && w.active.size+int64(len(record)) > w.options.SegmentMaxBytes {
+		err := w.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.writer.Write(record)
+	if err != nil {
+		w.failed = true
+		return err
+	}
+	w.active.size += int64(len(record))
+	w.active.records++
+	w.totalSize += int64(len(record))
+	w.pendingRecords = append(w.pendingRecords, record)
+	w.pendingSources = append(w.pendingSources, sources...)
+	if w.options.Fsync == WalFsyncAlways {
+		// A failed sync is retried by the next one, the record is pending until then.
+		_ = w.sync()
+	}
+	return nil
+}
+
+// repair truncates the active segment to its synced records and writes the pending records again, a failed write
+// may have left them partially written or lost them in the buffer.
+func (w *WriteAheadLog) repair() error {
+	err := w.file.Truncate(w.active.synced)
+	if err != nil {
+		return err
+	}
+	w.writer.Reset(w.file)
+	for _, record := range w.pendingRecords {
+		_, err = w.writer.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	w.failed = false
+	return nil
+}
+
+// waitRetry releases the lock for the backoff, or until the write-ahead log is closing.
+func (w *WriteAheadLog) waitRetry(backoff time.Duration) {
+	w.mutex.Unlock()
+	defer w.mutex.Lock()
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-w.stopChannel:
+		// Close takes the lock once the sync loop is stopped.
+		<-w.syncDone
+	}
+}
+
+// rotate seals the active segment and starts a new one.
+func (w *WriteAheadLog) rotate() error {
+	if !w.active.sealed {
+		err := w.sync()
+		if err != nil {
+			return err
+		}
+		// The records are synced, a failure to close the file doesn't lose them.
+		err = w.file.Close()
+		if err != nil {
+			SugaredLogger.Warnf("failed to close the write-ahead log segment %s: %s", w.active.path, err)
+		}
+		w.active.sealed = true
+	}
+	return w.openSegment(w.active.id + 1)
+}
+
+// sync writes the buffered records to the active segment, syncs it according to the fsync policy and marks the Kafka
+// messages of the records as done. The synced records can be replayed.
+func (w *WriteAheadLog) sync() error {
+	if w.active.synced == w.active.size {
+		return nil
+	}
+	var err error
+	if w.failed {
+		err = w.repair()
+	}
+	if err == nil {
+		err = w.writer.Flush()
+	}
+	if err == nil && w.options.Fsync != WalFsyncNever {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		SugaredLogger.Errorf("failed to sync the write-ahead log: %s", err)
+		sentry.CaptureException(err)
+		walWriteErrors.Inc()
+		w.failed = true
+		return err
+	}
+	w.active.synced = w.active.size
+	w.pendingRecords = nil
+	if w.kafkaTracker != nil {
+		w.kafkaTracker.MarkDone(w.pendingSources...)
+	}
+	w.pendingSources = nil
+	walBytes.Set(float64(w.totalSize))
+	w.cond.Broadcast()
+	return nil
+}
+
+// Flush syncs the write-ahead log and commits the Kafka offsets of the synced records.
+func (w *WriteAheadLog) Flush() {
+	w.mutex.Lock()
+	_ = w.sync()
+	w.mutex.Unlock()
+	if w.kafkaTracker != nil {
+		_ = w.kafkaTracker.Commit()
+	}
+}
+
+// syncForever flushes the write-ahead log every sync interval, until Close is called.
+func (w *WriteAheadLog) syncForever() {
+	defer close(w.syncDone)
+	ticker := time.NewTicker(w.options.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Flush()
+		case <-w.stopChannel:
+			return
+		}
+	}
+}
+
+// replay pushes the records of the segments in order, following the active segment as it's written.
+func (w *WriteAheadLog) replay() {
+	after := int32(-1)
+	for {
+		segment := w.nextSegment(after)
+		if segment == nil {
+			return
+		}
+		if !w.replaySegment(segment) {
+			return
+		}
+		after = segment.id
+	}
+}
+
+// nextSegment waits for the segment following the given id, it returns nil once the write-ahead log is closed.
+func (w *WriteAheadLog) nextSegment(after int32) *walSegment {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for !w.closed {
+		var next *walSegment
+		for id, segment := range w.segments {
+			if id > after && (next == nil || id < next.id) {
+				next = segment
+			}
+		}
+		if next != nil {
+			return next
+		}
+		w.cond.Wait()
+	}
+	return nil
+}
+
+// replaySegment pushes the synced records of the segment until it's sealed and fully read, the records that were
+// already delivered are skipped. It returns false once the write-ahead log is closed.
+func (w *WriteAheadLog) replaySegment(segment *walSegment) bool {
+	file, err := os.Open(segment.path)
+	if err != nil {
+		SugaredLogger.Errorf("failed to open the write-ahead log segment %s, skipping it: %s", segment.path, err)
+		sentry.CaptureException(err)
+		w.finishReplay(segment, 0)
+		return true
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	topic := walTopic
+	var position, index int64
+	for {
+		w.mutex.Lock()
+		for !w.closed && position == segment.synced && !segment.sealed {
+			w.cond.Wait()
+		}
+		closed, synced, committed := w.closed, segment.synced, segment.committed
+		w.mutex.Unlock()
+		if closed {
+			return false
+		}
+		if position == synced {
+			w.finishReplay(segment, index)
+			return true
+		}
+
+		stream, size, err := readWalRecord(reader, synced-position)
+		if err != nil {
+			SugaredLogger.Errorf("corrupted write-ahead log segment %s at byte %d, skipping the rest of it: %s", segment.path, position, err)
+			sentry.CaptureException(err)
+			walCorruptedSegments.Inc()
+			w.finishReplay(segment, index)
+			return true
+		}
+		position += size
+		if index >= committed {
+			source := kafka.TopicPartition{Topic: &topic, Partition: segment.id, Offset: kafka.Offset(index)}
+			w.tracker.Track(source)
+			stream.Sources = []kafka.TopicPartition{source}
+			w.pusher.Push(stream)
+		}
+		index++
+	}
+}
+
+// finishReplay records that the segment was replayed with the given number of records.
+func (w *WriteAheadLog) finishReplay(segment *walSegment, records int64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	segment.replayed = true
+	segment.records = records
+	w.deleteIfDelivered(segment)
+}
+
+// deleteIfDelivered deletes the segment once it's sealed, replayed and all its records are delivered.
+func (w *WriteAheadLog) deleteIfDelivered(segment *walSegment) {
+	if !segment.sealed || !segment.replayed || segment.committed < segment.records {
+		return
+	}
+	err := os.Remove(segment.path)
+	if err != nil && !os.IsNotExist(err) {
+		SugaredLogger.Errorf("failed to delete the write-ahead log segment %s: %s", segment.path, err)
+		sentry.CaptureException(err)
+		return
+	}
+	delete(w.segments, segment.id)
+	w.totalSize -= segment.size
+	walBytes.Set(float64(w.totalSize))
+	w.cond.Broadcast()
+}
+
+// CommitOffsets records the delivered records, the offsets are the next record to deliver of each segment.
+// It makes the WriteAheadLog the IOffsetCommitter of the OffsetTracker of the replayed records.
+func (w *WriteAheadLog) CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, offset := range offsets {
+		segment, ok := w.segments[offset.Partition]
+		if !ok || int64(offset.Offset) <= segment.committed {
+			continue
+		}
+		segment.committed = int64(offset.Offset)
+		w.deleteIfDelivered(segment)
+	}
+	return offsets, w.writeCheckpoint()
+}
+
+// writeCheckpoint saves the number of delivered records of the segments, so that they're not replayed on startup.
+func (w *WriteAheadLog) writeCheckpoint() error {
+	checkpoint := make(map[string]int64, len(w.segments))
+	for id, segment := range w.segments {
+		if segment.committed > 0 {
+			checkpoint[strconv.Itoa(int(id))] = segment.committed
+		}
+	}
+	content, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(w.options.Directory, walCheckpointFile)
+	err = ioutil.WriteFile(path+".tmp", content, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Close syncs the write-ahead log, commits the Kafka offsets of its records and stops the replay.
+// The records that weren't replayed yet are replayed on the next start.
+func (w *WriteAheadLog) Close() error {
+	close(w.stopChannel)
+	<-w.syncDone
+
+	w.mutex.Lock()
+	err := w.sync()
+	closeErr := w.file.Close()
+	w.closed = true
+	w.cond.Broadcast()
+	w.mutex.Unlock()
+	if w.kafkaTracker != nil {
+		_ = w.kafkaTracker.Commit()
+	}
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// encodeWalRecord encodes the stream as a record: the length and the CRC-32C of the payload followed by the payload.
+func encodeWalRecord(stream LokiStream) ([]byte, error) {
+	payload, err := json.Marshal(walRecord{
+		Labels: stream.Labels,
+		Values: stream.Values,
+		Size:   stream.Size,
+		Tenant: stream.Tenant,
+	})
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, walCrcTable))
+	return append(record, payload...), nil
+}
+
+// readWalRecord reads a record that must fit in the available bytes, it returns the stream and the size of the record.
+func readWalRecord(reader io.Reader, available int64) (LokiStream, int64, error) {
+	if available < walHeaderSize {
+		return LokiStream{}, 0, fmt.Errorf("truncated record header")
+	}
+	header := make([]byte, walHeaderSize)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return LokiStream{}, 0, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if walHeaderSize+length > available {
+		return LokiStream{}, 0, fmt.Errorf("record of %d bytes exceeds the %d bytes left", length, available-walHeaderSize)
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return LokiStream{}, 0, err
+	}
+	if crc32.Checksum(payload, walCrcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return LokiStream{}, 0, fmt.Errorf("record checksum mismatch")
+	}
+	var record walRecord
+	err = json.Unmarshal(payload, &record)
+	if err != nil {
+		return LokiStream{}, 0, err
+	}
+	return LokiStream{
+		Labels: record.Labels,
+		Values: record.Values,
+		Size:   record.Size,
+		Tenant: record.Tenant,
+	}, walHeaderSize + length, nil
+}
@@ -0,0 +1,294 @@
+package pkg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// recordingStreamPusher is an IStreamPusher that hands the pushed streams over a channel.
+type recordingStreamPusher struct {
+	streams chan LokiStream
+}
+
+func newRecordingStreamPusher() *recordingStreamPusher {
+	return &recordingStreamPusher{streams: make(chan LokiStream, 100)}
+}
+
+func (p *recordingStreamPusher) Push(stream LokiStream) {
+	p.streams <- stream
+}
+
+func (p *recordingStreamPusher) Flush() {
+}
+
+// next returns the next pushed stream, or fails the test.
+func (p *recordingStreamPusher) next(t *testing.T) LokiStream {
+	select {
+	case stream := <-p.streams:
+		return stream
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stream was replayed")
+		return LokiStream{}
+	}
+}
+
+// assertNoStream ensures that no other stream is pushed.
+func (p *recordingStreamPusher) assertNoStream(t *testing.T) {
+	select {
+	case stream := <-p.streams:
+		t.Fatalf("unexpected stream %v", stream)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// newTestWriteAheadLogOptions returns options with segments of 3 test records.
+func newTestWriteAheadLogOptions(t *testing.T) WriteAheadLogOptions {
+	record, err := encodeWalRecord(testWalStream("line-0"))
+	assert.Nil(t, err)
+	return WriteAheadLogOptions{
+		Directory:       t.TempDir(),
+		SegmentMaxBytes: 3 * int64(len(record)),
+		MaxBytes:        1 << 20,
+		Fsync:           WalFsyncAlways,
+		SyncInterval:    10 * time.Millisecond,
+	}
+}
+
+// testWalStream creates a stream with the given line.
+func testWalStream(line string) LokiStream {
+	return LokiStream{
+		Labels: map[string]string{"app": "speedy"},
+		Values: [][]string{{"1", line}},
+		Size:   len(line) + 8,
+		Tenant: "team-a",
+	}
+}
+
+// segmentFiles returns the names of the segment files of the directory, in order.
+func segmentFiles(t *testing.T, directory string) []string {
+	files, err := ioutil.ReadDir(directory)
+	assert.Nil(t, err)
+	var names []string
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == walSegmentExtension {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Test_NewWriteAheadLog_Options ensures that invalid options are rejected.
+func Test_NewWriteAheadLog_Options(t *testing.T) {
+	var tests = []WriteAheadLogOptions{
+		{SegmentMaxBytes: 10, MaxBytes: 20},
+		{Directory: t.TempDir(), SegmentMaxBytes: 10, MaxBytes: 20, Fsync: "sometimes"},
+		{Directory: t.TempDir(), SegmentMaxBytes: 0, MaxBytes: 20},
+		{Directory: t.TempDir(), SegmentMaxBytes: 10, MaxBytes: 19},
+	}
+	for index, options := range tests {
+		t.Run(fmt.Sprintf("test_%d", index), func(t *testing.T) {
+			_, err := NewWriteAheadLog(options, newRecordingStreamPusher())
+			assert.Error(t, err)
+		})
+	}
+}
+
+// Test_WriteAheadLog_Push ensures that the streams are replayed in order, that their Kafka messages are done once
+// synced and that the segments are deleted once delivered.
+func Test_WriteAheadLog_Push(t *testing.T) {
+	options := newTestWriteAheadLogOptions(t)
+	pusher := newRecordingStreamPusher()
+	wal, err := NewWriteAheadLog(options, pusher)
+	assert.Nil(t, err)
+	committer := &testOffsetCommitter{}
+	kafkaTracker := NewOffsetTracker(committer)
+	wal.SetOffsetTracker(kafkaTracker)
+
+	topic := "topic"
+	for index := 0; index < 10; index++ {
+		source := kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: kafka.Offset(index)}
+		kafkaTracker.Track(source)
+		stream := testWalStream(fmt.Sprintf("line-%d", index))
+		stream.Sources = []kafka.TopicPartition{source}
+		wal.Push(stream)
+	}
+	wal.Flush()
+	assert.Equal(t, map[string]int64{"topic[0]": 10}, committedOffsets(committer))
+
+	var replayed []kafka.TopicPartition
+	for index := 0; index < 10; index++ {
+		stream := pusher.next(t)
+		assert.Equal(t, fmt.Sprintf("line-%d", index), stream.Values[0][1])
+		assert.Equal(t, "team-a", stream.Tenant)
+		assert.Equal(t, map[string]string{"app": "speedy"}, stream.Labels)
+		assert.Len(t, stream.Sources, 1)
+		assert.Equal(t, walTopic, *stream.Sources[0].Topic)
+		replayed = append(replayed, stream.Sources...)
+	}
+	assert.Len(t, segmentFiles(t, options.Directory), 4)
+
+	wal.OffsetTracker().MarkDone(replayed...)
+	assert.Nil(t, wal.OffsetTracker().Commit())
+	// Only the active segment is left.
+	assert.Len(t, segmentFiles(t, options.Directory), 1)
+	assert.Nil(t, wal.Close())
+}
+
+// Test_WriteAheadLog_Replay ensures that the undelivered records are replayed on startup.
+func Test_WriteAheadLog_Replay(t *testing.T) {
+	options := newTestWriteAheadLogOptions(t)
+	pusher := newRecordingStreamPusher()
+	wal, err := NewWriteAheadLog(options, pusher)
+	assert.Nil(t, err)
+	for index := 0; index < 3; index++ {
+		wal.Push(testWalStream(fmt.Sprintf("line-%d", index)))
+	}
+	first := pusher.next(t)
+	pusher.next(t)
+	pusher.next(t)
+	wal.OffsetTracker().MarkDone(first.Sources...)
+	assert.Nil(t, wal.OffsetTracker().Commit())
+	assert.Nil(t, wal.Close())
+
+	pusher = newRecordingStreamPusher()
+	wal, err = NewWriteAheadLog(options, pusher)
+	assert.Nil(t, err)
+	assert.Equal(t, "line-1", pusher.next(t).Values[0][1])
+	assert.Equal(t, "line-2", pusher.next(t).Values[0][1])
+	pusher.assertNoStream(t)
+
+	wal.Push(testWalStream("line-3"))
+	assert.Equal(t, "line-3", pusher.next(t).Values[0][1])
+	assert.Nil(t, wal.Close())
+}
+
+// Test_WriteAheadLog_Corrupted ensures that the replay of a segment stops at a corrupted record and goes on with the
+// next segment.
+func Test_WriteAheadLog_Corrupted(t *testing.T) {
+	options := newTestWriteAheadLogOptions(t)
+	wal, err := NewWriteAheadLog(options, newRecordingStreamPusher())
+	assert.Nil(t, err)
+	for index := 0; index < 6; index++ {
+		wal.Push(testWalStream(fmt.Sprintf("line-%d", index)))
+	}
+	assert.Nil(t, wal.Close())
+
+	files := segmentFiles(t, options.Directory)
+	assert.Len(t, files, 2)
+	path := filepath.Join(options.Directory, files[0])
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	record, err := encodeWalRecord(testWalStream("line-0"))
+	assert.Nil(t, err)
+	// Flip a byte of the payload of the second record.
+	content[len(record)+walHeaderSize+5] ^= 0xff
+	assert.Nil(t, ioutil.WriteFile(path, content, 0o644))
+
+	pusher := newRecordingStreamPusher()
+	wal, err = NewWriteAheadLog(options, pusher)
+	assert.Nil(t, err)
+	assert.Equal(t, "line-0", pusher.next(t).Values[0][1])
+	// The first segment holds 3 records, the next segment is replayed.
+	assert.Equal(t, "line-3", pusher.next(t).Values[0][1])
+	assert.Equal(t, "line-4", pusher.next(t).Values[0][1])
+	assert.Equal(t, "line-5", pusher.next(t).Values[0][1])
+	pusher.assertNoStream(t)
+	assert.Nil(t, wal.Close())
+}
+
+// Test_WriteAheadLog_MaxBytes ensures that Push blocks while the write-ahead log is full.
+func Test_WriteAheadLog_MaxBytes(t *testing.T) {
+	options := newTestWriteAheadLogOptions(t)
+	options.MaxBytes = 2 * options.SegmentMaxBytes
+	pusher := newRecordingStreamPusher()
+	wal, err := NewWriteAheadLog(options, pusher)
+	assert.Nil(t, err)
+
+	pushed := make(chan struct{})
+	go func() {
+		defer close(pushed)
+		for index := 0; index < 10; index++ {
+			wal.Push(testWalStream(fmt.Sprintf("line-%d", index)))
+		}
+	}()
+	var replayed []kafka.TopicPartition
+	// Two segments of 3 records fill the write-ahead log.
+	for index := 0; index < 6; index++ {
+		replayed = append(replayed, pusher.next(t).Sources...)
+	}
+	select {
+	case <-pushed:
+		t.Fatal("the write-ahead log is full, Push must block")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	wal.OffsetTracker().MarkDone(replayed...)
+	assert.Nil(t, wal.OffsetTracker().Commit())
+	<-pushed
+	assert.Equal(t, "line-6", pusher.next(t).Values[0][1])
+	assert.Nil(t, wal.Close())
+	_, err = os.Stat(filepath.Join(options.Directory, walCheckpointFile))
+	assert.Nil(t, err)
+}
+
+// failingWriter is an io.Writer that always fails.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("no space left on device")
+}
+
+// Test_WriteAheadLog_WriteErrors ensures that the failed writes and syncs are retried, so that the streams are
+// replayed and their Kafka messages done.
+func Test_WriteAheadLog_WriteErrors(t *testing.T) {
+	options := newTestWriteAheadLogOptions(t)
+	pusher := newRecordingStreamPusher()
+	wal, err := NewWriteAheadLog(options, pusher)
+	assert.Nil(t, err)
+	wal.retryPolicy = RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	committer := &testOffsetCommitter{}
+	kafkaTracker := NewOffsetTracker(committer)
+	wal.SetOffsetTracker(kafkaTracker)
+	errorsBefore := testutil.ToFloat64(walWriteErrors)
+
+	topic := "topic"
+	push := func(index int) {
+		source := kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: kafka.Offset(index)}
+		kafkaTracker.Track(source)
+		stream := testWalStream(fmt.Sprintf("line-%d", index))
+		stream.Sources = []kafka.TopicPartition{source}
+		wal.Push(stream)
+	}
+	push(0)
+	// The record doesn't fit the buffer, its write fails.
+	wal.mutex.Lock()
+	wal.writer = bufio.NewWriterSize(failingWriter{}, 16)
+	wal.mutex.Unlock()
+	push(1)
+	// The record is buffered, its sync fails.
+	wal.mutex.Lock()
+	wal.writer = bufio.NewWriter(failingWriter{})
+	wal.mutex.Unlock()
+	push(2)
+	push(3)
+	wal.Flush()
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(walWriteErrors)-errorsBefore)
+	assert.Equal(t, map[string]int64{"topic[0]": 4}, committedOffsets(committer))
+	for index := 0; index < 4; index++ {
+		assert.Equal(t, fmt.Sprintf("line-%d", index), pusher.next(t).Values[0][1])
+	}
+	pusher.assertNoStream(t)
+	assert.Nil(t, wal.Close())
+}